@@ -14,15 +14,29 @@ vclusterConfig: configEntry+ EOF;
 
 configEntry: serviceEntry
            | managedDependencyEntry
+           | mockServiceEntry
+           | gatewayEntry
+           | egressEntry
            ;
 
 serviceEntry: 'service' serviceName '{' serviceConfigItem+ '}';
 
 managedDependencyEntry: 'managed_dependency' dependencyName '{' managedDependencyConfigItem+ '}';
 
-serviceName: IDENTIFIER;
+mockServiceEntry: 'mock_service' mockServiceName '{' mockServiceConfigItem+ '}';
 
-dependencyName: IDENTIFIER;
+gatewayEntry: 'gateway' '{' gatewayConfigItem+ '}';
+
+egressEntry: 'egress' '{' egressConfigItem* '}';
+
+serviceName: name;
+
+mockServiceName: name;
+
+dependencyName: name;
+
+// The name of a service or dependency, which may be a keyword such as gateway or metrics.
+name: IDENTIFIER | softKeyword;
 
 serviceConfigItem: 'repository' keyValueDelimiter STRING_LITERAL ';'?  # serviceConfigRepository
                  | 'branch' keyValueDelimiter STRING_LITERAL ';'?      # serviceConfigBranch
@@ -30,26 +44,121 @@ serviceConfigItem: 'repository' keyValueDelimiter STRING_LITERAL ';'?  # service
                  | 'commit' keyValueDelimiter STRING_LITERAL ';'?      # serviceConfigCommit
                  | 'directory' keyValueDelimiter STRING_LITERAL ';'?   # serviceConfigDirectory
                  | 'health_check' '{' healthCheck+ '}'   # serviceConfigHealthCheck
-                 | 'dependency' keyValueDelimiter IDENTIFIER ';'?      # serviceConfigDependency
+                 | 'dependency' keyValueDelimiter name ';'?            # serviceConfigDependency
                  | 'service_port' keyValueDelimiter PORT ';'?          # serviceConfigPort
                  | 'proxy_port' keyValueDelimiter PORT ';'?            # serviceConfigProxyPort
                  | 'run_commands' keyValueDelimiter '[' STRING_LITERAL (',' STRING_LITERAL)* ','? ']' ';'?  # serviceConfigRunCommands
+                 | 'mode' keyValueDelimiter STRING_LITERAL ';'?        # serviceConfigMode
+                 | 'recording' keyValueDelimiter STRING_LITERAL ';'?   # serviceConfigRecording
+                 | 'fault' '{' faultConfigItem+ '}'                    # serviceConfigFault
+                 | 'grpc' '{' grpcConfigItem* '}'                      # serviceConfigGrpc
+                 | 'proxy_tls' keyValueDelimiter IDENTIFIER ';'?       # serviceConfigProxyTls
+                 | 'metrics' '{' metricsConfigItem* '}'                # serviceConfigMetrics
+                 | 'limits' '{' limitsConfigItem* '}'                  # serviceConfigLimits
                  ;
 
 managedDependencyConfigItem:
-                   'dependency' keyValueDelimiter IDENTIFIER ';'?     # managedDependencyConfigDependency
-                 | 'managed_kafka' '{' managedKafkaConfigItem+ '}'    # managedDependencyConfigManagedKafka
-                 | 'managed_localstack' '{' managedLocalstackConfigItem '}'                      # managedDependencyConfigManagedLocalstack
+                   'dependency' keyValueDelimiter name ';'?           # managedDependencyConfigDependency
+                 | IDENTIFIER '{' dependencySetting* '}'                                        # managedDependencyConfigGeneric
                  ;
 
 healthCheck: 'endpoint' keyValueDelimiter STRING_LITERAL ';'?         # healthCheckEndpoint
            ;
 
-managedKafkaConfigItem: 'port' keyValueDelimiter PORT ';'?            # managedKafkaConfigPort
-                       ;
+mockServiceConfigItem: 'port' keyValueDelimiter PORT ';'?                                  # mockServiceConfigPort
+                     | 'route' IDENTIFIER STRING_LITERAL '{' mockRouteConfigItem* '}'        # mockServiceConfigRoute
+                     ;
+
+mockRouteConfigItem: mockResponseConfigItem                                              # mockRouteConfigResponseItem
+                   | 'match' '{' mockMatchConfigItem* '}'                                # mockRouteConfigMatch
+                   | 'when_state' keyValueDelimiter STRING_LITERAL ';'?                  # mockRouteConfigWhenState
+                   | 'set_state' keyValueDelimiter STRING_LITERAL ';'?                   # mockRouteConfigSetState
+                   | 'response' '{' mockResponseConfigItem* '}'                          # mockRouteConfigResponse
+                   ;
+
+mockResponseConfigItem: 'status' keyValueDelimiter PORT ';'?                             # mockResponseConfigStatus
+                      | 'body' keyValueDelimiter STRING_LITERAL ';'?                     # mockResponseConfigBody
+                      | 'body_file' keyValueDelimiter STRING_LITERAL ';'?                # mockResponseConfigBodyFile
+                      | 'delay_ms' keyValueDelimiter PORT ';'?                           # mockResponseConfigDelayMs
+                      | 'header' STRING_LITERAL keyValueDelimiter STRING_LITERAL ';'?    # mockResponseConfigHeader
+                      ;
+
+mockMatchConfigItem: 'header' STRING_LITERAL keyValueDelimiter STRING_LITERAL ';'?       # mockMatchConfigHeader
+                   | 'query' STRING_LITERAL keyValueDelimiter STRING_LITERAL ';'?        # mockMatchConfigQuery
+                   | 'body_contains' keyValueDelimiter STRING_LITERAL ';'?               # mockMatchConfigBodyContains
+                   | 'body_json' keyValueDelimiter STRING_LITERAL ';'?                   # mockMatchConfigBodyJson
+                   ;
+
+faultConfigItem: 'method' keyValueDelimiter (STRING_LITERAL | IDENTIFIER) ';'?   # faultConfigMethod
+               | 'path' keyValueDelimiter STRING_LITERAL ';'?                    # faultConfigPath
+               | 'percentage' keyValueDelimiter (PORT | STRING_LITERAL) ';'?     # faultConfigPercentage
+               | 'status' keyValueDelimiter PORT ';'?                            # faultConfigStatus
+               | 'reset' keyValueDelimiter IDENTIFIER ';'?                       # faultConfigReset
+               | 'truncate_bytes' keyValueDelimiter PORT ';'?                    # faultConfigTruncateBytes
+               | 'latency' '{' faultLatencyConfigItem+ '}'                       # faultConfigLatency
+               ;
+
+faultLatencyConfigItem: faultLatencyKey keyValueDelimiter PORT ';'?;
+
+faultLatencyKey: 'fixed_ms' | 'min_ms' | 'max_ms' | 'mean_ms' | 'stddev_ms';
+
+grpcConfigItem: 'descriptor_set' keyValueDelimiter STRING_LITERAL ';'?   # grpcConfigDescriptorSet
+              | 'reflection' keyValueDelimiter IDENTIFIER ';'?          # grpcConfigReflection
+              ;
+
+metricsConfigItem: 'path' keyValueDelimiter STRING_LITERAL ';'?       # metricsConfigPath
+                 | 'port' keyValueDelimiter PORT ';'?                 # metricsConfigPort
+                 | 'interval' keyValueDelimiter STRING_LITERAL ';'?   # metricsConfigInterval
+                 ;
+
+limitsConfigItem: 'memory' keyValueDelimiter (STRING_LITERAL | PORT) ';'?   # limitsConfigMemory
+                | 'cpu' keyValueDelimiter (DECIMAL | PORT) ';'?            # limitsConfigCpu
+                | 'pids' keyValueDelimiter PORT ';'?                       # limitsConfigPids
+                ;
+
+gatewayConfigItem: 'port' keyValueDelimiter PORT ';'?                # gatewayConfigPort
+                 | 'route' STRING_LITERAL '->' name ';'?               # gatewayConfigRoute
+                 | 'host' STRING_LITERAL '->' name ';'?                # gatewayConfigHost
+                 ;
+
+egressConfigItem: 'port' keyValueDelimiter PORT ';'?                  # egressConfigPort
+                | 'mitm' keyValueDelimiter IDENTIFIER ';'?             # egressConfigMitm
+                | 'rule' '{' egressRuleConfigItem+ '}'                 # egressConfigRule
+                ;
+
+egressRuleConfigItem: 'host' keyValueDelimiter STRING_LITERAL ';'?                    # egressRuleConfigHost
+                    | 'method' keyValueDelimiter (STRING_LITERAL | IDENTIFIER) ';'?   # egressRuleConfigMethod
+                    | 'path' keyValueDelimiter STRING_LITERAL ';'?                    # egressRuleConfigPath
+                    | 'block' keyValueDelimiter IDENTIFIER ';'?                       # egressRuleConfigBlock
+                    | 'status' keyValueDelimiter PORT ';'?                            # egressRuleConfigStatus
+                    | 'body' keyValueDelimiter STRING_LITERAL ';'?                    # egressRuleConfigBody
+                    | 'header' STRING_LITERAL keyValueDelimiter STRING_LITERAL ';'?   # egressRuleConfigHeader
+                    ;
+
+// Settings of a managed dependency, such as `managed_kafka { port = 9092 }`. The grammar does not know the dependency
+// types; the dependency registry looks up the type by name and validates its settings. A bare word value is a string,
+// except true and false.
+dependencySetting: dependencySettingKey keyValueDelimiter dependencySettingValue ';'?  # dependencySettingAssignment
+                 | dependencySettingKey '{' dependencySetting* '}'                     # dependencySettingBlock
+                 ;
+
+dependencySettingKey: IDENTIFIER | softKeyword;
+
+dependencySettingValue: STRING_LITERAL | PORT | DECIMAL | IDENTIFIER | softKeyword | stringList;
+
+// Every keyword of the language. Keywords are only reserved where the grammar expects them, so anywhere a word of the
+// user's choosing is expected accepts them too. A new keyword must be added here.
+softKeyword: 'service' | 'managed_dependency' | 'mock_service' | 'gateway' | 'egress'
+           | 'repository' | 'branch' | 'tag' | 'commit' | 'directory' | 'health_check' | 'endpoint' | 'dependency'
+           | 'service_port' | 'proxy_port' | 'run_commands' | 'mode' | 'recording' | 'proxy_tls'
+           | 'fault' | 'method' | 'path' | 'percentage' | 'status' | 'reset' | 'truncate_bytes' | 'latency'
+           | 'fixed_ms' | 'min_ms' | 'max_ms' | 'mean_ms' | 'stddev_ms'
+           | 'grpc' | 'descriptor_set' | 'reflection' | 'metrics' | 'interval' | 'limits' | 'memory' | 'cpu' | 'pids'
+           | 'port' | 'route' | 'match' | 'when_state' | 'set_state' | 'response' | 'body' | 'body_file' | 'delay_ms'
+           | 'header' | 'query' | 'body_contains' | 'body_json' | 'host' | 'mitm' | 'rule' | 'block'
+           ;
 
-managedLocalstackConfigItem: 'port' keyValueDelimiter PORT ';'?       # managedLocalstackConfigPort
-                            ;
+stringList: '[' (STRING_LITERAL (',' STRING_LITERAL)* ','?)? ']';
 
 keyValueDelimiter: ':' | '=';
 
@@ -58,6 +167,7 @@ STRING_LITERAL: '"' (ESC|.)*? '"' | [a-zA-Z_][a-zA-Z_0-9.-]*;
 fragment
 ESC : '\\"' | '\\\\' ; // 2-char sequences \" and \\
 PORT : [0-9]+;
+DECIMAL : [0-9]+ '.' [0-9]+;
 
 WS: [ \t\r\n]+ -> skip;
 C_BLOCK_COMMENT: '/*' .*? '*/' -> skip;
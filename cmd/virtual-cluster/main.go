@@ -18,6 +18,9 @@ import (
 	"strings"
 	"syscall"
 
+	// Dependency types register themselves with the dependency registry when imported. A build that adds its own
+	// types imports their packages here in the same way.
+	_ "github.com/asimihsan/virtual-cluster/internal/dependencies/builtin"
 	"github.com/asimihsan/virtual-cluster/internal/parser"
 	"github.com/asimihsan/virtual-cluster/internal/substrate"
 	"github.com/urfave/cli/v2"
@@ -65,6 +68,22 @@ func main() {
 								Aliases: []string{"p"},
 								Usage:   "manager port, default 1371",
 							},
+							&cli.IntFlag{
+								Name:  "capture-limit",
+								Usage: "bytes of each proxied body stored in the database, default 65536; larger bodies are kept in blob files next to the database",
+							},
+							&cli.StringFlag{
+								Name:  "blob-dir",
+								Usage: "directory for captured bodies larger than the capture limit, default <db-path>.blobs",
+							},
+							&cli.IntFlag{
+								Name:  "otlp-port",
+								Usage: "port of the OTLP/HTTP and OTLP/gRPC receiver managed processes export telemetry to, default 4318",
+							},
+							&cli.StringFlag{
+								Name:  "data-dir",
+								Usage: "directory for what the cluster keeps between runs, such as the local CA for proxy_tls, default <db-path>.data",
+							},
 						},
 						Action: func(c *cli.Context) error {
 							dbPath := c.String("db-path")
@@ -172,6 +191,18 @@ func main() {
 							if c.Int("manager-port") != 0 {
 								opts = append(opts, substrate.WithHTTPPort(c.Int("manager-port")))
 							}
+							if c.Int("capture-limit") != 0 {
+								opts = append(opts, substrate.WithCaptureLimit(c.Int("capture-limit")))
+							}
+							if c.String("blob-dir") != "" {
+								opts = append(opts, substrate.WithBlobDir(c.String("blob-dir")))
+							}
+							if c.Int("otlp-port") != 0 {
+								opts = append(opts, substrate.WithOTLPPort(c.Int("otlp-port")))
+							}
+							if c.String("data-dir") != "" {
+								opts = append(opts, substrate.WithDataDir(c.String("data-dir")))
+							}
 							manager, err := substrate.NewManager(dbPath, opts...)
 							if err != nil {
 								fmt.Fprintf(os.Stderr, "failed to create substrate manager: %s\n", err)
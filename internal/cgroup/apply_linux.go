@@ -0,0 +1,37 @@
+//go:build linux
+
+/*
+ * Copyright (c) 2023 Asim Ihsan.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ * SPDX-License-Identifier: MPL-2.0
+ */
+
+package cgroup
+
+import (
+	"github.com/pkg/errors"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// Apply makes cmd start in the group, so that none of its processes escape it by forking before being moved. This
+// needs clone3 with CLONE_INTO_CGROUP, from Linux 5.7, which seccomp profiles may also block: if cmd then fails to
+// start, it can be started again without Apply and moved in with Add. The returned function must be called once cmd
+// has started or failed to.
+func (g *Group) Apply(cmd *exec.Cmd) (func(), error) {
+	dir, err := os.Open(g.dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open cgroup")
+	}
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.UseCgroupFD = true
+	cmd.SysProcAttr.CgroupFD = int(dir.Fd())
+	return func() { _ = dir.Close() }, nil
+}
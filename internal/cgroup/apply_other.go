@@ -0,0 +1,23 @@
+//go:build !linux
+
+/*
+ * Copyright (c) 2023 Asim Ihsan.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ * SPDX-License-Identifier: MPL-2.0
+ */
+
+package cgroup
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+// Apply is only implemented on Linux, the only platform with cgroups.
+func (g *Group) Apply(cmd *exec.Cmd) (func(), error) {
+	return nil, fmt.Errorf("cgroups are not supported on this platform")
+}
@@ -0,0 +1,310 @@
+/*
+ * Copyright (c) 2023 Asim Ihsan.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ * SPDX-License-Identifier: MPL-2.0
+ */
+
+// Package cgroup places managed processes in cgroup v2 subtrees that limit the memory, CPU and number of tasks they
+// may use.
+//
+// Limits need a cgroup v2 hierarchy with the memory, cpu and pids controllers delegated to the substrate, as with
+// systemd-run --user --scope -p Delegate=yes, or running as root. The substrate moves itself into a leaf of its own
+// cgroup so that it can enable controllers for its siblings, one for each limited process.
+package cgroup
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/pkg/errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// DefaultMountPoint is where the cgroup v2 hierarchy is mounted.
+const DefaultMountPoint = "/sys/fs/cgroup"
+
+// managerCgroup is the leaf the substrate moves itself into, which is shared by every substrate in the same cgroup.
+const managerCgroup = "vcluster-manager"
+
+// cpuPeriod is the period of cpu.max in microseconds, the kernel's default.
+const cpuPeriod = 100000
+
+// Limits caps what the processes in a group may use. A nil field is not capped.
+type Limits struct {
+	MemoryBytes *int64
+
+	// CPU is how many CPUs' worth of time the processes may use, e.g. 1.5.
+	CPU *float64
+
+	Pids *int
+}
+
+// controllers returns the controllers the limits need.
+func (l Limits) controllers() []string {
+	var controllers []string
+	if l.MemoryBytes != nil {
+		controllers = append(controllers, "memory")
+	}
+	if l.CPU != nil {
+		controllers = append(controllers, "cpu")
+	}
+	if l.Pids != nil {
+		controllers = append(controllers, "pids")
+	}
+	return controllers
+}
+
+// Hierarchy is the subtree of the cgroup hierarchy the substrate creates groups in.
+type Hierarchy struct {
+	dir         string
+	controllers map[string]bool
+}
+
+// Setup creates a subtree for the groups of the process with pid, named name, in the cgroup the process is in, with
+// the controllers that are available of memory, cpu and pids enabled. ownCgroup is the path of the process's cgroup
+// relative to mountPoint, as /proc/<pid>/cgroup gives it. As only the root cgroup may both have processes and enable
+// controllers for its children, the process first moves into a leaf of its cgroup. Setup fails, leaving the process
+// where it was, if the cgroup has other processes in it, such as the shell of an interactive session.
+func Setup(mountPoint string, ownCgroup string, pid int, name string) (*Hierarchy, error) {
+	if _, err := os.Stat(filepath.Join(mountPoint, "cgroup.controllers")); err != nil {
+		return nil, errors.Errorf("no cgroup v2 hierarchy is mounted at %s", mountPoint)
+	}
+	parent := filepath.Join(mountPoint, ownCgroup)
+	available, err := readControllers(filepath.Join(parent, "cgroup.controllers"))
+	if err != nil {
+		return nil, err
+	}
+	controllers := make(map[string]bool)
+	for _, controller := range []string{"memory", "cpu", "pids"} {
+		if available[controller] {
+			controllers[controller] = true
+		}
+	}
+	if len(controllers) == 0 {
+		return nil, errors.Errorf("none of the memory, cpu and pids controllers are delegated to %s", parent)
+	}
+
+	leaf := ""
+	if filepath.Clean(ownCgroup) != "/" {
+		procs, err := readProcs(parent)
+		if err != nil {
+			return nil, err
+		}
+		for _, other := range procs {
+			if other != pid {
+				return nil, errors.Errorf("%s has other processes in it, such as %d", parent, other)
+			}
+		}
+		leaf = filepath.Join(parent, managerCgroup)
+		if err := os.MkdirAll(leaf, 0755); err != nil {
+			return nil, errors.Wrap(err, "failed to create cgroup for the substrate")
+		}
+		if err := writeFile(leaf, "cgroup.procs", strconv.Itoa(pid)); err != nil {
+			_ = os.Remove(leaf)
+			return nil, errors.Wrap(err, "failed to move the substrate into its own cgroup")
+		}
+	}
+	// restore moves the substrate back to where it was if a step after the move fails, so that a failed setup leaves
+	// no trace. The controllers go first, as a cgroup that enables controllers for its children cannot have processes.
+	restore := func() {
+		if leaf == "" {
+			return
+		}
+		_ = disableControllers(parent, controllers)
+		_ = writeFile(parent, "cgroup.procs", strconv.Itoa(pid))
+		_ = os.Remove(leaf)
+	}
+	if err := enableControllers(parent, controllers); err != nil {
+		restore()
+		return nil, errors.Wrapf(err, "failed to enable controllers in %s", parent)
+	}
+
+	dir := filepath.Join(parent, name)
+	_, err = os.Stat(dir)
+	created := os.IsNotExist(err)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		restore()
+		return nil, errors.Wrap(err, "failed to create cgroup")
+	}
+	if err := enableControllers(dir, controllers); err != nil {
+		if created {
+			_ = os.Remove(dir)
+		}
+		restore()
+		return nil, err
+	}
+	return &Hierarchy{dir: dir, controllers: controllers}, nil
+}
+
+// OwnCgroup returns the path of the cgroup v2 cgroup of the process with pid, relative to the hierarchy's mount point.
+func OwnCgroup(pid int) (string, error) {
+	file, err := os.Open(fmt.Sprintf("/proc/%d/cgroup", pid))
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// The cgroup v2 hierarchy has id 0 and no controllers: 0::/user.slice/user-1000.slice/session-2.scope
+		if path := strings.TrimPrefix(scanner.Text(), "0::"); path != scanner.Text() {
+			return path, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", errors.Errorf("process %d is in no cgroup v2 cgroup", pid)
+}
+
+// NewGroup creates a group named name with the limits applied.
+func (h *Hierarchy) NewGroup(name string, limits Limits) (*Group, error) {
+	for _, controller := range limits.controllers() {
+		if !h.controllers[controller] {
+			return nil, errors.Errorf("the %s controller is not delegated", controller)
+		}
+	}
+	dir := filepath.Join(h.dir, name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, errors.Wrap(err, "failed to create cgroup")
+	}
+	if limits.MemoryBytes != nil {
+		if err := writeFile(dir, "memory.max", strconv.FormatInt(*limits.MemoryBytes, 10)); err != nil {
+			return nil, err
+		}
+		// Without swap to spill into, going over the limit gets the processes OOM killed rather than slowed down.
+		if _, err := os.Stat(filepath.Join(dir, "memory.swap.max")); err == nil {
+			if err := writeFile(dir, "memory.swap.max", "0"); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if limits.CPU != nil {
+		quota := int64(*limits.CPU * cpuPeriod)
+		if err := writeFile(dir, "cpu.max", fmt.Sprintf("%d %d", quota, cpuPeriod)); err != nil {
+			return nil, err
+		}
+	}
+	if limits.Pids != nil {
+		if err := writeFile(dir, "pids.max", strconv.Itoa(*limits.Pids)); err != nil {
+			return nil, err
+		}
+	}
+	return &Group{dir: dir}, nil
+}
+
+// Remove removes the subtree, once the processes in it have exited. Groups that still have processes are kept.
+func (h *Hierarchy) Remove() error {
+	entries, err := os.ReadDir(h.dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			_ = os.Remove(filepath.Join(h.dir, entry.Name()))
+		}
+	}
+	return os.Remove(h.dir)
+}
+
+// Group is a cgroup that limits the processes in it.
+type Group struct {
+	dir string
+}
+
+// Add moves the process with pid into the group. Processes it started before it was moved stay where they were, so
+// Apply is preferred where the kernel supports it.
+func (g *Group) Add(pid int) error {
+	return writeFile(g.dir, "cgroup.procs", strconv.Itoa(pid))
+}
+
+// Path returns the directory of the group.
+func (g *Group) Path() string {
+	return g.dir
+}
+
+// OOMKills returns how many processes in the group the kernel has killed for going over its memory limit.
+func (g *Group) OOMKills() (int, error) {
+	file, err := os.Open(filepath.Join(g.dir, "memory.events"))
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == "oom_kill" {
+			return strconv.Atoi(fields[1])
+		}
+	}
+	return 0, scanner.Err()
+}
+
+// readProcs returns the processes in the cgroup in dir.
+func readProcs(dir string) ([]int, error) {
+	data, err := os.ReadFile(filepath.Join(dir, "cgroup.procs"))
+	if err != nil {
+		return nil, err
+	}
+	var procs []int
+	for _, field := range strings.Fields(string(data)) {
+		pid, err := strconv.Atoi(field)
+		if err != nil {
+			return nil, errors.Errorf("invalid process %q in %s", field, dir)
+		}
+		procs = append(procs, pid)
+	}
+	return procs, nil
+}
+
+func readControllers(path string) (map[string]bool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	controllers := make(map[string]bool)
+	for _, controller := range strings.Fields(string(data)) {
+		controllers[controller] = true
+	}
+	return controllers, nil
+}
+
+func enableControllers(dir string, controllers map[string]bool) error {
+	enabled, err := readControllers(filepath.Join(dir, "cgroup.subtree_control"))
+	if err != nil {
+		return err
+	}
+	var add []string
+	for _, controller := range []string{"memory", "cpu", "pids"} {
+		if controllers[controller] && !enabled[controller] {
+			add = append(add, "+"+controller)
+		}
+	}
+	if len(add) == 0 {
+		return nil
+	}
+	return writeFile(dir, "cgroup.subtree_control", strings.Join(add, " "))
+}
+
+// disableControllers disables controllers for the children of the cgroup at dir.
+func disableControllers(dir string, controllers map[string]bool) error {
+	var remove []string
+	for _, controller := range []string{"memory", "cpu", "pids"} {
+		if controllers[controller] {
+			remove = append(remove, "-"+controller)
+		}
+	}
+	return writeFile(dir, "cgroup.subtree_control", strings.Join(remove, " "))
+}
+
+func writeFile(dir string, name string, value string) error {
+	if err := os.WriteFile(filepath.Join(dir, name), []byte(value), 0644); err != nil {
+		return errors.Wrapf(err, "failed to write %s", name)
+	}
+	return nil
+}
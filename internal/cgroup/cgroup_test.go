@@ -0,0 +1,131 @@
+/*
+ * Copyright (c) 2023 Asim Ihsan.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ * SPDX-License-Identifier: MPL-2.0
+ */
+
+package cgroup
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeHierarchy lays out the files of a delegated cgroup at /user.slice/session.scope, and of the subtree Setup
+// creates in it, that the kernel would otherwise create.
+func fakeHierarchy(t *testing.T, controllers string) (string, string) {
+	mountPoint := t.TempDir()
+	parent := filepath.Join(mountPoint, "user.slice", "session.scope")
+	for _, dir := range []string{parent, filepath.Join(parent, "vcluster"), filepath.Join(parent, "vcluster", "orders")} {
+		assert.NoError(t, os.MkdirAll(dir, 0755))
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, "cgroup.subtree_control"), nil, 0644))
+	}
+	assert.NoError(t, os.WriteFile(filepath.Join(mountPoint, "cgroup.controllers"), []byte("cpuset cpu io memory pids"), 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(parent, "cgroup.controllers"), []byte(controllers), 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(parent, "cgroup.procs"), []byte("4242\n"), 0644))
+	return mountPoint, parent
+}
+
+func readFile(t *testing.T, path string) string {
+	data, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	return string(data)
+}
+
+func TestSetup_AppliesLimits(t *testing.T) {
+	mountPoint, parent := fakeHierarchy(t, "cpuset cpu io memory pids\n")
+
+	hierarchy, err := Setup(mountPoint, "/user.slice/session.scope", 4242, "vcluster")
+	assert.NoError(t, err)
+
+	// The substrate moves out of the way of its children, which then get the controllers.
+	assert.Equal(t, "4242", readFile(t, filepath.Join(parent, "vcluster-manager", "cgroup.procs")))
+	assert.Equal(t, "+memory +cpu +pids", readFile(t, filepath.Join(parent, "cgroup.subtree_control")))
+	assert.Equal(t, "+memory +cpu +pids", readFile(t, filepath.Join(parent, "vcluster", "cgroup.subtree_control")))
+
+	memory, cpu, pids := int64(512<<20), 1.5, 256
+	group, err := hierarchy.NewGroup("orders", Limits{MemoryBytes: &memory, CPU: &cpu, Pids: &pids})
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(parent, "vcluster", "orders"), group.Path())
+	assert.Equal(t, "536870912", readFile(t, filepath.Join(group.Path(), "memory.max")))
+	assert.Equal(t, "150000 100000", readFile(t, filepath.Join(group.Path(), "cpu.max")))
+	assert.Equal(t, "256", readFile(t, filepath.Join(group.Path(), "pids.max")))
+
+	assert.NoError(t, os.WriteFile(filepath.Join(group.Path(), "memory.events"),
+		[]byte("low 0\nhigh 0\nmax 12\noom 2\noom_kill 2\noom_group_kill 0\n"), 0644))
+	kills, err := group.OOMKills()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, kills)
+}
+
+func TestSetup_WithoutControllers_IsError(t *testing.T) {
+	mountPoint, _ := fakeHierarchy(t, "cpuset io\n")
+
+	_, err := Setup(mountPoint, "/user.slice/session.scope", 4242, "vcluster")
+	assert.Error(t, err)
+}
+
+func TestSetup_WithOtherProcesses_DoesNotMove(t *testing.T) {
+	mountPoint, parent := fakeHierarchy(t, "cpu memory pids\n")
+	assert.NoError(t, os.WriteFile(filepath.Join(parent, "cgroup.procs"), []byte("4242\n1001\n"), 0644))
+
+	_, err := Setup(mountPoint, "/user.slice/session.scope", 4242, "vcluster")
+	assert.Error(t, err)
+	_, err = os.Stat(filepath.Join(parent, "vcluster-manager"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestSetup_FailingToEnableControllers_MovesBack(t *testing.T) {
+	mountPoint, parent := fakeHierarchy(t, "cpu memory pids\n")
+	assert.NoError(t, os.Remove(filepath.Join(parent, "cgroup.subtree_control")))
+	assert.NoError(t, os.WriteFile(filepath.Join(parent, "cgroup.procs"), nil, 0644))
+
+	_, err := Setup(mountPoint, "/user.slice/session.scope", 4242, "vcluster")
+	assert.Error(t, err)
+	assert.Equal(t, "4242", readFile(t, filepath.Join(parent, "cgroup.procs")))
+}
+
+func TestSetup_FailingToCreateTheSubtree_MovesBack(t *testing.T) {
+	mountPoint, parent := fakeHierarchy(t, "cpu memory pids\n")
+	assert.NoError(t, os.Remove(filepath.Join(parent, "vcluster", "cgroup.subtree_control")))
+	assert.NoError(t, os.WriteFile(filepath.Join(parent, "cgroup.procs"), nil, 0644))
+
+	_, err := Setup(mountPoint, "/user.slice/session.scope", 4242, "vcluster")
+	assert.Error(t, err)
+	assert.Equal(t, "-memory -cpu -pids", readFile(t, filepath.Join(parent, "cgroup.subtree_control")))
+	assert.Equal(t, "4242", readFile(t, filepath.Join(parent, "cgroup.procs")))
+}
+
+func TestGroup_Add(t *testing.T) {
+	mountPoint, parent := fakeHierarchy(t, "cpu memory pids\n")
+	hierarchy, err := Setup(mountPoint, "/user.slice/session.scope", 4242, "vcluster")
+	assert.NoError(t, err)
+	pids := 64
+	group, err := hierarchy.NewGroup("orders", Limits{Pids: &pids})
+	assert.NoError(t, err)
+
+	assert.NoError(t, group.Add(5151))
+	assert.Equal(t, "5151", readFile(t, filepath.Join(parent, "vcluster", "orders", "cgroup.procs")))
+}
+
+func TestSetup_WithoutCgroupV2_IsError(t *testing.T) {
+	_, err := Setup(t.TempDir(), "/", 4242, "vcluster")
+	assert.Error(t, err)
+}
+
+func TestNewGroup_WithUndelegatedController_IsError(t *testing.T) {
+	mountPoint, _ := fakeHierarchy(t, "cpu pids\n")
+	hierarchy, err := Setup(mountPoint, "/user.slice/session.scope", 4242, "vcluster")
+	assert.NoError(t, err)
+
+	memory := int64(1 << 30)
+	_, err = hierarchy.NewGroup("orders", Limits{MemoryBytes: &memory})
+	assert.Error(t, err)
+}
@@ -0,0 +1,23 @@
+/*
+ * Copyright (c) 2023 Asim Ihsan.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ * SPDX-License-Identifier: MPL-2.0
+ */
+
+// Package builtin registers the dependency types that ship with virtual-cluster. Importing it for its side effects
+// makes managed_container, managed_kafka, managed_localstack, managed_postgres, managed_redis and managed_smtp
+// available to vcluster files.
+package builtin
+
+import (
+	_ "github.com/asimihsan/virtual-cluster/internal/dependencies/container"
+	_ "github.com/asimihsan/virtual-cluster/internal/dependencies/kafka"
+	_ "github.com/asimihsan/virtual-cluster/internal/dependencies/localstack"
+	_ "github.com/asimihsan/virtual-cluster/internal/dependencies/postgres"
+	_ "github.com/asimihsan/virtual-cluster/internal/dependencies/redis"
+	_ "github.com/asimihsan/virtual-cluster/internal/dependencies/smtp"
+)
@@ -0,0 +1,30 @@
+/*
+ * Copyright (c) 2023 Asim Ihsan.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ * SPDX-License-Identifier: MPL-2.0
+ */
+
+package builtin_test
+
+import (
+	"testing"
+
+	_ "github.com/asimihsan/virtual-cluster/internal/dependencies/builtin"
+	"github.com/asimihsan/virtual-cluster/pkg/dependencies"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuiltin_RegistersDependencyTypes(t *testing.T) {
+	assert.Equal(t, []string{
+		"managed_container",
+		"managed_kafka",
+		"managed_localstack",
+		"managed_postgres",
+		"managed_redis",
+		"managed_smtp",
+	}, dependencies.Kinds())
+}
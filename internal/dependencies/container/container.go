@@ -0,0 +1,131 @@
+/*
+ * Copyright (c) 2023 Asim Ihsan.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ * SPDX-License-Identifier: MPL-2.0
+ */
+
+package container
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"github.com/cbroglie/mustache"
+	"strconv"
+	"strings"
+)
+
+//go:embed *.mustache
+var fs embed.FS
+
+// Config describes a generic container dependency. Ports, Env and Volumes use docker compose short syntax, e.g.
+// "5432:5432", "POSTGRES_PASSWORD=postgres" and "./data:/var/lib/postgresql/data".
+type Config struct {
+	Image              string
+	Ports              []string
+	Env                []string
+	Volumes            []string
+	Command            []string
+	HealthCheckCommand string
+}
+
+// ContainerName is the Docker container name used for a managed dependency run in Docker, so that stale containers
+// from a previous run can be found and removed. It doubles as the docker compose project name, which must be lower
+// case.
+func ContainerName(dependencyName string) string {
+	return "vcluster_" + strings.ToLower(dependencyName)
+}
+
+// NetworkName is the default network docker compose creates for a managed dependency run in Docker.
+func NetworkName(dependencyName string) string {
+	return ContainerName(dependencyName) + "_default"
+}
+
+// HostPorts returns the host side of each port mapping. Mappings without a fixed host port, such as "5432", are
+// skipped.
+func HostPorts(ports []string) ([]int, error) {
+	var hostPorts []int
+	for _, mapping := range ports {
+		mapping = strings.SplitN(mapping, "/", 2)[0]
+		parts := strings.Split(mapping, ":")
+		if len(parts) < 2 {
+			continue
+		}
+		hostPort := parts[len(parts)-2]
+		port, err := strconv.Atoi(hostPort)
+		if err != nil {
+			return nil, fmt.Errorf("invalid host port in mapping: %s", mapping)
+		}
+		if port < 1 || port > 65535 {
+			return nil, fmt.Errorf("invalid port number: %d", port)
+		}
+		hostPorts = append(hostPorts, port)
+	}
+	return hostPorts, nil
+}
+
+func GenerateDockerComposeFile(dependencyName string, config Config) (string, error) {
+	if config.Image == "" {
+		return "", fmt.Errorf("image is empty")
+	}
+	if _, err := HostPorts(config.Ports); err != nil {
+		return "", err
+	}
+
+	// Read the embedded template file
+	templateFile, err := fs.ReadFile("docker-compose-template.mustache")
+	if err != nil {
+		return "", err
+	}
+
+	// Create a new template and parse the content
+	tmpl, err := mustache.ParseStringRaw(string(templateFile), true)
+	if err != nil {
+		return "", err
+	}
+
+	// Every user supplied value is quoted, so values containing quotes or colons do not break the compose file.
+	parameters := map[string]interface{}{
+		"project_name":            Quote(ContainerName(dependencyName)),
+		"service_name":            Quote(dependencyName),
+		"container_name":          Quote(ContainerName(dependencyName)),
+		"image":                   Quote(config.Image),
+		"has_ports":               len(config.Ports) > 0,
+		"ports":                   quoteAll(config.Ports),
+		"has_env":                 len(config.Env) > 0,
+		"env":                     quoteAll(config.Env),
+		"has_volumes":             len(config.Volumes) > 0,
+		"volumes":                 quoteAll(config.Volumes),
+		"has_command":             len(config.Command) > 0,
+		"command":                 strings.Join(quoteAll(config.Command), ", "),
+		"has_healthcheck_command": config.HealthCheckCommand != "",
+		"healthcheck_command":     Quote(config.HealthCheckCommand),
+	}
+
+	// Render the template
+	var buf strings.Builder
+	if err = tmpl.FRender(&buf, parameters); err != nil {
+		return "", err
+	}
+
+	// Return the generated content
+	return buf.String(), nil
+}
+
+// Quote renders value as a JSON string, which is also a valid YAML double-quoted string, for use in compose files.
+func Quote(value string) string {
+	quoted, _ := json.Marshal(value)
+	return string(quoted)
+}
+
+func quoteAll(values []string) []string {
+	quoted := make([]string, 0, len(values))
+	for _, value := range values {
+		quoted = append(quoted, Quote(value))
+	}
+	return quoted
+}
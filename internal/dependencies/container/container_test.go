@@ -0,0 +1,79 @@
+/*
+ * Copyright (c) 2023 Asim Ihsan.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ * SPDX-License-Identifier: MPL-2.0
+ */
+
+package container_test
+
+import (
+	"testing"
+
+	"github.com/asimihsan/virtual-cluster/internal/dependencies/container"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGenerateDockerComposeFile(t *testing.T) {
+	tests := []struct {
+		name       string
+		config     container.Config
+		wantOutput string
+		wantErr    bool
+	}{
+		{
+			name:       "image only",
+			config:     container.Config{Image: "redis:7"},
+			wantOutput: "---\nversion: '2'\nname: \"vcluster_cache\"\nservices:\n\n  \"cache\":\n    image: \"redis:7\"\n    container_name: \"vcluster_cache\"\n",
+			wantErr:    false,
+		},
+		{
+			name: "all fields",
+			config: container.Config{
+				Image:              "postgres:15",
+				Ports:              []string{"5432:5432"},
+				Env:                []string{"POSTGRES_PASSWORD=postgres"},
+				Volumes:            []string{"./data:/var/lib/postgresql/data"},
+				Command:            []string{"postgres", "-c", "log_statement=all"},
+				HealthCheckCommand: "pg_isready -U \"postgres\"",
+			},
+			wantOutput: "---\nversion: '2'\nname: \"vcluster_cache\"\nservices:\n\n  \"cache\":\n    image: \"postgres:15\"\n    container_name: \"vcluster_cache\"\n    ports:\n      - \"5432:5432\"\n    environment:\n      - \"POSTGRES_PASSWORD=postgres\"\n    volumes:\n      - \"./data:/var/lib/postgresql/data\"\n    command: [\"postgres\", \"-c\", \"log_statement=all\"]\n    healthcheck:\n      test: [\"CMD-SHELL\", \"pg_isready -U \\\"postgres\\\"\"]\n      interval: 1s\n      timeout: 5s\n      retries: 60\n",
+			wantErr:    false,
+		},
+		{
+			name:       "missing image",
+			config:     container.Config{},
+			wantOutput: "",
+			wantErr:    true,
+		},
+		{
+			name:       "invalid host port",
+			config:     container.Config{Image: "redis:7", Ports: []string{"redis:6379"}},
+			wantOutput: "",
+			wantErr:    true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotOutput, err := container.GenerateDockerComposeFile("cache", tt.config)
+
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantOutput, gotOutput)
+		})
+	}
+}
+
+func TestHostPorts(t *testing.T) {
+	ports, err := container.HostPorts([]string{"5432:5432", "127.0.0.1:6380:6379", "9200", "8125:8125/udp"})
+	assert.NoError(t, err)
+	assert.Equal(t, []int{5432, 6380, 8125}, ports)
+}
@@ -0,0 +1,139 @@
+/*
+ * Copyright (c) 2023 Asim Ihsan.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ * SPDX-License-Identifier: MPL-2.0
+ */
+
+package container
+
+import (
+	"fmt"
+	"github.com/asimihsan/virtual-cluster/internal/utils"
+	"github.com/asimihsan/virtual-cluster/pkg/dependencies"
+	"github.com/pkg/errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const Kind = "managed_container"
+
+func init() {
+	dependencies.Register(Kind, New)
+}
+
+type Container struct {
+	dependencies.Compose
+	config              Config
+	hostPorts           []int
+	healthCheckEndpoint string
+	healthCheckPort     int
+}
+
+func New(name string, config dependencies.Config) (dependencies.ManagedDependency, error) {
+	if err := config.CheckKeys("image", "ports", "env", "volumes", "command", "healthcheck"); err != nil {
+		return nil, err
+	}
+
+	c := &Container{}
+	var err error
+	if c.config.Image, err = config.String("image"); err != nil {
+		return nil, err
+	}
+	if c.config.Image == "" {
+		return nil, fmt.Errorf("managed container image is empty: %s", name)
+	}
+	if c.config.Ports, err = config.Strings("ports"); err != nil {
+		return nil, err
+	}
+	if c.config.Env, err = config.Strings("env"); err != nil {
+		return nil, err
+	}
+	if c.config.Volumes, err = config.Strings("volumes"); err != nil {
+		return nil, err
+	}
+	if c.config.Command, err = config.Strings("command"); err != nil {
+		return nil, err
+	}
+
+	healthCheck, err := config.Block("healthcheck")
+	if err != nil {
+		return nil, err
+	}
+	if healthCheck != nil {
+		if err := healthCheck.CheckKeys("endpoint", "port", "command"); err != nil {
+			return nil, errors.Wrap(err, "invalid healthcheck")
+		}
+		if c.config.HealthCheckCommand, err = healthCheck.String("command"); err != nil {
+			return nil, err
+		}
+		if c.healthCheckEndpoint, err = healthCheck.String("endpoint"); err != nil {
+			return nil, err
+		}
+		if _, ok := healthCheck["port"]; ok {
+			if c.healthCheckPort, err = healthCheck.Port("port"); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if c.hostPorts, err = HostPorts(c.config.Ports); err != nil {
+		return nil, errors.Wrap(err, "failed to parse container ports")
+	}
+
+	c.Compose = dependencies.Compose{
+		DependencyName: name,
+		Containers:     []string{ContainerName(name)},
+		Networks:       []string{NetworkName(name)},
+		Ports:          c.hostPorts,
+	}
+	return c, nil
+}
+
+func (c *Container) Render(dir string) error {
+	dockerComposeFile, err := GenerateDockerComposeFile(c.Name(), c.config)
+	if err != nil {
+		return errors.Wrap(err, "failed to generate docker compose file")
+	}
+	return c.WriteComposeFile(dir, dockerComposeFile)
+}
+
+// Wait waits for the container to be running, and healthy if it has a docker healthcheck, before trying any
+// endpoint or port check.
+func (c *Container) Wait() error {
+	waiters := []utils.Waiter{utils.NewContainerWaiter(ContainerName(c.Name()))}
+	if c.healthCheckEndpoint != "" {
+		waiters = append(waiters, utils.NewHTTPWaiter(c.healthCheckEndpoint, utils.WithTimeout(60*time.Second)))
+	}
+	if c.healthCheckPort != 0 {
+		waiters = append(waiters, utils.NewTCPWaiter(fmt.Sprintf("localhost:%d", c.healthCheckPort), utils.WithTimeout(60*time.Second)))
+	}
+
+	for _, waiter := range waiters {
+		if err := waiter.Wait(); err != nil {
+			return errors.Wrapf(err, "failed to wait for managed container: %s", c.Name())
+		}
+	}
+	return nil
+}
+
+func (c *Container) ConnectionInfo() map[string]string {
+	ports := make([]string, 0, len(c.hostPorts))
+	for _, port := range c.hostPorts {
+		ports = append(ports, strconv.Itoa(port))
+	}
+	return map[string]string{
+		"container_name": ContainerName(c.Name()),
+		"host":           "localhost",
+		"ports":          strings.Join(ports, ","),
+	}
+}
+
+// Observe does nothing, generic container traffic is not captured.
+func (c *Container) Observe(host dependencies.Host) error {
+	return nil
+}
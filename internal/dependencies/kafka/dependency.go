@@ -0,0 +1,187 @@
+/*
+ * Copyright (c) 2023 Asim Ihsan.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ * SPDX-License-Identifier: MPL-2.0
+ */
+
+package kafka
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/Shopify/sarama"
+	"github.com/asimihsan/virtual-cluster/internal/metrics"
+	"github.com/asimihsan/virtual-cluster/internal/tracing"
+	"github.com/asimihsan/virtual-cluster/internal/utils"
+	"github.com/asimihsan/virtual-cluster/pkg/dependencies"
+	"github.com/pkg/errors"
+	"log"
+	"time"
+)
+
+const Kind = "managed_kafka"
+
+func init() {
+	dependencies.Register(Kind, New)
+}
+
+type Kafka struct {
+	dependencies.Compose
+	port int
+}
+
+func New(name string, config dependencies.Config) (dependencies.ManagedDependency, error) {
+	if err := config.CheckKeys("port"); err != nil {
+		return nil, err
+	}
+	port, err := config.Port("port")
+	if err != nil {
+		return nil, err
+	}
+
+	return &Kafka{
+		Compose: dependencies.Compose{
+			DependencyName: name,
+			Containers:     []string{"broker12345", "kowl12345"},
+			Networks:       []string{"my_custom_network"},
+			Ports:          []int{port},
+		},
+		port: port,
+	}, nil
+}
+
+func (k *Kafka) Render(dir string) error {
+	dockerComposeFile, err := GenerateDockerComposeFile(k.port)
+	if err != nil {
+		return errors.Wrap(err, "failed to generate docker compose file")
+	}
+	return k.WriteComposeFile(dir, dockerComposeFile)
+}
+
+func (k *Kafka) Wait() error {
+	kw := utils.NewKafkaWaiter(k.broker())
+	if err := kw.Wait(); err != nil {
+		return errors.Wrap(err, "failed to wait for kafka")
+	}
+	return nil
+}
+
+func (k *Kafka) ConnectionInfo() map[string]string {
+	return map[string]string{
+		"bootstrap_servers": k.broker(),
+	}
+}
+
+func (k *Kafka) broker() string {
+	return fmt.Sprintf("localhost:%d", k.port)
+}
+
+// Observe consumes every topic on the broker, including topics created later, and stores each message in the
+// kafka_messages table.
+func (k *Kafka) Observe(host dependencies.Host) error {
+	config := sarama.NewConfig()
+	config.Consumer.Return.Errors = true
+	config.Metadata.RefreshFrequency = 1 * time.Second
+
+	// Connect to the Kafka broker
+	kafkaClient, err := sarama.NewClient([]string{k.broker()}, config)
+	if err != nil {
+		return err
+	}
+	defer func(kafkaClient sarama.Client) {
+		err := kafkaClient.Close()
+		if err != nil {
+			fmt.Println("failed to close kafka client:", err)
+		}
+	}(kafkaClient)
+
+	// Keep track of the topics we're already consuming
+	consumingTopics := make(map[string]bool)
+
+	for {
+		topics, err := kafkaClient.Topics()
+		if err != nil {
+			return err
+		}
+
+		// For each topicName, if we're not already consuming it, start a consumer
+		for _, topicName := range topics {
+			if consumingTopics[topicName] {
+				continue
+			}
+
+			consumingTopics[topicName] = true
+
+			consumer, err := sarama.NewConsumerFromClient(kafkaClient)
+			if err != nil {
+				return err
+			}
+
+			partitionConsumer, err := consumer.ConsumePartition(topicName, 0, sarama.OffsetOldest)
+			if err != nil {
+				return err
+			}
+
+			topic := topicName
+			go func() {
+				for err := range partitionConsumer.Errors() {
+					metrics.KafkaConsumerErrors.WithLabelValues(k.Name(), topic).Inc()
+					log.Printf("Failed to consume message from topic %s: %v", topic, err)
+				}
+			}()
+			go func() {
+				fmt.Printf("Consuming messages from topic: %s\n", topic)
+				for message := range partitionConsumer.Messages() {
+					fmt.Printf("Consumed message from topic: %s\n", topic)
+					fmt.Printf("Message: %s\n", string(message.Value))
+
+					// convert message.Timestamp to UTC then to format '%Y-%m-%dT%H:%M:%fZ', note that time.RFC3339 does not have fractional seconds!
+					timestamp := message.Timestamp.UTC().Format(utils.TimestampFormat)
+
+					// Messages produced within a trace carry its context in their headers.
+					headers := messageHeaders(message)
+					var encodedHeaders, traceID, spanID *string
+					if len(headers) > 0 {
+						encoded, _ := json.Marshal(headers)
+						encodedHeaders = new(string)
+						*encodedHeaders = string(encoded)
+					}
+					if span, ok := tracing.FromHeaders(headers); ok {
+						traceID = &span.TraceID
+						if span.SpanID != "" {
+							spanID = &span.SpanID
+						}
+					}
+
+					// For each message, store it in the SQLite database
+					metrics.KafkaMessages.WithLabelValues(k.Name(), topic).Inc()
+					start := time.Now()
+					_, err := host.DB().Exec("INSERT INTO kafka_messages (broker_name, topic_name, message_key, message_value, timestamp, headers, trace_id, span_id) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+						k.Name(), topic, string(message.Key), string(message.Value), timestamp, encodedHeaders, traceID, spanID)
+					metrics.ObserveWrite("kafka_messages", start, err)
+					if err != nil {
+						log.Printf("Failed to insert message into database: %v", err)
+					}
+				}
+			}()
+		}
+
+		// Wait for a bit before checking for new topics
+		time.Sleep(1 * time.Second)
+	}
+}
+
+// messageHeaders returns the headers of a message by name. A header repeated in a message keeps its last value.
+func messageHeaders(message *sarama.ConsumerMessage) map[string]string {
+	headers := make(map[string]string, len(message.Headers))
+	for _, header := range message.Headers {
+		if header != nil {
+			headers[string(header.Key)] = string(header.Value)
+		}
+	}
+	return headers
+}
@@ -0,0 +1,80 @@
+/*
+ * Copyright (c) 2023 Asim Ihsan.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ * SPDX-License-Identifier: MPL-2.0
+ */
+
+package localstack
+
+import (
+	"fmt"
+	"github.com/asimihsan/virtual-cluster/internal/utils"
+	"github.com/asimihsan/virtual-cluster/pkg/dependencies"
+	"github.com/pkg/errors"
+)
+
+const Kind = "managed_localstack"
+
+func init() {
+	dependencies.Register(Kind, New)
+}
+
+type Localstack struct {
+	dependencies.Compose
+	port int
+}
+
+func New(name string, config dependencies.Config) (dependencies.ManagedDependency, error) {
+	if err := config.CheckKeys("port"); err != nil {
+		return nil, err
+	}
+	port, err := config.Port("port")
+	if err != nil {
+		return nil, err
+	}
+
+	return &Localstack{
+		Compose: dependencies.Compose{
+			DependencyName: name,
+			Containers:     []string{"localstack_main"},
+			Networks:       []string{"localstack_default"},
+			Ports:          []int{port},
+		},
+		port: port,
+	}, nil
+}
+
+func (l *Localstack) Render(dir string) error {
+	dockerComposeFile, err := GenerateDockerComposeFile(l.port)
+	if err != nil {
+		return errors.Wrap(err, "failed to generate docker compose file")
+	}
+	return l.WriteComposeFile(dir, dockerComposeFile)
+}
+
+func (l *Localstack) Wait() error {
+	localstackWaiter := utils.NewLocalStackWaiter(l.endpoint())
+	if err := localstackWaiter.Wait(); err != nil {
+		return errors.Wrap(err, "failed to wait for localstack")
+	}
+	return nil
+}
+
+func (l *Localstack) ConnectionInfo() map[string]string {
+	return map[string]string{
+		"endpoint": l.endpoint(),
+	}
+}
+
+func (l *Localstack) endpoint() string {
+	return fmt.Sprintf("http://localhost:%d", l.port)
+}
+
+// Observe does nothing, LocalStack traffic is not captured.
+func (l *Localstack) Observe(host dependencies.Host) error {
+	return nil
+}
@@ -0,0 +1,110 @@
+/*
+ * Copyright (c) 2023 Asim Ihsan.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ * SPDX-License-Identifier: MPL-2.0
+ */
+
+package postgres
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/asimihsan/virtual-cluster/internal/dependencies/tcp"
+	"io"
+	"net"
+)
+
+// NewProxy listens on listenAddr and forwards Postgres connections to backend, calling record for every finished
+// query together with the client the connection was attributed to.
+func NewProxy(
+	listenAddr string,
+	backend string,
+	client func(conn net.Conn) string,
+	record func(client string, query Query),
+) (*tcp.Server, error) {
+	return tcp.NewProxy(listenAddr, backend, client, func(clientConn net.Conn, serverConn net.Conn, client string) {
+		forward(clientConn, serverConn, client, record)
+	})
+}
+
+func forward(clientConn net.Conn, serverConn net.Conn, client string, record func(client string, query Query)) {
+	clientReader := bufio.NewReader(clientConn)
+	serverReader := bufio.NewReader(serverConn)
+
+	// The startup phase is strictly request/response, so it is handled inline before the two directions are
+	// decoded independently.
+	var parameters map[string]string
+	for {
+		raw, code, err := readStartupMessage(clientReader)
+		if err != nil {
+			return
+		}
+		if _, err := serverConn.Write(raw); err != nil {
+			return
+		}
+
+		if code == sslRequestCode || code == gssEncRequestCode {
+			// The server answers with a single unframed byte. Anything but a refusal means the rest of the
+			// connection is encrypted and cannot be decoded.
+			answer, err := serverReader.ReadByte()
+			if err != nil {
+				return
+			}
+			if _, err := clientConn.Write([]byte{answer}); err != nil {
+				return
+			}
+			if answer != 'N' {
+				tcp.Pipe(clientConn, clientReader, serverConn, serverReader)
+				return
+			}
+			continue
+		}
+		if code == cancelRequestCode {
+			tcp.Pipe(clientConn, clientReader, serverConn, serverReader)
+			return
+		}
+
+		parameters = startupParameters(raw)
+		break
+	}
+
+	if client == "" {
+		client = parameters["application_name"]
+	}
+	database := parameters["database"]
+	if database == "" {
+		database = parameters["user"]
+	}
+	s := newSession(database, func(query Query) {
+		record(client, query)
+	})
+	tcp.Forward(clientConn, serverConn, func() {
+		forwardMessages(clientReader, serverConn, s.frontend)
+	}, func() {
+		forwardMessages(serverReader, clientConn, s.backend)
+	})
+}
+
+// forwardMessages copies typed messages from r to w, handing each one to observe before it is forwarded, so that a
+// statement is pending before the server can possibly answer it.
+func forwardMessages(r *bufio.Reader, w io.Writer, observe func(typ byte, payload []byte)) {
+	for {
+		typ, raw, payload, err := readMessage(r)
+		if err != nil {
+			if err != io.EOF {
+				fmt.Printf("postgres proxy: failed to read message: %v\n", err)
+			}
+			// Whatever is left, e.g. after a framing error, is still forwarded untouched.
+			_, _ = io.Copy(w, r)
+			return
+		}
+		observe(typ, payload)
+		if _, err := w.Write(raw); err != nil {
+			return
+		}
+	}
+}
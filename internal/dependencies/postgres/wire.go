@@ -0,0 +1,374 @@
+/*
+ * Copyright (c) 2023 Asim Ihsan.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ * SPDX-License-Identifier: MPL-2.0
+ */
+
+package postgres
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Protocol codes that can appear in place of a protocol version in the first message of a connection.
+const (
+	sslRequestCode    = 80877103
+	gssEncRequestCode = 80877104
+	cancelRequestCode = 80877102
+)
+
+// maxMessageLength guards against reading garbage as a message length, e.g. after losing track of the stream.
+const maxMessageLength = 1 << 30
+
+// readStartupMessage reads the first message of a connection, which unlike every later message has no type byte.
+// It returns the raw bytes to forward and the protocol code.
+func readStartupMessage(r *bufio.Reader) ([]byte, uint32, error) {
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, 0, err
+	}
+	length := binary.BigEndian.Uint32(header[0:4])
+	if length < 8 || length > maxMessageLength {
+		return nil, 0, fmt.Errorf("invalid startup message length: %d", length)
+	}
+	raw := make([]byte, length)
+	copy(raw, header)
+	if _, err := io.ReadFull(r, raw[8:]); err != nil {
+		return nil, 0, err
+	}
+	return raw, binary.BigEndian.Uint32(header[4:8]), nil
+}
+
+// startupParameters parses the key/value pairs of a StartupMessage, such as user, database and application_name.
+func startupParameters(raw []byte) map[string]string {
+	parameters := make(map[string]string)
+	fields := bytes.Split(raw[8:], []byte{0})
+	for i := 0; i+1 < len(fields); i += 2 {
+		if len(fields[i]) == 0 {
+			break
+		}
+		parameters[string(fields[i])] = string(fields[i+1])
+	}
+	return parameters
+}
+
+// readMessage reads one typed message. raw is the whole message to forward, payload excludes the type and length.
+func readMessage(r *bufio.Reader) (byte, []byte, []byte, error) {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, nil, err
+	}
+	length := binary.BigEndian.Uint32(header[1:5])
+	if length < 4 || length > maxMessageLength {
+		return 0, nil, nil, fmt.Errorf("invalid message length: %d", length)
+	}
+	raw := make([]byte, length+1)
+	copy(raw, header)
+	if _, err := io.ReadFull(r, raw[5:]); err != nil {
+		return 0, nil, nil, err
+	}
+	return header[0], raw, raw[5:], nil
+}
+
+// messageReader reads the fields of a message payload. Reads past the end return zero values rather than failing,
+// so a malformed message degrades the capture instead of the connection.
+type messageReader struct {
+	payload []byte
+}
+
+func (m *messageReader) cstring() string {
+	i := bytes.IndexByte(m.payload, 0)
+	if i < 0 {
+		s := string(m.payload)
+		m.payload = nil
+		return s
+	}
+	s := string(m.payload[:i])
+	m.payload = m.payload[i+1:]
+	return s
+}
+
+func (m *messageReader) int16() int {
+	if len(m.payload) < 2 {
+		m.payload = nil
+		return 0
+	}
+	v := int16(binary.BigEndian.Uint16(m.payload))
+	m.payload = m.payload[2:]
+	return int(v)
+}
+
+func (m *messageReader) int32() int {
+	if len(m.payload) < 4 {
+		m.payload = nil
+		return 0
+	}
+	v := int32(binary.BigEndian.Uint32(m.payload))
+	m.payload = m.payload[4:]
+	return int(v)
+}
+
+func (m *messageReader) bytes(n int) []byte {
+	if n > len(m.payload) {
+		n = len(m.payload)
+	}
+	b := m.payload[:n]
+	m.payload = m.payload[n:]
+	return b
+}
+
+// Query is one captured statement execution.
+type Query struct {
+	Database string
+	Query    string
+
+	// Parameters of an extended-protocol query, nil for NULL. Binary parameters are hex encoded with a \x prefix,
+	// like Postgres displays bytea.
+	Parameters []*string
+
+	Start    time.Time
+	Duration time.Duration
+	Rows     int64
+	Error    string
+}
+
+type pendingKind int
+
+const (
+	pendingSimple pendingKind = iota
+	pendingExecute
+	pendingSync
+)
+
+type pending struct {
+	kind     pendingKind
+	query    Query
+	dataRows int64
+	rows     int64
+	hasRows  bool
+}
+
+type boundPortal struct {
+	query      string
+	parameters []*string
+}
+
+// session follows one client connection through the frontend and backend messages that pass the proxy and turns
+// them into Query records. The simple protocol yields one record per Query message, the extended protocol one per
+// Execute.
+type session struct {
+	mu         sync.Mutex
+	database   string
+	statements map[string]string
+	portals    map[string]boundPortal
+	pending    []*pending
+	record     func(Query)
+	now        func() time.Time
+}
+
+func newSession(database string, record func(Query)) *session {
+	return &session{
+		database:   database,
+		statements: make(map[string]string),
+		portals:    make(map[string]boundPortal),
+		record:     record,
+		now:        time.Now,
+	}
+}
+
+func (s *session) frontend(typ byte, payload []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m := &messageReader{payload: payload}
+	switch typ {
+	case 'Q':
+		s.push(pendingSimple, m.cstring(), nil)
+	case 'P':
+		name := m.cstring()
+		s.statements[name] = m.cstring()
+	case 'B':
+		portal := m.cstring()
+		statement := m.cstring()
+		count := m.int16()
+		if count < 0 {
+			// A malformed Bind is not decoded any further.
+			return
+		}
+		formats := make([]int, count)
+		for i := range formats {
+			formats[i] = m.int16()
+		}
+		count = m.int16()
+		if count < 0 {
+			return
+		}
+		parameters := make([]*string, count)
+		for i := range parameters {
+			length := m.int32()
+			if length < 0 {
+				continue
+			}
+			value := m.bytes(length)
+			format := 0
+			if len(formats) == 1 {
+				format = formats[0]
+			} else if i < len(formats) {
+				format = formats[i]
+			}
+			var text string
+			if format == 1 {
+				text = `\x` + hex.EncodeToString(value)
+			} else {
+				text = string(value)
+			}
+			parameters[i] = &text
+		}
+		s.portals[portal] = boundPortal{query: s.statements[statement], parameters: parameters}
+	case 'E':
+		portal := s.portals[m.cstring()]
+		s.push(pendingExecute, portal.query, portal.parameters)
+	case 'S':
+		s.pending = append(s.pending, &pending{kind: pendingSync})
+	case 'C':
+		kind := m.cstring()
+		name := m.cstring()
+		if kind == "S" {
+			delete(s.statements, name)
+		} else {
+			delete(s.portals, name)
+		}
+	}
+}
+
+func (s *session) push(kind pendingKind, query string, parameters []*string) {
+	s.pending = append(s.pending, &pending{
+		kind: kind,
+		query: Query{
+			Database:   s.database,
+			Query:      query,
+			Parameters: parameters,
+			Start:      s.now(),
+		},
+	})
+}
+
+// head returns the oldest statement still waiting for its result, or nil if the server is next going to answer a
+// Sync.
+func (s *session) head() *pending {
+	if len(s.pending) == 0 || s.pending[0].kind == pendingSync {
+		return nil
+	}
+	return s.pending[0]
+}
+
+func (s *session) backend(typ byte, payload []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m := &messageReader{payload: payload}
+	head := s.head()
+	switch typ {
+	case 'D':
+		if head != nil {
+			head.dataRows++
+		}
+	case 'C':
+		if head == nil {
+			return
+		}
+		if rows, ok := commandTagRows(m.cstring()); ok {
+			head.rows += rows
+			head.hasRows = true
+		}
+		if head.kind == pendingExecute {
+			s.finish(head)
+			s.pending = s.pending[1:]
+		}
+	case 'I', 's':
+		if head != nil && head.kind == pendingExecute {
+			s.finish(head)
+			s.pending = s.pending[1:]
+		}
+	case 'E':
+		if head == nil {
+			return
+		}
+		head.query.Error = errorResponseMessage(m)
+		// The simple protocol still sends ReadyForQuery after an error, which finishes the query below.
+		if head.kind == pendingExecute {
+			s.finish(head)
+			s.pending = s.pending[1:]
+		}
+	case 'Z':
+		// ReadyForQuery answers either a simple query or a Sync. Executes still queued before the Sync were
+		// skipped by the server after an error and never ran.
+		for len(s.pending) > 0 {
+			p := s.pending[0]
+			s.pending = s.pending[1:]
+			if p.kind == pendingSync {
+				return
+			}
+			if p.kind == pendingSimple {
+				s.finish(p)
+				return
+			}
+		}
+	}
+}
+
+func (s *session) finish(p *pending) {
+	p.query.Duration = s.now().Sub(p.query.Start)
+	if p.hasRows {
+		p.query.Rows = p.rows
+	} else {
+		p.query.Rows = p.dataRows
+	}
+	s.record(p.query)
+}
+
+// commandTagRows returns the row count at the end of a CommandComplete tag such as "SELECT 5" or "INSERT 0 1".
+func commandTagRows(tag string) (int64, bool) {
+	fields := strings.Fields(tag)
+	if len(fields) < 2 {
+		return 0, false
+	}
+	rows, err := strconv.ParseInt(fields[len(fields)-1], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return rows, true
+}
+
+// errorResponseMessage formats an ErrorResponse like psql does, e.g. `ERROR: relation "x" does not exist (42P01)`.
+func errorResponseMessage(m *messageReader) string {
+	fields := make(map[byte]string)
+	for len(m.payload) > 0 {
+		code := m.bytes(1)[0]
+		if code == 0 {
+			break
+		}
+		fields[code] = m.cstring()
+	}
+	message := fields['M']
+	if severity, ok := fields['S']; ok {
+		message = severity + ": " + message
+	}
+	if code, ok := fields['C']; ok {
+		message += " (" + code + ")"
+	}
+	return message
+}
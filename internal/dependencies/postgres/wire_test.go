@@ -0,0 +1,253 @@
+/*
+ * Copyright (c) 2023 Asim Ihsan.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ * SPDX-License-Identifier: MPL-2.0
+ */
+
+package postgres
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type messageBuilder struct {
+	buf bytes.Buffer
+}
+
+func (b *messageBuilder) cstring(s string) *messageBuilder {
+	b.buf.WriteString(s)
+	b.buf.WriteByte(0)
+	return b
+}
+
+func (b *messageBuilder) int16(v int) *messageBuilder {
+	_ = binary.Write(&b.buf, binary.BigEndian, int16(v))
+	return b
+}
+
+func (b *messageBuilder) int32(v int) *messageBuilder {
+	_ = binary.Write(&b.buf, binary.BigEndian, int32(v))
+	return b
+}
+
+func (b *messageBuilder) raw(p []byte) *messageBuilder {
+	b.buf.Write(p)
+	return b
+}
+
+func (b *messageBuilder) message(typ byte) []byte {
+	out := []byte{typ, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(out[1:], uint32(b.buf.Len()+4))
+	return append(out, b.buf.Bytes()...)
+}
+
+func payloadOf(message []byte) []byte {
+	return message[5:]
+}
+
+func newTestSession() (*session, *[]Query) {
+	var queries []Query
+	s := newSession("orders", func(query Query) {
+		queries = append(queries, query)
+	})
+	start := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	calls := 0
+	s.now = func() time.Time {
+		calls++
+		return start.Add(time.Duration(calls) * time.Millisecond)
+	}
+	return s, &queries
+}
+
+func TestSession_SimpleQuery(t *testing.T) {
+	s, queries := newTestSession()
+
+	s.frontend('Q', payloadOf((&messageBuilder{}).cstring("SELECT id FROM orders").message('Q')))
+	s.backend('T', nil)
+	s.backend('D', nil)
+	s.backend('D', nil)
+	s.backend('C', payloadOf((&messageBuilder{}).cstring("SELECT 2").message('C')))
+	s.backend('Z', []byte{'I'})
+
+	assert.Len(t, *queries, 1)
+	query := (*queries)[0]
+	assert.Equal(t, "orders", query.Database)
+	assert.Equal(t, "SELECT id FROM orders", query.Query)
+	assert.Nil(t, query.Parameters)
+	assert.Equal(t, int64(2), query.Rows)
+	assert.Equal(t, time.Millisecond, query.Duration)
+	assert.Empty(t, query.Error)
+}
+
+func TestSession_SimpleQueryError(t *testing.T) {
+	s, queries := newTestSession()
+
+	s.frontend('Q', payloadOf((&messageBuilder{}).cstring("SELECT * FROM missing").message('Q')))
+	errorResponse := (&messageBuilder{}).
+		raw([]byte{'S'}).cstring("ERROR").
+		raw([]byte{'C'}).cstring("42P01").
+		raw([]byte{'M'}).cstring(`relation "missing" does not exist`).
+		raw([]byte{0}).
+		message('E')
+	s.backend('E', payloadOf(errorResponse))
+	s.backend('Z', []byte{'I'})
+
+	assert.Len(t, *queries, 1)
+	assert.Equal(t, `ERROR: relation "missing" does not exist (42P01)`, (*queries)[0].Error)
+}
+
+func TestSession_ExtendedQuery(t *testing.T) {
+	s, queries := newTestSession()
+
+	s.frontend('P', payloadOf((&messageBuilder{}).cstring("").cstring("SELECT * FROM orders WHERE id = $1 AND data = $2 AND note = $3").int16(0).message('P')))
+	bind := (&messageBuilder{}).
+		cstring("").cstring("").
+		int16(3).int16(0).int16(1).int16(0).
+		int16(3).
+		int32(2).raw([]byte("42")).
+		int32(2).raw([]byte{0xde, 0xad}).
+		int32(-1).
+		int16(0).
+		message('B')
+	s.frontend('B', payloadOf(bind))
+	s.frontend('E', payloadOf((&messageBuilder{}).cstring("").int32(0).message('E')))
+	s.frontend('S', nil)
+
+	s.backend('1', nil)
+	s.backend('2', nil)
+	s.backend('D', nil)
+	s.backend('C', payloadOf((&messageBuilder{}).cstring("SELECT 1").message('C')))
+	s.backend('Z', []byte{'I'})
+
+	assert.Len(t, *queries, 1)
+	query := (*queries)[0]
+	assert.Equal(t, "SELECT * FROM orders WHERE id = $1 AND data = $2 AND note = $3", query.Query)
+	assert.Len(t, query.Parameters, 3)
+	assert.Equal(t, "42", *query.Parameters[0])
+	assert.Equal(t, `\xdead`, *query.Parameters[1])
+	assert.Nil(t, query.Parameters[2])
+	assert.Equal(t, int64(1), query.Rows)
+}
+
+func TestSession_ExtendedQueryErrorSkipsRestOfBatch(t *testing.T) {
+	s, queries := newTestSession()
+
+	s.frontend('P', payloadOf((&messageBuilder{}).cstring("").cstring("INSERT INTO orders VALUES (1)").int16(0).message('P')))
+	s.frontend('B', payloadOf((&messageBuilder{}).cstring("").cstring("").int16(0).int16(0).int16(0).message('B')))
+	s.frontend('E', payloadOf((&messageBuilder{}).cstring("").int32(0).message('E')))
+	s.frontend('E', payloadOf((&messageBuilder{}).cstring("").int32(0).message('E')))
+	s.frontend('S', nil)
+	s.frontend('Q', payloadOf((&messageBuilder{}).cstring("SELECT 1").message('Q')))
+
+	errorResponse := (&messageBuilder{}).raw([]byte{'M'}).cstring("duplicate key").raw([]byte{0}).message('E')
+	s.backend('E', payloadOf(errorResponse))
+	s.backend('Z', []byte{'E'})
+	s.backend('C', payloadOf((&messageBuilder{}).cstring("SELECT 1").message('C')))
+	s.backend('Z', []byte{'I'})
+
+	assert.Len(t, *queries, 2)
+	assert.Equal(t, "duplicate key", (*queries)[0].Error)
+	assert.Equal(t, "SELECT 1", (*queries)[1].Query)
+	assert.Empty(t, (*queries)[1].Error)
+}
+
+func TestSession_MalformedBindIsNotDecoded(t *testing.T) {
+	s, queries := newTestSession()
+
+	s.frontend('P', payloadOf((&messageBuilder{}).cstring("").cstring("SELECT $1").int16(0).message('P')))
+	assert.NotPanics(t, func() {
+		s.frontend('B', payloadOf((&messageBuilder{}).cstring("").cstring("").int16(-1).message('B')))
+		s.frontend('B', payloadOf((&messageBuilder{}).cstring("").cstring("").int16(0).int16(-2).message('B')))
+	})
+	s.frontend('Q', payloadOf((&messageBuilder{}).cstring("SELECT 1").message('Q')))
+	s.backend('C', payloadOf((&messageBuilder{}).cstring("SELECT 1").message('C')))
+	s.backend('Z', []byte{'I'})
+
+	assert.Len(t, *queries, 1)
+	assert.Equal(t, "SELECT 1", (*queries)[0].Query)
+}
+
+func TestProxy_ForwardsAndRecords(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer backend.Close()
+
+	// A fake server that refuses SSL and answers a single simple query.
+	go func() {
+		conn, err := backend.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		_, _, _ = readStartupMessage(r)
+		_, _ = conn.Write([]byte{'N'})
+		_, _, _ = readStartupMessage(r)
+		_, _ = conn.Write((&messageBuilder{}).raw([]byte{'I'}).message('Z'))
+		_, _, _, _ = readMessage(r)
+		_, _ = conn.Write((&messageBuilder{}).cstring("SELECT 0").message('C'))
+		_, _ = conn.Write((&messageBuilder{}).raw([]byte{'I'}).message('Z'))
+	}()
+
+	recorded := make(chan Query, 1)
+	var recordedClient string
+	proxy, err := NewProxy(
+		"127.0.0.1:0",
+		backend.Addr().String(),
+		func(conn net.Conn) string { return "" },
+		func(client string, query Query) {
+			recordedClient = client
+			recorded <- query
+		},
+	)
+	assert.NoError(t, err)
+	defer proxy.Close()
+	go func() {
+		_ = proxy.Serve()
+	}()
+
+	conn, err := net.Dial("tcp", proxy.Addr().String())
+	assert.NoError(t, err)
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	sslRequest := []byte{0, 0, 0, 8, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(sslRequest[4:], sslRequestCode)
+	_, err = conn.Write(sslRequest)
+	assert.NoError(t, err)
+	answer, err := r.ReadByte()
+	assert.NoError(t, err)
+	assert.Equal(t, byte('N'), answer)
+
+	startup := (&messageBuilder{}).int32(196608).cstring("user").cstring("postgres").cstring("database").cstring("orders").cstring("application_name").cstring("billing").raw([]byte{0}).buf.Bytes()
+	startupMessage := append(binary.BigEndian.AppendUint32(nil, uint32(len(startup)+4)), startup...)
+	_, err = conn.Write(startupMessage)
+	assert.NoError(t, err)
+	typ, _, _, err := readMessage(r)
+	assert.NoError(t, err)
+	assert.Equal(t, byte('Z'), typ)
+
+	_, err = conn.Write((&messageBuilder{}).cstring("SELECT 1 WHERE false").message('Q'))
+	assert.NoError(t, err)
+
+	select {
+	case query := <-recorded:
+		assert.Equal(t, "billing", recordedClient)
+		assert.Equal(t, "orders", query.Database)
+		assert.Equal(t, "SELECT 1 WHERE false", query.Query)
+		assert.Equal(t, int64(0), query.Rows)
+	case <-time.After(5 * time.Second):
+		t.Fatal("query was not recorded")
+	}
+}
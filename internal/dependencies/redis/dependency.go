@@ -0,0 +1,143 @@
+/*
+ * Copyright (c) 2023 Asim Ihsan.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ * SPDX-License-Identifier: MPL-2.0
+ */
+
+package redis
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/asimihsan/virtual-cluster/internal/dependencies/container"
+	"github.com/asimihsan/virtual-cluster/internal/dependencies/tcp"
+	"github.com/asimihsan/virtual-cluster/internal/utils"
+	"github.com/asimihsan/virtual-cluster/pkg/dependencies"
+	"github.com/pkg/errors"
+	"log"
+	"strconv"
+	"time"
+)
+
+const Kind = "managed_redis"
+
+func init() {
+	dependencies.Register(Kind, New)
+}
+
+// Redis is a Redis server in Docker whose commands are captured by a proxy on the configured port.
+type Redis struct {
+	dependencies.Compose
+	port        int
+	backendPort int
+	proxy       *tcp.Server
+}
+
+func New(name string, config dependencies.Config) (dependencies.ManagedDependency, error) {
+	if err := config.CheckKeys("port"); err != nil {
+		return nil, err
+	}
+	port, err := config.Port("port")
+	if err != nil {
+		return nil, err
+	}
+
+	return &Redis{
+		Compose: dependencies.Compose{
+			DependencyName: name,
+			Containers:     []string{container.ContainerName(name)},
+			Networks:       []string{container.NetworkName(name)},
+			Ports:          []int{port},
+		},
+		port: port,
+	}, nil
+}
+
+// Render writes the compose file, publishing Redis on a free port for the proxy to forward to.
+func (r *Redis) Render(dir string) error {
+	backendPort, err := utils.FreePort()
+	if err != nil {
+		return errors.Wrap(err, "failed to find a free port for redis")
+	}
+	r.backendPort = backendPort
+
+	dockerComposeFile, err := GenerateDockerComposeFile(r.Name(), r.backendPort)
+	if err != nil {
+		return errors.Wrap(err, "failed to generate docker compose file")
+	}
+	return r.WriteComposeFile(dir, dockerComposeFile)
+}
+
+func (r *Redis) Start(host dependencies.Host) error {
+	if err := r.Compose.Start(host); err != nil {
+		return err
+	}
+
+	proxy, err := NewProxy(
+		fmt.Sprintf(":%d", r.port),
+		fmt.Sprintf("localhost:%d", r.backendPort),
+		host.ServiceForConnection,
+		func(client string, command Command) {
+			r.store(host, client, command)
+		},
+	)
+	if err != nil {
+		return errors.Wrap(err, "failed to start redis proxy")
+	}
+	r.proxy = proxy
+	return nil
+}
+
+func (r *Redis) Wait() error {
+	cw := utils.NewContainerWaiter(container.ContainerName(r.Name()))
+	if err := cw.Wait(); err != nil {
+		return errors.Wrap(err, "failed to wait for redis")
+	}
+	return nil
+}
+
+func (r *Redis) Stop() error {
+	if r.proxy != nil {
+		if err := r.proxy.Close(); err != nil {
+			log.Printf("failed to close redis proxy: %v", err)
+		}
+	}
+	return r.Compose.Stop()
+}
+
+func (r *Redis) ConnectionInfo() map[string]string {
+	return map[string]string{
+		"host": "localhost",
+		"port": strconv.Itoa(r.port),
+		"url":  fmt.Sprintf("redis://localhost:%d", r.port),
+	}
+}
+
+// Observe records every command into the redis_commands table until the dependency is stopped.
+func (r *Redis) Observe(host dependencies.Host) error {
+	if r.proxy == nil {
+		return fmt.Errorf("redis proxy is not running: %s", r.Name())
+	}
+	return r.proxy.Serve()
+}
+
+func (r *Redis) store(host dependencies.Host, client string, command Command) {
+	arguments, _ := json.Marshal(command.Arguments)
+	var commandError *string
+	if command.Error != "" {
+		commandError = &command.Error
+	}
+
+	_, err := host.DB().Exec(`
+		INSERT INTO redis_commands (timestamp, dependency_name, client_name, command, arguments, reply_type, error, duration_ms)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		command.Start.UTC().Format(utils.TimestampFormat), r.Name(), client, command.Name, string(arguments),
+		command.ReplyType, commandError, float64(command.Duration)/float64(time.Millisecond))
+	if err != nil {
+		log.Printf("Failed to insert redis command into database: %v", err)
+	}
+}
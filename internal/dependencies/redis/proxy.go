@@ -0,0 +1,62 @@
+/*
+ * Copyright (c) 2023 Asim Ihsan.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ * SPDX-License-Identifier: MPL-2.0
+ */
+
+package redis
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/asimihsan/virtual-cluster/internal/dependencies/tcp"
+	"io"
+	"net"
+)
+
+// NewProxy listens on listenAddr and forwards Redis connections to backend, calling record for every answered command
+// together with the client the connection was attributed to.
+func NewProxy(
+	listenAddr string,
+	backend string,
+	client func(conn net.Conn) string,
+	record func(client string, command Command),
+) (*tcp.Server, error) {
+	return tcp.NewProxy(listenAddr, backend, client, func(clientConn net.Conn, serverConn net.Conn, client string) {
+		s := newSession(func(command Command) {
+			record(client, command)
+		})
+		tcp.Forward(clientConn, serverConn, func() {
+			forwardValues(bufio.NewReader(clientConn), serverConn, s.command)
+		}, func() {
+			forwardValues(bufio.NewReader(serverConn), clientConn, s.reply)
+		})
+	})
+}
+
+// forwardValues copies RESP values from r to w, observing each one before it is written, as a reply can only follow
+// once its command has been written.
+func forwardValues(r *bufio.Reader, w io.Writer, observe func(value)) {
+	rr := &respReader{r: r}
+	for {
+		v, err := rr.next()
+		if err != nil {
+			// Whatever was read of a value that could not be decoded, and everything after it, is still forwarded
+			// untouched.
+			_, _ = w.Write(rr.take())
+			if err != io.EOF {
+				fmt.Printf("redis proxy: failed to read value: %v\n", err)
+				_, _ = io.Copy(w, r)
+			}
+			return
+		}
+		observe(v)
+		if _, err := w.Write(rr.take()); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,245 @@
+/*
+ * Copyright (c) 2023 Asim Ihsan.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ * SPDX-License-Identifier: MPL-2.0
+ */
+
+package redis
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxBulkLength guards against reading garbage as a length, e.g. after losing track of the stream. It matches the
+// proto-max-bulk-len default of Redis.
+const maxBulkLength = 512 * 1024 * 1024
+
+// maxPreallocatedElements bounds how many elements are allocated up front for an aggregate, whose length may be
+// garbage. Longer aggregates grow as their elements are read.
+const maxPreallocatedElements = 1024
+
+// maxArgumentLength is how much of each command argument is captured.
+const maxArgumentLength = 256
+
+// respReader reads RESP2 and RESP3 values, keeping every byte it consumes so that the value can be forwarded
+// unchanged.
+type respReader struct {
+	r   *bufio.Reader
+	raw bytes.Buffer
+}
+
+// value is a decoded RESP value. Only what the capture needs is kept: the type, the text of simple values and the
+// elements of aggregates.
+type value struct {
+	kind     string
+	text     string
+	elements []value
+}
+
+func (rr *respReader) line() (string, error) {
+	line, err := rr.r.ReadString('\n')
+	rr.raw.WriteString(line)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r"), nil
+}
+
+func (rr *respReader) length(s string) (int, error) {
+	n, err := strconv.Atoi(s)
+	if err != nil || n > maxBulkLength {
+		return 0, fmt.Errorf("invalid length: %q", s)
+	}
+	return n, nil
+}
+
+func (rr *respReader) bulk(n int) (string, error) {
+	data := make([]byte, n+2)
+	m, err := io.ReadFull(rr.r, data)
+	rr.raw.Write(data[:m])
+	if err != nil {
+		return "", err
+	}
+	return string(data[:n]), nil
+}
+
+// next reads one complete value. Client commands sent in the inline format, e.g. "PING\r\n" typed into telnet, are
+// returned as an array of their words.
+func (rr *respReader) next() (value, error) {
+	line, err := rr.line()
+	if err != nil {
+		return value{}, err
+	}
+	if line == "" {
+		return value{kind: "inline"}, nil
+	}
+
+	prefix, rest := line[0], line[1:]
+	switch prefix {
+	case '+':
+		return value{kind: "simple_string", text: rest}, nil
+	case '-':
+		return value{kind: "error", text: rest}, nil
+	case ':':
+		return value{kind: "integer", text: rest}, nil
+	case '_':
+		return value{kind: "null"}, nil
+	case ',':
+		return value{kind: "double", text: rest}, nil
+	case '#':
+		return value{kind: "boolean", text: rest}, nil
+	case '(':
+		return value{kind: "big_number", text: rest}, nil
+	case '$', '!', '=':
+		n, err := rr.length(rest)
+		if err != nil {
+			return value{}, err
+		}
+		if n < 0 {
+			return value{kind: "null"}, nil
+		}
+		text, err := rr.bulk(n)
+		if err != nil {
+			return value{}, err
+		}
+		kinds := map[byte]string{'$': "bulk_string", '!': "error", '=': "verbatim_string"}
+		return value{kind: kinds[prefix], text: text}, nil
+	case '*', '~', '>', '%', '|':
+		n, err := rr.length(rest)
+		if err != nil {
+			return value{}, err
+		}
+		if n < 0 {
+			return value{kind: "null"}, nil
+		}
+		if prefix == '%' || prefix == '|' {
+			n *= 2
+		}
+		capacity := n
+		if capacity > maxPreallocatedElements {
+			capacity = maxPreallocatedElements
+		}
+		elements := make([]value, 0, capacity)
+		for i := 0; i < n; i++ {
+			element, err := rr.next()
+			if err != nil {
+				return value{}, err
+			}
+			elements = append(elements, element)
+		}
+		kinds := map[byte]string{'*': "array", '~': "set", '>': "push", '%': "map", '|': "attribute"}
+		v := value{kind: kinds[prefix], elements: elements}
+		if prefix == '|' {
+			// Attributes annotate the value that follows them, which is the actual reply.
+			return rr.next()
+		}
+		return v, nil
+	default:
+		words := strings.Fields(line)
+		elements := make([]value, 0, len(words))
+		for _, word := range words {
+			elements = append(elements, value{kind: "bulk_string", text: word})
+		}
+		return value{kind: "array", elements: elements}, nil
+	}
+}
+
+// take returns the bytes consumed since the last call.
+func (rr *respReader) take() []byte {
+	raw := append([]byte(nil), rr.raw.Bytes()...)
+	rr.raw.Reset()
+	return raw
+}
+
+// Command is one captured command with its reply.
+type Command struct {
+	Name      string
+	Arguments []string
+	ReplyType string
+	Error     string
+	Start     time.Time
+	Duration  time.Duration
+}
+
+// session pairs the commands of one client connection with their replies, which Redis sends in order.
+type session struct {
+	mu      sync.Mutex
+	pending []Command
+	record  func(Command)
+	now     func() time.Time
+
+	// subscribed is set once the client has subscribed to a channel, after which the server sends messages that
+	// answer no command.
+	subscribed bool
+}
+
+func newSession(record func(Command)) *session {
+	return &session{record: record, now: time.Now}
+}
+
+func (s *session) command(v value) {
+	if v.kind != "array" || len(v.elements) == 0 {
+		return
+	}
+
+	name := strings.ToUpper(v.elements[0].text)
+	arguments := make([]string, 0, len(v.elements)-1)
+	for _, element := range v.elements[1:] {
+		argument := element.text
+		if len(argument) > maxArgumentLength {
+			argument = fmt.Sprintf("%s...(%d bytes)", argument[:maxArgumentLength], len(argument))
+		}
+		arguments = append(arguments, argument)
+	}
+	if name == "AUTH" || name == "HELLO" || name == "MIGRATE" {
+		// These carry passwords.
+		arguments = []string{"[redacted]"}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if name == "SUBSCRIBE" || name == "PSUBSCRIBE" || name == "SSUBSCRIBE" {
+		s.subscribed = true
+	}
+	s.pending = append(s.pending, Command{Name: name, Arguments: arguments, Start: s.now()})
+}
+
+func (s *session) reply(v value) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Out-of-band pushes, and pub/sub messages once a client has subscribed, answer no command.
+	if v.kind == "push" || (s.subscribed && len(s.pending) == 0) {
+		return
+	}
+	if len(s.pending) == 0 {
+		// Any other reply without a command means the stream was not followed, which is recorded rather than
+		// hidden.
+		s.record(Command{
+			ReplyType: v.kind,
+			Error:     fmt.Sprintf("%s reply to no pending command", v.kind),
+			Start:     s.now(),
+		})
+		return
+	}
+
+	command := s.pending[0]
+	s.pending = s.pending[1:]
+	command.Duration = s.now().Sub(command.Start)
+	command.ReplyType = v.kind
+	if v.kind == "error" {
+		command.Error = v.text
+	}
+	s.record(command)
+}
@@ -0,0 +1,256 @@
+/*
+ * Copyright (c) 2023 Asim Ihsan.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ * SPDX-License-Identifier: MPL-2.0
+ */
+
+package redis
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func readAll(t *testing.T, input string) ([]value, string) {
+	rr := &respReader{r: bufio.NewReader(strings.NewReader(input))}
+	var values []value
+	var raw strings.Builder
+	for {
+		v, err := rr.next()
+		raw.Write(rr.take())
+		if err != nil {
+			break
+		}
+		values = append(values, v)
+	}
+	return values, raw.String()
+}
+
+func TestRespReader(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected []value
+	}{
+		{
+			name:  "command",
+			input: "*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$5\r\nva\r\nl\r\n",
+			expected: []value{{kind: "array", elements: []value{
+				{kind: "bulk_string", text: "SET"},
+				{kind: "bulk_string", text: "key"},
+				{kind: "bulk_string", text: "va\r\nl"},
+			}}},
+		},
+		{
+			name:  "inline command",
+			input: "PING hello\r\n",
+			expected: []value{{kind: "array", elements: []value{
+				{kind: "bulk_string", text: "PING"},
+				{kind: "bulk_string", text: "hello"},
+			}}},
+		},
+		{
+			name:  "simple replies",
+			input: "+OK\r\n-ERR wrong\r\n:42\r\n$-1\r\n_\r\n",
+			expected: []value{
+				{kind: "simple_string", text: "OK"},
+				{kind: "error", text: "ERR wrong"},
+				{kind: "integer", text: "42"},
+				{kind: "null"},
+				{kind: "null"},
+			},
+		},
+		{
+			name:  "resp3 map with attribute",
+			input: "|1\r\n+ttl\r\n:3\r\n%1\r\n+a\r\n#t\r\n",
+			expected: []value{{kind: "map", elements: []value{
+				{kind: "simple_string", text: "a"},
+				{kind: "boolean", text: "t"},
+			}}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			values, raw := readAll(t, tt.input)
+			assert.Equal(t, tt.expected, values)
+			assert.Equal(t, tt.input, raw)
+		})
+	}
+}
+
+func TestRespReader_TruncatedValueIsForwarded(t *testing.T) {
+	input := "$10\r\nabc"
+	values, raw := readAll(t, input)
+	assert.Empty(t, values)
+	assert.Equal(t, input, raw)
+}
+
+func newTestSession() (*session, *[]Command) {
+	var commands []Command
+	s := newSession(func(command Command) {
+		commands = append(commands, command)
+	})
+	start := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	calls := 0
+	s.now = func() time.Time {
+		calls++
+		return start.Add(time.Duration(calls) * time.Millisecond)
+	}
+	return s, &commands
+}
+
+func command(words ...string) value {
+	elements := make([]value, 0, len(words))
+	for _, word := range words {
+		elements = append(elements, value{kind: "bulk_string", text: word})
+	}
+	return value{kind: "array", elements: elements}
+}
+
+func TestSession_PipelinedCommands(t *testing.T) {
+	s, commands := newTestSession()
+
+	s.command(command("set", "key", "value"))
+	s.command(command("INCR", "key"))
+	s.reply(value{kind: "simple_string", text: "OK"})
+	s.reply(value{kind: "error", text: "ERR value is not an integer or out of range"})
+
+	assert.Equal(t, []Command{
+		{
+			Name:      "SET",
+			Arguments: []string{"key", "value"},
+			ReplyType: "simple_string",
+			Start:     time.Date(2023, 6, 1, 12, 0, 0, int(time.Millisecond), time.UTC),
+			Duration:  2 * time.Millisecond,
+		},
+		{
+			Name:      "INCR",
+			Arguments: []string{"key"},
+			ReplyType: "error",
+			Error:     "ERR value is not an integer or out of range",
+			Start:     time.Date(2023, 6, 1, 12, 0, 0, int(2*time.Millisecond), time.UTC),
+			Duration:  2 * time.Millisecond,
+		},
+	}, *commands)
+}
+
+func TestSession_RedactsAndTruncatesArguments(t *testing.T) {
+	s, commands := newTestSession()
+
+	s.command(command("AUTH", "user", "secret"))
+	s.command(command("SET", "key", strings.Repeat("x", 300)))
+	s.reply(value{kind: "simple_string", text: "OK"})
+	s.reply(value{kind: "simple_string", text: "OK"})
+
+	assert.Len(t, *commands, 2)
+	assert.Equal(t, []string{"[redacted]"}, (*commands)[0].Arguments)
+	assert.Equal(t, strings.Repeat("x", 256)+"...(300 bytes)", (*commands)[1].Arguments[1])
+}
+
+func TestSession_IgnoresPushes(t *testing.T) {
+	s, commands := newTestSession()
+
+	s.command(command("GET", "key"))
+	s.reply(value{kind: "push", elements: []value{{kind: "bulk_string", text: "message"}}})
+	s.reply(value{kind: "bulk_string", text: "value"})
+
+	assert.Len(t, *commands, 1)
+	assert.Equal(t, "GET", (*commands)[0].Name)
+	assert.Equal(t, "bulk_string", (*commands)[0].ReplyType)
+}
+
+func TestSession_IgnoresMessagesOnceSubscribed(t *testing.T) {
+	s, commands := newTestSession()
+
+	s.command(command("SUBSCRIBE", "orders"))
+	s.reply(value{kind: "array"})
+	s.reply(value{kind: "array"})
+
+	assert.Len(t, *commands, 1)
+	assert.Equal(t, "SUBSCRIBE", (*commands)[0].Name)
+}
+
+func TestSession_RecordsUnmatchedReply(t *testing.T) {
+	s, commands := newTestSession()
+
+	s.reply(value{kind: "simple_string", text: "OK"})
+	s.command(command("GET", "key"))
+	s.reply(value{kind: "bulk_string", text: "value"})
+
+	if assert.Len(t, *commands, 2) {
+		assert.Equal(t, "", (*commands)[0].Name)
+		assert.Equal(t, "simple_string reply to no pending command", (*commands)[0].Error)
+		assert.Equal(t, "GET", (*commands)[1].Name)
+		assert.Equal(t, "bulk_string", (*commands)[1].ReplyType)
+	}
+}
+
+func TestRespReader_HugeArrayLength(t *testing.T) {
+	rr := &respReader{r: bufio.NewReader(strings.NewReader("*536870912\r\n+OK\r\n"))}
+	_, err := rr.next()
+	assert.Error(t, err)
+}
+
+func TestProxy_ForwardsAndRecords(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer backend.Close()
+
+	// A fake server that answers a single PING.
+	go func() {
+		conn, err := backend.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		rr := &respReader{r: bufio.NewReader(conn)}
+		_, _ = rr.next()
+		_, _ = conn.Write([]byte("+PONG\r\n"))
+	}()
+
+	recorded := make(chan Command, 1)
+	var recordedClient string
+	proxy, err := NewProxy(
+		"127.0.0.1:0",
+		backend.Addr().String(),
+		func(conn net.Conn) string { return "billing" },
+		func(client string, command Command) {
+			recordedClient = client
+			recorded <- command
+		},
+	)
+	assert.NoError(t, err)
+	defer proxy.Close()
+	go func() {
+		_ = proxy.Serve()
+	}()
+
+	conn, err := net.Dial("tcp", proxy.Addr().String())
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("*1\r\n$4\r\nPING\r\n"))
+	assert.NoError(t, err)
+	reply, err := bufio.NewReader(conn).ReadString('\n')
+	assert.NoError(t, err)
+	assert.Equal(t, "+PONG\r\n", reply)
+
+	select {
+	case command := <-recorded:
+		assert.Equal(t, "billing", recordedClient)
+		assert.Equal(t, "PING", command.Name)
+		assert.Equal(t, "simple_string", command.ReplyType)
+	case <-time.After(5 * time.Second):
+		t.Fatal("command was not recorded")
+	}
+}
@@ -0,0 +1,137 @@
+/*
+ * Copyright (c) 2023 Asim Ihsan.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ * SPDX-License-Identifier: MPL-2.0
+ */
+
+package smtp
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/asimihsan/virtual-cluster/internal/dependencies/tcp"
+	"github.com/asimihsan/virtual-cluster/internal/utils"
+	"github.com/asimihsan/virtual-cluster/pkg/dependencies"
+	"github.com/pkg/errors"
+	"log"
+	"strconv"
+)
+
+const Kind = "managed_smtp"
+
+func init() {
+	dependencies.Register(Kind, New)
+}
+
+// SMTP is a mail sink that runs inside the substrate. Every message sent to it is parsed and stored in the emails
+// table instead of being delivered.
+type SMTP struct {
+	name   string
+	port   int
+	server *tcp.Server
+}
+
+func New(name string, config dependencies.Config) (dependencies.ManagedDependency, error) {
+	if err := config.CheckKeys("port"); err != nil {
+		return nil, err
+	}
+	port, err := config.Port("port")
+	if err != nil {
+		return nil, err
+	}
+	return &SMTP{name: name, port: port}, nil
+}
+
+func (s *SMTP) Name() string {
+	return s.name
+}
+
+// Render does nothing, as the server needs no files.
+func (s *SMTP) Render(dir string) error {
+	return nil
+}
+
+func (s *SMTP) Start(host dependencies.Host) error {
+	pw := utils.NewPortWaiter(strconv.Itoa(s.port))
+	if err := pw.Wait(); err != nil {
+		return errors.Wrapf(err, "failed to wait for port %d: %s", s.port, s.name)
+	}
+
+	server, err := NewServer(
+		fmt.Sprintf(":%d", s.port),
+		host.ServiceForConnection,
+		func(client string, envelope Envelope) {
+			s.store(host, client, envelope)
+		},
+	)
+	if err != nil {
+		return errors.Wrap(err, "failed to start smtp server")
+	}
+	s.server = server
+	return nil
+}
+
+// Wait returns straight away, since the server accepts connections as soon as Start returns.
+func (s *SMTP) Wait() error {
+	return nil
+}
+
+func (s *SMTP) Stop() error {
+	if s.server == nil {
+		return nil
+	}
+	return s.server.Close()
+}
+
+func (s *SMTP) ConnectionInfo() map[string]string {
+	return map[string]string{
+		"host": "localhost",
+		"port": strconv.Itoa(s.port),
+		"url":  fmt.Sprintf("smtp://localhost:%d", s.port),
+	}
+}
+
+// Observe serves the SMTP server until the dependency is stopped.
+func (s *SMTP) Observe(host dependencies.Host) error {
+	if s.server == nil {
+		return fmt.Errorf("smtp server is not running: %s", s.name)
+	}
+	return s.server.Serve()
+}
+
+func (s *SMTP) store(host dependencies.Host, client string, envelope Envelope) {
+	email, err := ParseEmail(envelope.Data)
+	if err != nil {
+		log.Printf("Failed to parse email from %s: %v", envelope.From, err)
+		email = &Email{}
+	}
+
+	recipients, _ := json.Marshal(envelope.Recipients)
+	to, _ := json.Marshal(nonNil(email.To))
+	cc, _ := json.Marshal(nonNil(email.Cc))
+	attachments := []byte("[]")
+	if len(email.Attachments) > 0 {
+		attachments, _ = json.Marshal(email.Attachments)
+	}
+
+	_, err = host.DB().Exec(`
+		INSERT INTO emails (timestamp, dependency_name, client_name, envelope_from, envelope_to, from_address, to_addresses, cc_addresses, subject, message_id, text_body, html_body, attachments, size, raw)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		envelope.Received.UTC().Format(utils.TimestampFormat), s.name, client, envelope.From, string(recipients),
+		email.From, string(to), string(cc), email.Subject, email.MessageID, email.TextBody, email.HTMLBody,
+		string(attachments), len(envelope.Data), string(envelope.Data))
+	if err != nil {
+		log.Printf("Failed to insert email into database: %v", err)
+	}
+}
+
+func nonNil(values []string) []string {
+	if values == nil {
+		return []string{}
+	}
+	return values
+}
@@ -0,0 +1,180 @@
+/*
+ * Copyright (c) 2023 Asim Ihsan.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ * SPDX-License-Identifier: MPL-2.0
+ */
+
+package smtp
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"strings"
+)
+
+// Email is a parsed message. Addresses are as written in the headers, which may differ from the envelope.
+type Email struct {
+	From        string
+	To          []string
+	Cc          []string
+	Subject     string
+	MessageID   string
+	Date        string
+	TextBody    string
+	HTMLBody    string
+	Attachments []Attachment
+}
+
+// Attachment describes an attachment or inline part that is not a message body. The content itself is not kept.
+type Attachment struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	ContentID   string `json:"content_id,omitempty"`
+	Size        int    `json:"size"`
+}
+
+// wordDecoder decodes RFC 2047 encoded words such as "=?UTF-8?Q?caf=C3=A9?=". Only UTF-8, US-ASCII and ISO-8859-1
+// are understood; headers in other charsets are stored as they are.
+var wordDecoder = new(mime.WordDecoder)
+
+// ParseEmail parses a message as received in the SMTP DATA command. Parts it cannot decode are skipped, so that a
+// malformed message is still stored with whatever could be read from it.
+func ParseEmail(data []byte) (*Email, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	email := &Email{
+		From:      decodeHeader(msg.Header.Get("From")),
+		To:        addressList(msg.Header, "To"),
+		Cc:        addressList(msg.Header, "Cc"),
+		Subject:   decodeHeader(msg.Header.Get("Subject")),
+		MessageID: strings.Trim(msg.Header.Get("Message-Id"), "<>"),
+		Date:      msg.Header.Get("Date"),
+	}
+	walkPart(email, msg.Header, msg.Body)
+	return email, nil
+}
+
+// header is satisfied by both mail.Header and textproto.MIMEHeader.
+type header interface {
+	Get(key string) string
+}
+
+// walkPart collects the first text and HTML bodies and describes every other leaf part as an attachment.
+func walkPart(email *Email, header header, body io.Reader) {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		// RFC 2045 defaults a missing or invalid content type to plain text.
+		mediaType, params = "text/plain", map[string]string{}
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		boundary := params["boundary"]
+		if boundary == "" {
+			return
+		}
+		reader := multipart.NewReader(body, boundary)
+		for {
+			p, err := reader.NextRawPart()
+			if err != nil {
+				return
+			}
+			walkPart(email, p.Header, p)
+		}
+	}
+
+	content, err := io.ReadAll(decodeTransfer(header.Get("Content-Transfer-Encoding"), body))
+	if err != nil {
+		return
+	}
+
+	disposition, dispositionParams, _ := mime.ParseMediaType(header.Get("Content-Disposition"))
+	filename := dispositionParams["filename"]
+	if filename == "" {
+		filename = params["name"]
+	}
+	isAttachment := disposition == "attachment" || filename != ""
+
+	switch {
+	case mediaType == "text/plain" && !isAttachment && email.TextBody == "":
+		email.TextBody = string(content)
+	case mediaType == "text/html" && !isAttachment && email.HTMLBody == "":
+		email.HTMLBody = string(content)
+	default:
+		email.Attachments = append(email.Attachments, Attachment{
+			Filename:    decodeHeader(filename),
+			ContentType: mediaType,
+			ContentID:   strings.Trim(header.Get("Content-Id"), "<>"),
+			Size:        len(content),
+		})
+	}
+}
+
+func decodeTransfer(encoding string, body io.Reader) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, &newlineStripper{r: body})
+	case "quoted-printable":
+		return quotedprintable.NewReader(body)
+	default:
+		return body
+	}
+}
+
+// newlineStripper drops line breaks, which base64.NewDecoder only tolerates as "\r\n" or "\n" and not as stray
+// whitespace some mailers add.
+type newlineStripper struct {
+	r io.Reader
+}
+
+func (n *newlineStripper) Read(p []byte) (int, error) {
+	for {
+		count, err := n.r.Read(p)
+		kept := 0
+		for _, b := range p[:count] {
+			if b != '\r' && b != '\n' && b != ' ' && b != '\t' {
+				p[kept] = b
+				kept++
+			}
+		}
+		if kept > 0 || err != nil {
+			return kept, err
+		}
+	}
+}
+
+func decodeHeader(value string) string {
+	decoded, err := wordDecoder.DecodeHeader(value)
+	if err != nil {
+		return value
+	}
+	return decoded
+}
+
+func addressList(header mail.Header, key string) []string {
+	value := header.Get(key)
+	if value == "" {
+		return nil
+	}
+	addresses, err := header.AddressList(key)
+	if err != nil {
+		// Keep the raw header rather than lose the recipients.
+		return []string{decodeHeader(value)}
+	}
+	out := make([]string, 0, len(addresses))
+	for _, address := range addresses {
+		out = append(out, address.Address)
+	}
+	return out
+}
@@ -0,0 +1,214 @@
+/*
+ * Copyright (c) 2023 Asim Ihsan.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ * SPDX-License-Identifier: MPL-2.0
+ */
+
+package smtp
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/asimihsan/virtual-cluster/internal/dependencies/tcp"
+	"io"
+	"log"
+	"net"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// maxMessageSize is the largest message accepted, advertised through the SIZE extension.
+const maxMessageSize = 32 * 1024 * 1024
+
+// Envelope is one accepted message as it was handed over in the SMTP transaction. Data is the message with dot
+// stuffing removed and line endings normalized to "\n".
+type Envelope struct {
+	From       string
+	Recipients []string
+	Data       []byte
+	Received   time.Time
+}
+
+// NewServer listens on listenAddr as an SMTP sink. It accepts every message from any sender for any recipient and
+// hands it to deliver, together with the client the connection was attributed to, without relaying it anywhere.
+func NewServer(
+	listenAddr string,
+	client func(conn net.Conn) string,
+	deliver func(client string, envelope Envelope),
+) (*tcp.Server, error) {
+	s := &sink{hostname: "vcluster.local", deliver: deliver}
+	return tcp.NewServer(listenAddr, client, s.handle)
+}
+
+// sink answers the SMTP sessions of a server.
+type sink struct {
+	hostname string
+	deliver  func(client string, envelope Envelope)
+}
+
+// transaction is the state of a mail transaction, reset by RSET and after every message.
+type transaction struct {
+	from       string
+	hasFrom    bool
+	recipients []string
+}
+
+func (s *sink) handle(conn net.Conn, client string) {
+	text := textproto.NewConn(conn)
+	reply := func(code int, lines ...string) bool {
+		for i, line := range lines {
+			separator := " "
+			if i < len(lines)-1 {
+				separator = "-"
+			}
+			if err := text.PrintfLine("%d%s%s", code, separator, line); err != nil {
+				return false
+			}
+		}
+		return true
+	}
+
+	if !reply(220, s.hostname+" ESMTP vcluster") {
+		return
+	}
+
+	var tx transaction
+	greeted := false
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Minute))
+		line, err := text.ReadLine()
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("smtp: failed to read command: %v", err)
+			}
+			return
+		}
+
+		verb, argument, _ := strings.Cut(line, " ")
+		verb = strings.ToUpper(verb)
+		argument = strings.TrimSpace(argument)
+
+		var ok bool
+		switch verb {
+		case "HELO":
+			greeted = true
+			tx = transaction{}
+			ok = reply(250, s.hostname)
+		case "EHLO":
+			greeted = true
+			tx = transaction{}
+			ok = reply(250, s.hostname, "8BITMIME", "SMTPUTF8", "PIPELINING", fmt.Sprintf("SIZE %d", maxMessageSize))
+		case "MAIL":
+			switch {
+			case !greeted:
+				ok = reply(503, "Send HELO or EHLO first")
+			case tx.hasFrom:
+				ok = reply(503, "Nested MAIL command")
+			default:
+				from, valid := parsePath(argument, "FROM:")
+				if !valid {
+					ok = reply(501, "Syntax: MAIL FROM:<address>")
+					break
+				}
+				tx = transaction{from: from, hasFrom: true}
+				ok = reply(250, "OK")
+			}
+		case "RCPT":
+			if !tx.hasFrom {
+				ok = reply(503, "Need MAIL before RCPT")
+				break
+			}
+			recipient, valid := parsePath(argument, "TO:")
+			if !valid || recipient == "" {
+				ok = reply(501, "Syntax: RCPT TO:<address>")
+				break
+			}
+			tx.recipients = append(tx.recipients, recipient)
+			ok = reply(250, "OK")
+		case "DATA":
+			if len(tx.recipients) == 0 {
+				ok = reply(503, "Need RCPT before DATA")
+				break
+			}
+			if !reply(354, "End data with <CR><LF>.<CR><LF>") {
+				return
+			}
+			data, err := readData(text.DotReader())
+			if err != nil {
+				if err == errMessageTooLarge {
+					ok = reply(552, "Message exceeds fixed maximum message size")
+					tx = transaction{}
+					break
+				}
+				return
+			}
+			s.deliver(client, Envelope{
+				From:       tx.from,
+				Recipients: tx.recipients,
+				Data:       data,
+				Received:   time.Now(),
+			})
+			tx = transaction{}
+			ok = reply(250, "OK: message accepted")
+		case "RSET":
+			tx = transaction{}
+			ok = reply(250, "OK")
+		case "NOOP":
+			ok = reply(250, "OK")
+		case "VRFY":
+			ok = reply(252, "Cannot VRFY user, but will accept message")
+		case "QUIT":
+			reply(221, "Bye")
+			return
+		default:
+			ok = reply(502, "Command not implemented")
+		}
+		if !ok {
+			return
+		}
+	}
+}
+
+var errMessageTooLarge = fmt.Errorf("message exceeds %d bytes", maxMessageSize)
+
+// readData reads the message up to the terminating dot, draining the rest of an oversized message so that the
+// connection stays usable.
+func readData(r io.Reader) ([]byte, error) {
+	var data bytes.Buffer
+	n, err := io.Copy(&data, io.LimitReader(r, maxMessageSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if n > maxMessageSize {
+		_, err := io.Copy(io.Discard, r)
+		if err != nil {
+			return nil, err
+		}
+		return nil, errMessageTooLarge
+	}
+	return data.Bytes(), nil
+}
+
+// parsePath extracts the address from a MAIL FROM or RCPT TO argument such as "FROM:<a@example.com> SIZE=123".
+// The null reverse-path "<>" yields "".
+func parsePath(argument string, prefix string) (string, bool) {
+	if len(argument) < len(prefix) || !strings.EqualFold(argument[:len(prefix)], prefix) {
+		return "", false
+	}
+	path := strings.TrimSpace(argument[len(prefix):])
+	if strings.HasPrefix(path, "<") {
+		end := strings.IndexByte(path, '>')
+		if end < 0 {
+			return "", false
+		}
+		return path[1:end], true
+	}
+	// Some clients leave out the angle brackets.
+	address, _, _ := strings.Cut(path, " ")
+	return address, true
+}
@@ -0,0 +1,133 @@
+/*
+ * Copyright (c) 2023 Asim Ihsan.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ * SPDX-License-Identifier: MPL-2.0
+ */
+
+package smtp
+
+import (
+	"net"
+	netsmtp "net/smtp"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const multipartEmail = "From: Orders <orders@example.com>\r\n" +
+	"To: alice@example.com, \"Bob\" <bob@example.com>\r\n" +
+	"Cc: audit@example.com\r\n" +
+	"Subject: =?UTF-8?Q?Your_order_caf=C3=A9?=\r\n" +
+	"Message-ID: <123@example.com>\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/mixed; boundary=outer\r\n" +
+	"\r\n" +
+	"--outer\r\n" +
+	"Content-Type: multipart/alternative; boundary=inner\r\n" +
+	"\r\n" +
+	"--inner\r\n" +
+	"Content-Type: text/plain; charset=utf-8\r\n" +
+	"Content-Transfer-Encoding: quoted-printable\r\n" +
+	"\r\n" +
+	"Order shipped =E2=9C=93\r\n" +
+	"--inner\r\n" +
+	"Content-Type: text/html; charset=utf-8\r\n" +
+	"\r\n" +
+	"<p>Order shipped</p>\r\n" +
+	"--inner--\r\n" +
+	"--outer\r\n" +
+	"Content-Type: application/pdf; name=\"invoice.pdf\"\r\n" +
+	"Content-Disposition: attachment; filename=\"invoice.pdf\"\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"JVBERi0x\r\n" +
+	"LjQK\r\n" +
+	"--outer--\r\n"
+
+func TestParseEmail_Multipart(t *testing.T) {
+	email, err := ParseEmail([]byte(multipartEmail))
+	assert.NoError(t, err)
+
+	assert.Equal(t, &Email{
+		From:      "Orders <orders@example.com>",
+		To:        []string{"alice@example.com", "bob@example.com"},
+		Cc:        []string{"audit@example.com"},
+		Subject:   "Your order café",
+		MessageID: "123@example.com",
+		TextBody:  "Order shipped ✓",
+		HTMLBody:  "<p>Order shipped</p>",
+		Attachments: []Attachment{
+			{Filename: "invoice.pdf", ContentType: "application/pdf", Size: 9},
+		},
+	}, email)
+}
+
+func TestParseEmail_PlainWithoutContentType(t *testing.T) {
+	email, err := ParseEmail([]byte("From: a@example.com\r\nTo: b@example.com\r\nSubject: hi\r\n\r\nhello\r\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, "hello\r\n", email.TextBody)
+	assert.Empty(t, email.HTMLBody)
+	assert.Empty(t, email.Attachments)
+}
+
+func TestParsePath(t *testing.T) {
+	tests := []struct {
+		argument string
+		prefix   string
+		expected string
+		valid    bool
+	}{
+		{"FROM:<a@example.com>", "FROM:", "a@example.com", true},
+		{"from: <a@example.com> SIZE=100", "FROM:", "a@example.com", true},
+		{"FROM:<>", "FROM:", "", true},
+		{"TO:b@example.com", "TO:", "b@example.com", true},
+		{"TO:<b@example.com", "TO:", "", false},
+		{"<b@example.com>", "TO:", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.argument, func(t *testing.T) {
+			address, valid := parsePath(tt.argument, tt.prefix)
+			assert.Equal(t, tt.valid, valid)
+			assert.Equal(t, tt.expected, address)
+		})
+	}
+}
+
+func TestServer_AcceptsMail(t *testing.T) {
+	delivered := make(chan Envelope, 1)
+	var deliveredClient string
+	server, err := NewServer(
+		"127.0.0.1:0",
+		func(conn net.Conn) string { return "orders" },
+		func(client string, envelope Envelope) {
+			deliveredClient = client
+			delivered <- envelope
+		},
+	)
+	assert.NoError(t, err)
+	defer server.Close()
+	go func() {
+		_ = server.Serve()
+	}()
+
+	body := "Subject: hi\r\n\r\n.leading dot\r\nbye\r\n"
+	err = netsmtp.SendMail(server.Addr().String(), nil, "orders@example.com",
+		[]string{"alice@example.com", "bob@example.com"}, []byte(body))
+	assert.NoError(t, err)
+
+	select {
+	case envelope := <-delivered:
+		assert.Equal(t, "orders", deliveredClient)
+		assert.Equal(t, "orders@example.com", envelope.From)
+		assert.Equal(t, []string{"alice@example.com", "bob@example.com"}, envelope.Recipients)
+		assert.Equal(t, "Subject: hi\n\n.leading dot\nbye\n", string(envelope.Data))
+	case <-time.After(5 * time.Second):
+		t.Fatal("email was not delivered")
+	}
+}
@@ -0,0 +1,133 @@
+/*
+ * Copyright (c) 2023 Asim Ihsan.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ * SPDX-License-Identifier: MPL-2.0
+ */
+
+// Package tcp serves the ports of managed dependencies that speak their own protocol over TCP, such as the capturing
+// proxies in front of Postgres and Redis and the SMTP sink, leaving only the decoding of the protocol to each of them.
+package tcp
+
+import (
+	"github.com/pkg/errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+)
+
+// Server accepts connections on a port and hands each one to a handler, together with the service the connection was
+// attributed to.
+type Server struct {
+	listener net.Listener
+	handle   func(conn net.Conn, client string)
+
+	// client names the service behind a connection. It returns "" if the service is unknown.
+	client func(conn net.Conn) string
+}
+
+// NewServer listens on listenAddr. Each connection accepted by Serve is handed to handle, and closed once it returns.
+func NewServer(
+	listenAddr string,
+	client func(conn net.Conn) string,
+	handle func(conn net.Conn, client string),
+) (*Server, error) {
+	listener, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		return nil, err
+	}
+	return &Server{
+		listener: listener,
+		handle:   handle,
+		client:   client,
+	}, nil
+}
+
+// NewProxy returns a Server that connects every connection it accepts to backend. forward passes the traffic between
+// the two connections, decoding what it captures on the way.
+func NewProxy(
+	listenAddr string,
+	backend string,
+	client func(conn net.Conn) string,
+	forward func(clientConn net.Conn, serverConn net.Conn, client string),
+) (*Server, error) {
+	return NewServer(listenAddr, client, func(clientConn net.Conn, client string) {
+		serverConn, err := net.Dial("tcp", backend)
+		if err != nil {
+			log.Printf("proxy: failed to connect to backend %s: %v", backend, err)
+			return
+		}
+		defer serverConn.Close()
+		forward(clientConn, serverConn, client)
+	})
+}
+
+// Serve accepts connections until Close is called, after which it returns nil.
+func (s *Server) Serve() error {
+	for {
+		conn, err := s.listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			s.handle(conn, s.client(conn))
+		}()
+	}
+}
+
+func (s *Server) Close() error {
+	return s.listener.Close()
+}
+
+// Addr is the address the server listens on.
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// Forward runs toServer and toClient, which each copy one direction of a proxied connection, until both are done.
+// Once a direction is done its end is passed on to the other side, which may still be answering.
+func Forward(clientConn net.Conn, serverConn net.Conn, toServer func(), toClient func()) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		toServer()
+		closeWrite(serverConn)
+	}()
+	go func() {
+		defer wg.Done()
+		toClient()
+		closeWrite(clientConn)
+	}()
+	wg.Wait()
+}
+
+// Pipe copies both directions without decoding, for connections that cannot be captured, until either is done.
+// clientReader and serverReader are read in place of the connections, so that what was buffered while decoding is not
+// lost.
+func Pipe(clientConn net.Conn, clientReader io.Reader, serverConn net.Conn, serverReader io.Reader) {
+	done := make(chan struct{}, 2)
+	go func() {
+		_, _ = io.Copy(serverConn, clientReader)
+		done <- struct{}{}
+	}()
+	go func() {
+		_, _ = io.Copy(clientConn, serverReader)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+func closeWrite(conn net.Conn) {
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		_ = tcpConn.CloseWrite()
+	}
+}
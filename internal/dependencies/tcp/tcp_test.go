@@ -0,0 +1,78 @@
+/*
+ * Copyright (c) 2023 Asim Ihsan.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ * SPDX-License-Identifier: MPL-2.0
+ */
+
+package tcp
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProxy_ForwardsBothDirections(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer backend.Close()
+
+	// An echo server that answers only once the client is done sending, so that the end of the client's direction
+	// must be passed on.
+	go func() {
+		conn, err := backend.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		request, _ := io.ReadAll(conn)
+		_, _ = conn.Write(append([]byte("echo: "), request...))
+	}()
+
+	clients := make(chan string, 1)
+	proxy, err := NewProxy(
+		"127.0.0.1:0",
+		backend.Addr().String(),
+		func(conn net.Conn) string { return "orders" },
+		func(clientConn net.Conn, serverConn net.Conn, client string) {
+			clients <- client
+			Forward(clientConn, serverConn, func() {
+				_, _ = io.Copy(serverConn, clientConn)
+			}, func() {
+				_, _ = io.Copy(clientConn, serverConn)
+			})
+		},
+	)
+	assert.NoError(t, err)
+	served := make(chan error, 1)
+	go func() {
+		served <- proxy.Serve()
+	}()
+
+	conn, err := net.Dial("tcp", proxy.Addr().String())
+	assert.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("ping"))
+	assert.NoError(t, err)
+	assert.NoError(t, conn.(*net.TCPConn).CloseWrite())
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	response, err := io.ReadAll(conn)
+	assert.NoError(t, err)
+	assert.Equal(t, "echo: ping", string(response))
+	assert.Equal(t, "orders", <-clients)
+
+	assert.NoError(t, proxy.Close())
+	select {
+	case err := <-served:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve did not return after Close")
+	}
+}
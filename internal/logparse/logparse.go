@@ -0,0 +1,418 @@
+/*
+ * Copyright (c) 2023 Asim Ihsan.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ * SPDX-License-Identifier: MPL-2.0
+ */
+
+// Package logparse reads the level, message, logger, trace context and fields of log lines in the formats services
+// commonly log in: JSON, logfmt, and the text output of zerolog, zap, slog and logrus.
+package logparse
+
+import (
+	"encoding/json"
+	"github.com/asimihsan/virtual-cluster/internal/tracing"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Formats of log lines.
+const (
+	FormatJSON    = "json"
+	FormatLogfmt  = "logfmt"
+	FormatZerolog = "zerolog"
+	FormatZap     = "zap"
+	FormatSlog    = "slog"
+	FormatLogrus  = "logrus"
+
+	// FormatText is unstructured text that starts with a level, such as "ERROR: disk full" or Python's
+	// "WARNING:root:disk nearly full".
+	FormatText = "text"
+)
+
+// Levels, from least to most severe, which the levels of every format are normalized to.
+var Levels = []string{"trace", "debug", "info", "warn", "error", "fatal", "panic"}
+
+// Entry is what a log line says. Format is empty for lines in no format Parse knows, and then the other fields are
+// empty too.
+type Entry struct {
+	Format  string
+	Level   string
+	Message string
+	Logger  string
+	TraceID string
+	SpanID  string
+
+	// Fields are the fields of the line besides its level, message, logger, trace context and time.
+	Fields map[string]interface{}
+}
+
+// The keys structured loggers write the level, message, logger and time of a record under, in order of preference.
+var (
+	levelKeys   = []string{"level", "lvl", "severity", "levelname", "log.level", "@l"}
+	messageKeys = []string{"msg", "message", "@m"}
+	loggerKeys  = []string{"logger", "logger_name", "loggerName", "log.logger", "name"}
+	timeKeys    = []string{"time", "timestamp", "ts", "@t", "@timestamp"}
+)
+
+var (
+	ansiPattern = regexp.MustCompile("\x1b\\[[0-9;]*m")
+
+	// 3:04PM INF message key=value, with an optional caller before a ">".
+	zerologPattern = regexp.MustCompile(`^(\S*\d\S*) (TRC|DBG|INF|WRN|ERR|FTL|PNC|\?\?\?) (.*)$`)
+	callerPattern  = regexp.MustCompile(`^(\S+:\d+) > (.*)$`)
+
+	// INFO[0000] message    key=value
+	logrusPattern = regexp.MustCompile(`^(TRAC|DEBU|INFO|WARN|ERRO|FATA|PANI)\[[^\]]*\] (.*)$`)
+
+	// 2023/01/02 15:04:05 INFO message key=value, from the default handler of slog through the log package.
+	slogPattern = regexp.MustCompile(`^\d{4}/\d{2}/\d{2} \d{2}:\d{2}:\d{2}(?:\.\d+)? (DEBUG|INFO|WARN|ERROR)(?:[+-]\d+)? (.*)$`)
+
+	// WARNING:root:message, as Python's logging writes by default.
+	pythonPattern = regexp.MustCompile(`^(DEBUG|INFO|WARNING|ERROR|CRITICAL):([^:\s]*):(.*)$`)
+
+	// [ERROR] message, ERROR: message or ERROR message.
+	textPattern = regexp.MustCompile(`^\[?(TRACE|DEBUG|INFO|WARN|WARNING|ERROR|FATAL|CRITICAL|PANIC)\]?:? (.*)$`)
+
+	zapCallerPattern = regexp.MustCompile(`^\S+:\d+$`)
+)
+
+// Parse reads a line of output.
+func Parse(line string) Entry {
+	line = strings.TrimRight(line, "\r\n")
+	if strings.HasPrefix(strings.TrimSpace(line), "{") {
+		if entry, ok := parseJSON(strings.TrimSpace(line)); ok {
+			return entry
+		}
+	}
+	line = ansiPattern.ReplaceAllString(line, "")
+	for _, parse := range []func(string) (Entry, bool){parseZap, parseZerolog, parseLogrus, parseSlog, parseLogfmt, parseText} {
+		if entry, ok := parse(line); ok {
+			return entry
+		}
+	}
+	return Entry{}
+}
+
+func parseJSON(line string) (Entry, bool) {
+	var fields map[string]interface{}
+	if err := json.Unmarshal([]byte(line), &fields); err != nil {
+		return Entry{}, false
+	}
+	return fromFields(FormatJSON, fields), true
+}
+
+// fromFields reads the entry of a structured record, taking its level, message, logger, trace context and time out of
+// its fields.
+func fromFields(format string, fields map[string]interface{}) Entry {
+	entry := Entry{Format: format}
+	if key, value, ok := take(fields, levelKeys); ok {
+		entry.Level = normalizeLevel(value)
+		if entry.Level == "" {
+			// An unknown level is kept as a field rather than lost.
+			fields[key] = value
+		}
+	}
+	if _, value, ok := take(fields, messageKeys); ok {
+		entry.Message = stringValue(value)
+	}
+	if _, value, ok := take(fields, loggerKeys); ok {
+		entry.Logger = stringValue(value)
+	}
+	take(fields, timeKeys)
+	if span, ok := tracing.FromFields(fields); ok {
+		entry.TraceID, entry.SpanID = span.TraceID, span.SpanID
+		for key := range fields {
+			if tracing.IsContextField(key) {
+				delete(fields, key)
+			}
+		}
+	}
+	if len(fields) > 0 {
+		entry.Fields = fields
+	}
+	return entry
+}
+
+// take removes the first of keys that fields has and returns it and its value.
+func take(fields map[string]interface{}, keys []string) (string, interface{}, bool) {
+	for _, key := range keys {
+		if value, ok := fields[key]; ok {
+			delete(fields, key)
+			return key, value, true
+		}
+	}
+	return "", nil, false
+}
+
+func stringValue(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case nil:
+		return ""
+	}
+	encoded, _ := json.Marshal(value)
+	return string(encoded)
+}
+
+// normalizeLevel returns one of Levels for the level of a record, as a name or abbreviation in any case, a slog
+// level with an offset such as INFO+2, or a pino or bunyan number, or "" if it is none of those.
+func normalizeLevel(value interface{}) string {
+	if number, ok := value.(float64); ok {
+		switch {
+		case number >= 60:
+			return "fatal"
+		case number >= 50:
+			return "error"
+		case number >= 40:
+			return "warn"
+		case number >= 30:
+			return "info"
+		case number >= 20:
+			return "debug"
+		case number >= 10:
+			return "trace"
+		}
+		return ""
+	}
+	level, ok := value.(string)
+	if !ok {
+		return ""
+	}
+	level = strings.ToLower(strings.TrimSpace(level))
+	if i := strings.IndexAny(level, "+-"); i > 0 {
+		level = level[:i]
+	}
+	switch level {
+	case "trace", "trac", "trc", "finest", "finer":
+		return "trace"
+	case "debug", "debu", "dbg", "fine", "verbose":
+		return "debug"
+	case "info", "inf", "information", "informational", "notice":
+		return "info"
+	case "warn", "warning", "wrn":
+		return "warn"
+	case "error", "erro", "err", "severe":
+		return "error"
+	case "fatal", "fata", "ftl", "critical", "crit", "alert", "emergency", "emerg":
+		return "fatal"
+	case "panic", "pani", "pnc", "dpanic":
+		return "panic"
+	}
+	return ""
+}
+
+// parseLogfmt reads a line of key=value pairs, such as the text handler of slog and the text formatter of logrus
+// write.
+func parseLogfmt(line string) (Entry, bool) {
+	pairs, ok := splitLogfmt(line)
+	if !ok || len(pairs) < 2 {
+		return Entry{}, false
+	}
+	fields := make(map[string]interface{}, len(pairs))
+	for _, pair := range pairs {
+		fields[pair[0]] = pair[1]
+	}
+
+	// Both start with time, level and msg, and are told apart by how they write levels.
+	format := FormatLogfmt
+	if len(pairs) >= 3 && pairs[0][0] == "time" && pairs[1][0] == "level" && pairs[2][0] == "msg" {
+		if pairs[1][1] == strings.ToUpper(pairs[1][1]) {
+			format = FormatSlog
+		} else {
+			format = FormatLogrus
+		}
+	}
+	return fromFields(format, fields), true
+}
+
+// splitLogfmt splits a line into its key=value pairs, unquoting quoted values. It returns false if the line is not
+// made of pairs alone.
+func splitLogfmt(line string) ([][2]string, bool) {
+	var pairs [][2]string
+	rest := strings.TrimSpace(line)
+	for rest != "" {
+		eq := strings.IndexByte(rest, '=')
+		if eq <= 0 || strings.ContainsAny(rest[:eq], " \t\"") {
+			return nil, false
+		}
+		key := rest[:eq]
+		rest = rest[eq+1:]
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			end := closingQuote(rest)
+			if end < 0 {
+				return nil, false
+			}
+			unquoted, err := strconv.Unquote(rest[:end+1])
+			if err != nil {
+				return nil, false
+			}
+			value, rest = unquoted, rest[end+1:]
+			if rest != "" && rest[0] != ' ' && rest[0] != '\t' {
+				return nil, false
+			}
+		} else if end := strings.IndexAny(rest, " \t"); end >= 0 {
+			value, rest = rest[:end], rest[end:]
+		} else {
+			value, rest = rest, ""
+		}
+		pairs = append(pairs, [2]string{key, value})
+		rest = strings.TrimLeft(rest, " \t")
+	}
+	return pairs, len(pairs) > 0
+}
+
+// closingQuote returns the index of the quote that closes the quoted string s starts with, or -1.
+func closingQuote(s string) int {
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '"':
+			return i
+		}
+	}
+	return -1
+}
+
+// splitMessage splits the message of a text line from the key=value fields that follow it, if any.
+func splitMessage(text string) (string, map[string]interface{}) {
+	if start := firstPair(text); start >= 0 {
+		if pairs, ok := splitLogfmt(text[start:]); ok {
+			fields := make(map[string]interface{}, len(pairs))
+			for _, pair := range pairs {
+				fields[pair[0]] = pair[1]
+			}
+			return strings.TrimSpace(text[:start]), fields
+		}
+	}
+	return strings.TrimSpace(text), nil
+}
+
+// firstPair returns the index of the first space separated word of text that looks like a key=value pair, or -1.
+func firstPair(text string) int {
+	for start := 0; start < len(text); {
+		end := strings.IndexByte(text[start:], ' ')
+		if end < 0 {
+			end = len(text)
+		} else {
+			end += start
+		}
+		word := text[start:end]
+		if eq := strings.IndexByte(word, '='); eq > 0 && !strings.ContainsAny(word[:eq], "\t\"") {
+			return start
+		}
+		start = end + 1
+	}
+	return -1
+}
+
+// textEntry is the entry of a text line with a level and a message, followed by key=value fields if it has any.
+func textEntry(format string, level string, text string, extra map[string]interface{}) Entry {
+	message, fields := splitMessage(text)
+	if fields == nil {
+		fields = make(map[string]interface{})
+	}
+	for key, value := range extra {
+		fields[key] = value
+	}
+	entry := fromFields(format, fields)
+	entry.Level = normalizeLevel(level)
+	entry.Message = message
+	return entry
+}
+
+// parseZerolog reads a line of zerolog's console writer.
+func parseZerolog(line string) (Entry, bool) {
+	match := zerologPattern.FindStringSubmatch(line)
+	if match == nil {
+		return Entry{}, false
+	}
+	text := match[3]
+	var extra map[string]interface{}
+	if caller := callerPattern.FindStringSubmatch(text); caller != nil {
+		extra = map[string]interface{}{"caller": caller[1]}
+		text = caller[2]
+	}
+	return textEntry(FormatZerolog, match[2], text, extra), true
+}
+
+// parseLogrus reads a line of logrus's text formatter writing to a terminal.
+func parseLogrus(line string) (Entry, bool) {
+	match := logrusPattern.FindStringSubmatch(line)
+	if match == nil {
+		return Entry{}, false
+	}
+	return textEntry(FormatLogrus, match[1], match[2], nil), true
+}
+
+// parseSlog reads a line of slog's default handler, which writes through the log package.
+func parseSlog(line string) (Entry, bool) {
+	match := slogPattern.FindStringSubmatch(line)
+	if match == nil {
+		return Entry{}, false
+	}
+	return textEntry(FormatSlog, match[1], match[2], nil), true
+}
+
+// parseZap reads a line of zap's console encoder: tab separated time, level, logger and caller if they are
+// configured, message, and the other fields as JSON.
+func parseZap(line string) (Entry, bool) {
+	parts := strings.Split(line, "\t")
+	if len(parts) < 3 {
+		return Entry{}, false
+	}
+	level := normalizeLevel(parts[1])
+	if level == "" || strings.ContainsAny(parts[1], "[]") {
+		return Entry{}, false
+	}
+	parts = parts[2:]
+
+	fields := make(map[string]interface{})
+	if last := parts[len(parts)-1]; len(parts) > 1 && strings.HasPrefix(last, "{") {
+		if err := json.Unmarshal([]byte(last), &fields); err == nil {
+			parts = parts[:len(parts)-1]
+		}
+	}
+	entry := fromFields(FormatZap, fields)
+	entry.Level = level
+	entry.Message = parts[len(parts)-1]
+	for _, part := range parts[:len(parts)-1] {
+		if zapCallerPattern.MatchString(part) {
+			if entry.Fields == nil {
+				entry.Fields = make(map[string]interface{})
+			}
+			entry.Fields["caller"] = part
+		} else {
+			entry.Logger = part
+		}
+	}
+	return entry, true
+}
+
+// parseText reads an unstructured line that starts with a level.
+func parseText(line string) (Entry, bool) {
+	if match := pythonPattern.FindStringSubmatch(line); match != nil {
+		return Entry{Format: FormatText, Level: normalizeLevel(match[1]), Logger: match[2], Message: match[3]}, true
+	}
+	if match := textPattern.FindStringSubmatch(line); match != nil {
+		return Entry{Format: FormatText, Level: normalizeLevel(match[1]), Message: strings.TrimSpace(match[2])}, true
+	}
+	return Entry{}, false
+}
+
+// LevelsFrom returns level and the levels more severe than it, or nil if level is not one of Levels.
+func LevelsFrom(level string) []string {
+	for i, l := range Levels {
+		if l == level {
+			return Levels[i:]
+		}
+	}
+	return nil
+}
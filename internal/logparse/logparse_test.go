@@ -0,0 +1,152 @@
+/*
+ * Copyright (c) 2023 Asim Ihsan.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ * SPDX-License-Identifier: MPL-2.0
+ */
+
+package logparse
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name     string
+		line     string
+		expected Entry
+	}{
+		{
+			name: "zerolog JSON with trace context",
+			line: `{"level":"warn","time":"2023-01-02T15:04:05Z","logger":"db","trace_id":"4bf92f3577b34da6a3ce929d0e0e4736","span_id":"00f067aa0ba902b7","message":"slow query","ms":812}` + "\n",
+			expected: Entry{
+				Format:  FormatJSON,
+				Level:   "warn",
+				Message: "slow query",
+				Logger:  "db",
+				TraceID: "4bf92f3577b34da6a3ce929d0e0e4736",
+				SpanID:  "00f067aa0ba902b7",
+				Fields:  map[string]interface{}{"ms": float64(812)},
+			},
+		},
+		{
+			name:     "pino JSON with numeric level",
+			line:     `{"level":50,"time":1672671845000,"name":"api","msg":"failed"}`,
+			expected: Entry{Format: FormatJSON, Level: "error", Message: "failed", Logger: "api"},
+		},
+		{
+			name:     "slog JSON with level offset",
+			line:     `{"time":"2023-01-02T15:04:05Z","level":"INFO+2","msg":"started"}`,
+			expected: Entry{Format: FormatJSON, Level: "info", Message: "started"},
+		},
+		{
+			name:     "JSON with unknown level keeps it",
+			line:     `{"level":"loud","msg":"hi"}`,
+			expected: Entry{Format: FormatJSON, Message: "hi", Fields: map[string]interface{}{"level": "loud"}},
+		},
+		{
+			name: "slog text",
+			line: `time=2023-01-02T15:04:05.000Z level=ERROR msg="request failed" path=/users status=500`,
+			expected: Entry{
+				Format:  FormatSlog,
+				Level:   "error",
+				Message: "request failed",
+				Fields:  map[string]interface{}{"path": "/users", "status": "500"},
+			},
+		},
+		{
+			name:     "logrus text",
+			line:     `time="2023-01-02T15:04:05Z" level=warning msg="disk nearly full" free=10%`,
+			expected: Entry{Format: FormatLogrus, Level: "warn", Message: "disk nearly full", Fields: map[string]interface{}{"free": "10%"}},
+		},
+		{
+			name:     "logfmt",
+			line:     `lvl=debug logger=cache msg=hit key="a b"`,
+			expected: Entry{Format: FormatLogfmt, Level: "debug", Message: "hit", Logger: "cache", Fields: map[string]interface{}{"key": "a b"}},
+		},
+		{
+			name:     "logrus terminal",
+			line:     "\x1b[36mINFO\x1b[0m[0003] listening                                     \x1b[36mport\x1b[0m=8080",
+			expected: Entry{Format: FormatLogrus, Level: "info", Message: "listening", Fields: map[string]interface{}{"port": "8080"}},
+		},
+		{
+			name: "zerolog console with caller",
+			line: "3:04PM ERR main.go:42 > connect failed error=\"connection refused\" attempt=3",
+			expected: Entry{
+				Format:  FormatZerolog,
+				Level:   "error",
+				Message: "connect failed",
+				Fields:  map[string]interface{}{"caller": "main.go:42", "error": "connection refused", "attempt": "3"},
+			},
+		},
+		{
+			name:     "zerolog console without fields",
+			line:     "2023-01-02T15:04:05Z INF ready",
+			expected: Entry{Format: FormatZerolog, Level: "info", Message: "ready"},
+		},
+		{
+			name: "zap console",
+			line: "2023-01-02T15:04:05.000Z\tWARN\tpayments\tpay/charge.go:17\tretrying charge\t{\"attempt\": 2, \"trace_id\": \"4bf92f3577b34da6a3ce929d0e0e4736\"}",
+			expected: Entry{
+				Format:  FormatZap,
+				Level:   "warn",
+				Message: "retrying charge",
+				Logger:  "payments",
+				TraceID: "4bf92f3577b34da6a3ce929d0e0e4736",
+				Fields:  map[string]interface{}{"attempt": float64(2), "caller": "pay/charge.go:17"},
+			},
+		},
+		{
+			name:     "zap console without fields",
+			line:     "2023-01-02T15:04:05.000Z\tinfo\tserving",
+			expected: Entry{Format: FormatZap, Level: "info", Message: "serving"},
+		},
+		{
+			name:     "slog default handler",
+			line:     "2023/01/02 15:04:05 WARN cache miss key=users",
+			expected: Entry{Format: FormatSlog, Level: "warn", Message: "cache miss", Fields: map[string]interface{}{"key": "users"}},
+		},
+		{
+			name:     "text level with an equals sign in the message keeps it whole",
+			line:     "[WARN] retry=3 exceeded for upstream",
+			expected: Entry{Format: FormatText, Level: "warn", Message: "retry=3 exceeded for upstream"},
+		},
+		{
+			name:     "python logging",
+			line:     "WARNING:root:low memory",
+			expected: Entry{Format: FormatText, Level: "warn", Message: "low memory", Logger: "root"},
+		},
+		{
+			name:     "bracketed level",
+			line:     "[ERROR] could not open config.yaml",
+			expected: Entry{Format: FormatText, Level: "error", Message: "could not open config.yaml"},
+		},
+		{
+			name:     "plain text",
+			line:     "Listening on :8080\n",
+			expected: Entry{},
+		},
+		{
+			name:     "invalid JSON",
+			line:     "{not json",
+			expected: Entry{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, Parse(tt.line))
+		})
+	}
+}
+
+func TestLevelsFrom(t *testing.T) {
+	assert.Equal(t, []string{"error", "fatal", "panic"}, LevelsFrom("error"))
+	assert.Nil(t, LevelsFrom("loud"))
+}
@@ -0,0 +1,172 @@
+/*
+ * Copyright (c) 2023 Asim Ihsan.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ * SPDX-License-Identifier: MPL-2.0
+ */
+
+// Package metrics holds the Prometheus metrics the substrate keeps about itself, which the manager serves on /metrics.
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"time"
+)
+
+const namespace = "vcluster"
+
+// Registry holds the substrate's metrics, apart from the default registry, so that only they are served.
+var Registry = prometheus.NewRegistry()
+
+var (
+	// ProxyRequests counts the requests a service's proxy has served, by caller and status code. Requests the service
+	// never answered have the code 0. Calls to external hosts are counted under the service "egress", and requests
+	// whose caller is not known have an empty caller.
+	ProxyRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "proxy",
+		Name:      "requests_total",
+		Help:      "Requests served by the proxy of a service, by caller and status code.",
+	}, []string{"service", "caller", "code"})
+
+	// ProxyRequestDuration is the latency of the requests a service's proxy has served, from when a request arrived
+	// to when the last byte of its response was sent, by caller and method. Methods other than the standard HTTP
+	// methods are labelled "other".
+	ProxyRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "proxy",
+		Name:      "request_duration_seconds",
+		Help:      "Latency of requests served by the proxy of a service, by caller and method.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"service", "caller", "method"})
+
+	// ProxyBytes counts the body bytes a service's proxy has passed through, by caller and direction: "request" or
+	// "response".
+	ProxyBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "proxy",
+		Name:      "bytes_total",
+		Help:      "Body bytes passed through the proxy of a service, by caller and direction.",
+	}, []string{"service", "caller", "direction"})
+
+	// CaptureWriteDuration is the latency of writing what the substrate captures to its database, by table.
+	CaptureWriteDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "capture",
+		Name:      "write_duration_seconds",
+		Help:      "Latency of writing captured traffic, messages and logs to the database, by table.",
+		Buckets:   []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+	}, []string{"table"})
+
+	// CaptureWriteErrors counts the writes to the database that failed, by table.
+	CaptureWriteErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "capture",
+		Name:      "write_errors_total",
+		Help:      "Writes of captured traffic, messages and logs to the database that failed, by table.",
+	}, []string{"table"})
+
+	// KafkaMessages counts the messages consumed from a Kafka dependency, by topic.
+	KafkaMessages = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "kafka",
+		Name:      "messages_consumed_total",
+		Help:      "Messages consumed from a Kafka dependency, by topic.",
+	}, []string{"dependency", "topic"})
+
+	// KafkaConsumerErrors counts the errors consuming from a Kafka dependency, by topic.
+	KafkaConsumerErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "kafka",
+		Name:      "consumer_errors_total",
+		Help:      "Errors consuming from a Kafka dependency, by topic.",
+	}, []string{"dependency", "topic"})
+
+	// LogLines counts the lines of output of a service's processes, by stream: "stdout" or "stderr".
+	LogLines = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "logs",
+		Name:      "lines_total",
+		Help:      "Lines of output of the processes of a service, by stream.",
+	}, []string{"service", "stream"})
+
+	// ProcessStarts counts the commands started for a service. A process started again after it exited, whether by
+	// a later run command or by a restart, counts again.
+	ProcessStarts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "process",
+		Name:      "starts_total",
+		Help:      "Commands started for a service.",
+	}, []string{"service"})
+
+	// ProcessExits counts the commands of a service that exited, by outcome: "success", "failure" or "stopped".
+	ProcessExits = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "process",
+		Name:      "exits_total",
+		Help:      "Commands of a service that exited, by outcome.",
+	}, []string{"service", "outcome"})
+
+	// WebsocketClients is the number of clients connected to the websocket.
+	WebsocketClients = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "websocket",
+		Name:      "clients",
+		Help:      "Clients connected to the websocket.",
+	})
+
+	// WebsocketMessages counts the messages broadcast to websocket clients, once per client.
+	WebsocketMessages = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "websocket",
+		Name:      "messages_sent_total",
+		Help:      "Messages queued for websocket clients, once per client.",
+	})
+
+	// WebsocketDroppedMessages counts the messages not sent to websocket clients that could not keep up.
+	WebsocketDroppedMessages = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "websocket",
+		Name:      "dropped_messages_total",
+		Help:      "Messages dropped for websocket clients that could not keep up.",
+	})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		ProxyRequests,
+		ProxyRequestDuration,
+		ProxyBytes,
+		CaptureWriteDuration,
+		CaptureWriteErrors,
+		KafkaMessages,
+		KafkaConsumerErrors,
+		LogLines,
+		ProcessStarts,
+		ProcessExits,
+		WebsocketClients,
+		WebsocketMessages,
+		WebsocketDroppedMessages,
+	)
+}
+
+// Handler serves the substrate's metrics in the Prometheus exposition format.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
+
+// ObserveWrite records the latency of a write to table that started at start, and whether it failed.
+func ObserveWrite(table string, start time.Time, err error) {
+	CaptureWriteDuration.WithLabelValues(table).Observe(time.Since(start).Seconds())
+	if err != nil {
+		CaptureWriteErrors.WithLabelValues(table).Inc()
+	}
+}
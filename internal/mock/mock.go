@@ -0,0 +1,261 @@
+/*
+ * Copyright (c) 2023 Asim Ihsan.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ * SPDX-License-Identifier: MPL-2.0
+ */
+
+package mock
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"net/http"
+	"os"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// Service serves the routes of a mock_service, recording every request and response into the http_requests and
+// http_responses tables under the mock service name.
+type Service struct {
+	name   string
+	db     *sql.DB
+	routes []*route
+
+	readFile func(path string) ([]byte, error)
+	verbose  bool
+
+	mu    sync.Mutex
+	state string
+}
+
+type ServiceOption func(*Service)
+
+// WithFileReader sets how body_file paths are read. Files are read relative to the working directory by default.
+func WithFileReader(readFile func(path string) ([]byte, error)) ServiceOption {
+	return func(s *Service) {
+		s.readFile = readFile
+	}
+}
+
+func WithVerbose(verbose bool) ServiceOption {
+	return func(s *Service) {
+		s.verbose = verbose
+	}
+}
+
+// route is a Route prepared for serving, with its path pattern parsed and its response bodies compiled.
+type route struct {
+	Route
+	pattern   []segment
+	responses []compiledResponse
+
+	// hits counts the requests the route has answered, to pick the next of its sequential responses.
+	hits int
+}
+
+type compiledResponse struct {
+	status  int
+	headers map[string]string
+	body    *template.Template
+	delay   time.Duration
+}
+
+// templateData is what response body templates see, e.g. `{"id": "{{.Params.id}}", "hit": {{.Count}}}`.
+type templateData struct {
+	Method string
+	Path   string
+	Params map[string]string
+
+	// Query and Headers hold the first value of each query parameter and header. Header names are canonical, e.g.
+	// {{index .Headers "X-Request-Id"}}.
+	Query   map[string]string
+	Headers map[string]string
+
+	Body string
+
+	// JSON is the request body parsed as JSON, or nil if it is not JSON.
+	JSON interface{}
+
+	// State is the state of the mock service when the request arrived.
+	State string
+
+	// Count is the number of times the route has been hit, including this request.
+	Count int
+}
+
+var templateFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+	"now": func() string {
+		return time.Now().UTC().Format(time.RFC3339)
+	},
+}
+
+func NewService(name string, routes []Route, db *sql.DB, opts ...ServiceOption) (*Service, error) {
+	s := &Service{
+		name:     name,
+		db:       db,
+		readFile: os.ReadFile,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	for _, r := range routes {
+		if err := r.Validate(); err != nil {
+			return nil, err
+		}
+		pattern, err := parsePattern(r.Path)
+		if err != nil {
+			return nil, err
+		}
+
+		responses := r.Responses
+		if len(responses) == 0 {
+			responses = []Response{{}}
+		}
+		compiled := make([]compiledResponse, 0, len(responses))
+		for _, response := range responses {
+			c, err := s.compile(r.Response.merge(response))
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid response for route %s %s", r.Method, r.Path)
+			}
+			compiled = append(compiled, c)
+		}
+
+		s.routes = append(s.routes, &route{Route: r, pattern: pattern, responses: compiled})
+	}
+	return s, nil
+}
+
+func (s *Service) compile(response Response) (compiledResponse, error) {
+	c := compiledResponse{status: http.StatusOK, headers: response.Headers}
+	if response.Status != nil {
+		c.status = *response.Status
+	}
+	if response.DelayMs != nil {
+		c.delay = time.Duration(*response.DelayMs) * time.Millisecond
+	}
+
+	var body string
+	switch {
+	case response.Body != nil:
+		body = *response.Body
+	case response.BodyFile != nil:
+		content, err := s.readFile(*response.BodyFile)
+		if err != nil {
+			return c, errors.Wrapf(err, "failed to read body_file: %s", *response.BodyFile)
+		}
+		body = string(content)
+	}
+	tmpl, err := template.New("body").Funcs(templateFuncs).Option("missingkey=zero").Parse(body)
+	if err != nil {
+		return c, errors.Wrap(err, "failed to parse body template")
+	}
+	c.body = tmpl
+	return c, nil
+}
+
+// State returns the current state of the service.
+func (s *Service) State() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state
+}
+
+func (s *Service) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	serveRecorded(w, r, s.db, s.name, s.verbose, s.respond)
+}
+
+// respond picks the route answering the request and renders its response. The route's hit count and the state of
+// the service are updated under one lock, so that concurrent requests see consistent sequences.
+func (s *Service) respond(r *http.Request, body []byte) (int, http.Header, []byte, time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	header := http.Header{}
+	for _, rt := range s.routes {
+		if rt.Method != r.Method {
+			continue
+		}
+		params, ok := matchPath(rt.pattern, r.URL.Path)
+		if !ok {
+			continue
+		}
+		if rt.WhenState != nil && *rt.WhenState != s.state {
+			continue
+		}
+		if !rt.Match.matches(r, body) {
+			continue
+		}
+
+		rt.hits++
+		response := rt.responses[len(rt.responses)-1]
+		if rt.hits <= len(rt.responses) {
+			response = rt.responses[rt.hits-1]
+		}
+
+		data := newTemplateData(r, body, params, s.state, rt.hits)
+		if rt.SetState != nil {
+			s.state = *rt.SetState
+		}
+
+		var rendered bytes.Buffer
+		if err := response.body.Execute(&rendered, data); err != nil {
+			header.Set("Content-Type", "text/plain; charset=utf-8")
+			return http.StatusInternalServerError, header,
+				[]byte(fmt.Sprintf("mock service %s: failed to render body: %v\n", s.name, err)), 0
+		}
+		for name, value := range response.headers {
+			header.Set(name, value)
+		}
+		if header.Get("Content-Type") == "" && rendered.Len() > 0 {
+			header.Set("Content-Type", http.DetectContentType(rendered.Bytes()))
+			if json.Valid(rendered.Bytes()) {
+				header.Set("Content-Type", "application/json")
+			}
+		}
+		return response.status, header, rendered.Bytes(), response.delay
+	}
+
+	header.Set("Content-Type", "application/json")
+	notFound, _ := json.Marshal(map[string]string{
+		"error": fmt.Sprintf("mock service %s has no route for %s %s", s.name, r.Method, r.URL.Path),
+	})
+	return http.StatusNotFound, header, notFound, 0
+}
+
+func newTemplateData(r *http.Request, body []byte, params map[string]string, state string, count int) templateData {
+	data := templateData{
+		Method:  r.Method,
+		Path:    r.URL.Path,
+		Params:  params,
+		Query:   map[string]string{},
+		Headers: map[string]string{},
+		Body:    string(body),
+		State:   state,
+		Count:   count,
+	}
+	for name, values := range r.URL.Query() {
+		data.Query[name] = values[0]
+	}
+	for name, values := range r.Header {
+		data.Headers[name] = values[0]
+	}
+	var parsed interface{}
+	if json.Unmarshal(body, &parsed) == nil {
+		data.JSON = parsed
+	}
+	return data
+}
@@ -0,0 +1,198 @@
+/*
+ * Copyright (c) 2023 Asim Ihsan.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ * SPDX-License-Identifier: MPL-2.0
+ */
+
+package mock
+
+import (
+	"database/sql"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/asimihsan/virtual-cluster/internal/schema"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+)
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+func newTestDB(t *testing.T) *sql.DB {
+	db, err := sql.Open("sqlite3", ":memory:")
+	assert.NoError(t, err)
+	db.SetMaxOpenConns(1)
+	assert.NoError(t, schema.Create(db))
+	return db
+}
+
+func do(t *testing.T, h http.Handler, method, target, body string, headers ...string) (int, string, http.Header) {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	for i := 0; i+1 < len(headers); i += 2 {
+		r.Header.Set(headers[i], headers[i+1])
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	responseBody, _ := io.ReadAll(w.Result().Body)
+	return w.Code, string(responseBody), w.Result().Header
+}
+
+func TestMatchPath(t *testing.T) {
+	tests := []struct {
+		pattern  string
+		path     string
+		expected map[string]string
+		matches  bool
+	}{
+		{"/users", "/users", map[string]string{}, true},
+		{"/users", "/users/1", nil, false},
+		{"/users/{id}", "/users/42", map[string]string{"id": "42"}, true},
+		{"/users/{id}", "/users/", nil, false},
+		{"/users/{id}/orders/{order}", "/users/1/orders/2", map[string]string{"id": "1", "order": "2"}, true},
+		{"/files/{path...}", "/files/a/b/c.txt", map[string]string{"path": "a/b/c.txt"}, true},
+		{"/files/{path...}", "/other/a", nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.pattern+" "+tt.path, func(t *testing.T) {
+			pattern, err := parsePattern(tt.pattern)
+			assert.NoError(t, err)
+			params, ok := matchPath(pattern, tt.path)
+			assert.Equal(t, tt.matches, ok)
+			assert.Equal(t, tt.expected, params)
+		})
+	}
+}
+
+func TestRouteValidate(t *testing.T) {
+	assert.Error(t, Route{Method: "GET", Path: "users"}.Validate())
+	assert.Error(t, Route{Method: "get", Path: "/users"}.Validate())
+	assert.Error(t, Route{Method: "GET", Path: "/files/{path...}/x"}.Validate())
+	assert.Error(t, Route{Method: "POST", Path: "/users", Match: Match{BodyJSON: ptr("{")}}.Validate())
+	assert.NoError(t, Route{Method: "GET", Path: "/users/{id}"}.Validate())
+}
+
+func TestService_TemplatedBody(t *testing.T) {
+	db := newTestDB(t)
+	s, err := NewService("users", []Route{
+		{
+			Method: "GET",
+			Path:   "/users/{id}",
+			Response: Response{
+				Body:    ptr(`{"id": "{{.Params.id}}", "verbose": "{{.Query.verbose}}", "tenant": "{{index .Headers "X-Tenant"}}"}`),
+				Headers: map[string]string{"X-Mock": "yes"},
+			},
+		},
+	}, db)
+	assert.NoError(t, err)
+
+	status, body, header := do(t, s, "GET", "/users/42?verbose=true", "", "X-Tenant", "acme")
+	assert.Equal(t, http.StatusOK, status)
+	assert.JSONEq(t, `{"id": "42", "verbose": "true", "tenant": "acme"}`, body)
+	assert.Equal(t, "yes", header.Get("X-Mock"))
+	assert.Equal(t, "application/json", header.Get("Content-Type"))
+
+	var requests, responses int
+	assert.NoError(t, db.QueryRow("SELECT count(*) FROM http_requests WHERE process_name = 'users' AND url = '/users/42?verbose=true'").Scan(&requests))
+	assert.NoError(t, db.QueryRow("SELECT count(*) FROM http_responses WHERE process_name = 'users' AND status_code = 200").Scan(&responses))
+	assert.Equal(t, 1, requests)
+	assert.Equal(t, 1, responses)
+}
+
+func TestService_BodyFile(t *testing.T) {
+	s, err := NewService("users", []Route{
+		{Method: "GET", Path: "/users", Response: Response{BodyFile: ptr("users.json")}},
+	}, newTestDB(t), WithFileReader(func(path string) ([]byte, error) {
+		return []byte(`[{"path": "{{.Path}}"}]`), nil
+	}))
+	assert.NoError(t, err)
+
+	_, body, _ := do(t, s, "GET", "/users", "")
+	assert.JSONEq(t, `[{"path": "/users"}]`, body)
+}
+
+func TestService_RequestMatching(t *testing.T) {
+	s, err := NewService("payments", []Route{
+		{
+			Method:   "POST",
+			Path:     "/charges",
+			Match:    Match{BodyJSON: ptr(`{"currency": "EUR"}`)},
+			Response: Response{Status: ptr(402), Body: ptr("declined")},
+		},
+		{
+			Method:   "POST",
+			Path:     "/charges",
+			Match:    Match{Headers: map[string]string{"Idempotency-Key": "k1"}, BodyContains: ptr("amount")},
+			Response: Response{Status: ptr(201), Body: ptr("created")},
+		},
+	}, newTestDB(t))
+	assert.NoError(t, err)
+
+	status, body, _ := do(t, s, "POST", "/charges", `{"amount": 1, "currency": "EUR"}`)
+	assert.Equal(t, 402, status)
+	assert.Equal(t, "declined", body)
+
+	status, body, _ = do(t, s, "POST", "/charges", `{"amount": 1, "currency": "USD"}`, "Idempotency-Key", "k1")
+	assert.Equal(t, 201, status)
+	assert.Equal(t, "created", body)
+
+	status, _, _ = do(t, s, "POST", "/charges", `{"amount": 1, "currency": "USD"}`)
+	assert.Equal(t, http.StatusNotFound, status)
+}
+
+func TestService_SequentialResponses(t *testing.T) {
+	s, err := NewService("jobs", []Route{
+		{
+			Method:   "GET",
+			Path:     "/jobs/{id}",
+			Response: Response{Headers: map[string]string{"Content-Type": "text/plain"}},
+			Responses: []Response{
+				{Status: ptr(202), Body: ptr("pending {{.Count}}")},
+				{Status: ptr(202), Body: ptr("running {{.Count}}")},
+				{Body: ptr("done {{.Count}}")},
+			},
+		},
+	}, newTestDB(t))
+	assert.NoError(t, err)
+
+	var got []string
+	for i := 0; i < 4; i++ {
+		status, body, header := do(t, s, "GET", "/jobs/1", "")
+		assert.Equal(t, "text/plain", header.Get("Content-Type"))
+		got = append(got, body)
+		if i < 2 {
+			assert.Equal(t, 202, status)
+		} else {
+			assert.Equal(t, 200, status)
+		}
+	}
+	assert.Equal(t, []string{"pending 1", "running 2", "done 3", "done 4"}, got)
+}
+
+func TestService_State(t *testing.T) {
+	s, err := NewService("carts", []Route{
+		{Method: "GET", Path: "/cart", WhenState: ptr(""), Response: Response{Body: ptr("empty")}},
+		{Method: "POST", Path: "/cart", SetState: ptr("filled"), Response: Response{Status: ptr(201)}},
+		{Method: "GET", Path: "/cart", WhenState: ptr("filled"), Response: Response{Body: ptr("{{.State}}")}},
+	}, newTestDB(t))
+	assert.NoError(t, err)
+
+	_, body, _ := do(t, s, "GET", "/cart", "")
+	assert.Equal(t, "empty", body)
+
+	status, _, _ := do(t, s, "POST", "/cart", "")
+	assert.Equal(t, 201, status)
+	assert.Equal(t, "filled", s.State())
+
+	_, body, _ = do(t, s, "GET", "/cart", "")
+	assert.Equal(t, "filled", body)
+}
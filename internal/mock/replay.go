@@ -0,0 +1,240 @@
+/*
+ * Copyright (c) 2023 Asim Ihsan.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ * SPDX-License-Identifier: MPL-2.0
+ */
+
+package mock
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/asimihsan/virtual-cluster/internal/proxy"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/pkg/errors"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Replay answers requests to a service with the responses captured for it in a previous run, so that the service
+// does not need to run. Requests are matched on method, path, query and normalized body. When the same request was
+// captured several times, the captured responses are returned in order, the last one repeating once they run out.
+type Replay struct {
+	name    string
+	db      *sql.DB
+	verbose bool
+
+	mu        sync.Mutex
+	exchanges map[string][]recordedResponse
+	hits      map[string]int
+}
+
+type recordedResponse struct {
+	status int
+	header http.Header
+	body   []byte
+}
+
+type ReplayOption func(*Replay)
+
+func WithReplayVerbose(verbose bool) ReplayOption {
+	return func(p *Replay) {
+		p.verbose = verbose
+	}
+}
+
+// hopHeaders are headers of the captured response that describe the original connection rather than the response,
+// and are left for the server to set.
+var hopHeaders = []string{"Connection", "Content-Length", "Keep-Alive", "Transfer-Encoding", "Trailer", "Upgrade"}
+
+// NewReplay loads the exchanges captured for the service name from the substrate database at recordingPath. Hits
+// on the replay are recorded into db under the same name.
+func NewReplay(name string, recordingPath string, db *sql.DB, opts ...ReplayOption) (*Replay, error) {
+	recording, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?mode=ro", recordingPath))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open recording: %s", recordingPath)
+	}
+	defer recording.Close()
+
+	exchanges, err := loadExchanges(recording, proxy.NewBlobStore(proxy.BlobDir(recordingPath), proxy.DefaultMaxBlobSize), name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to load recording: %s", recordingPath)
+	}
+	if len(exchanges) == 0 {
+		return nil, fmt.Errorf("recording has no requests for service %s: %s", name, recordingPath)
+	}
+
+	replay := &Replay{
+		name:      name,
+		db:        db,
+		exchanges: exchanges,
+		hits:      map[string]int{},
+	}
+	for _, opt := range opts {
+		opt(replay)
+	}
+	return replay, nil
+}
+
+func loadExchanges(recording *sql.DB, blobs *proxy.BlobStore, name string) (map[string][]recordedResponse, error) {
+	// Recordings made by older versions lack the columns describing how bodies were captured.
+	blobColumns := "'', ''"
+	hasBlobs, err := hasColumn(recording, "http_responses", "body_blob")
+	if err != nil {
+		return nil, err
+	}
+	if hasBlobs {
+		blobColumns = "COALESCE(req.body_blob, ''), COALESCE(resp.body_blob, '')"
+	}
+	decodedColumn := "0"
+	hasDecoded, err := hasColumn(recording, "http_responses", "body_decoded")
+	if err != nil {
+		return nil, err
+	}
+	if hasDecoded {
+		decodedColumn = "COALESCE(resp.body_decoded, 0)"
+	}
+
+	rows, err := recording.Query(`
+		SELECT req.method, req.url, req.body, resp.status_code, resp.headers, resp.body, `+blobColumns+`, `+decodedColumn+`
+		FROM http_requests req
+		JOIN http_responses resp ON resp.http_request_id = req.id
+		WHERE req.process_name = ?
+		ORDER BY req.id ASC`, name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	exchanges := map[string][]recordedResponse{}
+	for rows.Next() {
+		var method, rawURL, headers, requestBlob, responseBlob string
+		var requestBody, responseBody []byte
+		var status int
+		var decoded bool
+		err := rows.Scan(&method, &rawURL, &requestBody, &status, &headers, &responseBody, &requestBlob, &responseBlob,
+			&decoded)
+		if err != nil {
+			return nil, err
+		}
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			continue
+		}
+		if requestBody, err = wholeBody(blobs, requestBody, requestBlob); err != nil {
+			return nil, err
+		}
+		if responseBody, err = wholeBody(blobs, responseBody, responseBlob); err != nil {
+			return nil, err
+		}
+
+		header := http.Header{}
+		_ = json.Unmarshal([]byte(headers), &header)
+		for _, name := range hopHeaders {
+			header.Del(name)
+		}
+		if decoded {
+			// The body was captured with its content encoding removed, and is replayed that way.
+			header.Del("Content-Encoding")
+		}
+
+		key := exchangeKey(method, u, requestBody)
+		exchanges[key] = append(exchanges[key], recordedResponse{
+			status: status,
+			header: header,
+			body:   responseBody,
+		})
+	}
+	return exchanges, rows.Err()
+}
+
+// wholeBody returns the whole of a captured body, reading it from its blob if it was too large for the row.
+func wholeBody(blobs *proxy.BlobStore, body []byte, blob string) ([]byte, error) {
+	if blob == "" {
+		return body, nil
+	}
+	whole, err := blobs.Read(blob)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read captured body: %s", blob)
+	}
+	return whole, nil
+}
+
+func hasColumn(db *sql.DB, table string, column string) (bool, error) {
+	var count int
+	err := db.QueryRow("SELECT count(*) FROM pragma_table_info(?) WHERE name = ?", table, column).Scan(&count)
+	return count > 0, err
+}
+
+// exchangeKey identifies a request for matching. Query parameters are compared regardless of their order, and JSON
+// bodies regardless of formatting and key order.
+func exchangeKey(method string, u *url.URL, body []byte) string {
+	query := u.Query()
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var canonicalQuery strings.Builder
+	for _, key := range keys {
+		values := append([]string(nil), query[key]...)
+		sort.Strings(values)
+		for _, value := range values {
+			canonicalQuery.WriteString(url.QueryEscape(key) + "=" + url.QueryEscape(value) + "&")
+		}
+	}
+	return strings.Join([]string{method, u.Path, canonicalQuery.String(), normalizeBody(body)}, "\n")
+}
+
+func normalizeBody(body []byte) string {
+	var parsed interface{}
+	if err := json.Unmarshal(body, &parsed); err == nil {
+		// Marshalling sorts the keys of objects.
+		normalized, err := json.Marshal(parsed)
+		if err == nil {
+			return string(normalized)
+		}
+	}
+	return string(bytes.TrimSpace(body))
+}
+
+func (p *Replay) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	serveRecorded(w, r, p.db, p.name, p.verbose, p.respond)
+}
+
+func (p *Replay) respond(r *http.Request, body []byte) (int, http.Header, []byte, time.Duration) {
+	key := exchangeKey(r.Method, r.URL, body)
+
+	p.mu.Lock()
+	responses, ok := p.exchanges[key]
+	hit := p.hits[key]
+	if ok {
+		p.hits[key] = hit + 1
+	}
+	p.mu.Unlock()
+
+	if !ok {
+		header := http.Header{}
+		header.Set("Content-Type", "application/json")
+		notFound, _ := json.Marshal(map[string]string{
+			"error": fmt.Sprintf("replay of %s has no recorded response for %s %s", p.name, r.Method, r.URL.RequestURI()),
+		})
+		return http.StatusNotFound, header, notFound, 0
+	}
+
+	response := responses[len(responses)-1]
+	if hit < len(responses) {
+		response = responses[hit]
+	}
+	return response.status, response.header.Clone(), response.body, 0
+}
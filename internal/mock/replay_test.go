@@ -0,0 +1,77 @@
+/*
+ * Copyright (c) 2023 Asim Ihsan.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ * SPDX-License-Identifier: MPL-2.0
+ */
+
+package mock
+
+import (
+	"database/sql"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestRecording(t *testing.T) string {
+	path := filepath.Join(t.TempDir(), "recording.db")
+	db, err := sql.Open("sqlite3", path)
+	assert.NoError(t, err)
+	defer db.Close()
+
+	_, err = db.Exec(`
+		CREATE TABLE http_requests (id INTEGER PRIMARY KEY, timestamp TEXT, process_name TEXT, method TEXT, url TEXT, headers TEXT, body TEXT);
+		CREATE TABLE http_responses (id INTEGER PRIMARY KEY, http_request_id INTEGER, timestamp TEXT, process_name TEXT, status_code INTEGER, headers TEXT, body TEXT);
+		INSERT INTO http_requests (id, process_name, method, url, headers, body) VALUES
+			(1, 'rates', 'GET', '/rates?to=EUR&from=USD', '{}', ''),
+			(2, 'rates', 'POST', '/quotes', '{}', '{"amount": 10, "currency": "EUR"}'),
+			(3, 'rates', 'POST', '/quotes', '{}', '{"amount": 10, "currency": "EUR"}'),
+			(4, 'other', 'GET', '/rates?to=EUR&from=USD', '{}', '');
+		INSERT INTO http_responses (http_request_id, process_name, status_code, headers, body) VALUES
+			(1, 'rates', 200, '{"Content-Type": ["application/json"], "Content-Length": ["11"]}', '{"rate": 1}'),
+			(2, 'rates', 201, '{}', 'quote 1'),
+			(3, 'rates', 429, '{}', 'slow down'),
+			(4, 'other', 500, '{}', 'wrong service');
+	`)
+	assert.NoError(t, err)
+	return path
+}
+
+func TestReplay(t *testing.T) {
+	db := newTestDB(t)
+	replay, err := NewReplay("rates", newTestRecording(t), db)
+	assert.NoError(t, err)
+
+	// Query parameters match regardless of order.
+	status, body, header := do(t, replay, "GET", "/rates?from=USD&to=EUR", "")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, `{"rate": 1}`, body)
+	assert.Equal(t, "application/json", header.Get("Content-Type"))
+
+	// JSON bodies match regardless of formatting, and repeated requests get the recorded responses in order.
+	status, body, _ = do(t, replay, "POST", "/quotes", `{"currency":"EUR","amount":10}`)
+	assert.Equal(t, 201, status)
+	assert.Equal(t, "quote 1", body)
+	status, _, _ = do(t, replay, "POST", "/quotes", `{"amount": 10, "currency": "EUR"}`)
+	assert.Equal(t, 429, status)
+	status, _, _ = do(t, replay, "POST", "/quotes", `{"amount": 10, "currency": "EUR"}`)
+	assert.Equal(t, 429, status)
+
+	status, _, _ = do(t, replay, "POST", "/quotes", `{"amount": 11, "currency": "EUR"}`)
+	assert.Equal(t, http.StatusNotFound, status)
+
+	var requests int
+	assert.NoError(t, db.QueryRow("SELECT count(*) FROM http_requests WHERE process_name = 'rates'").Scan(&requests))
+	assert.Equal(t, 5, requests)
+}
+
+func TestReplay_EmptyRecordingIsError(t *testing.T) {
+	_, err := NewReplay("missing", newTestRecording(t), newTestDB(t))
+	assert.Error(t, err)
+}
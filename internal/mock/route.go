@@ -0,0 +1,230 @@
+/*
+ * Copyright (c) 2023 Asim Ihsan.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ * SPDX-License-Identifier: MPL-2.0
+ */
+
+package mock
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Route is one `route` block of a mock_service. Routes are tried in the order they are declared and the first one
+// that matches the request answers it.
+type Route struct {
+	Method string
+
+	// Path is matched segment by segment. "{name}" matches any single segment and "{name...}", as the last segment,
+	// matches the rest of the path. The matched values are available to templates as .Params.
+	Path string
+
+	Match Match
+
+	// WhenState restricts the route to when the mock service is in that state. The service starts in the state "".
+	WhenState *string
+
+	// SetState moves the mock service into another state after the route has answered.
+	SetState *string
+
+	// Response holds the defaults for every entry of Responses. A route without Responses always answers with it.
+	Response Response
+
+	// Responses are returned one after another on successive hits, the last one repeating once they run out.
+	Responses []Response
+}
+
+// Match holds the conditions a request must meet, besides method and path, for a route to answer it.
+type Match struct {
+	// Headers and Query must be present with exactly these values.
+	Headers map[string]string
+	Query   map[string]string
+
+	// BodyContains must be a substring of the request body.
+	BodyContains *string
+
+	// BodyJSON must be a subset of the request body parsed as JSON: every field it has must be present in the body
+	// with the same value, and arrays must match element by element.
+	BodyJSON *string
+}
+
+// Response is what a route answers with. Body and BodyFile are Go templates, see templateData.
+type Response struct {
+	Status   *int
+	Headers  map[string]string
+	Body     *string
+	BodyFile *string
+	DelayMs  *int
+}
+
+func (r Route) Validate() error {
+	if r.Method != strings.ToUpper(r.Method) {
+		return fmt.Errorf("route method must be upper case: %s", r.Method)
+	}
+	if !strings.HasPrefix(r.Path, "/") {
+		return fmt.Errorf("route path must start with '/': %s", r.Path)
+	}
+	if _, err := parsePattern(r.Path); err != nil {
+		return err
+	}
+	if r.Match.BodyJSON != nil && !json.Valid([]byte(*r.Match.BodyJSON)) {
+		return fmt.Errorf("body_json is not valid JSON: %s %s", r.Method, r.Path)
+	}
+	for _, response := range append([]Response{r.Response}, r.Responses...) {
+		if response.Status != nil && (*response.Status < 100 || *response.Status > 999) {
+			return fmt.Errorf("invalid status: %d", *response.Status)
+		}
+		if response.Body != nil && response.BodyFile != nil {
+			return fmt.Errorf("body and body_file are mutually exclusive: %s %s", r.Method, r.Path)
+		}
+	}
+	return nil
+}
+
+// merge returns r with the fields set in override replaced.
+func (r Response) merge(override Response) Response {
+	if override.Status != nil {
+		r.Status = override.Status
+	}
+	if override.Body != nil || override.BodyFile != nil {
+		r.Body, r.BodyFile = override.Body, override.BodyFile
+	}
+	if override.DelayMs != nil {
+		r.DelayMs = override.DelayMs
+	}
+	if len(override.Headers) > 0 {
+		headers := make(map[string]string, len(r.Headers)+len(override.Headers))
+		for k, v := range r.Headers {
+			headers[k] = v
+		}
+		for k, v := range override.Headers {
+			headers[k] = v
+		}
+		r.Headers = headers
+	}
+	return r
+}
+
+type segment struct {
+	literal  string
+	param    string
+	wildcard bool
+}
+
+func parsePattern(path string) ([]segment, error) {
+	parts := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	segments := make([]segment, 0, len(parts))
+	for i, part := range parts {
+		if !strings.HasPrefix(part, "{") || !strings.HasSuffix(part, "}") {
+			if strings.ContainsAny(part, "{}") {
+				return nil, fmt.Errorf("invalid path parameter in %s: %s", path, part)
+			}
+			segments = append(segments, segment{literal: part})
+			continue
+		}
+
+		name := part[1 : len(part)-1]
+		wildcard := strings.HasSuffix(name, "...")
+		name = strings.TrimSuffix(name, "...")
+		if name == "" {
+			return nil, fmt.Errorf("path parameter without a name in %s", path)
+		}
+		if wildcard && i != len(parts)-1 {
+			return nil, fmt.Errorf("%s must be the last segment of %s", part, path)
+		}
+		segments = append(segments, segment{param: name, wildcard: wildcard})
+	}
+	return segments, nil
+}
+
+// matchPath matches a request path against a parsed pattern, returning the path parameters.
+func matchPath(pattern []segment, path string) (map[string]string, bool) {
+	parts := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	params := map[string]string{}
+	for i, seg := range pattern {
+		if seg.wildcard {
+			params[seg.param] = strings.Join(parts[i:], "/")
+			return params, true
+		}
+		if i >= len(parts) {
+			return nil, false
+		}
+		switch {
+		case seg.param != "":
+			if parts[i] == "" {
+				return nil, false
+			}
+			params[seg.param] = parts[i]
+		case seg.literal != parts[i]:
+			return nil, false
+		}
+	}
+	if len(parts) != len(pattern) {
+		return nil, false
+	}
+	return params, true
+}
+
+func (m Match) matches(r *http.Request, body []byte) bool {
+	for name, value := range m.Headers {
+		if r.Header.Get(name) != value {
+			return false
+		}
+	}
+	query := r.URL.Query()
+	for name, value := range m.Query {
+		if !query.Has(name) || query.Get(name) != value {
+			return false
+		}
+	}
+	if m.BodyContains != nil && !bytes.Contains(body, []byte(*m.BodyContains)) {
+		return false
+	}
+	if m.BodyJSON != nil {
+		var expected, actual interface{}
+		if json.Unmarshal([]byte(*m.BodyJSON), &expected) != nil || json.Unmarshal(body, &actual) != nil {
+			return false
+		}
+		if !jsonSubset(expected, actual) {
+			return false
+		}
+	}
+	return true
+}
+
+func jsonSubset(expected, actual interface{}) bool {
+	switch expected := expected.(type) {
+	case map[string]interface{}:
+		actual, ok := actual.(map[string]interface{})
+		if !ok {
+			return false
+		}
+		for key, value := range expected {
+			if actualValue, ok := actual[key]; !ok || !jsonSubset(value, actualValue) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		actual, ok := actual.([]interface{})
+		if !ok || len(actual) != len(expected) {
+			return false
+		}
+		for i := range expected {
+			if !jsonSubset(expected[i], actual[i]) {
+				return false
+			}
+		}
+		return true
+	default:
+		return expected == actual
+	}
+}
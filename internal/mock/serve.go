@@ -0,0 +1,81 @@
+/*
+ * Copyright (c) 2023 Asim Ihsan.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ * SPDX-License-Identifier: MPL-2.0
+ */
+
+package mock
+
+import (
+	"database/sql"
+	"github.com/asimihsan/virtual-cluster/internal/proxy"
+	"github.com/rs/zerolog/log"
+	"io"
+	"net/http"
+	"time"
+)
+
+// responder produces the response to a request: status, headers, body and how long to wait before sending it.
+type responder func(r *http.Request, body []byte) (int, http.Header, []byte, time.Duration)
+
+// serveRecorded answers a request with respond, recording the request and response into the http_requests and
+// http_responses tables under name, just as the proxy does for real services.
+func serveRecorded(w http.ResponseWriter, r *http.Request, db *sql.DB, name string, verbose bool, respond responder) {
+	start := time.Now()
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		log.Printf("Error reading request body: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	r.Body.Close()
+
+	if verbose {
+		log.Debug().
+			Str("mock_service", name).
+			Str("method", r.Method).
+			Str("url", r.URL.String()).
+			Str("body", string(body)).
+			Msg("Mock service request")
+	}
+
+	requestID, err := proxy.RecordRequest(db, name, r, proxy.NewCapturedBody(body, r.Header), nil)
+	if err != nil {
+		log.Printf("Error recording HTTP request: %v", err)
+	}
+
+	status, header, responseBody, delay := respond(r, body)
+
+	if delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	for key, values := range header {
+		w.Header()[key] = values
+	}
+	firstByte := time.Now()
+	w.WriteHeader(status)
+	_, _ = w.Write(responseBody)
+
+	if requestID != 0 {
+		err = proxy.RecordResponse(db, requestID, name, proxy.CapturedResponse{
+			StatusCode: status,
+			Header:     header,
+			Body:       proxy.NewCapturedBody(responseBody, header),
+			Start:      start,
+			FirstByte:  firstByte,
+			End:        time.Now(),
+		})
+		if err != nil {
+			log.Printf("Error recording HTTP response: %v", err)
+		}
+	}
+}
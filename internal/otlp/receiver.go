@@ -0,0 +1,237 @@
+/*
+ * Copyright (c) 2023 Asim Ihsan.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ * SPDX-License-Identifier: MPL-2.0
+ */
+
+// Package otlp receives the traces, logs and metrics that services export with OpenTelemetry, over OTLP/HTTP and
+// OTLP/gRPC, and stores them in the otel_spans, otel_logs and otel_metrics tables.
+package otlp
+
+import (
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/rs/zerolog/log"
+	collogspb "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// DefaultPort is the port OpenTelemetry SDKs export OTLP/HTTP to when they are not told otherwise.
+const DefaultPort = 4318
+
+// maxMessageSize bounds the size of an export request, as decompressed.
+const maxMessageSize = 64 << 20
+
+// Receiver serves the OTLP/HTTP endpoints /v1/traces, /v1/logs and /v1/metrics, and the OTLP/gRPC services on the
+// same port, so that one OTEL_EXPORTER_OTLP_ENDPOINT works for exporters of either protocol. gRPC needs HTTP/2, which
+// servers without TLS only speak when the receiver is wrapped with h2c.
+type Receiver struct {
+	db   *sql.DB
+	grpc *grpc.Server
+}
+
+func NewReceiver(db *sql.DB) *Receiver {
+	r := &Receiver{
+		db:   db,
+		grpc: grpc.NewServer(grpc.MaxRecvMsgSize(maxMessageSize)),
+	}
+	coltracepb.RegisterTraceServiceServer(r.grpc, &traceService{r: r})
+	collogspb.RegisterLogsServiceServer(r.grpc, &logsService{r: r})
+	colmetricspb.RegisterMetricsServiceServer(r.grpc, &metricsService{r: r})
+	return r
+}
+
+func (r *Receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.ProtoMajor == 2 && strings.HasPrefix(req.Header.Get("Content-Type"), "application/grpc") {
+		r.grpc.ServeHTTP(w, req)
+		return
+	}
+
+	var request, response proto.Message
+	var store func() error
+	switch req.URL.Path {
+	case "/v1/traces":
+		traces := &coltracepb.ExportTraceServiceRequest{}
+		request, response = traces, &coltracepb.ExportTraceServiceResponse{}
+		store = func() error { return r.storeTraces(traces) }
+	case "/v1/logs":
+		logs := &collogspb.ExportLogsServiceRequest{}
+		request, response = logs, &collogspb.ExportLogsServiceResponse{}
+		store = func() error { return r.storeLogs(logs) }
+	case "/v1/metrics":
+		metrics := &colmetricspb.ExportMetricsServiceRequest{}
+		request, response = metrics, &colmetricspb.ExportMetricsServiceResponse{}
+		store = func() error { return r.storeMetrics(metrics) }
+	default:
+		http.NotFound(w, req)
+		return
+	}
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "OTLP exports must be POSTed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body := io.Reader(req.Body)
+	if req.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(req.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer gz.Close()
+		body = gz
+	}
+	data, err := io.ReadAll(io.LimitReader(body, maxMessageSize+1))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(data) > maxMessageSize {
+		http.Error(w, "export request is too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	contentType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	switch contentType {
+	case "application/x-protobuf":
+		err = proto.Unmarshal(data, request)
+	case "application/json":
+		err = unmarshalJSON(data, request)
+	default:
+		http.Error(w, "Content-Type must be application/x-protobuf or application/json", http.StatusUnsupportedMediaType)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := store(); err != nil {
+		log.Printf("Error storing OTLP export: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	// Responses are encoded as their requests were.
+	var encoded []byte
+	if contentType == "application/json" {
+		encoded, err = protojson.Marshal(response)
+	} else {
+		encoded, err = proto.Marshal(response)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	_, _ = w.Write(encoded)
+}
+
+// Stop ends the gRPC streams the receiver is serving.
+func (r *Receiver) Stop() {
+	r.grpc.Stop()
+}
+
+// unmarshalJSON reads an export request in the OTLP/JSON encoding, which differs from the standard JSON mapping of
+// protobuf in writing trace and span ids in hex rather than base64.
+func unmarshalJSON(data []byte, request proto.Message) error {
+	var decoded interface{}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+	hexIDsToBase64(decoded)
+	data, err := json.Marshal(decoded)
+	if err != nil {
+		return err
+	}
+	return protojson.UnmarshalOptions{DiscardUnknown: true}.Unmarshal(data, request)
+}
+
+// idFields are the fields of spans, span links, log records and exemplars holding ids, in both of the field name
+// forms protojson accepts.
+var idFields = map[string]bool{
+	"traceId": true, "spanId": true, "parentSpanId": true,
+	"trace_id": true, "span_id": true, "parent_span_id": true,
+}
+
+func hexIDsToBase64(value interface{}) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, field := range v {
+			if id, ok := field.(string); ok && idFields[key] {
+				if decoded, err := hex.DecodeString(id); err == nil {
+					v[key] = base64.StdEncoding.EncodeToString(decoded)
+				}
+				continue
+			}
+			hexIDsToBase64(field)
+		}
+	case []interface{}:
+		for _, element := range v {
+			hexIDsToBase64(element)
+		}
+	}
+}
+
+type traceService struct {
+	coltracepb.UnimplementedTraceServiceServer
+	r *Receiver
+}
+
+func (s *traceService) Export(
+	ctx context.Context,
+	request *coltracepb.ExportTraceServiceRequest,
+) (*coltracepb.ExportTraceServiceResponse, error) {
+	if err := s.r.storeTraces(request); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &coltracepb.ExportTraceServiceResponse{}, nil
+}
+
+type logsService struct {
+	collogspb.UnimplementedLogsServiceServer
+	r *Receiver
+}
+
+func (s *logsService) Export(
+	ctx context.Context,
+	request *collogspb.ExportLogsServiceRequest,
+) (*collogspb.ExportLogsServiceResponse, error) {
+	if err := s.r.storeLogs(request); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &collogspb.ExportLogsServiceResponse{}, nil
+}
+
+type metricsService struct {
+	colmetricspb.UnimplementedMetricsServiceServer
+	r *Receiver
+}
+
+func (s *metricsService) Export(
+	ctx context.Context,
+	request *colmetricspb.ExportMetricsServiceRequest,
+) (*colmetricspb.ExportMetricsServiceResponse, error) {
+	if err := s.r.storeMetrics(request); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &colmetricspb.ExportMetricsServiceResponse{}, nil
+}
@@ -0,0 +1,224 @@
+/*
+ * Copyright (c) 2023 Asim Ihsan.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ * SPDX-License-Identifier: MPL-2.0
+ */
+
+package otlp
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/asimihsan/virtual-cluster/internal/schema"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/protobuf/proto"
+)
+
+func newTestDB(t *testing.T) *sql.DB {
+	db, err := sql.Open("sqlite3", ":memory:")
+	assert.NoError(t, err)
+	db.SetMaxOpenConns(1)
+	assert.NoError(t, schema.Create(db))
+	return db
+}
+
+func serviceResource(name string) *resourcepb.Resource {
+	return &resourcepb.Resource{Attributes: []*commonpb.KeyValue{
+		{Key: "service.name", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: name}}},
+	}}
+}
+
+func TestReceiver_HTTPProtobufTraces(t *testing.T) {
+	db := newTestDB(t)
+	server := httptest.NewServer(NewReceiver(db))
+	defer server.Close()
+
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	request := &coltracepb.ExportTraceServiceRequest{ResourceSpans: []*tracepb.ResourceSpans{{
+		Resource: serviceResource("orders"),
+		ScopeSpans: []*tracepb.ScopeSpans{{Spans: []*tracepb.Span{{
+			TraceId:           []byte{0x4b, 0xf9, 0x2f, 0x35, 0x77, 0xb3, 0x4d, 0xa6, 0xa3, 0xce, 0x92, 0x9d, 0x0e, 0x0e, 0x47, 0x36},
+			SpanId:            []byte{0x00, 0xf0, 0x67, 0xaa, 0x0b, 0xa9, 0x02, 0xb7},
+			Name:              "POST /orders",
+			Kind:              tracepb.Span_SPAN_KIND_SERVER,
+			StartTimeUnixNano: uint64(start.UnixNano()),
+			EndTimeUnixNano:   uint64(start.Add(25 * time.Millisecond).UnixNano()),
+			Attributes: []*commonpb.KeyValue{
+				{Key: "http.status_code", Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_IntValue{IntValue: 201}}},
+			},
+			Status: &tracepb.Status{Code: tracepb.Status_STATUS_CODE_OK},
+		}}}},
+	}}}
+	body, err := proto.Marshal(request)
+	assert.NoError(t, err)
+	resp, err := http.Post(server.URL+"/v1/traces", "application/x-protobuf", bytes.NewReader(body))
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "application/x-protobuf", resp.Header.Get("Content-Type"))
+
+	var timestamp, serviceName, traceID, spanID, name, kind, statusCode, attributes string
+	var parentSpanID sql.NullString
+	var durationMs float64
+	err = db.QueryRow("SELECT timestamp, service_name, trace_id, span_id, parent_span_id, name, kind, duration_ms, status_code, attributes FROM otel_spans").
+		Scan(&timestamp, &serviceName, &traceID, &spanID, &parentSpanID, &name, &kind, &durationMs, &statusCode, &attributes)
+	assert.NoError(t, err)
+	assert.Equal(t, "2023-01-01T00:00:00.000Z", timestamp)
+	assert.Equal(t, "orders", serviceName)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", traceID)
+	assert.Equal(t, "00f067aa0ba902b7", spanID)
+	assert.False(t, parentSpanID.Valid)
+	assert.Equal(t, "POST /orders", name)
+	assert.Equal(t, "server", kind)
+	assert.Equal(t, 25.0, durationMs)
+	assert.Equal(t, "ok", statusCode)
+	assert.JSONEq(t, `{"http.status_code": 201}`, attributes)
+}
+
+func TestReceiver_HTTPJSONLogs(t *testing.T) {
+	db := newTestDB(t)
+	server := httptest.NewServer(NewReceiver(db))
+	defer server.Close()
+
+	// OTLP/JSON writes ids in hex, and a resource without a service name is stored under UnknownService.
+	body := `{"resourceLogs": [{"scopeLogs": [{"scope": {"name": "app"}, "logRecords": [{
+		"timeUnixNano": "1672531200000000000",
+		"severityNumber": 17,
+		"severityText": "ERROR",
+		"body": {"stringValue": "charge failed"},
+		"traceId": "4bf92f3577b34da6a3ce929d0e0e4736",
+		"spanId": "00f067aa0ba902b7",
+		"attributes": [{"key": "order.id", "value": {"stringValue": "o1"}}]
+	}]}]}]}`
+	resp, err := http.Post(server.URL+"/v1/logs", "application/json", bytes.NewReader([]byte(body)))
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var timestamp, serviceName, severityText, logBody, traceID, spanID, attributes, scopeName string
+	var severityNumber int
+	err = db.QueryRow("SELECT timestamp, service_name, severity_number, severity_text, body, trace_id, span_id, attributes, scope_name FROM otel_logs").
+		Scan(&timestamp, &serviceName, &severityNumber, &severityText, &logBody, &traceID, &spanID, &attributes, &scopeName)
+	assert.NoError(t, err)
+	assert.Equal(t, "2023-01-01T00:00:00.000Z", timestamp)
+	assert.Equal(t, UnknownService, serviceName)
+	assert.Equal(t, 17, severityNumber)
+	assert.Equal(t, "ERROR", severityText)
+	assert.Equal(t, "charge failed", logBody)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", traceID)
+	assert.Equal(t, "00f067aa0ba902b7", spanID)
+	assert.JSONEq(t, `{"order.id": "o1"}`, attributes)
+	assert.Equal(t, "app", scopeName)
+}
+
+func TestReceiver_HTTPErrors(t *testing.T) {
+	server := httptest.NewServer(NewReceiver(newTestDB(t)))
+	defer server.Close()
+
+	resp, err := http.Post(server.URL+"/v1/traces", "text/plain", bytes.NewReader(nil))
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnsupportedMediaType, resp.StatusCode)
+
+	resp, err = http.Get(server.URL + "/v1/traces")
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+
+	resp, err = http.Post(server.URL+"/v1/profiles", "application/x-protobuf", bytes.NewReader(nil))
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestReceiver_GRPCMetrics(t *testing.T) {
+	db := newTestDB(t)
+	receiver := NewReceiver(db)
+	defer receiver.Stop()
+	server := httptest.NewServer(h2c.NewHandler(receiver, &http2.Server{}))
+	defer server.Close()
+
+	conn, err := grpc.Dial(server.Listener.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	now := uint64(time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC).UnixNano())
+	sum := 12.5
+	_, err = colmetricspb.NewMetricsServiceClient(conn).Export(context.Background(), &colmetricspb.ExportMetricsServiceRequest{
+		ResourceMetrics: []*metricspb.ResourceMetrics{{
+			Resource: serviceResource("orders"),
+			ScopeMetrics: []*metricspb.ScopeMetrics{{Metrics: []*metricspb.Metric{
+				{
+					Name: "orders.created",
+					Data: &metricspb.Metric_Sum{Sum: &metricspb.Sum{
+						AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE,
+						IsMonotonic:            true,
+						DataPoints: []*metricspb.NumberDataPoint{{
+							TimeUnixNano: now,
+							Value:        &metricspb.NumberDataPoint_AsInt{AsInt: 3},
+						}},
+					}},
+				},
+				{
+					Name: "http.server.duration",
+					Unit: "ms",
+					Data: &metricspb.Metric_Histogram{Histogram: &metricspb.Histogram{
+						AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_DELTA,
+						DataPoints: []*metricspb.HistogramDataPoint{{
+							TimeUnixNano:   now,
+							Count:          2,
+							Sum:            &sum,
+							ExplicitBounds: []float64{10},
+							BucketCounts:   []uint64{1, 1},
+						}},
+					}},
+				},
+			}}},
+		}},
+	})
+	assert.NoError(t, err)
+
+	rows, err := db.Query("SELECT service_name, name, type, temporality, monotonic, value, data FROM otel_metrics ORDER BY id")
+	assert.NoError(t, err)
+	defer rows.Close()
+	type point struct {
+		serviceName, name, kind, temporality string
+		monotonic                            sql.NullBool
+		value                                float64
+		data                                 sql.NullString
+	}
+	var points []point
+	for rows.Next() {
+		var p point
+		assert.NoError(t, rows.Scan(&p.serviceName, &p.name, &p.kind, &p.temporality, &p.monotonic, &p.value, &p.data))
+		points = append(points, p)
+	}
+	assert.Len(t, points, 2)
+	assert.Equal(t, point{serviceName: "orders", name: "orders.created", kind: "sum", temporality: "cumulative",
+		monotonic: sql.NullBool{Bool: true, Valid: true}, value: 3}, points[0])
+	assert.Equal(t, "histogram", points[1].kind)
+	assert.Equal(t, "delta", points[1].temporality)
+	assert.Equal(t, 12.5, points[1].value)
+	assert.JSONEq(t, `{"count": 2, "sum": 12.5, "explicit_bounds": [10], "bucket_counts": [1, 1]}`, points[1].data.String)
+}
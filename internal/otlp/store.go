@@ -0,0 +1,376 @@
+/*
+ * Copyright (c) 2023 Asim Ihsan.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ * SPDX-License-Identifier: MPL-2.0
+ */
+
+package otlp
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"github.com/asimihsan/virtual-cluster/internal/schema"
+	"github.com/asimihsan/virtual-cluster/internal/utils"
+	collogspb "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"strings"
+	"time"
+)
+
+// UnknownService is the service name of telemetry whose resource has no service.name, as OpenTelemetry SDKs name it.
+const UnknownService = "unknown_service"
+
+// resource is what the stored rows of a resource share: its service name and attributes.
+type resource struct {
+	serviceName string
+	attributes  string
+}
+
+func newResource(r *resourcepb.Resource) resource {
+	attributes := Attributes(r.GetAttributes())
+	serviceName, _ := attributes["service.name"].(string)
+	if serviceName == "" {
+		serviceName = UnknownService
+	}
+	return resource{serviceName: serviceName, attributes: encodeJSON(attributes)}
+}
+
+func (r *Receiver) storeTraces(request *coltracepb.ExportTraceServiceRequest) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	insert, err := tx.Prepare(`
+		INSERT INTO otel_spans (timestamp, service_name, trace_id, span_id, parent_span_id, trace_state, name, kind,
+			start_time_unix_nano, end_time_unix_nano, duration_ms, status_code, status_message, attributes, events,
+			links, resource_attributes, scope_name, scope_version)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer insert.Close()
+
+	for _, resourceSpans := range request.GetResourceSpans() {
+		res := newResource(resourceSpans.GetResource())
+		for _, scopeSpans := range resourceSpans.GetScopeSpans() {
+			scope := scopeSpans.GetScope()
+			for _, span := range scopeSpans.GetSpans() {
+				_, err := insert.Exec(
+					timestamp(span.GetStartTimeUnixNano()), res.serviceName, hex.EncodeToString(span.GetTraceId()),
+					hex.EncodeToString(span.GetSpanId()), schema.NullIfEmpty(hex.EncodeToString(span.GetParentSpanId())),
+					schema.NullIfEmpty(span.GetTraceState()), span.GetName(), SpanKind(span.GetKind()),
+					span.GetStartTimeUnixNano(), span.GetEndTimeUnixNano(), durationMs(span),
+					StatusCode(span.GetStatus().GetCode()), schema.NullIfEmpty(span.GetStatus().GetMessage()),
+					encodeJSON(Attributes(span.GetAttributes())), encodeJSON(spanEvents(span.GetEvents())),
+					encodeJSON(spanLinks(span.GetLinks())), res.attributes, scope.GetName(), scope.GetVersion())
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+func (r *Receiver) storeLogs(request *collogspb.ExportLogsServiceRequest) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	insert, err := tx.Prepare(`
+		INSERT INTO otel_logs (timestamp, observed_timestamp, service_name, severity_number, severity_text, body,
+			trace_id, span_id, attributes, resource_attributes, scope_name)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer insert.Close()
+
+	for _, resourceLogs := range request.GetResourceLogs() {
+		res := newResource(resourceLogs.GetResource())
+		for _, scopeLogs := range resourceLogs.GetScopeLogs() {
+			for _, record := range scopeLogs.GetLogRecords() {
+				// Records that were not timestamped at their source are ordered by when they were observed.
+				observed := record.GetObservedTimeUnixNano()
+				if observed == 0 {
+					observed = uint64(time.Now().UnixNano())
+				}
+				recorded := record.GetTimeUnixNano()
+				if recorded == 0 {
+					recorded = observed
+				}
+				body := AnyValue(record.GetBody())
+				var encodedBody interface{}
+				if s, ok := body.(string); ok {
+					encodedBody = s
+				} else if body != nil {
+					encodedBody = encodeJSON(body)
+				}
+				_, err := insert.Exec(
+					timestamp(recorded), timestamp(observed), res.serviceName, int32(record.GetSeverityNumber()),
+					schema.NullIfEmpty(record.GetSeverityText()), encodedBody,
+					schema.NullIfEmpty(hex.EncodeToString(record.GetTraceId())), schema.NullIfEmpty(hex.EncodeToString(record.GetSpanId())),
+					encodeJSON(Attributes(record.GetAttributes())), res.attributes, scopeLogs.GetScope().GetName())
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+// metricPoint is a data point of a metric as it is stored. Value is the value of gauges and sums and the sum of
+// histograms and summaries; Data holds the rest of histograms and summaries.
+type metricPoint struct {
+	start      uint64
+	time       uint64
+	attributes []*commonpb.KeyValue
+	value      *float64
+	data       map[string]interface{}
+}
+
+func (r *Receiver) storeMetrics(request *colmetricspb.ExportMetricsServiceRequest) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	insert, err := tx.Prepare(`
+		INSERT INTO otel_metrics (timestamp, start_timestamp, service_name, name, description, unit, type, temporality,
+			monotonic, value, data, attributes, resource_attributes, scope_name)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer insert.Close()
+
+	for _, resourceMetrics := range request.GetResourceMetrics() {
+		res := newResource(resourceMetrics.GetResource())
+		for _, scopeMetrics := range resourceMetrics.GetScopeMetrics() {
+			for _, metric := range scopeMetrics.GetMetrics() {
+				kind, temporality, monotonic, points := metricPoints(metric)
+				for _, point := range points {
+					var start, data interface{}
+					if point.start != 0 {
+						start = timestamp(point.start)
+					}
+					if point.data != nil {
+						data = encodeJSON(point.data)
+					}
+					_, err := insert.Exec(
+						timestamp(point.time), start, res.serviceName, metric.GetName(),
+						schema.NullIfEmpty(metric.GetDescription()), schema.NullIfEmpty(metric.GetUnit()), kind, temporality, monotonic,
+						point.value, data, encodeJSON(Attributes(point.attributes)), res.attributes,
+						scopeMetrics.GetScope().GetName())
+					if err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+// metricPoints returns the type of a metric, its aggregation temporality and whether it is monotonic where those
+// apply, and its data points.
+func metricPoints(metric *metricspb.Metric) (kind string, temporality interface{}, monotonic interface{}, points []metricPoint) {
+	switch data := metric.GetData().(type) {
+	case *metricspb.Metric_Gauge:
+		return "gauge", nil, nil, numberPoints(data.Gauge.GetDataPoints())
+	case *metricspb.Metric_Sum:
+		return "sum", aggregationTemporality(data.Sum.GetAggregationTemporality()), data.Sum.GetIsMonotonic(),
+			numberPoints(data.Sum.GetDataPoints())
+	case *metricspb.Metric_Histogram:
+		for _, p := range data.Histogram.GetDataPoints() {
+			d := map[string]interface{}{
+				"count":           p.GetCount(),
+				"explicit_bounds": nonNil(p.GetExplicitBounds()),
+				"bucket_counts":   nonNil(p.GetBucketCounts()),
+			}
+			addOptional(d, p.Sum, p.Min, p.Max)
+			points = append(points, metricPoint{start: p.GetStartTimeUnixNano(), time: p.GetTimeUnixNano(),
+				attributes: p.GetAttributes(), value: p.Sum, data: d})
+		}
+		return "histogram", aggregationTemporality(data.Histogram.GetAggregationTemporality()), nil, points
+	case *metricspb.Metric_ExponentialHistogram:
+		for _, p := range data.ExponentialHistogram.GetDataPoints() {
+			d := map[string]interface{}{
+				"count":      p.GetCount(),
+				"scale":      p.GetScale(),
+				"zero_count": p.GetZeroCount(),
+				"positive": map[string]interface{}{
+					"offset":        p.GetPositive().GetOffset(),
+					"bucket_counts": nonNil(p.GetPositive().GetBucketCounts()),
+				},
+				"negative": map[string]interface{}{
+					"offset":        p.GetNegative().GetOffset(),
+					"bucket_counts": nonNil(p.GetNegative().GetBucketCounts()),
+				},
+			}
+			addOptional(d, p.Sum, p.Min, p.Max)
+			points = append(points, metricPoint{start: p.GetStartTimeUnixNano(), time: p.GetTimeUnixNano(),
+				attributes: p.GetAttributes(), value: p.Sum, data: d})
+		}
+		return "exponential_histogram", aggregationTemporality(data.ExponentialHistogram.GetAggregationTemporality()),
+			nil, points
+	case *metricspb.Metric_Summary:
+		for _, p := range data.Summary.GetDataPoints() {
+			quantiles := make([]map[string]float64, 0, len(p.GetQuantileValues()))
+			for _, q := range p.GetQuantileValues() {
+				quantiles = append(quantiles, map[string]float64{"quantile": q.GetQuantile(), "value": q.GetValue()})
+			}
+			sum := p.GetSum()
+			points = append(points, metricPoint{start: p.GetStartTimeUnixNano(), time: p.GetTimeUnixNano(),
+				attributes: p.GetAttributes(), value: &sum,
+				data: map[string]interface{}{"count": p.GetCount(), "sum": sum, "quantiles": quantiles}})
+		}
+		return "summary", nil, nil, points
+	}
+	return "", nil, nil, nil
+}
+
+func numberPoints(dataPoints []*metricspb.NumberDataPoint) []metricPoint {
+	points := make([]metricPoint, 0, len(dataPoints))
+	for _, p := range dataPoints {
+		var value float64
+		switch v := p.GetValue().(type) {
+		case *metricspb.NumberDataPoint_AsDouble:
+			value = v.AsDouble
+		case *metricspb.NumberDataPoint_AsInt:
+			value = float64(v.AsInt)
+		}
+		points = append(points, metricPoint{start: p.GetStartTimeUnixNano(), time: p.GetTimeUnixNano(),
+			attributes: p.GetAttributes(), value: &value})
+	}
+	return points
+}
+
+func aggregationTemporality(t metricspb.AggregationTemporality) interface{} {
+	switch t {
+	case metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_DELTA:
+		return "delta"
+	case metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE:
+		return "cumulative"
+	}
+	return nil
+}
+
+// addOptional adds the sum, min and max of a histogram point to its data when they were recorded.
+func addOptional(data map[string]interface{}, sum, min, max *float64) {
+	for key, value := range map[string]*float64{"sum": sum, "min": min, "max": max} {
+		if value != nil {
+			data[key] = *value
+		}
+	}
+}
+
+// SpanKind is the kind of a span as it is stored: internal, server, client, producer or consumer.
+func SpanKind(kind tracepb.Span_SpanKind) string {
+	if kind == tracepb.Span_SPAN_KIND_UNSPECIFIED {
+		return "unspecified"
+	}
+	return strings.ToLower(strings.TrimPrefix(kind.String(), "SPAN_KIND_"))
+}
+
+// StatusCode is the status of a span as it is stored: unset, ok or error.
+func StatusCode(code tracepb.Status_StatusCode) string {
+	return strings.ToLower(strings.TrimPrefix(code.String(), "STATUS_CODE_"))
+}
+
+func durationMs(span *tracepb.Span) float64 {
+	if span.GetEndTimeUnixNano() < span.GetStartTimeUnixNano() {
+		return 0
+	}
+	return float64(span.GetEndTimeUnixNano()-span.GetStartTimeUnixNano()) / float64(time.Millisecond)
+}
+
+func spanEvents(events []*tracepb.Span_Event) []map[string]interface{} {
+	encoded := make([]map[string]interface{}, 0, len(events))
+	for _, event := range events {
+		encoded = append(encoded, map[string]interface{}{
+			"time_unix_nano": event.GetTimeUnixNano(),
+			"name":           event.GetName(),
+			"attributes":     Attributes(event.GetAttributes()),
+		})
+	}
+	return encoded
+}
+
+func spanLinks(links []*tracepb.Span_Link) []map[string]interface{} {
+	encoded := make([]map[string]interface{}, 0, len(links))
+	for _, link := range links {
+		encoded = append(encoded, map[string]interface{}{
+			"trace_id":    hex.EncodeToString(link.GetTraceId()),
+			"span_id":     hex.EncodeToString(link.GetSpanId()),
+			"trace_state": link.GetTraceState(),
+			"attributes":  Attributes(link.GetAttributes()),
+		})
+	}
+	return encoded
+}
+
+// Attributes returns OpenTelemetry attributes as a map from their keys to their values, as AnyValue returns them.
+func Attributes(kvs []*commonpb.KeyValue) map[string]interface{} {
+	attributes := make(map[string]interface{}, len(kvs))
+	for _, kv := range kvs {
+		attributes[kv.GetKey()] = AnyValue(kv.GetValue())
+	}
+	return attributes
+}
+
+// AnyValue returns an OpenTelemetry value as the Go value JSON encodes it as. Integers are int64, bytes []byte,
+// arrays []interface{} and key-value lists maps.
+func AnyValue(v *commonpb.AnyValue) interface{} {
+	switch value := v.GetValue().(type) {
+	case *commonpb.AnyValue_StringValue:
+		return value.StringValue
+	case *commonpb.AnyValue_BoolValue:
+		return value.BoolValue
+	case *commonpb.AnyValue_IntValue:
+		return value.IntValue
+	case *commonpb.AnyValue_DoubleValue:
+		return value.DoubleValue
+	case *commonpb.AnyValue_BytesValue:
+		return value.BytesValue
+	case *commonpb.AnyValue_ArrayValue:
+		values := make([]interface{}, 0, len(value.ArrayValue.GetValues()))
+		for _, element := range value.ArrayValue.GetValues() {
+			values = append(values, AnyValue(element))
+		}
+		return values
+	case *commonpb.AnyValue_KvlistValue:
+		return Attributes(value.KvlistValue.GetValues())
+	}
+	return nil
+}
+
+// timestamp formats Unix nanoseconds as the tables' timestamp columns are, so that telemetry sorts with the rest of
+// what the cluster captures.
+func timestamp(unixNano uint64) string {
+	return time.Unix(0, int64(unixNano)).UTC().Format(utils.TimestampFormat)
+}
+
+func encodeJSON(v interface{}) string {
+	encoded, _ := json.Marshal(v)
+	return string(encoded)
+}
+
+func nonNil[T any](values []T) []T {
+	if values == nil {
+		return []T{}
+	}
+	return values
+}
@@ -13,15 +13,27 @@ package parser
 import (
 	"fmt"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/antlr4-go/antlr/v4"
 	parser "github.com/asimihsan/virtual-cluster/generated/vcluster"
+	// Validate looks dependency types up in the registry, so the built-in types are registered wherever vcluster
+	// files are parsed.
+	_ "github.com/asimihsan/virtual-cluster/internal/dependencies/builtin"
+	"github.com/asimihsan/virtual-cluster/internal/mock"
+	"github.com/asimihsan/virtual-cluster/internal/proxy"
 	"github.com/asimihsan/virtual-cluster/internal/utils"
+	"github.com/asimihsan/virtual-cluster/pkg/dependencies"
+	"github.com/pkg/errors"
 )
 
 type VClusterAST struct {
 	Services            []VClusterServiceDefinitionAST
 	ManagedDependencies []VClusterManagedDependencyDefinitionAST
+	MockServices        []VClusterMockServiceDefinitionAST
+	Gateways            []VClusterGatewayDefinitionAST
+	Egress              *VClusterEgressDefinitionAST
 }
 
 func (a VClusterAST) Validate() error {
@@ -35,6 +47,21 @@ func (a VClusterAST) Validate() error {
 			return err
 		}
 	}
+	for _, mockService := range a.MockServices {
+		if err := mockService.Validate(); err != nil {
+			return err
+		}
+	}
+	for _, gateway := range a.Gateways {
+		if err := gateway.Validate(); err != nil {
+			return err
+		}
+	}
+	if a.Egress != nil {
+		if err := a.Egress.Validate(); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -50,12 +77,213 @@ type VClusterServiceDefinitionAST struct {
 	ProxyPort    *int
 	Dependencies []VClusterDependency
 	RunCommands  []string
+
+	// Mode is how the service is provided: ServiceModeRun starts it from RunCommands, and ServiceModeReplay answers
+	// its requests with the responses captured for it in Recording, the database of an earlier run.
+	Mode      *string
+	Recording *string
+
+	// Faults are injected by the proxy in front of the service, and can be changed at runtime through the manager.
+	Faults []proxy.FaultRule
+
+	// GRPC configures how the proxy decodes the messages of gRPC calls to the service.
+	GRPC *GRPCConfig
+
+	// ProxyTLS makes the proxy port serve TLS with a certificate from the cluster's local CA, while the service itself
+	// keeps serving plain HTTP.
+	ProxyTLS bool
+
+	// Metrics makes the substrate scrape the service's Prometheus metrics.
+	Metrics *MetricsConfig
+
+	// Limits caps what the service's processes may use.
+	Limits *LimitsConfig
+}
+
+// MinCPULimit is the smallest CPU limit the kernel accepts: a quota of 1ms in each 100ms period of cpu.max.
+const MinCPULimit = 0.01
+
+// LimitsConfig caps the memory, CPU and number of processes and threads of a service. A nil field is not capped.
+type LimitsConfig struct {
+	MemoryBytes *int64
+
+	// CPU is how many CPUs' worth of time the service may use, e.g. 1.5.
+	CPU *float64
+
+	Pids *int
+}
+
+// MetricsConfig is where and how often the substrate scrapes a service's metrics in the Prometheus text format. Port
+// defaults to the service port.
+type MetricsConfig struct {
+	Path     string
+	Port     *int
+	Interval time.Duration
+}
+
+const (
+	DefaultMetricsPath     = "/metrics"
+	DefaultMetricsInterval = 15 * time.Second
+)
+
+// GRPCConfig lists where the proxy finds the descriptors of a gRPC service: FileDescriptorSet files written by
+// protoc --include_imports --descriptor_set_out, and the service's own server reflection.
+type GRPCConfig struct {
+	DescriptorSets []string
+	Reflection     bool
 }
 
+const (
+	ServiceModeRun    = "run"
+	ServiceModeReplay = "replay"
+)
+
 func (v *VClusterServiceDefinitionAST) Validate() error {
 	if v.Name == "" {
 		return fmt.Errorf("service name is empty")
 	}
+	for _, fault := range v.Faults {
+		if err := fault.Validate(); err != nil {
+			return errors.Wrapf(err, "invalid fault rule: %s", v.Name)
+		}
+	}
+	if v.GRPC != nil && v.ProxyPort == nil {
+		return fmt.Errorf("grpc requires proxy_port, as calls are captured by the proxy: %s", v.Name)
+	}
+	if v.ProxyTLS && v.ProxyPort == nil {
+		return fmt.Errorf("proxy_tls requires proxy_port, as TLS is served by the proxy: %s", v.Name)
+	}
+	if v.Metrics != nil {
+		if !strings.HasPrefix(v.Metrics.Path, "/") {
+			return fmt.Errorf("metrics path must start with /: %s", v.Name)
+		}
+		if v.Metrics.Interval <= 0 {
+			return fmt.Errorf("metrics interval must be positive: %s", v.Name)
+		}
+		if v.Metrics.Port == nil && v.ServicePort == nil {
+			return fmt.Errorf("metrics requires service_port or a metrics port: %s", v.Name)
+		}
+		if v.IsReplay() {
+			return fmt.Errorf("metrics cannot be scraped from a replayed service: %s", v.Name)
+		}
+	}
+	if v.Limits != nil {
+		if v.Limits.MemoryBytes != nil && *v.Limits.MemoryBytes <= 0 {
+			return fmt.Errorf("memory limit must be positive: %s", v.Name)
+		}
+		if v.Limits.CPU != nil && *v.Limits.CPU < MinCPULimit {
+			return fmt.Errorf("cpu limit must be at least %g: %s", MinCPULimit, v.Name)
+		}
+		if v.Limits.Pids != nil && *v.Limits.Pids < 1 {
+			return fmt.Errorf("pids limit must be at least 1: %s", v.Name)
+		}
+		if v.IsReplay() {
+			return fmt.Errorf("limits cannot apply to a replayed service, which runs no processes: %s", v.Name)
+		}
+	}
+	if v.Mode == nil {
+		if v.Recording != nil {
+			return fmt.Errorf("recording requires mode = \"replay\": %s", v.Name)
+		}
+		return nil
+	}
+	switch *v.Mode {
+	case ServiceModeRun:
+		if v.Recording != nil {
+			return fmt.Errorf("recording requires mode = \"replay\": %s", v.Name)
+		}
+	case ServiceModeReplay:
+		if v.Recording == nil || *v.Recording == "" {
+			return fmt.Errorf("replay mode requires a recording: %s", v.Name)
+		}
+		if v.ServicePort == nil && v.ProxyPort == nil {
+			return fmt.Errorf("replay mode requires service_port or proxy_port: %s", v.Name)
+		}
+	default:
+		return fmt.Errorf("unknown service mode %q: %s", *v.Mode, v.Name)
+	}
+	return nil
+}
+
+// IsReplay returns whether the service is replayed from a recording instead of being run.
+func (v *VClusterServiceDefinitionAST) IsReplay() bool {
+	return v.Mode != nil && *v.Mode == ServiceModeReplay
+}
+
+// VClusterMockServiceDefinitionAST is an HTTP service served by the substrate itself from the routes declared in the
+// vcluster file, standing in for an API that is not run locally.
+type VClusterMockServiceDefinitionAST struct {
+	Name   string
+	Port   int
+	Routes []mock.Route
+}
+
+func (v *VClusterMockServiceDefinitionAST) Validate() error {
+	if v.Name == "" {
+		return fmt.Errorf("mock service name is empty")
+	}
+	if v.Port == 0 {
+		return fmt.Errorf("mock service port is missing: %s", v.Name)
+	}
+	for _, route := range v.Routes {
+		if err := route.Validate(); err != nil {
+			return errors.Wrapf(err, "invalid mock service: %s", v.Name)
+		}
+	}
+	return nil
+}
+
+// VClusterGatewayDefinitionAST is a single listener in front of several services, like a production API gateway.
+// Requests go to the service of the route whose Host matches theirs, and otherwise to the one with the longest Path
+// prefix.
+type VClusterGatewayDefinitionAST struct {
+	Port   int
+	Routes []GatewayRoute
+}
+
+// GatewayRoute sends requests for either a Host or a Path prefix to a service or mock service.
+type GatewayRoute struct {
+	Host    string
+	Path    string
+	Service string
+}
+
+func (v *VClusterGatewayDefinitionAST) Validate() error {
+	if v.Port == 0 {
+		return fmt.Errorf("gateway port is missing")
+	}
+	if len(v.Routes) == 0 {
+		return fmt.Errorf("gateway has no routes: %d", v.Port)
+	}
+	for _, route := range v.Routes {
+		if route.Path != "" && !strings.HasPrefix(route.Path, "/") {
+			return fmt.Errorf("gateway route must start with /: %s", route.Path)
+		}
+		if route.Host == "" && route.Path == "" {
+			return fmt.Errorf("gateway route for %s has neither a host nor a path", route.Service)
+		}
+	}
+	return nil
+}
+
+// VClusterEgressDefinitionAST is the forward proxy that managed processes send their outbound calls through, so
+// that they are captured and can be stubbed or blocked by Rules. With MITM set, HTTPS calls are intercepted with
+// certificates from the local CA rather than tunnelled.
+type VClusterEgressDefinitionAST struct {
+	Port  int
+	MITM  bool
+	Rules []proxy.EgressRule
+}
+
+func (v *VClusterEgressDefinitionAST) Validate() error {
+	if v.Port == 0 {
+		return fmt.Errorf("egress port is missing")
+	}
+	for _, rule := range v.Rules {
+		if err := rule.Validate(); err != nil {
+			return errors.Wrap(err, "invalid egress rule")
+		}
+	}
 	return nil
 }
 
@@ -68,25 +296,26 @@ type HealthCheck struct {
 }
 
 type VClusterManagedDependencyDefinitionAST struct {
-	Name              string
-	HealthChecks      HealthCheck
-	Dependencies      []VClusterDependency
-	ManagedKafka      *ManagedKafka
-	ManagedLocalstack *ManagedLocalstack
-}
-
-type ManagedKafka struct {
-	Port int
-}
+	Name         string
+	HealthChecks HealthCheck
+	Dependencies []VClusterDependency
 
-type ManagedLocalstack struct {
-	Port int
+	// Kind and Config are the dependency type and its settings, e.g. `managed_kafka { port = 9092 }`. The parser
+	// does not know the types; Validate looks Kind up in the dependency registry.
+	Kind   string
+	Config dependencies.Config
 }
 
 func (v *VClusterManagedDependencyDefinitionAST) Validate() error {
 	if v.Name == "" {
 		return fmt.Errorf("dependency name is empty")
 	}
+	if v.Kind == "" {
+		return fmt.Errorf("managed dependency %s has no type", v.Name)
+	}
+	if _, err := dependencies.New(v.Kind, v.Name, v.Config); err != nil {
+		return errors.Wrapf(err, "invalid managed dependency: %s", v.Name)
+	}
 	return nil
 }
 
@@ -94,6 +323,13 @@ type vclusterListener struct {
 	parser.BaseVClusterListener
 	ast   *VClusterAST
 	error error
+
+	// configs is the stack of generic dependency blocks being parsed, innermost last.
+	configs []dependencies.Config
+
+	// mockResponse is the mock route response that response settings apply to: the route defaults, or the
+	// `response` block being parsed.
+	mockResponse *mock.Response
 }
 
 func (l *vclusterListener) EnterVclusterConfig(ctx *parser.VclusterConfigContext) {
@@ -112,16 +348,188 @@ func (l *vclusterListener) EnterManagedDependencyEntry(ctx *parser.ManagedDepend
 	l.ast.ManagedDependencies = append(l.ast.ManagedDependencies, dependencyConfig)
 }
 
+func (l *vclusterListener) EnterMockServiceEntry(ctx *parser.MockServiceEntryContext) {
+	l.ast.MockServices = append(l.ast.MockServices, VClusterMockServiceDefinitionAST{})
+}
+
+func (l *vclusterListener) EnterGatewayEntry(ctx *parser.GatewayEntryContext) {
+	l.ast.Gateways = append(l.ast.Gateways, VClusterGatewayDefinitionAST{})
+}
+
+func (l *vclusterListener) currentGateway() *VClusterGatewayDefinitionAST {
+	return &l.ast.Gateways[len(l.ast.Gateways)-1]
+}
+
+func (l *vclusterListener) EnterGatewayConfigPort(ctx *parser.GatewayConfigPortContext) {
+	port := ctx.PORT()
+	if port == nil {
+		return
+	}
+	value, err := strconv.Atoi(port.GetText())
+	if err != nil {
+		l.error = err
+		return
+	}
+	l.currentGateway().Port = value
+}
+
+func (l *vclusterListener) EnterGatewayConfigRoute(ctx *parser.GatewayConfigRouteContext) {
+	path, service := ctx.STRING_LITERAL(), ctx.Name()
+	if path == nil || service == nil {
+		return
+	}
+	gateway := l.currentGateway()
+	gateway.Routes = append(gateway.Routes, GatewayRoute{
+		Path:    utils.HandleStringLiteral(path.GetText()),
+		Service: service.GetText(),
+	})
+}
+
+func (l *vclusterListener) EnterGatewayConfigHost(ctx *parser.GatewayConfigHostContext) {
+	host, service := ctx.STRING_LITERAL(), ctx.Name()
+	if host == nil || service == nil {
+		return
+	}
+	gateway := l.currentGateway()
+	gateway.Routes = append(gateway.Routes, GatewayRoute{
+		Host:    strings.ToLower(utils.HandleStringLiteral(host.GetText())),
+		Service: service.GetText(),
+	})
+}
+
+func (l *vclusterListener) EnterEgressEntry(ctx *parser.EgressEntryContext) {
+	if l.ast.Egress != nil {
+		l.error = fmt.Errorf("only one egress entry is allowed")
+		return
+	}
+	l.ast.Egress = &VClusterEgressDefinitionAST{}
+}
+
+func (l *vclusterListener) EnterEgressConfigPort(ctx *parser.EgressConfigPortContext) {
+	port := ctx.PORT()
+	if port == nil {
+		return
+	}
+	value, err := strconv.Atoi(port.GetText())
+	if err != nil {
+		l.error = err
+		return
+	}
+	l.ast.Egress.Port = value
+}
+
+func (l *vclusterListener) EnterEgressConfigMitm(ctx *parser.EgressConfigMitmContext) {
+	mitm := ctx.IDENTIFIER()
+	if mitm == nil {
+		return
+	}
+	value, err := strconv.ParseBool(mitm.GetText())
+	if err != nil {
+		l.error = fmt.Errorf("egress mitm must be true or false: %s", mitm.GetText())
+		return
+	}
+	l.ast.Egress.MITM = value
+}
+
+func (l *vclusterListener) EnterEgressConfigRule(ctx *parser.EgressConfigRuleContext) {
+	l.ast.Egress.Rules = append(l.ast.Egress.Rules, proxy.EgressRule{})
+}
+
+func (l *vclusterListener) currentEgressRule() *proxy.EgressRule {
+	return &l.ast.Egress.Rules[len(l.ast.Egress.Rules)-1]
+}
+
+func (l *vclusterListener) EnterEgressRuleConfigHost(ctx *parser.EgressRuleConfigHostContext) {
+	host := ctx.STRING_LITERAL()
+	if host == nil {
+		return
+	}
+	l.currentEgressRule().Host = utils.HandleStringLiteral(host.GetText())
+}
+
+func (l *vclusterListener) EnterEgressRuleConfigMethod(ctx *parser.EgressRuleConfigMethodContext) {
+	if method := ctx.STRING_LITERAL(); method != nil {
+		l.currentEgressRule().Method = strings.ToUpper(utils.HandleStringLiteral(method.GetText()))
+	} else if method := ctx.IDENTIFIER(); method != nil {
+		l.currentEgressRule().Method = strings.ToUpper(method.GetText())
+	}
+}
+
+func (l *vclusterListener) EnterEgressRuleConfigPath(ctx *parser.EgressRuleConfigPathContext) {
+	path := ctx.STRING_LITERAL()
+	if path == nil {
+		return
+	}
+	l.currentEgressRule().Path = utils.HandleStringLiteral(path.GetText())
+}
+
+func (l *vclusterListener) EnterEgressRuleConfigBlock(ctx *parser.EgressRuleConfigBlockContext) {
+	block := ctx.IDENTIFIER()
+	if block == nil {
+		return
+	}
+	value, err := strconv.ParseBool(block.GetText())
+	if err != nil {
+		l.error = fmt.Errorf("egress block must be true or false: %s", block.GetText())
+		return
+	}
+	l.currentEgressRule().Block = value
+}
+
+func (l *vclusterListener) EnterEgressRuleConfigStatus(ctx *parser.EgressRuleConfigStatusContext) {
+	status := ctx.PORT()
+	if status == nil {
+		return
+	}
+	value, err := strconv.Atoi(status.GetText())
+	if err != nil {
+		l.error = err
+		return
+	}
+	l.currentEgressRule().Status = value
+}
+
+func (l *vclusterListener) EnterEgressRuleConfigBody(ctx *parser.EgressRuleConfigBodyContext) {
+	body := ctx.STRING_LITERAL()
+	if body == nil {
+		return
+	}
+	l.currentEgressRule().Body = utils.HandleStringLiteral(body.GetText())
+}
+
+func (l *vclusterListener) EnterEgressRuleConfigHeader(ctx *parser.EgressRuleConfigHeaderContext) {
+	name, value := ctx.STRING_LITERAL(0), ctx.STRING_LITERAL(1)
+	if name == nil || value == nil {
+		return
+	}
+	rule := l.currentEgressRule()
+	if rule.Headers == nil {
+		rule.Headers = make(map[string]string)
+	}
+	key := utils.HandleStringLiteral(name.GetText())
+	rule.Headers[key] = utils.HandleStringLiteral(value.GetText())
+}
+
+func (l *vclusterListener) EnterMockServiceName(ctx *parser.MockServiceNameContext) {
+	if ctx.Name() == nil {
+		return
+	}
+	l.currentMockService().Name = ctx.Name().GetText()
+}
+
 func (l *vclusterListener) EnterServiceName(ctx *parser.ServiceNameContext) {
-	if ctx.IDENTIFIER() == nil {
+	if ctx.Name() == nil {
 		return
 	}
-	serviceName := ctx.IDENTIFIER().GetText()
+	serviceName := ctx.Name().GetText()
 	l.ast.Services[len(l.ast.Services)-1].Name = serviceName
 }
 
 func (l *vclusterListener) EnterDependencyName(ctx *parser.DependencyNameContext) {
-	dependencyName := ctx.IDENTIFIER().GetText()
+	if ctx.Name() == nil {
+		return
+	}
+	dependencyName := ctx.Name().GetText()
 	l.ast.ManagedDependencies[len(l.ast.ManagedDependencies)-1].Name = dependencyName
 }
 
@@ -201,6 +609,286 @@ func (l *vclusterListener) EnterServiceConfigProxyPort(ctx *parser.ServiceConfig
 	l.ast.Services[len(l.ast.Services)-1].ProxyPort = &value
 }
 
+func (l *vclusterListener) EnterServiceConfigMode(ctx *parser.ServiceConfigModeContext) {
+	mode := ctx.STRING_LITERAL()
+	if mode == nil {
+		return
+	}
+	value := utils.HandleStringLiteral(mode.GetText())
+	l.ast.Services[len(l.ast.Services)-1].Mode = &value
+}
+
+func (l *vclusterListener) EnterServiceConfigRecording(ctx *parser.ServiceConfigRecordingContext) {
+	recording := ctx.STRING_LITERAL()
+	if recording == nil {
+		return
+	}
+	value := utils.HandleStringLiteral(recording.GetText())
+	l.ast.Services[len(l.ast.Services)-1].Recording = &value
+}
+
+func (l *vclusterListener) currentFault() *proxy.FaultRule {
+	service := &l.ast.Services[len(l.ast.Services)-1]
+	return &service.Faults[len(service.Faults)-1]
+}
+
+func (l *vclusterListener) EnterServiceConfigFault(ctx *parser.ServiceConfigFaultContext) {
+	service := &l.ast.Services[len(l.ast.Services)-1]
+	service.Faults = append(service.Faults, proxy.FaultRule{})
+}
+
+func (l *vclusterListener) EnterFaultConfigMethod(ctx *parser.FaultConfigMethodContext) {
+	if method := ctx.STRING_LITERAL(); method != nil {
+		l.currentFault().Method = strings.ToUpper(utils.HandleStringLiteral(method.GetText()))
+	} else if method := ctx.IDENTIFIER(); method != nil {
+		l.currentFault().Method = strings.ToUpper(method.GetText())
+	}
+}
+
+func (l *vclusterListener) EnterFaultConfigPath(ctx *parser.FaultConfigPathContext) {
+	path := ctx.STRING_LITERAL()
+	if path == nil {
+		return
+	}
+	l.currentFault().Path = utils.HandleStringLiteral(path.GetText())
+}
+
+func (l *vclusterListener) EnterFaultConfigPercentage(ctx *parser.FaultConfigPercentageContext) {
+	var text string
+	if percentage := ctx.PORT(); percentage != nil {
+		text = percentage.GetText()
+	} else if percentage := ctx.STRING_LITERAL(); percentage != nil {
+		text = utils.HandleStringLiteral(percentage.GetText())
+	}
+	value, err := strconv.ParseFloat(text, 64)
+	if err != nil {
+		l.error = errors.Wrapf(err, "invalid fault percentage: %s", text)
+		return
+	}
+	l.currentFault().Percentage = &value
+}
+
+func (l *vclusterListener) EnterFaultConfigStatus(ctx *parser.FaultConfigStatusContext) {
+	status := ctx.PORT()
+	if status == nil {
+		return
+	}
+	value, err := strconv.Atoi(status.GetText())
+	if err != nil {
+		l.error = err
+		return
+	}
+	l.currentFault().Status = value
+}
+
+func (l *vclusterListener) EnterFaultConfigReset(ctx *parser.FaultConfigResetContext) {
+	reset := ctx.IDENTIFIER()
+	if reset == nil {
+		return
+	}
+	value, err := strconv.ParseBool(reset.GetText())
+	if err != nil {
+		l.error = fmt.Errorf("fault reset must be true or false: %s", reset.GetText())
+		return
+	}
+	l.currentFault().Reset = value
+}
+
+func (l *vclusterListener) EnterServiceConfigGrpc(ctx *parser.ServiceConfigGrpcContext) {
+	l.ast.Services[len(l.ast.Services)-1].GRPC = &GRPCConfig{}
+}
+
+func (l *vclusterListener) EnterGrpcConfigDescriptorSet(ctx *parser.GrpcConfigDescriptorSetContext) {
+	descriptorSet := ctx.STRING_LITERAL()
+	if descriptorSet == nil {
+		return
+	}
+	config := l.ast.Services[len(l.ast.Services)-1].GRPC
+	config.DescriptorSets = append(config.DescriptorSets, utils.HandleStringLiteral(descriptorSet.GetText()))
+}
+
+func (l *vclusterListener) EnterGrpcConfigReflection(ctx *parser.GrpcConfigReflectionContext) {
+	reflection := ctx.IDENTIFIER()
+	if reflection == nil {
+		return
+	}
+	value, err := strconv.ParseBool(reflection.GetText())
+	if err != nil {
+		l.error = fmt.Errorf("grpc reflection must be true or false: %s", reflection.GetText())
+		return
+	}
+	l.ast.Services[len(l.ast.Services)-1].GRPC.Reflection = value
+}
+
+func (l *vclusterListener) EnterServiceConfigProxyTls(ctx *parser.ServiceConfigProxyTlsContext) {
+	proxyTLS := ctx.IDENTIFIER()
+	if proxyTLS == nil {
+		return
+	}
+	value, err := strconv.ParseBool(proxyTLS.GetText())
+	if err != nil {
+		l.error = fmt.Errorf("proxy_tls must be true or false: %s", proxyTLS.GetText())
+		return
+	}
+	l.ast.Services[len(l.ast.Services)-1].ProxyTLS = value
+}
+
+func (l *vclusterListener) EnterServiceConfigMetrics(ctx *parser.ServiceConfigMetricsContext) {
+	l.ast.Services[len(l.ast.Services)-1].Metrics = &MetricsConfig{
+		Path:     DefaultMetricsPath,
+		Interval: DefaultMetricsInterval,
+	}
+}
+
+func (l *vclusterListener) EnterMetricsConfigPath(ctx *parser.MetricsConfigPathContext) {
+	path := ctx.STRING_LITERAL()
+	if path == nil {
+		return
+	}
+	l.ast.Services[len(l.ast.Services)-1].Metrics.Path = utils.HandleStringLiteral(path.GetText())
+}
+
+func (l *vclusterListener) EnterMetricsConfigPort(ctx *parser.MetricsConfigPortContext) {
+	port := ctx.PORT()
+	if port == nil {
+		return
+	}
+	value, err := strconv.Atoi(port.GetText())
+	if err != nil {
+		l.error = err
+		return
+	}
+	l.ast.Services[len(l.ast.Services)-1].Metrics.Port = &value
+}
+
+func (l *vclusterListener) EnterMetricsConfigInterval(ctx *parser.MetricsConfigIntervalContext) {
+	interval := ctx.STRING_LITERAL()
+	if interval == nil {
+		return
+	}
+	text := utils.HandleStringLiteral(interval.GetText())
+	value, err := time.ParseDuration(text)
+	if err != nil {
+		l.error = errors.Wrapf(err, "invalid metrics interval: %s", text)
+		return
+	}
+	l.ast.Services[len(l.ast.Services)-1].Metrics.Interval = value
+}
+
+func (l *vclusterListener) EnterServiceConfigLimits(ctx *parser.ServiceConfigLimitsContext) {
+	l.ast.Services[len(l.ast.Services)-1].Limits = &LimitsConfig{}
+}
+
+func (l *vclusterListener) EnterLimitsConfigMemory(ctx *parser.LimitsConfigMemoryContext) {
+	var text string
+	if memory := ctx.PORT(); memory != nil {
+		text = memory.GetText()
+	} else if memory := ctx.STRING_LITERAL(); memory != nil {
+		text = utils.HandleStringLiteral(memory.GetText())
+	}
+	value, err := ParseByteSize(text)
+	if err != nil {
+		l.error = errors.Wrapf(err, "invalid memory limit: %s", text)
+		return
+	}
+	l.ast.Services[len(l.ast.Services)-1].Limits.MemoryBytes = &value
+}
+
+func (l *vclusterListener) EnterLimitsConfigCpu(ctx *parser.LimitsConfigCpuContext) {
+	var text string
+	if cpu := ctx.DECIMAL(); cpu != nil {
+		text = cpu.GetText()
+	} else if cpu := ctx.PORT(); cpu != nil {
+		text = cpu.GetText()
+	}
+	value, err := strconv.ParseFloat(text, 64)
+	if err != nil {
+		l.error = errors.Wrapf(err, "invalid cpu limit: %s", text)
+		return
+	}
+	l.ast.Services[len(l.ast.Services)-1].Limits.CPU = &value
+}
+
+func (l *vclusterListener) EnterLimitsConfigPids(ctx *parser.LimitsConfigPidsContext) {
+	pids := ctx.PORT()
+	if pids == nil {
+		return
+	}
+	value, err := strconv.Atoi(pids.GetText())
+	if err != nil {
+		l.error = err
+		return
+	}
+	l.ast.Services[len(l.ast.Services)-1].Limits.Pids = &value
+}
+
+// byteSizeUnits are the suffixes of byte sizes, in the binary and decimal forms Kubernetes quantities use.
+var byteSizeUnits = []struct {
+	suffix     string
+	multiplier int64
+}{
+	{"Ki", 1 << 10}, {"Mi", 1 << 20}, {"Gi", 1 << 30}, {"Ti", 1 << 40},
+	{"K", 1e3}, {"k", 1e3}, {"M", 1e6}, {"G", 1e9}, {"T", 1e12},
+}
+
+// ParseByteSize parses a size in bytes such as 512Mi, 1G or 1048576.
+func ParseByteSize(text string) (int64, error) {
+	number, multiplier := text, int64(1)
+	for _, unit := range byteSizeUnits {
+		if strings.HasSuffix(text, unit.suffix) {
+			number, multiplier = strings.TrimSuffix(text, unit.suffix), unit.multiplier
+			break
+		}
+	}
+	value, err := strconv.ParseFloat(number, 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("expected a number of bytes with an optional unit such as Mi or G")
+	}
+	return int64(value * float64(multiplier)), nil
+}
+
+func (l *vclusterListener) EnterFaultConfigTruncateBytes(ctx *parser.FaultConfigTruncateBytesContext) {
+	truncateBytes := ctx.PORT()
+	if truncateBytes == nil {
+		return
+	}
+	value, err := strconv.Atoi(truncateBytes.GetText())
+	if err != nil {
+		l.error = err
+		return
+	}
+	l.currentFault().TruncateBytes = &value
+}
+
+func (l *vclusterListener) EnterFaultConfigLatency(ctx *parser.FaultConfigLatencyContext) {
+	l.currentFault().Latency = &proxy.LatencyFault{}
+}
+
+func (l *vclusterListener) EnterFaultLatencyConfigItem(ctx *parser.FaultLatencyConfigItemContext) {
+	key, milliseconds := ctx.FaultLatencyKey(), ctx.PORT()
+	if key == nil || milliseconds == nil {
+		return
+	}
+	value, err := strconv.Atoi(milliseconds.GetText())
+	if err != nil {
+		l.error = err
+		return
+	}
+	latency := l.currentFault().Latency
+	switch key.GetText() {
+	case "fixed_ms":
+		latency.FixedMs = &value
+	case "min_ms":
+		latency.MinMs = &value
+	case "max_ms":
+		latency.MaxMs = &value
+	case "mean_ms":
+		latency.MeanMs = &value
+	case "stddev_ms":
+		latency.StddevMs = &value
+	}
+}
+
 func (l *vclusterListener) EnterServiceConfigDependency(ctx *parser.ServiceConfigDependencyContext) {}
 
 func (l *vclusterListener) EnterDependencyConfigDependency(ctx *parser.ManagedDependencyConfigDependencyContext) {
@@ -230,14 +918,16 @@ func (l *vclusterListener) EnterServiceConfigRunCommands(ctx *parser.ServiceConf
 	}
 }
 
-// EnterDependencyConfigManagedKafka is called when production dependencyConfigManagedKafka is entered.
-func (l *vclusterListener) EnterManagedDependencyConfigManagedKafka(ctx *parser.ManagedDependencyConfigManagedKafkaContext) {
-	managedKafka := &ManagedKafka{}
-	l.ast.ManagedDependencies[len(l.ast.ManagedDependencies)-1].ManagedKafka = managedKafka
+func (l *vclusterListener) currentMockService() *VClusterMockServiceDefinitionAST {
+	return &l.ast.MockServices[len(l.ast.MockServices)-1]
+}
+
+func (l *vclusterListener) currentMockRoute() *mock.Route {
+	mockService := l.currentMockService()
+	return &mockService.Routes[len(mockService.Routes)-1]
 }
 
-// EnterManagedKafkaConfigPort is called when production managedKafkaConfigPort is entered.
-func (l *vclusterListener) EnterManagedKafkaConfigPort(ctx *parser.ManagedKafkaConfigPortContext) {
+func (l *vclusterListener) EnterMockServiceConfigPort(ctx *parser.MockServiceConfigPortContext) {
 	port := ctx.PORT()
 	if port == nil {
 		return
@@ -247,25 +937,223 @@ func (l *vclusterListener) EnterManagedKafkaConfigPort(ctx *parser.ManagedKafkaC
 		l.error = err
 		return
 	}
-	l.ast.ManagedDependencies[len(l.ast.ManagedDependencies)-1].ManagedKafka.Port = value
+	l.currentMockService().Port = value
 }
 
-func (l *vclusterListener) EnterManagedDependencyConfigManagedLocalstack(ctx *parser.ManagedDependencyConfigManagedLocalstackContext) {
-	managedLocalstack := &ManagedLocalstack{}
-	l.ast.ManagedDependencies[len(l.ast.ManagedDependencies)-1].ManagedLocalstack = managedLocalstack
+func (l *vclusterListener) EnterMockServiceConfigRoute(ctx *parser.MockServiceConfigRouteContext) {
+	// The route is added even if its method or path failed to parse, as the settings in its block refer to it.
+	route := mock.Route{}
+	if method := ctx.IDENTIFIER(); method != nil {
+		route.Method = method.GetText()
+	}
+	if path := ctx.STRING_LITERAL(); path != nil {
+		route.Path = utils.HandleStringLiteral(path.GetText())
+	}
+	mockService := l.currentMockService()
+	mockService.Routes = append(mockService.Routes, route)
+	l.mockResponse = &l.currentMockRoute().Response
 }
 
-func (l *vclusterListener) EnterManagedLocalstackConfigPort(ctx *parser.ManagedLocalstackConfigPortContext) {
-	port := ctx.PORT()
-	if port == nil {
+func (l *vclusterListener) EnterMockRouteConfigWhenState(ctx *parser.MockRouteConfigWhenStateContext) {
+	state := ctx.STRING_LITERAL()
+	if state == nil {
 		return
 	}
-	value, err := strconv.Atoi(port.GetText())
+	value := utils.HandleStringLiteral(state.GetText())
+	l.currentMockRoute().WhenState = &value
+}
+
+func (l *vclusterListener) EnterMockRouteConfigSetState(ctx *parser.MockRouteConfigSetStateContext) {
+	state := ctx.STRING_LITERAL()
+	if state == nil {
+		return
+	}
+	value := utils.HandleStringLiteral(state.GetText())
+	l.currentMockRoute().SetState = &value
+}
+
+func (l *vclusterListener) EnterMockRouteConfigResponse(ctx *parser.MockRouteConfigResponseContext) {
+	route := l.currentMockRoute()
+	route.Responses = append(route.Responses, mock.Response{})
+	l.mockResponse = &route.Responses[len(route.Responses)-1]
+}
+
+func (l *vclusterListener) ExitMockRouteConfigResponse(ctx *parser.MockRouteConfigResponseContext) {
+	l.mockResponse = &l.currentMockRoute().Response
+}
+
+func (l *vclusterListener) EnterMockResponseConfigStatus(ctx *parser.MockResponseConfigStatusContext) {
+	status := ctx.PORT()
+	if status == nil {
+		return
+	}
+	value, err := strconv.Atoi(status.GetText())
 	if err != nil {
 		l.error = err
 		return
 	}
-	l.ast.ManagedDependencies[len(l.ast.ManagedDependencies)-1].ManagedLocalstack.Port = value
+	l.mockResponse.Status = &value
+}
+
+func (l *vclusterListener) EnterMockResponseConfigBody(ctx *parser.MockResponseConfigBodyContext) {
+	body := ctx.STRING_LITERAL()
+	if body == nil {
+		return
+	}
+	value := utils.HandleStringLiteral(body.GetText())
+	l.mockResponse.Body = &value
+}
+
+func (l *vclusterListener) EnterMockResponseConfigBodyFile(ctx *parser.MockResponseConfigBodyFileContext) {
+	bodyFile := ctx.STRING_LITERAL()
+	if bodyFile == nil {
+		return
+	}
+	value := utils.HandleStringLiteral(bodyFile.GetText())
+	l.mockResponse.BodyFile = &value
+}
+
+func (l *vclusterListener) EnterMockResponseConfigDelayMs(ctx *parser.MockResponseConfigDelayMsContext) {
+	delay := ctx.PORT()
+	if delay == nil {
+		return
+	}
+	value, err := strconv.Atoi(delay.GetText())
+	if err != nil {
+		l.error = err
+		return
+	}
+	l.mockResponse.DelayMs = &value
+}
+
+func (l *vclusterListener) EnterMockResponseConfigHeader(ctx *parser.MockResponseConfigHeaderContext) {
+	key, value := ctx.STRING_LITERAL(0), ctx.STRING_LITERAL(1)
+	if key == nil || value == nil {
+		return
+	}
+	if l.mockResponse.Headers == nil {
+		l.mockResponse.Headers = map[string]string{}
+	}
+	name := utils.HandleStringLiteral(key.GetText())
+	l.mockResponse.Headers[name] = utils.HandleStringLiteral(value.GetText())
+}
+
+func (l *vclusterListener) EnterMockMatchConfigHeader(ctx *parser.MockMatchConfigHeaderContext) {
+	key, value := ctx.STRING_LITERAL(0), ctx.STRING_LITERAL(1)
+	if key == nil || value == nil {
+		return
+	}
+	match := &l.currentMockRoute().Match
+	if match.Headers == nil {
+		match.Headers = map[string]string{}
+	}
+	name := utils.HandleStringLiteral(key.GetText())
+	match.Headers[name] = utils.HandleStringLiteral(value.GetText())
+}
+
+func (l *vclusterListener) EnterMockMatchConfigQuery(ctx *parser.MockMatchConfigQueryContext) {
+	key, value := ctx.STRING_LITERAL(0), ctx.STRING_LITERAL(1)
+	if key == nil || value == nil {
+		return
+	}
+	match := &l.currentMockRoute().Match
+	if match.Query == nil {
+		match.Query = map[string]string{}
+	}
+	name := utils.HandleStringLiteral(key.GetText())
+	match.Query[name] = utils.HandleStringLiteral(value.GetText())
+}
+
+func (l *vclusterListener) EnterMockMatchConfigBodyContains(ctx *parser.MockMatchConfigBodyContainsContext) {
+	bodyContains := ctx.STRING_LITERAL()
+	if bodyContains == nil {
+		return
+	}
+	value := utils.HandleStringLiteral(bodyContains.GetText())
+	l.currentMockRoute().Match.BodyContains = &value
+}
+
+func (l *vclusterListener) EnterMockMatchConfigBodyJson(ctx *parser.MockMatchConfigBodyJsonContext) {
+	bodyJSON := ctx.STRING_LITERAL()
+	if bodyJSON == nil {
+		return
+	}
+	value := utils.HandleStringLiteral(bodyJSON.GetText())
+	l.currentMockRoute().Match.BodyJSON = &value
+}
+
+func (l *vclusterListener) EnterManagedDependencyConfigGeneric(ctx *parser.ManagedDependencyConfigGenericContext) {
+	config := dependencies.Config{}
+	l.configs = append(l.configs, config)
+	kind := ctx.IDENTIFIER()
+	if kind == nil {
+		return
+	}
+	dependency := &l.ast.ManagedDependencies[len(l.ast.ManagedDependencies)-1]
+	if dependency.Kind != "" {
+		l.error = fmt.Errorf("managed dependency %s has more than one type: %s and %s",
+			dependency.Name, dependency.Kind, kind.GetText())
+		return
+	}
+	dependency.Kind = kind.GetText()
+	dependency.Config = config
+}
+
+func (l *vclusterListener) ExitManagedDependencyConfigGeneric(ctx *parser.ManagedDependencyConfigGenericContext) {
+	l.configs = l.configs[:len(l.configs)-1]
+}
+
+func (l *vclusterListener) EnterDependencySettingAssignment(ctx *parser.DependencySettingAssignmentContext) {
+	key, value := ctx.DependencySettingKey(), ctx.DependencySettingValue()
+	if key == nil || value == nil {
+		return
+	}
+	config := l.configs[len(l.configs)-1]
+	switch {
+	case value.STRING_LITERAL() != nil:
+		config[key.GetText()] = utils.HandleStringLiteral(value.STRING_LITERAL().GetText())
+	case value.PORT() != nil:
+		number, err := strconv.Atoi(value.PORT().GetText())
+		if err != nil {
+			l.error = err
+			return
+		}
+		config[key.GetText()] = number
+	case value.DECIMAL() != nil:
+		config[key.GetText()] = value.DECIMAL().GetText()
+	case value.IDENTIFIER() != nil || value.SoftKeyword() != nil:
+		switch word := value.GetText(); word {
+		case "true", "false":
+			config[key.GetText()] = word == "true"
+		default:
+			config[key.GetText()] = word
+		}
+	case value.StringList() != nil:
+		config[key.GetText()] = stringListValues(value.StringList())
+	}
+}
+
+func (l *vclusterListener) EnterDependencySettingBlock(ctx *parser.DependencySettingBlockContext) {
+	block := dependencies.Config{}
+	if key := ctx.DependencySettingKey(); key != nil {
+		l.configs[len(l.configs)-1][key.GetText()] = block
+	}
+	l.configs = append(l.configs, block)
+}
+
+func (l *vclusterListener) ExitDependencySettingBlock(ctx *parser.DependencySettingBlockContext) {
+	l.configs = l.configs[:len(l.configs)-1]
+}
+
+func stringListValues(ctx parser.IStringListContext) []string {
+	if ctx == nil {
+		return nil
+	}
+	var values []string
+	for _, item := range ctx.AllSTRING_LITERAL() {
+		values = append(values, utils.HandleStringLiteral(item.GetText()))
+	}
+	return values
 }
 
 type vclusterErrorListenerType struct {
@@ -11,8 +11,17 @@
 package parser
 
 import (
+	"fmt"
 	"testing"
+	"time"
 
+	"github.com/asimihsan/virtual-cluster/internal/dependencies/container"
+	"github.com/asimihsan/virtual-cluster/internal/dependencies/postgres"
+	"github.com/asimihsan/virtual-cluster/internal/dependencies/redis"
+	"github.com/asimihsan/virtual-cluster/internal/dependencies/smtp"
+	"github.com/asimihsan/virtual-cluster/internal/mock"
+	"github.com/asimihsan/virtual-cluster/internal/proxy"
+	"github.com/asimihsan/virtual-cluster/pkg/dependencies"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -171,3 +180,845 @@ managed_dependency kafka {
 	_, err := ParseVCluster(input)
 	assert.NoError(t, err)
 }
+
+func TestParseVCluster_ManagedContainer(t *testing.T) {
+	input := `
+managed_dependency postgres {
+    managed_container {
+        image = "postgres:15"
+        ports = ["5432:5432"]
+        env = ["POSTGRES_PASSWORD=postgres", "POSTGRES_DB=orders"]
+        volumes = ["./data:/var/lib/postgresql/data"]
+        command = ["postgres", "-c", "log_statement=all"]
+        healthcheck {
+            command = "pg_isready -U postgres"
+        }
+    }
+}
+`
+
+	ast, err := ParseVCluster(input)
+	assert.NoError(t, err)
+
+	expected := &VClusterAST{
+		ManagedDependencies: []VClusterManagedDependencyDefinitionAST{
+			{
+				Name: "postgres",
+				Kind: container.Kind,
+				Config: dependencies.Config{
+					"image":       "postgres:15",
+					"ports":       []string{"5432:5432"},
+					"env":         []string{"POSTGRES_PASSWORD=postgres", "POSTGRES_DB=orders"},
+					"volumes":     []string{"./data:/var/lib/postgresql/data"},
+					"command":     []string{"postgres", "-c", "log_statement=all"},
+					"healthcheck": dependencies.Config{"command": "pg_isready -U postgres"},
+				},
+			},
+		},
+	}
+
+	assert.Equal(t, expected, ast)
+}
+
+func TestParseVCluster_ManagedContainerWithoutImage_IsError(t *testing.T) {
+	input := `
+managed_dependency redis {
+    managed_container {
+        ports = ["6379:6379"]
+    }
+}
+`
+
+	_, err := ParseVCluster(input)
+	assert.Error(t, err)
+}
+
+type memcachedDependency struct {
+	dependencies.Compose
+}
+
+func (m *memcachedDependency) Render(dir string) error              { return nil }
+func (m *memcachedDependency) Wait() error                          { return nil }
+func (m *memcachedDependency) ConnectionInfo() map[string]string    { return nil }
+func (m *memcachedDependency) Observe(host dependencies.Host) error { return nil }
+
+func TestParseVCluster_GenericManagedDependency(t *testing.T) {
+	dependencies.Register("managed_memcached", func(name string, config dependencies.Config) (dependencies.ManagedDependency, error) {
+		if err := config.CheckKeys("port", "image", "healthcheck"); err != nil {
+			return nil, err
+		}
+		return &memcachedDependency{Compose: dependencies.Compose{DependencyName: name}}, nil
+	})
+
+	input := `
+managed_dependency cache {
+    managed_memcached {
+        port = 11211
+        image = "memcached:1.6"
+        healthcheck {
+            port = 11211
+        }
+    }
+}
+`
+
+	ast, err := ParseVCluster(input)
+	assert.NoError(t, err)
+
+	expected := &VClusterAST{
+		ManagedDependencies: []VClusterManagedDependencyDefinitionAST{
+			{
+				Name: "cache",
+				Kind: "managed_memcached",
+				Config: dependencies.Config{
+					"port":        11211,
+					"image":       "memcached:1.6",
+					"healthcheck": dependencies.Config{"port": 11211},
+				},
+			},
+		},
+	}
+
+	assert.Equal(t, expected, ast)
+}
+
+func TestParseVCluster_GenericManagedDependencySettings(t *testing.T) {
+	dependencies.Register("managed_search", func(name string, config dependencies.Config) (dependencies.ManagedDependency, error) {
+		return &memcachedDependency{Compose: dependencies.Compose{DependencyName: name}}, nil
+	})
+
+	input := `
+managed_dependency search {
+    managed_search {
+        repository = "https://example.com/search.git"
+        version = 15.4
+        enabled = true
+        mode = block
+        match {
+            path = "/"
+        }
+    }
+}
+`
+
+	ast, err := ParseVCluster(input)
+	assert.NoError(t, err)
+
+	expected := dependencies.Config{
+		"repository": "https://example.com/search.git",
+		"version":    "15.4",
+		"enabled":    true,
+		"mode":       "block",
+		"match":      dependencies.Config{"path": "/"},
+	}
+	assert.Equal(t, expected, ast.ManagedDependencies[0].Config)
+}
+
+func TestParseVCluster_ManagedDependencyWithTwoTypes_IsError(t *testing.T) {
+	input := `
+managed_dependency cache {
+    managed_redis {
+        port = 6379
+    }
+    managed_container {
+        image = "redis:7"
+    }
+}
+`
+
+	_, err := ParseVCluster(input)
+	assert.EqualError(t, err, "managed dependency cache has more than one type: managed_redis and managed_container")
+}
+
+func TestParseVCluster_UnknownManagedDependency_IsError(t *testing.T) {
+	input := `
+managed_dependency cache {
+    managed_unknown {
+        port = 11211
+    }
+}
+`
+
+	_, err := ParseVCluster(input)
+	assert.Error(t, err)
+}
+
+func TestParseVCluster_ManagedPostgres(t *testing.T) {
+	input := `
+managed_dependency postgres {
+    managed_postgres {
+        port = 5432
+        version = 15
+        databases = ["orders", "payments"]
+        init_sql = "./schema.sql"
+    }
+}
+`
+
+	ast, err := ParseVCluster(input)
+	assert.NoError(t, err)
+
+	expected := &VClusterAST{
+		ManagedDependencies: []VClusterManagedDependencyDefinitionAST{
+			{
+				Name: "postgres",
+				Kind: postgres.Kind,
+				Config: dependencies.Config{
+					"port":      5432,
+					"version":   15,
+					"databases": []string{"orders", "payments"},
+					"init_sql":  "./schema.sql",
+				},
+			},
+		},
+	}
+
+	assert.Equal(t, expected, ast)
+}
+
+func TestParseVCluster_ManagedRedis(t *testing.T) {
+	input := `
+managed_dependency cache {
+    managed_redis {
+        port = 6379
+    }
+}
+`
+
+	ast, err := ParseVCluster(input)
+	assert.NoError(t, err)
+
+	expected := &VClusterAST{
+		ManagedDependencies: []VClusterManagedDependencyDefinitionAST{
+			{
+				Name:   "cache",
+				Kind:   redis.Kind,
+				Config: dependencies.Config{"port": 6379},
+			},
+		},
+	}
+
+	assert.Equal(t, expected, ast)
+}
+
+func TestParseVCluster_ManagedSMTP(t *testing.T) {
+	input := `
+managed_dependency mail {
+    managed_smtp {
+        port = 2525
+    }
+}
+`
+
+	ast, err := ParseVCluster(input)
+	assert.NoError(t, err)
+
+	expected := &VClusterAST{
+		ManagedDependencies: []VClusterManagedDependencyDefinitionAST{
+			{
+				Name:   "mail",
+				Kind:   smtp.Kind,
+				Config: dependencies.Config{"port": 2525},
+			},
+		},
+	}
+
+	assert.Equal(t, expected, ast)
+}
+
+func TestParseVCluster_MockService(t *testing.T) {
+	input := `
+mock_service users {
+    port = 9001
+    route GET "/users/{id}" {
+        status = 200
+        body_file = "./fixtures/user.json"
+        delay_ms = 50
+        header "Content-Type" = "application/json"
+    }
+    route POST "/users" {
+        match {
+            header "X-Tenant" = "acme"
+            body_json = "{\"role\": \"admin\"}"
+        }
+        set_state = "created"
+        response {
+            status = 201
+            body = "{\"id\": 1}"
+        }
+        response {
+            status = 409
+        }
+    }
+}
+`
+
+	ast, err := ParseVCluster(input)
+	assert.NoError(t, err)
+
+	status200, status201, status409, delay := 200, 201, 409, 50
+	bodyFile, body := "./fixtures/user.json", `{"id": 1}`
+	bodyJSON, state := `{"role": "admin"}`, "created"
+	expected := &VClusterAST{
+		MockServices: []VClusterMockServiceDefinitionAST{
+			{
+				Name: "users",
+				Port: 9001,
+				Routes: []mock.Route{
+					{
+						Method: "GET",
+						Path:   "/users/{id}",
+						Response: mock.Response{
+							Status:   &status200,
+							Headers:  map[string]string{"Content-Type": "application/json"},
+							BodyFile: &bodyFile,
+							DelayMs:  &delay,
+						},
+					},
+					{
+						Method: "POST",
+						Path:   "/users",
+						Match: mock.Match{
+							Headers:  map[string]string{"X-Tenant": "acme"},
+							BodyJSON: &bodyJSON,
+						},
+						SetState: &state,
+						Responses: []mock.Response{
+							{Status: &status201, Body: &body},
+							{Status: &status409},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	assert.Equal(t, expected, ast)
+}
+
+func TestParseVCluster_MockServiceWithoutPort_IsError(t *testing.T) {
+	input := `
+mock_service users {
+    route GET "/users" {
+        status = 200
+    }
+}
+`
+
+	_, err := ParseVCluster(input)
+	assert.Error(t, err)
+}
+
+func TestParseVCluster_ReplayService(t *testing.T) {
+	input := `
+service rates {
+    proxy_port = 9002
+    mode = "replay"
+    recording = "./recordings/rates.db"
+}
+`
+
+	ast, err := ParseVCluster(input)
+	assert.NoError(t, err)
+
+	proxyPort, mode, recording := 9002, "replay", "./recordings/rates.db"
+	expected := &VClusterAST{
+		Services: []VClusterServiceDefinitionAST{
+			{
+				Name:      "rates",
+				ProxyPort: &proxyPort,
+				Mode:      &mode,
+				Recording: &recording,
+			},
+		},
+	}
+
+	assert.Equal(t, expected, ast)
+	assert.True(t, ast.Services[0].IsReplay())
+}
+
+func TestParseVCluster_ReplayServiceWithoutRecording_IsError(t *testing.T) {
+	input := `
+service rates {
+    proxy_port = 9002
+    mode = "replay"
+}
+`
+
+	_, err := ParseVCluster(input)
+	assert.Error(t, err)
+}
+
+func TestParseVCluster_ServiceFaults(t *testing.T) {
+	input := `
+service orders {
+    service_port = 8080
+    proxy_port = 9080
+    fault {
+        method = GET
+        path = "/orders/*"
+        percentage = "12.5"
+        status = 503
+    }
+    fault {
+        path = "/orders/**"
+        latency {
+            min_ms = 50
+            max_ms = 200
+        }
+    }
+    fault {
+        reset = true
+        percentage = 5
+    }
+}
+`
+
+	ast, err := ParseVCluster(input)
+	assert.NoError(t, err)
+
+	servicePort, proxyPort := 8080, 9080
+	statusPercentage, resetPercentage := 12.5, 5.0
+	minMs, maxMs := 50, 200
+	expected := &VClusterAST{
+		Services: []VClusterServiceDefinitionAST{
+			{
+				Name:        "orders",
+				ServicePort: &servicePort,
+				ProxyPort:   &proxyPort,
+				Faults: []proxy.FaultRule{
+					{Method: "GET", Path: "/orders/*", Percentage: &statusPercentage, Status: 503},
+					{Path: "/orders/**", Latency: &proxy.LatencyFault{MinMs: &minMs, MaxMs: &maxMs}},
+					{Reset: true, Percentage: &resetPercentage},
+				},
+			},
+		},
+	}
+
+	assert.Equal(t, expected, ast)
+}
+
+func TestParseVCluster_FaultWithoutEffect_IsError(t *testing.T) {
+	input := `
+service orders {
+    fault {
+        path = "/orders"
+    }
+}
+`
+
+	_, err := ParseVCluster(input)
+	assert.Error(t, err)
+}
+
+func TestParseVCluster_ServiceGRPC(t *testing.T) {
+	input := `
+service payments {
+    service_port = 50051
+    proxy_port = 50061
+    grpc {
+        descriptor_set = "protos/payments.pb"
+        descriptor_set = "protos/common.pb"
+        reflection = true
+    }
+}
+`
+
+	ast, err := ParseVCluster(input)
+	assert.NoError(t, err)
+
+	servicePort, proxyPort := 50051, 50061
+	expected := &VClusterAST{
+		Services: []VClusterServiceDefinitionAST{
+			{
+				Name:        "payments",
+				ServicePort: &servicePort,
+				ProxyPort:   &proxyPort,
+				GRPC: &GRPCConfig{
+					DescriptorSets: []string{"protos/payments.pb", "protos/common.pb"},
+					Reflection:     true,
+				},
+			},
+		},
+	}
+
+	assert.Equal(t, expected, ast)
+}
+
+func TestParseVCluster_GRPCWithoutProxyPort_IsError(t *testing.T) {
+	input := `
+service payments {
+    service_port = 50051
+    grpc {
+        reflection = true
+    }
+}
+`
+
+	_, err := ParseVCluster(input)
+	assert.Error(t, err)
+}
+
+func TestParseVCluster_ServiceProxyTLS(t *testing.T) {
+	input := `
+service orders {
+    service_port = 9000
+    proxy_port = 9443
+    proxy_tls = true
+}
+`
+
+	ast, err := ParseVCluster(input)
+	assert.NoError(t, err)
+
+	servicePort, proxyPort := 9000, 9443
+	expected := &VClusterAST{
+		Services: []VClusterServiceDefinitionAST{
+			{
+				Name:        "orders",
+				ServicePort: &servicePort,
+				ProxyPort:   &proxyPort,
+				ProxyTLS:    true,
+			},
+		},
+	}
+
+	assert.Equal(t, expected, ast)
+}
+
+func TestParseVCluster_ProxyTLSWithoutProxyPort_IsError(t *testing.T) {
+	input := `
+service orders {
+    service_port = 9000
+    proxy_tls = true
+}
+`
+
+	_, err := ParseVCluster(input)
+	assert.Error(t, err)
+}
+
+func TestParseVCluster_ServiceMetrics(t *testing.T) {
+	input := `
+service orders {
+    service_port = 9000
+    metrics {
+        path = "/internal/metrics"
+        interval = "5s"
+    }
+}
+
+service payments {
+    service_port = 9100
+    metrics {
+        port = 9190
+    }
+}
+`
+
+	ast, err := ParseVCluster(input)
+	assert.NoError(t, err)
+
+	ordersPort, paymentsPort, paymentsMetricsPort := 9000, 9100, 9190
+	expected := &VClusterAST{
+		Services: []VClusterServiceDefinitionAST{
+			{
+				Name:        "orders",
+				ServicePort: &ordersPort,
+				Metrics:     &MetricsConfig{Path: "/internal/metrics", Interval: 5 * time.Second},
+			},
+			{
+				Name:        "payments",
+				ServicePort: &paymentsPort,
+				Metrics:     &MetricsConfig{Path: DefaultMetricsPath, Port: &paymentsMetricsPort, Interval: DefaultMetricsInterval},
+			},
+		},
+	}
+
+	assert.Equal(t, expected, ast)
+}
+
+func TestParseVCluster_MetricsWithInvalidInterval_IsError(t *testing.T) {
+	input := `
+service orders {
+    service_port = 9000
+    metrics {
+        interval = "often"
+    }
+}
+`
+
+	_, err := ParseVCluster(input)
+	assert.Error(t, err)
+}
+
+func TestParseVCluster_ServiceLimits(t *testing.T) {
+	input := `
+service orders {
+    run_commands = ["./orders"]
+    limits {
+        memory = "512Mi"
+        cpu = 1.5
+        pids = 256
+    }
+}
+
+service payments {
+    run_commands = ["./payments"]
+    limits {
+        cpu = 2;
+    }
+}
+`
+
+	ast, err := ParseVCluster(input)
+	assert.NoError(t, err)
+
+	memory, ordersCPU, pids, paymentsCPU := int64(512<<20), 1.5, 256, 2.0
+	expected := &VClusterAST{
+		Services: []VClusterServiceDefinitionAST{
+			{
+				Name:        "orders",
+				RunCommands: []string{"./orders"},
+				Limits:      &LimitsConfig{MemoryBytes: &memory, CPU: &ordersCPU, Pids: &pids},
+			},
+			{
+				Name:        "payments",
+				RunCommands: []string{"./payments"},
+				Limits:      &LimitsConfig{CPU: &paymentsCPU},
+			},
+		},
+	}
+
+	assert.Equal(t, expected, ast)
+}
+
+func TestParseVCluster_LimitsWithInvalidMemory_IsError(t *testing.T) {
+	input := `
+service orders {
+    run_commands = ["./orders"]
+    limits {
+        memory = "lots"
+    }
+}
+`
+
+	_, err := ParseVCluster(input)
+	assert.Error(t, err)
+}
+
+func TestVClusterServiceDefinitionAST_ValidateLimits(t *testing.T) {
+	tests := []struct {
+		name    string
+		limits  LimitsConfig
+		wantErr string
+	}{
+		{name: "smallest cpu", limits: LimitsConfig{CPU: ptr(0.01)}},
+		{name: "one pid", limits: LimitsConfig{Pids: ptr(1)}},
+		{name: "no cpu", limits: LimitsConfig{CPU: ptr(0.0)}, wantErr: "cpu limit must be at least 0.01: orders"},
+		{name: "too little cpu", limits: LimitsConfig{CPU: ptr(0.001)}, wantErr: "cpu limit must be at least 0.01: orders"},
+		{name: "no pids", limits: LimitsConfig{Pids: ptr(0)}, wantErr: "pids limit must be at least 1: orders"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service := VClusterServiceDefinitionAST{Name: "orders", Limits: &tt.limits}
+			err := service.Validate()
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func ptr[T any](value T) *T {
+	return &value
+}
+
+func TestParseByteSize(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected int64
+		wantErr  bool
+	}{
+		{input: "1048576", expected: 1 << 20},
+		{input: "512Mi", expected: 512 << 20},
+		{input: "1.5Gi", expected: 3 << 29},
+		{input: "64Ki", expected: 64 << 10},
+		{input: "2G", expected: 2e9},
+		{input: "100k", expected: 1e5},
+		{input: "Mi", wantErr: true},
+		{input: "-1Mi", wantErr: true},
+		{input: "512MB", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			value, err := ParseByteSize(tt.input)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, value)
+		})
+	}
+}
+
+func TestParseVCluster_Gateway(t *testing.T) {
+	input := `
+gateway {
+    port = 8000
+    route "/orders" -> orders
+    route "/orders/admin" -> admin;
+    host "Payments.local" -> payments
+}
+`
+
+	ast, err := ParseVCluster(input)
+	assert.NoError(t, err)
+
+	expected := &VClusterAST{
+		Gateways: []VClusterGatewayDefinitionAST{
+			{
+				Port: 8000,
+				Routes: []GatewayRoute{
+					{Path: "/orders", Service: "orders"},
+					{Path: "/orders/admin", Service: "admin"},
+					{Host: "payments.local", Service: "payments"},
+				},
+			},
+		},
+	}
+
+	assert.Equal(t, expected, ast)
+}
+
+func TestParseVCluster_NamesThatAreGatewayKeywords(t *testing.T) {
+	input := `
+service gateway {
+    service_port = 8080
+}
+
+service host {
+    service_port = 8081
+    dependency = gateway
+}
+
+gateway {
+    port = 8000
+    route "/" -> gateway
+    host "api.local" -> host
+}
+`
+
+	ast, err := ParseVCluster(input)
+	assert.NoError(t, err)
+
+	assert.Equal(t, "gateway", ast.Services[0].Name)
+	assert.Equal(t, "host", ast.Services[1].Name)
+	assert.Equal(t, []GatewayRoute{
+		{Path: "/", Service: "gateway"},
+		{Host: "api.local", Service: "host"},
+	}, ast.Gateways[0].Routes)
+}
+
+func TestParseVCluster_NamesThatAreKeywords(t *testing.T) {
+	for _, name := range []string{"metrics", "interval", "egress", "grpc", "status", "query", "route", "mode", "path"} {
+		t.Run(name, func(t *testing.T) {
+			input := fmt.Sprintf(`
+service %[1]s {
+    service_port = 8080
+    dependency = %[1]s
+}
+
+mock_service %[1]s {
+    port = 9001
+}
+
+managed_dependency %[1]s {
+    managed_redis {
+        port = 6379
+    }
+}
+`, name)
+
+			ast, err := ParseVCluster(input)
+			assert.NoError(t, err)
+
+			assert.Equal(t, name, ast.Services[0].Name)
+			assert.Equal(t, name, ast.MockServices[0].Name)
+			assert.Equal(t, name, ast.ManagedDependencies[0].Name)
+		})
+	}
+}
+
+func TestParseVCluster_GatewayRouteWithoutSlash_IsError(t *testing.T) {
+	input := `
+gateway {
+    port = 8000
+    route "orders" -> orders
+}
+`
+
+	_, err := ParseVCluster(input)
+	assert.Error(t, err)
+}
+
+func TestParseVCluster_Egress(t *testing.T) {
+	input := `
+egress {
+    port = 3128
+    mitm = true
+    rule {
+        host = "*.stripe.com"
+        method = POST
+        path = "/v1/charges"
+        status = 201
+        header "Content-Type" = "application/json"
+        body = "{}"
+    }
+    rule {
+        host = "api.segment.io"
+        block = true
+    }
+}
+`
+
+	ast, err := ParseVCluster(input)
+	assert.NoError(t, err)
+
+	expected := &VClusterAST{
+		Egress: &VClusterEgressDefinitionAST{
+			Port: 3128,
+			MITM: true,
+			Rules: []proxy.EgressRule{
+				{
+					Host:    "*.stripe.com",
+					Method:  "POST",
+					Path:    "/v1/charges",
+					Status:  201,
+					Headers: map[string]string{"Content-Type": "application/json"},
+					Body:    "{}",
+				},
+				{Host: "api.segment.io", Block: true},
+			},
+		},
+	}
+
+	assert.Equal(t, expected, ast)
+}
+
+func TestParseVCluster_EgressRuleWithoutAction_IsError(t *testing.T) {
+	input := `
+egress {
+    port = 3128
+    rule {
+        host = "api.segment.io"
+    }
+}
+`
+
+	_, err := ParseVCluster(input)
+	assert.Error(t, err)
+}
@@ -0,0 +1,74 @@
+/*
+ * Copyright (c) 2023 Asim Ihsan.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ * SPDX-License-Identifier: MPL-2.0
+ */
+
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// CallerHeader names the service that made a request, for requests that do not carry their caller in their context.
+// The egress proxy sets it on the calls it passes on to the proxy ports of other services, and services may set it
+// themselves, e.g. from VCLUSTER_SERVICE_NAME.
+const CallerHeader = "X-Vcluster-Caller"
+
+type callerKey struct{}
+
+type connKey struct{}
+
+// clientConn is a connection accepted by a server, whose caller is found at most once for all the requests on it.
+type clientConn struct {
+	conn   net.Conn
+	once   sync.Once
+	caller string
+}
+
+// ConnContext is an http.Server ConnContext that keeps the connection in the context of its requests, so that a
+// Proxy with WithClient can tell which managed service made them.
+func ConnContext(ctx context.Context, conn net.Conn) context.Context {
+	return context.WithValue(ctx, connKey{}, &clientConn{conn: conn})
+}
+
+// connCaller returns the caller of the connection ctx was served on according to client, or "" if the server did not
+// keep its connections with ConnContext.
+func connCaller(ctx context.Context, client func(conn net.Conn) string) string {
+	c, ok := ctx.Value(connKey{}).(*clientConn)
+	if !ok || client == nil {
+		return ""
+	}
+	c.once.Do(func() {
+		c.caller = client(c.conn)
+	})
+	return c.caller
+}
+
+// WithCaller returns a context carrying the name of the service that made a request, which RecordRequest stores
+// with it.
+func WithCaller(ctx context.Context, caller string) context.Context {
+	return context.WithValue(ctx, callerKey{}, caller)
+}
+
+// CallerFrom returns the name of the service that made the request with context ctx, or "" if it is not known.
+func CallerFrom(ctx context.Context) string {
+	caller, _ := ctx.Value(callerKey{}).(string)
+	return caller
+}
+
+// RequestCaller returns the name of the service that made r, from its context or else its CallerHeader, or "" if it
+// is not known.
+func RequestCaller(r *http.Request) string {
+	if caller := CallerFrom(r.Context()); caller != "" {
+		return caller
+	}
+	return r.Header.Get(CallerHeader)
+}
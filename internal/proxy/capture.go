@@ -0,0 +1,371 @@
+/*
+ * Copyright (c) 2023 Asim Ihsan.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ * SPDX-License-Identifier: MPL-2.0
+ */
+
+package proxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// BlobDir is where the blobs of the substrate database at dbPath are kept.
+func BlobDir(dbPath string) string {
+	return dbPath + ".blobs"
+}
+
+// DefaultCaptureLimit is how many bytes of each body are stored in the database row by default.
+const DefaultCaptureLimit = 64 * 1024
+
+// DefaultMaxBlobSize is the largest body spilled to a blob file by default. Bodies beyond it, such as endless event
+// streams, are only captured up to the capture limit.
+const DefaultMaxBlobSize = 256 * 1024 * 1024
+
+// BlobStore keeps bodies too large for a database row as files named by the SHA-256 of their content, so that
+// identical bodies are stored once.
+type BlobStore struct {
+	dir         string
+	maxBlobSize int64
+}
+
+func NewBlobStore(dir string, maxBlobSize int64) *BlobStore {
+	return &BlobStore{dir: dir, maxBlobSize: maxBlobSize}
+}
+
+// Path returns the file of a blob referenced by a row.
+func (s *BlobStore) Path(blob string) string {
+	if len(blob) < 2 {
+		return filepath.Join(s.dir, blob)
+	}
+	return filepath.Join(s.dir, blob[:2], blob)
+}
+
+// Read returns the content of a blob referenced by a row.
+func (s *BlobStore) Read(blob string) ([]byte, error) {
+	return os.ReadFile(s.Path(blob))
+}
+
+// blobWriter writes a body to a temporary file, which commit moves to its content address.
+type blobWriter struct {
+	store *BlobStore
+	file  *os.File
+	hash  io.Writer
+	sum   func() []byte
+	size  int64
+}
+
+func (s *BlobStore) create() (*blobWriter, error) {
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return nil, err
+	}
+	file, err := os.CreateTemp(s.dir, "spill-*")
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.New()
+	return &blobWriter{store: s, file: file, hash: hash, sum: func() []byte { return hash.Sum(nil) }}, nil
+}
+
+func (w *blobWriter) Write(p []byte) (int, error) {
+	if w.size+int64(len(p)) > w.store.maxBlobSize {
+		return 0, errors.New("body exceeds the maximum blob size")
+	}
+	if _, err := w.file.Write(p); err != nil {
+		return 0, err
+	}
+	_, _ = w.hash.Write(p)
+	w.size += int64(len(p))
+	return len(p), nil
+}
+
+func (w *blobWriter) commit() (string, error) {
+	if err := w.file.Close(); err != nil {
+		_ = os.Remove(w.file.Name())
+		return "", err
+	}
+	blob := hex.EncodeToString(w.sum())
+	path := w.store.Path(blob)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		_ = os.Remove(w.file.Name())
+		return "", err
+	}
+	if err := os.Rename(w.file.Name(), path); err != nil {
+		_ = os.Remove(w.file.Name())
+		return "", err
+	}
+	return blob, nil
+}
+
+func (w *blobWriter) discard() {
+	_ = w.file.Close()
+	_ = os.Remove(w.file.Name())
+}
+
+// CapturedBody is what was captured of a request or response body.
+type CapturedBody struct {
+	// Data is the start of the body, up to the capture limit.
+	Data []byte
+
+	// Size is the length of the whole body.
+	Size int64
+
+	// Truncated is set when Data is not the whole body.
+	Truncated bool
+
+	// Binary is set when the body is not text, in which case it is stored as a BLOB rather than TEXT.
+	Binary bool
+
+	// Blob is the content address of the whole body in the blob store, if it was spilled there.
+	Blob string
+
+	// ContentType and ContentEncoding are the body's Content-Type and Content-Encoding headers.
+	ContentType     string
+	ContentEncoding string
+
+	// Decoded is set when the body was stored with its content encoding removed. Size then counts decoded bytes.
+	Decoded bool
+}
+
+// NewCapturedBody captures a body that is already in memory in full, sent with header.
+func NewCapturedBody(data []byte, header http.Header) CapturedBody {
+	body := CapturedBody{
+		Data:            data,
+		Size:            int64(len(data)),
+		ContentType:     header.Get("Content-Type"),
+		ContentEncoding: contentEncoding(header),
+	}
+	if codings, ok := contentCodings(body.ContentEncoding); ok && len(codings) > 0 && len(data) > 0 {
+		decoded, err := decodeContent(bytes.NewReader(data), codings)
+		if err == nil {
+			var content []byte
+			if content, err = io.ReadAll(decoded); err == nil {
+				body.Data, body.Size, body.Decoded = content, int64(len(content)), true
+			}
+		}
+		if err != nil {
+			log.Printf("Error decoding captured body: %v", err)
+		}
+	}
+	body.Binary = isBinary(body.Data, false)
+	return body
+}
+
+func contentEncoding(header http.Header) string {
+	return strings.Join(header.Values("Content-Encoding"), ", ")
+}
+
+// value is the body as stored in the body column: TEXT for text and BLOB for binary data.
+func (b CapturedBody) value() interface{} {
+	if b.Binary {
+		return b.Data
+	}
+	return string(b.Data)
+}
+
+func (b CapturedBody) blob() *string {
+	if b.Blob == "" {
+		return nil
+	}
+	return &b.Blob
+}
+
+// bodyCapture records a body as it streams through the proxy. It keeps the first limit bytes in memory and, once a
+// body grows beyond that, spills all of it into the blob store. Content encodings such as gzip are removed from the
+// captured copy as the body arrives. Writes never fail, so that a capture problem never breaks the proxied exchange.
+type bodyCapture struct {
+	limit int
+	blobs *BlobStore
+
+	contentType     string
+	contentEncoding string
+
+	// decoding, if set, removes the content encoding before the body is stored. The start of the encoded body is
+	// kept in raw, to be stored instead if it cannot be decoded.
+	decoding *decodingWriter
+	raw      bytes.Buffer
+	rawSize  int64
+
+	mu     sync.Mutex
+	inline bytes.Buffer
+	size   int64
+	spill  *blobWriter
+
+	// spillFailed is set once spilling has been given up, e.g. because the body is too large.
+	spillFailed bool
+}
+
+func newBodyCapture(limit int, blobs *BlobStore) *bodyCapture {
+	return &bodyCapture{limit: limit, blobs: blobs}
+}
+
+// setHeader records the headers the body was sent with. It must be called before the body is written.
+func (c *bodyCapture) setHeader(header http.Header) {
+	c.contentType = header.Get("Content-Type")
+	c.contentEncoding = contentEncoding(header)
+	if codings, ok := contentCodings(c.contentEncoding); ok && len(codings) > 0 {
+		c.decoding = newDecodingWriter(writerFunc(c.store), codings)
+	}
+}
+
+func (c *bodyCapture) Write(p []byte) (int, error) {
+	if c.decoding == nil {
+		return c.store(p)
+	}
+
+	c.mu.Lock()
+	c.rawSize += int64(len(p))
+	if room := c.limit - c.raw.Len(); room > 0 {
+		if room > len(p) {
+			room = len(p)
+		}
+		c.raw.Write(p[:room])
+	}
+	c.mu.Unlock()
+
+	_, _ = c.decoding.Write(p)
+	return len(p), nil
+}
+
+// store captures the body as it is to be stored, with any content encoding removed.
+func (c *bodyCapture) store(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.size += int64(len(p))
+	if room := c.limit - c.inline.Len(); room > 0 {
+		if room > len(p) {
+			room = len(p)
+		}
+		c.inline.Write(p[:room])
+	}
+
+	if c.size <= int64(c.limit) || c.blobs == nil || c.spillFailed {
+		return len(p), nil
+	}
+	if c.spill == nil {
+		spill, err := c.blobs.create()
+		if err != nil {
+			log.Printf("Error creating blob for captured body: %v", err)
+			c.spillFailed = true
+			return len(p), nil
+		}
+		c.spill = spill
+		// The inline buffer holds the start of the body; the rest of what was already seen is in p.
+		alreadySeen := c.size - int64(len(p))
+		if _, err := c.spill.Write(c.inline.Bytes()[:alreadySeen]); err != nil {
+			c.abandonSpill(err)
+			return len(p), nil
+		}
+	}
+	if _, err := c.spill.Write(p); err != nil {
+		c.abandonSpill(err)
+	}
+	return len(p), nil
+}
+
+func (c *bodyCapture) abandonSpill(err error) {
+	log.Printf("Not spilling captured body to a blob: %v", err)
+	c.spill.discard()
+	c.spill = nil
+	c.spillFailed = true
+}
+
+// finish returns the captured body, committing the spilled blob if there is one.
+func (c *bodyCapture) finish() CapturedBody {
+	decodeErr := c.closeDecoding()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	body := CapturedBody{
+		Data:            append([]byte(nil), c.inline.Bytes()...),
+		Size:            c.size,
+		Truncated:       c.size > int64(c.inline.Len()),
+		ContentType:     c.contentType,
+		ContentEncoding: c.contentEncoding,
+		Decoded:         c.decoding != nil,
+	}
+	if decodeErr != nil {
+		// Store the start of the body as it was sent, rather than the part that could be decoded.
+		if c.rawSize > 0 {
+			log.Printf("Error decoding captured body: %v", decodeErr)
+		}
+		if c.spill != nil {
+			c.spill.discard()
+			c.spill = nil
+		}
+		body.Data = append([]byte(nil), c.raw.Bytes()...)
+		body.Size = c.rawSize
+		body.Truncated = c.rawSize > int64(c.raw.Len())
+		body.Decoded = false
+	}
+	body.Binary = isBinary(body.Data, body.Truncated)
+	if c.spill != nil {
+		blob, err := c.spill.commit()
+		if err != nil {
+			log.Printf("Error committing blob for captured body: %v", err)
+		} else {
+			body.Blob = blob
+		}
+		c.spill = nil
+	}
+	return body
+}
+
+func (c *bodyCapture) closeDecoding() error {
+	if c.decoding == nil {
+		return nil
+	}
+	return c.decoding.Close()
+}
+
+// writerFunc adapts a function to io.Writer.
+type writerFunc func([]byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
+
+// isBinary reports whether data is not UTF-8 text. A body cut off at the capture limit may end in the middle of a
+// multi-byte character, which is not held against it.
+func isBinary(data []byte, truncated bool) bool {
+	if bytes.IndexByte(data, 0) >= 0 {
+		return true
+	}
+	if truncated {
+		for i := 0; i < utf8.UTFMax-1 && len(data) > 0 && !utf8.Valid(data); i++ {
+			data = data[:len(data)-1]
+		}
+	}
+	return !utf8.Valid(data)
+}
+
+// captureReader tees a request body into a capture as the proxied service reads it.
+type captureReader struct {
+	io.ReadCloser
+	capture *bodyCapture
+}
+
+func (r *captureReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 {
+		_, _ = r.capture.Write(p[:n])
+	}
+	return n, err
+}
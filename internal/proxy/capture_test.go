@@ -0,0 +1,188 @@
+/*
+ * Copyright (c) 2023 Asim Ihsan.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ * SPDX-License-Identifier: MPL-2.0
+ */
+
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBodyCapture(t *testing.T) {
+	large := bytes.Repeat([]byte("0123456789"), 10)
+	largeSum := sha256.Sum256(large)
+
+	tests := []struct {
+		name          string
+		writes        [][]byte
+		maxBlobSize   int64
+		wantData      string
+		wantTruncated bool
+		wantBinary    bool
+		wantBlob      string
+	}{
+		{
+			name:     "within the limit",
+			writes:   [][]byte{[]byte("hello "), []byte("world")},
+			wantData: "hello world",
+		},
+		{
+			name:          "over the limit is spilled to a blob",
+			writes:        [][]byte{large[:5], large[5:60], large[60:]},
+			maxBlobSize:   1024,
+			wantData:      string(large[:16]),
+			wantTruncated: true,
+			wantBlob:      hex.EncodeToString(largeSum[:]),
+		},
+		{
+			name:          "over the maximum blob size is only truncated",
+			writes:        [][]byte{large},
+			maxBlobSize:   50,
+			wantData:      string(large[:16]),
+			wantTruncated: true,
+		},
+		{
+			name:       "binary",
+			writes:     [][]byte{{0x89, 'P', 'N', 'G', 0x00, 0xff}},
+			wantData:   "\x89PNG\x00\xff",
+			wantBinary: true,
+		},
+		{
+			name:          "text cut in the middle of a character",
+			writes:        [][]byte{[]byte("fifteen bytes €€")},
+			wantData:      "fifteen bytes \xe2\x82",
+			wantTruncated: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			blobs := NewBlobStore(filepath.Join(t.TempDir(), "blobs"), tt.maxBlobSize)
+			capture := newBodyCapture(16, blobs)
+			var size int64
+			for _, write := range tt.writes {
+				n, err := capture.Write(write)
+				assert.NoError(t, err)
+				assert.Equal(t, len(write), n)
+				size += int64(len(write))
+			}
+
+			body := capture.finish()
+			assert.Equal(t, tt.wantData, string(body.Data))
+			assert.Equal(t, size, body.Size)
+			assert.Equal(t, tt.wantTruncated, body.Truncated)
+			assert.Equal(t, tt.wantBinary, body.Binary)
+			assert.Equal(t, tt.wantBlob, body.Blob)
+			if tt.wantBlob != "" {
+				whole, err := blobs.Read(body.Blob)
+				assert.NoError(t, err)
+				assert.Equal(t, large, whole)
+			}
+		})
+	}
+}
+
+func TestProxy_StreamsResponse(t *testing.T) {
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = io.WriteString(w, "data: first\n\n")
+		w.(http.Flusher).Flush()
+		<-release
+		_, _ = io.WriteString(w, "data: second\n\n")
+	}))
+	defer backend.Close()
+
+	db := newTestDB(t)
+	p, err := NewProxy(backend.URL, "events", db)
+	assert.NoError(t, err)
+	server := httptest.NewServer(p)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/events")
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+
+	// The first event arrives while the service is still writing the response.
+	reader := bufio.NewReader(resp.Body)
+	line, err := reader.ReadString('\n')
+	assert.NoError(t, err)
+	assert.Equal(t, "data: first\n", line)
+	close(release)
+	rest, err := io.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.Equal(t, "\ndata: second\n\n", string(rest))
+
+	var body string
+	assert.Eventually(t, func() bool {
+		return db.QueryRow("SELECT body FROM http_responses").Scan(&body) == nil
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, "data: first\n\ndata: second\n\n", body)
+}
+
+func TestProxy_CapsCapturedBodies(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/octet-stream")
+		_, _ = w.Write(append([]byte{0x00, 0x01}, received...))
+	}))
+	defer backend.Close()
+
+	db := newTestDB(t)
+	blobs := NewBlobStore(filepath.Join(t.TempDir(), "blobs"), DefaultMaxBlobSize)
+	p, err := NewProxy(backend.URL, "uploads", db, WithCaptureLimit(8), WithBlobStore(blobs))
+	assert.NoError(t, err)
+	server := httptest.NewServer(p)
+	defer server.Close()
+
+	upload := strings.Repeat("x", 100)
+	resp, err := http.Post(server.URL+"/upload", "text/plain", strings.NewReader(upload))
+	assert.NoError(t, err)
+	received, err := io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, 102, len(received), "the client gets the whole body")
+
+	for _, table := range []string{"http_requests", "http_responses"} {
+		var data []byte
+		var size int64
+		var truncated, binary bool
+		var blob string
+		err := db.QueryRow(fmt.Sprintf(
+			"SELECT body, body_size, body_truncated, body_binary, body_blob FROM %s", table)).Scan(
+			&data, &size, &truncated, &binary, &blob)
+		assert.NoError(t, err, table)
+		assert.Len(t, data, 8, table)
+		assert.True(t, truncated, table)
+		whole, err := blobs.Read(blob)
+		assert.NoError(t, err, table)
+		assert.Equal(t, size, int64(len(whole)), table)
+
+		if table == "http_requests" {
+			assert.Equal(t, upload, string(whole))
+			assert.False(t, binary)
+		} else {
+			assert.Equal(t, received, whole)
+			assert.True(t, binary)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+/*
+ * Copyright (c) 2023 Asim Ihsan.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ * SPDX-License-Identifier: MPL-2.0
+ */
+
+package proxy
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+	"io"
+	"strings"
+)
+
+// contentDecoder wraps a reader of content in one content coding with a reader of the decoded content.
+type contentDecoder func(io.Reader) (io.Reader, error)
+
+var contentDecoders = map[string]contentDecoder{
+	"gzip":   func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) },
+	"x-gzip": func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) },
+	"deflate": func(r io.Reader) (io.Reader, error) {
+		// HTTP deflate is zlib-wrapped, but some servers send raw deflate data instead.
+		return newDeflateReader(r)
+	},
+	"br": func(r io.Reader) (io.Reader, error) { return brotli.NewReader(r), nil },
+	"zstd": func(r io.Reader) (io.Reader, error) {
+		decoder, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	},
+}
+
+// contentCodings parses a Content-Encoding header into the codings applied to the content, in the order they were
+// applied. It returns false if the content is encoded with a coding that cannot be decoded.
+func contentCodings(contentEncoding string) ([]string, bool) {
+	var codings []string
+	for _, coding := range strings.Split(contentEncoding, ",") {
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding == "" || coding == "identity" {
+			continue
+		}
+		if _, ok := contentDecoders[coding]; !ok {
+			return nil, false
+		}
+		codings = append(codings, coding)
+	}
+	return codings, true
+}
+
+// decodeContent returns a reader of the content read from r with the codings removed.
+func decodeContent(r io.Reader, codings []string) (io.Reader, error) {
+	for i := len(codings) - 1; i >= 0; i-- {
+		decoded, err := contentDecoders[codings[i]](r)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to decode %s content", codings[i])
+		}
+		r = decoded
+	}
+	return r, nil
+}
+
+// newDeflateReader reads zlib-wrapped deflate data, falling back to raw deflate data when the zlib header is missing.
+func newDeflateReader(r io.Reader) (io.Reader, error) {
+	var header [2]byte
+	n, err := io.ReadFull(r, header[:])
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	r = io.MultiReader(bytes.NewReader(header[:n]), r)
+	// A zlib header is a compression method of 8 and a check value making the 16-bit header a multiple of 31.
+	if n == 2 && header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+		return zlib.NewReader(r)
+	}
+	return flate.NewReader(r), nil
+}
+
+// decodingWriter decodes encoded content written to it into w as it arrives. Decoding runs in its own goroutine,
+// reading from a pipe, so that the content can be decoded a piece at a time as it streams through the proxy.
+type decodingWriter struct {
+	pipe *io.PipeWriter
+	done chan struct{}
+	err  error
+}
+
+func newDecodingWriter(w io.Writer, codings []string) *decodingWriter {
+	reader, writer := io.Pipe()
+	d := &decodingWriter{pipe: writer, done: make(chan struct{})}
+	go func() {
+		defer close(d.done)
+		decoded, err := decodeContent(reader, codings)
+		if err == nil {
+			_, err = io.Copy(w, decoded)
+		}
+		if err != nil {
+			d.err = err
+		}
+		// Keep accepting the encoded content after a decoding error, so that the writer never blocks.
+		_, _ = io.Copy(io.Discard, reader)
+	}()
+	return d
+}
+
+func (d *decodingWriter) Write(p []byte) (int, error) {
+	return d.pipe.Write(p)
+}
+
+// Close waits for everything written to be decoded, and returns the decoding error, if any.
+func (d *decodingWriter) Close() error {
+	_ = d.pipe.Close()
+	<-d.done
+	if d.err != nil {
+		return errors.Wrap(d.err, "failed to decode captured body")
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+/*
+ * Copyright (c) 2023 Asim Ihsan.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ * SPDX-License-Identifier: MPL-2.0
+ */
+
+package proxy
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+)
+
+func encode(t *testing.T, coding string, content []byte) []byte {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	var err error
+	switch coding {
+	case "gzip":
+		w = gzip.NewWriter(&buf)
+	case "zlib":
+		w = zlib.NewWriter(&buf)
+	case "raw-deflate":
+		w, err = flate.NewWriter(&buf, flate.DefaultCompression)
+	case "br":
+		w = brotli.NewWriter(&buf)
+	case "zstd":
+		w, err = zstd.NewWriter(&buf)
+	}
+	assert.NoError(t, err)
+	_, err = w.Write(content)
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+	return buf.Bytes()
+}
+
+func TestBodyCapture_Decodes(t *testing.T) {
+	content := []byte(`{"order": 42, "items": ["tea", "milk"]}`)
+
+	tests := []struct {
+		name            string
+		contentEncoding string
+		body            []byte
+		wantData        []byte
+		wantDecoded     bool
+	}{
+		{name: "gzip", contentEncoding: "gzip", body: encode(t, "gzip", content), wantData: content, wantDecoded: true},
+		{name: "deflate", contentEncoding: "deflate", body: encode(t, "zlib", content), wantData: content, wantDecoded: true},
+		{name: "raw deflate", contentEncoding: "deflate", body: encode(t, "raw-deflate", content), wantData: content, wantDecoded: true},
+		{name: "brotli", contentEncoding: "br", body: encode(t, "br", content), wantData: content, wantDecoded: true},
+		{name: "zstd", contentEncoding: "zstd", body: encode(t, "zstd", content), wantData: content, wantDecoded: true},
+		{
+			name:            "several codings",
+			contentEncoding: "gzip, br",
+			body:            encode(t, "br", encode(t, "gzip", content)),
+			wantData:        content,
+			wantDecoded:     true,
+		},
+		{name: "identity", contentEncoding: "identity", body: content, wantData: content},
+		{name: "unknown coding", contentEncoding: "compress", body: []byte("\x1f\x9d\x90"), wantData: []byte("\x1f\x9d\x90")},
+		{name: "corrupt", contentEncoding: "gzip", body: []byte("not gzip"), wantData: []byte("not gzip")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{"Content-Type": {"application/json"}, "Content-Encoding": {tt.contentEncoding}}
+
+			capture := newBodyCapture(DefaultCaptureLimit, nil)
+			capture.setHeader(header)
+			// Write a byte at a time, as a slow stream would arrive.
+			for i := range tt.body {
+				_, err := capture.Write(tt.body[i : i+1])
+				assert.NoError(t, err)
+			}
+			body := capture.finish()
+			assert.Equal(t, tt.wantData, body.Data)
+			assert.Equal(t, int64(len(tt.wantData)), body.Size)
+			assert.Equal(t, tt.wantDecoded, body.Decoded)
+			assert.False(t, body.Truncated)
+			assert.Equal(t, "application/json", body.ContentType)
+			assert.Equal(t, tt.contentEncoding, body.ContentEncoding)
+
+			inMemory := NewCapturedBody(tt.body, header)
+			assert.Equal(t, tt.wantData, inMemory.Data)
+			assert.Equal(t, tt.wantDecoded, inMemory.Decoded)
+		})
+	}
+}
+
+func TestProxy_PassesEncodedBodyThrough(t *testing.T) {
+	content := []byte(`{"status": "shipped"}`)
+	encoded := encode(t, "gzip", content)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Encoding", "gzip")
+		_, _ = w.Write(encoded)
+	}))
+	defer backend.Close()
+
+	db := newTestDB(t)
+	p, err := NewProxy(backend.URL, "orders", db)
+	assert.NoError(t, err)
+	server := httptest.NewServer(p)
+	defer server.Close()
+
+	req, err := http.NewRequest("GET", server.URL+"/orders/1", nil)
+	assert.NoError(t, err)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	received, err := io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, encoded, received, "the client gets the bytes the service sent")
+
+	var body, contentType, contentEncoding string
+	var decoded bool
+	err = db.QueryRow("SELECT body, content_type, content_encoding, body_decoded FROM http_responses").Scan(
+		&body, &contentType, &contentEncoding, &decoded)
+	assert.NoError(t, err)
+	assert.Equal(t, string(content), body)
+	assert.Equal(t, "application/json", contentType)
+	assert.Equal(t, "gzip", contentEncoding)
+	assert.True(t, decoded)
+}
@@ -0,0 +1,564 @@
+/*
+ * Copyright (c) 2023 Asim Ihsan.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ * SPDX-License-Identifier: MPL-2.0
+ */
+
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/net/http2"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EgressService is the service under which the calls to external hosts are counted in metrics, as there is no bound
+// on the hosts that may be called.
+const EgressService = "egress"
+
+// EgressRule stubs or blocks the outbound calls it matches.
+type EgressRule struct {
+	// Host matches the host called, without its port, with path.Match, e.g. "*.stripe.com". Empty matches every
+	// host.
+	Host string `json:"host,omitempty"`
+
+	// Method and Path match the request as they do for a FaultRule. A tunnel that is not intercepted has neither, so
+	// only rules that block without them apply to it. Stubbing HTTPS calls needs the proxy to intercept them.
+	Method string `json:"method,omitempty"`
+	Path   string `json:"path,omitempty"`
+
+	// Block refuses the call with 403 Forbidden.
+	Block bool `json:"block,omitempty"`
+
+	// Status, Headers and Body answer the call in place of the host. Status defaults to 200 OK.
+	Status  int               `json:"status,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    string            `json:"body,omitempty"`
+}
+
+func (r EgressRule) Validate() error {
+	if _, err := path.Match(r.Host, "example.com"); err != nil {
+		return fmt.Errorf("invalid egress host pattern: %s", r.Host)
+	}
+	if r.Path != "" && !validPathPattern(r.Path) {
+		return fmt.Errorf("invalid egress path pattern: %s", r.Path)
+	}
+	if r.Status != 0 && (r.Status < 100 || r.Status > 999) {
+		return fmt.Errorf("invalid egress status: %d", r.Status)
+	}
+	stub := r.Status != 0 || len(r.Headers) > 0 || r.Body != ""
+	if r.Block && stub {
+		return fmt.Errorf("an egress rule cannot both block and stub a call")
+	}
+	if !r.Block && !stub {
+		return fmt.Errorf("egress rule for %s %s %s neither blocks nor stubs", r.Host, r.Method, r.Path)
+	}
+	return nil
+}
+
+func (r EgressRule) matchesHost(host string) bool {
+	if r.Host == "" {
+		return true
+	}
+	matched, _ := path.Match(strings.ToLower(r.Host), strings.ToLower(host))
+	return matched
+}
+
+// response is what the rule answers a call with.
+func (r EgressRule) response() (int, http.Header, []byte) {
+	if r.Block {
+		header := http.Header{"Content-Type": []string{"text/plain; charset=utf-8"}}
+		return http.StatusForbidden, header, []byte("blocked by vcluster egress rule\n")
+	}
+	status := r.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	header := make(http.Header)
+	for key, value := range r.Headers {
+		header.Set(key, value)
+	}
+	return status, header, []byte(r.Body)
+}
+
+// EgressRules is the set of rules of an egress proxy. It is safe to replace the rules while the proxy is serving.
+type EgressRules struct {
+	mu    sync.Mutex
+	rules []EgressRule
+}
+
+func NewEgressRules(rules []EgressRule) (*EgressRules, error) {
+	e := &EgressRules{}
+	if err := e.Set(rules); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// Set replaces the rules.
+func (e *EgressRules) Set(rules []EgressRule) error {
+	for _, rule := range rules {
+		if err := rule.Validate(); err != nil {
+			return err
+		}
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.rules = append([]EgressRule(nil), rules...)
+	return nil
+}
+
+// Rules returns a copy of the current rules.
+func (e *EgressRules) Rules() []EgressRule {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]EgressRule{}, e.rules...)
+}
+
+// match returns the first rule that matches a call to host, or nil. A nil req is a tunnel, which only rules that
+// block without a method and path match: the client would take a stub's 2xx as the tunnel being established.
+func (e *EgressRules) match(host string, req *http.Request) *EgressRule {
+	if e == nil {
+		return nil
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, rule := range e.rules {
+		if !rule.matchesHost(host) {
+			continue
+		}
+		if req == nil {
+			if rule.Block && rule.Method == "" && rule.Path == "" {
+				return &rule
+			}
+			continue
+		}
+		if requestMatches(rule.Method, rule.Path, req) {
+			return &rule
+		}
+	}
+	return nil
+}
+
+// Egress is a forward proxy for the calls services make, set as their HTTP_PROXY and HTTPS_PROXY. Calls are captured
+// like those to a service's proxy port, under the name of the host called and with the name of the calling service,
+// which it gives as the user of the proxy URL, e.g. http://orders@localhost:3128. HTTPS calls are tunnelled with
+// CONNECT and only captured in full when the proxy intercepts them with certificates from the local CA.
+type Egress struct {
+	db           *sql.DB
+	rules        *EgressRules
+	ca           *CertificateAuthority
+	proxyOptions []ProxyOption
+
+	// captureLimit and blobs capture the calls the proxy answers itself.
+	captureLimit int
+	blobs        *BlobStore
+
+	// internal holds the host:port addresses of the cluster's own proxy ports, which capture the calls to them
+	// already. transport carries those calls when set.
+	internal  map[string]bool
+	transport http.RoundTripper
+
+	// client names the caller of calls made without a proxy user, from the connection they were made on.
+	client func(conn net.Conn) string
+
+	mu      sync.Mutex
+	proxies map[string]*Proxy
+	certs   map[string]*tls.Certificate
+}
+
+type EgressOption func(*Egress)
+
+// WithEgressRules stubs or blocks the calls that match rules.
+func WithEgressRules(rules *EgressRules) EgressOption {
+	return func(e *Egress) {
+		e.rules = rules
+	}
+}
+
+// WithEgressMITM intercepts HTTPS calls with certificates issued by ca, which callers must trust, so that they are
+// captured in full rather than as opaque tunnels.
+func WithEgressMITM(ca *CertificateAuthority) EgressOption {
+	return func(e *Egress) {
+		e.ca = ca
+	}
+}
+
+// WithEgressInternalHosts passes calls to the host:port addresses in hosts, the cluster's own proxy ports, on
+// without capturing them, as the proxy port captures them already. The name of the caller is passed on in the
+// CallerHeader instead.
+func WithEgressInternalHosts(hosts ...string) EgressOption {
+	return func(e *Egress) {
+		for _, host := range hosts {
+			e.internal[strings.ToLower(host)] = true
+		}
+	}
+}
+
+// WithEgressProxyOptions sets the options of the proxies that forward and capture calls.
+func WithEgressProxyOptions(opts ...ProxyOption) EgressOption {
+	return func(e *Egress) {
+		e.proxyOptions = append(e.proxyOptions, opts...)
+	}
+}
+
+func NewEgress(db *sql.DB, opts ...EgressOption) *Egress {
+	e := &Egress{
+		db:       db,
+		proxies:  make(map[string]*Proxy),
+		certs:    make(map[string]*tls.Certificate),
+		internal: make(map[string]bool),
+	}
+	for _, opt := range opts {
+		opt(e)
+	}
+	settings := &Proxy{captureLimit: DefaultCaptureLimit}
+	for _, opt := range e.proxyOptions {
+		opt(settings)
+	}
+	e.captureLimit, e.blobs, e.transport = settings.captureLimit, settings.blobs, settings.transport
+	e.client = settings.client
+	return e
+}
+
+func (e *Egress) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	caller := proxyCaller(r)
+	if caller == "" {
+		caller = connCaller(r.Context(), e.client)
+	}
+	r.Header.Del("Proxy-Authorization")
+	r = r.WithContext(WithCaller(r.Context(), caller))
+
+	if r.Method == http.MethodConnect {
+		e.connect(w, r)
+		return
+	}
+	if !r.URL.IsAbs() {
+		http.Error(w, "the egress proxy only forwards requests for absolute URLs", http.StatusBadRequest)
+		return
+	}
+	e.forward(w, r)
+}
+
+// forward answers a call with the first matching rule, or else passes it on to the host.
+func (e *Egress) forward(w http.ResponseWriter, r *http.Request) {
+	host := r.URL.Hostname()
+	if e.isInternal(r.URL.Scheme, r.URL.Host) {
+		if caller := CallerFrom(r.Context()); caller != "" {
+			r.Header.Set(CallerHeader, caller)
+		}
+		proxy := httputil.NewSingleHostReverseProxy(&url.URL{Scheme: r.URL.Scheme, Host: r.URL.Host})
+		if e.transport != nil {
+			proxy.Transport = e.transport
+		}
+		proxy.ServeHTTP(w, r)
+		return
+	}
+	if rule := e.rules.match(host, r); rule != nil {
+		e.respond(w, r, host, rule)
+		return
+	}
+
+	target := r.URL.Scheme + "://" + r.URL.Host
+	e.mu.Lock()
+	p, ok := e.proxies[target]
+	if !ok {
+		var err error
+		p, err = NewProxy(target, host, e.db, e.proxyOptions...)
+		if err != nil {
+			e.mu.Unlock()
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		p.egress = true
+		e.proxies[target] = p
+	}
+	e.mu.Unlock()
+	p.ServeHTTP(w, r)
+}
+
+// isInternal reports whether host, with or without its port, is one of the cluster's own proxy ports.
+func (e *Egress) isInternal(scheme string, host string) bool {
+	if len(e.internal) == 0 {
+		return false
+	}
+	host = strings.ToLower(host)
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		if scheme == "https" {
+			host = net.JoinHostPort(host, "443")
+		} else {
+			host = net.JoinHostPort(host, "80")
+		}
+	}
+	return e.internal[host]
+}
+
+// respond answers a call with rule, capturing it as the proxy of a service would.
+func (e *Egress) respond(w http.ResponseWriter, r *http.Request, host string, rule *EgressRule) {
+	start := time.Now()
+	requestBody := newBodyCapture(e.captureLimit, e.blobs)
+	requestBody.setHeader(r.Header)
+	if r.Body != nil {
+		_, _ = io.Copy(requestBody, r.Body)
+	}
+	applied := "egress:stub"
+	if rule.Block {
+		applied = "egress:block"
+	}
+	requestID, err := RecordRequest(e.db, host, r, requestBody.finish(), []string{applied})
+	if err != nil {
+		log.Printf("Error recording HTTP request: %v", err)
+	}
+
+	status, header, body := rule.response()
+	for key, values := range header {
+		w.Header()[key] = values
+	}
+	firstByte := time.Now()
+	w.WriteHeader(status)
+	_, _ = w.Write(body)
+	if err != nil {
+		return
+	}
+	err = RecordResponse(e.db, requestID, host, CapturedResponse{
+		StatusCode: status,
+		Header:     header,
+		Body:       NewCapturedBody(body, header),
+		Start:      start,
+		FirstByte:  firstByte,
+		End:        time.Now(),
+	})
+	if err != nil {
+		log.Printf("Error recording HTTP response: %v", err)
+	}
+}
+
+// connect opens a tunnel to the host, which the proxy either intercepts or copies through untouched.
+func (e *Egress) connect(w http.ResponseWriter, r *http.Request) {
+	host := r.URL.Host
+	hostname, port, err := net.SplitHostPort(host)
+	if err != nil {
+		http.Error(w, "CONNECT needs a host and port", http.StatusBadRequest)
+		return
+	}
+
+	// Tunnels to the cluster's own proxy ports are not captured, as the proxy port captures what goes through them.
+	var upstream net.Conn
+	if e.ca == nil && e.isInternal("https", host) {
+		upstream, err = net.DialTimeout("tcp", host, 10*time.Second)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+	} else if e.ca == nil {
+		if rule := e.rules.match(hostname, nil); rule != nil {
+			e.respond(w, r, hostname, rule)
+			return
+		}
+		start := time.Now()
+		requestID, err := RecordRequest(e.db, hostname, r, CapturedBody{}, nil)
+		if err != nil {
+			log.Printf("Error recording HTTP request: %v", err)
+		}
+		upstream, err = net.DialTimeout("tcp", host, 10*time.Second)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			e.recordTunnel(requestID, hostname, http.StatusBadGateway, start, time.Now(), err.Error())
+			return
+		}
+		defer func() {
+			e.recordTunnel(requestID, hostname, http.StatusOK, start, time.Now(), "")
+		}()
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "CONNECT is only supported over HTTP/1", http.StatusHTTPVersionNotSupported)
+		return
+	}
+	conn, buffered, err := hijacker.Hijack()
+	if err != nil {
+		log.Printf("Error hijacking CONNECT: %v", err)
+		return
+	}
+	defer conn.Close()
+	if _, err := io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+		return
+	}
+	client := &bufferedConn{Conn: conn, reader: buffered.Reader}
+
+	if upstream == nil {
+		if port == "443" {
+			host = hostname
+		}
+		e.intercept(client, host, hostname, CallerFrom(r.Context()))
+		return
+	}
+	defer upstream.Close()
+	done := make(chan struct{}, 2)
+	go func() {
+		_, _ = io.Copy(upstream, client)
+		if tcpConn, ok := upstream.(*net.TCPConn); ok {
+			_ = tcpConn.CloseWrite()
+		}
+		done <- struct{}{}
+	}()
+	go func() {
+		_, _ = io.Copy(conn, upstream)
+		done <- struct{}{}
+	}()
+	<-done
+	<-done
+}
+
+func (e *Egress) recordTunnel(requestID int64, host string, status int, start time.Time, end time.Time, upstreamError string) {
+	if requestID == 0 {
+		return
+	}
+	err := RecordResponse(e.db, requestID, host, CapturedResponse{
+		StatusCode:    status,
+		Header:        http.Header{},
+		Start:         start,
+		FirstByte:     start,
+		End:           end,
+		UpstreamError: upstreamError,
+	})
+	if err != nil {
+		log.Printf("Error recording HTTP response: %v", err)
+	}
+}
+
+// intercept terminates TLS on the client side of a tunnel with a certificate for the host, and serves the calls in
+// it as HTTPS calls to host.
+func (e *Egress) intercept(conn net.Conn, host string, hostname string, caller string) {
+	tlsConn := tls.Server(conn, &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			name := hello.ServerName
+			if name == "" {
+				name = hostname
+			}
+			return e.certificate(name)
+		},
+		NextProtos: []string{"h2", "http/1.1"},
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	err := tlsConn.HandshakeContext(ctx)
+	cancel()
+	if err != nil {
+		log.Printf("Error intercepting TLS to %s: %v", host, err)
+		return
+	}
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.URL.Scheme = "https"
+		r.URL.Host = host
+		e.forward(w, r.WithContext(WithCaller(r.Context(), caller)))
+	})
+	if tlsConn.ConnectionState().NegotiatedProtocol == http2.NextProtoTLS {
+		(&http2.Server{}).ServeConn(tlsConn, &http2.ServeConnOpts{Handler: handler})
+		return
+	}
+	server := &http.Server{Handler: handler}
+	_ = server.Serve(newConnListener(tlsConn))
+}
+
+// certificate returns a certificate for host issued by the local CA, which it keeps for later tunnels.
+func (e *Egress) certificate(host string) (*tls.Certificate, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if cert, ok := e.certs[host]; ok && time.Now().Add(certRenewal).Before(cert.Leaf.NotAfter) {
+		return cert, nil
+	}
+	cert, err := e.ca.Issue(host)
+	if err != nil {
+		return nil, err
+	}
+	e.certs[host] = cert
+	return cert, nil
+}
+
+// proxyCaller returns the user of the Basic Proxy-Authorization of r, which callers set to their service name.
+func proxyCaller(r *http.Request) string {
+	encoded, ok := strings.CutPrefix(r.Header.Get("Proxy-Authorization"), "Basic ")
+	if !ok {
+		return ""
+	}
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return ""
+	}
+	user, _, _ := strings.Cut(string(decoded), ":")
+	return user
+}
+
+// bufferedConn reads what the HTTP server buffered from a hijacked connection before reading from the connection.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// connListener hands a single connection to an http.Server, and then blocks until the connection is closed.
+type connListener struct {
+	conn   net.Conn
+	once   sync.Once
+	closed chan struct{}
+}
+
+func newConnListener(conn net.Conn) *connListener {
+	return &connListener{conn: conn, closed: make(chan struct{})}
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	var conn net.Conn
+	l.once.Do(func() {
+		conn = &closeNotifyingConn{Conn: l.conn, closed: l.closed}
+	})
+	if conn != nil {
+		return conn, nil
+	}
+	<-l.closed
+	return nil, net.ErrClosed
+}
+
+func (l *connListener) Close() error {
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
+
+type closeNotifyingConn struct {
+	net.Conn
+	once   sync.Once
+	closed chan struct{}
+}
+
+func (c *closeNotifyingConn) Close() error {
+	c.once.Do(func() {
+		close(c.closed)
+	})
+	return c.Conn.Close()
+}
@@ -0,0 +1,265 @@
+/*
+ * Copyright (c) 2023 Asim Ihsan.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ * SPDX-License-Identifier: MPL-2.0
+ */
+
+package proxy
+
+import (
+	"crypto/tls"
+	"database/sql"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/asimihsan/virtual-cluster/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEgressRule_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		rule    EgressRule
+		wantErr bool
+	}{
+		{name: "block", rule: EgressRule{Host: "*.stripe.com", Block: true}},
+		{name: "stub", rule: EgressRule{Host: "api.github.com", Method: "GET", Path: "/users/*", Body: "{}"}},
+		{name: "nothing", rule: EgressRule{Host: "api.github.com"}, wantErr: true},
+		{name: "block and stub", rule: EgressRule{Block: true, Status: 200}, wantErr: true},
+		{name: "bad host pattern", rule: EgressRule{Host: "[", Block: true}, wantErr: true},
+		{name: "bad status", rule: EgressRule{Status: 42}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.rule.Validate()
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+// egressClient calls through the egress proxy at proxyURL as the service caller.
+func egressClient(t *testing.T, proxyURL string, caller string, tlsConfig *tls.Config) *http.Client {
+	u, err := url.Parse(proxyURL)
+	assert.NoError(t, err)
+	u.User = url.User(caller)
+	return &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(u), TLSClientConfig: tlsConfig}}
+}
+
+// egressCall is an outbound call as the egress proxy captured it.
+type egressCall struct {
+	processName string
+	caller      string
+	method      string
+	url         string
+	faults      string
+	status      int
+}
+
+func egressCalls(t *testing.T, db *sql.DB, want int) []egressCall {
+	assert.Eventually(t, func() bool {
+		var count int
+		return db.QueryRow("SELECT COUNT(*) FROM http_responses").Scan(&count) == nil && count == want
+	}, 2*time.Second, 10*time.Millisecond)
+	rows, err := db.Query(`
+		SELECT q.process_name, COALESCE(q.caller, ''), q.method, q.url, COALESCE(q.faults, ''), r.status_code
+		FROM http_requests q JOIN http_responses r ON r.http_request_id = q.id ORDER BY q.id`)
+	assert.NoError(t, err)
+	defer rows.Close()
+	var calls []egressCall
+	for rows.Next() {
+		var call egressCall
+		assert.NoError(t, rows.Scan(&call.processName, &call.caller, &call.method, &call.url, &call.faults, &call.status))
+		calls = append(calls, call)
+	}
+	return calls
+}
+
+func TestEgress_CapturesPlainHTTP(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Empty(t, r.Header.Get("Proxy-Authorization"))
+		_, _ = io.WriteString(w, "rates")
+	}))
+	defer backend.Close()
+
+	db := newTestDB(t)
+	rules, err := NewEgressRules([]EgressRule{
+		{Host: "127.0.0.1", Path: "/blocked/**", Block: true},
+		{Host: "127.0.0.1", Method: "POST", Path: "/charges", Status: 201, Body: `{"id":"ch_1"}`,
+			Headers: map[string]string{"Content-Type": "application/json"}},
+	})
+	assert.NoError(t, err)
+	egress := httptest.NewServer(NewEgress(db, WithEgressRules(rules)))
+	defer egress.Close()
+	client := egressClient(t, egress.URL, "orders", nil)
+
+	resp, err := client.Get(backend.URL + "/rates")
+	assert.NoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, "rates", string(body))
+
+	resp, err = client.Post(backend.URL+"/charges", "application/json", strings.NewReader(`{"amount":100}`))
+	assert.NoError(t, err)
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	assert.Equal(t, `{"id":"ch_1"}`, string(body))
+
+	resp, err = client.Get(backend.URL + "/blocked/thing")
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	assert.Equal(t, []egressCall{
+		{processName: "127.0.0.1", caller: "orders", method: "GET", url: backend.URL + "/rates", status: 200},
+		{processName: "127.0.0.1", caller: "orders", method: "POST", url: backend.URL + "/charges",
+			faults: `["egress:stub"]`, status: 201},
+		{processName: "127.0.0.1", caller: "orders", method: "GET", url: backend.URL + "/blocked/thing",
+			faults: `["egress:block"]`, status: 403},
+	}, egressCalls(t, db, 3))
+
+	var requestBody string
+	assert.NoError(t, db.QueryRow("SELECT body FROM http_requests WHERE method = 'POST'").Scan(&requestBody))
+	assert.Equal(t, `{"amount":100}`, requestBody)
+}
+
+func TestEgress_CountsCallsUnderEgress(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "rates")
+	}))
+	defer backend.Close()
+
+	db := newTestDB(t)
+	egress := httptest.NewServer(NewEgress(db))
+	defer egress.Close()
+	client := egressClient(t, egress.URL, "metrics-caller", nil)
+
+	resp, err := client.Get(backend.URL + "/rates")
+	assert.NoError(t, err)
+	resp.Body.Close()
+
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.ProxyRequests.WithLabelValues(EgressService, "metrics-caller", "200")))
+	assert.Equal(t, 0.0, testutil.ToFloat64(metrics.ProxyRequests.WithLabelValues("127.0.0.1", "metrics-caller", "200")))
+}
+
+func TestEgress_TunnelsHTTPS(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "secret")
+	}))
+	defer backend.Close()
+
+	db := newTestDB(t)
+	rules, err := NewEgressRules([]EgressRule{
+		{Host: "127.0.0.1", Body: "stub"},
+		{Host: "localhost", Block: true},
+	})
+	assert.NoError(t, err)
+	egress := httptest.NewServer(NewEgress(db, WithEgressRules(rules)))
+	defer egress.Close()
+	client := egressClient(t, egress.URL, "orders", backend.Client().Transport.(*http.Transport).TLSClientConfig)
+
+	// Stubs cannot answer a tunnel that is not intercepted, so the call reaches the host.
+	resp, err := client.Get(backend.URL + "/secret")
+	assert.NoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, "secret", string(body))
+	client.CloseIdleConnections()
+
+	// Without interception, only host-wide rules that block apply, and they refuse the tunnel.
+	blocked := strings.Replace(backend.URL, "127.0.0.1", "localhost", 1)
+	_, err = client.Get(blocked + "/secret")
+	assert.Error(t, err)
+
+	host := strings.TrimPrefix(backend.URL, "https://")
+	assert.Equal(t, []egressCall{
+		{processName: "127.0.0.1", caller: "orders", method: "CONNECT", url: "//" + host, status: 200},
+		{processName: "localhost", caller: "orders", method: "CONNECT",
+			url: "//" + strings.Replace(host, "127.0.0.1", "localhost", 1), faults: `["egress:block"]`, status: 403},
+	}, egressCalls(t, db, 2))
+}
+
+func TestEgress_InterceptsHTTPS(t *testing.T) {
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "secret "+r.Proto)
+	}))
+	backend.EnableHTTP2 = true
+	backend.StartTLS()
+	defer backend.Close()
+
+	ca, err := LoadOrCreateCA(t.TempDir())
+	assert.NoError(t, err)
+	db := newTestDB(t)
+	upstream := backend.Client().Transport.(*http.Transport).Clone()
+	egress := httptest.NewServer(NewEgress(db, WithEgressMITM(ca), WithEgressProxyOptions(WithTransport(upstream))))
+	defer egress.Close()
+
+	for _, h2 := range []bool{false, true} {
+		u, err := url.Parse(egress.URL)
+		assert.NoError(t, err)
+		u.User = url.User("orders")
+		client := &http.Client{Transport: &http.Transport{
+			Proxy:             http.ProxyURL(u),
+			TLSClientConfig:   &tls.Config{RootCAs: ca.Pool()},
+			ForceAttemptHTTP2: h2,
+		}}
+		resp, err := client.Get(backend.URL + "/secret")
+		assert.NoError(t, err)
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.Equal(t, "secret HTTP/2.0", string(body))
+		client.CloseIdleConnections()
+	}
+
+	// Intercepted calls are captured in full, as calls to the host.
+	assert.Equal(t, []egressCall{
+		{processName: "127.0.0.1", caller: "orders", method: "GET", url: backend.URL + "/secret", status: 200},
+		{processName: "127.0.0.1", caller: "orders", method: "GET", url: backend.URL + "/secret", status: 200},
+	}, egressCalls(t, db, 2))
+}
+
+func TestEgress_PassesInternalCallsOn(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Empty(t, r.Header.Get(CallerHeader), "the service does not see how calls are attributed")
+		_, _ = io.WriteString(w, "order")
+	}))
+	defer backend.Close()
+
+	db := newTestDB(t)
+	p, err := NewProxy(backend.URL, "orders", db)
+	assert.NoError(t, err)
+	proxyPort := httptest.NewServer(p)
+	defer proxyPort.Close()
+
+	internal := strings.TrimPrefix(proxyPort.URL, "http://")
+	egress := httptest.NewServer(NewEgress(db, WithEgressInternalHosts(internal)))
+	defer egress.Close()
+	client := egressClient(t, egress.URL, "frontend", nil)
+
+	resp, err := client.Get(proxyPort.URL + "/orders/1")
+	assert.NoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, "order", string(body))
+
+	// The call is captured once, by the proxy port, with the caller the egress proxy passed on.
+	assert.Equal(t, []egressCall{
+		{processName: "orders", caller: "frontend", method: "GET", url: "/orders/1", status: 200},
+	}, egressCalls(t, db, 1))
+}
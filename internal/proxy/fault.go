@@ -0,0 +1,233 @@
+/*
+ * Copyright (c) 2023 Asim Ihsan.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ * SPDX-License-Identifier: MPL-2.0
+ */
+
+package proxy
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FaultRule injects faults into the requests it matches, to exercise the retries and timeouts of callers. A rule
+// may combine several faults; when it fires, all of them are applied.
+type FaultRule struct {
+	// Method matches the request method. Empty matches every method.
+	Method string `json:"method,omitempty"`
+
+	// Path matches the request path with path.Match, e.g. "/users/*". A pattern ending in "/**" matches everything
+	// under the prefix before it. Empty matches every path.
+	Path string `json:"path,omitempty"`
+
+	// Percentage is how likely the rule is to fire for a matching request, from 0 to 100. Nil means always.
+	Percentage *float64 `json:"percentage,omitempty"`
+
+	// Latency delays the request before it is forwarded.
+	Latency *LatencyFault `json:"latency,omitempty"`
+
+	// Status answers the request with this status code instead of forwarding it.
+	Status int `json:"status,omitempty"`
+
+	// Reset closes the client connection with a TCP reset instead of forwarding the request.
+	Reset bool `json:"reset,omitempty"`
+
+	// TruncateBytes forwards the request but cuts the response body off after this many bytes and drops the
+	// connection.
+	TruncateBytes *int `json:"truncate_bytes,omitempty"`
+}
+
+// LatencyFault is a fixed delay, a delay uniformly distributed between MinMs and MaxMs, or a normally distributed
+// delay with MeanMs and StddevMs. Exactly one of these must be set.
+type LatencyFault struct {
+	FixedMs  *int `json:"fixed_ms,omitempty"`
+	MinMs    *int `json:"min_ms,omitempty"`
+	MaxMs    *int `json:"max_ms,omitempty"`
+	MeanMs   *int `json:"mean_ms,omitempty"`
+	StddevMs *int `json:"stddev_ms,omitempty"`
+}
+
+func (r FaultRule) Validate() error {
+	if r.Path != "" && !validPathPattern(r.Path) {
+		return fmt.Errorf("invalid fault path pattern: %s", r.Path)
+	}
+	if r.Percentage != nil && (*r.Percentage < 0 || *r.Percentage > 100) {
+		return fmt.Errorf("fault percentage must be between 0 and 100: %v", *r.Percentage)
+	}
+	if r.Status != 0 && (r.Status < 100 || r.Status > 999) {
+		return fmt.Errorf("invalid fault status: %d", r.Status)
+	}
+	if r.TruncateBytes != nil && *r.TruncateBytes < 0 {
+		return fmt.Errorf("fault truncate_bytes must not be negative: %d", *r.TruncateBytes)
+	}
+	if r.Status != 0 && r.Reset {
+		return fmt.Errorf("a fault cannot both inject a status and reset the connection")
+	}
+	if r.Latency == nil && r.Status == 0 && !r.Reset && r.TruncateBytes == nil {
+		return fmt.Errorf("fault rule for %s %s injects nothing", r.Method, r.Path)
+	}
+	if r.Latency != nil {
+		return r.Latency.validate()
+	}
+	return nil
+}
+
+func (l LatencyFault) validate() error {
+	fixed := l.FixedMs != nil
+	uniform := l.MinMs != nil || l.MaxMs != nil
+	normal := l.MeanMs != nil || l.StddevMs != nil
+	switch {
+	case fixed && !uniform && !normal:
+		if *l.FixedMs < 0 {
+			return fmt.Errorf("latency fixed_ms must not be negative")
+		}
+	case uniform && !fixed && !normal:
+		if l.MinMs == nil || l.MaxMs == nil || *l.MinMs < 0 || *l.MaxMs < *l.MinMs {
+			return fmt.Errorf("latency needs 0 <= min_ms <= max_ms")
+		}
+	case normal && !fixed && !uniform:
+		if l.MeanMs == nil || l.StddevMs == nil || *l.MeanMs < 0 || *l.StddevMs < 0 {
+			return fmt.Errorf("latency needs non-negative mean_ms and stddev_ms")
+		}
+	default:
+		return fmt.Errorf("latency needs exactly one of fixed_ms, min_ms and max_ms, or mean_ms and stddev_ms")
+	}
+	return nil
+}
+
+func (l LatencyFault) sample(rnd *rand.Rand) time.Duration {
+	var ms float64
+	switch {
+	case l.FixedMs != nil:
+		ms = float64(*l.FixedMs)
+	case l.MinMs != nil:
+		ms = float64(*l.MinMs) + rnd.Float64()*float64(*l.MaxMs-*l.MinMs)
+	default:
+		ms = float64(*l.MeanMs) + rnd.NormFloat64()*float64(*l.StddevMs)
+	}
+	if ms < 0 {
+		ms = 0
+	}
+	return time.Duration(ms * float64(time.Millisecond))
+}
+
+func (r FaultRule) matches(req *http.Request) bool {
+	return requestMatches(r.Method, r.Path, req)
+}
+
+// requestMatches reports whether req has method, and a path matching pattern as described for FaultRule.Path. Empty
+// method and pattern match everything.
+func requestMatches(method string, pattern string, req *http.Request) bool {
+	if method != "" && !strings.EqualFold(method, req.Method) {
+		return false
+	}
+	if pattern == "" {
+		return true
+	}
+	if prefix, ok := strings.CutSuffix(pattern, "/**"); ok {
+		return req.URL.Path == prefix || strings.HasPrefix(req.URL.Path, prefix+"/")
+	}
+	matched, _ := path.Match(pattern, req.URL.Path)
+	return matched
+}
+
+// validPathPattern reports whether pattern is a valid FaultRule.Path.
+func validPathPattern(pattern string) bool {
+	_, err := path.Match(strings.TrimSuffix(pattern, "/**"), "/")
+	return err == nil
+}
+
+// Faults is the set of fault rules of one proxy. It is safe to replace the rules while the proxy is serving.
+type Faults struct {
+	mu    sync.Mutex
+	rules []FaultRule
+	rnd   *rand.Rand
+}
+
+func NewFaults(rules []FaultRule) (*Faults, error) {
+	f := &Faults{rnd: rand.New(rand.NewSource(time.Now().UnixNano()))}
+	if err := f.Set(rules); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Set replaces the rules.
+func (f *Faults) Set(rules []FaultRule) error {
+	for _, rule := range rules {
+		if err := rule.Validate(); err != nil {
+			return err
+		}
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.rules = append([]FaultRule(nil), rules...)
+	return nil
+}
+
+// Rules returns a copy of the current rules.
+func (f *Faults) Rules() []FaultRule {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]FaultRule{}, f.rules...)
+}
+
+// injection is the combined effect of the rules that fired for a request.
+type injection struct {
+	latency       time.Duration
+	status        int
+	reset         bool
+	truncateBytes *int
+
+	// applied describes each injected fault, e.g. "latency:150ms", for the captured request row.
+	applied []string
+}
+
+// pick decides which faults to inject into a request. Every matching rule fires independently; when several inject
+// a status or truncate the body, the first one wins.
+func (f *Faults) pick(req *http.Request) injection {
+	var inj injection
+	if f == nil {
+		return inj
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, rule := range f.rules {
+		if !rule.matches(req) {
+			continue
+		}
+		if rule.Percentage != nil && f.rnd.Float64()*100 >= *rule.Percentage {
+			continue
+		}
+
+		if rule.Latency != nil {
+			latency := rule.Latency.sample(f.rnd)
+			inj.latency += latency
+			inj.applied = append(inj.applied, fmt.Sprintf("latency:%s", latency.Round(time.Millisecond)))
+		}
+		if rule.Reset && !inj.reset && inj.status == 0 {
+			inj.reset = true
+			inj.applied = append(inj.applied, "reset")
+		}
+		if rule.Status != 0 && inj.status == 0 && !inj.reset {
+			inj.status = rule.Status
+			inj.applied = append(inj.applied, fmt.Sprintf("status:%d", rule.Status))
+		}
+		if rule.TruncateBytes != nil && inj.truncateBytes == nil {
+			inj.truncateBytes = rule.TruncateBytes
+			inj.applied = append(inj.applied, fmt.Sprintf("truncate:%d", *rule.TruncateBytes))
+		}
+	}
+	return inj
+}
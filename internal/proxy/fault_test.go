@@ -0,0 +1,156 @@
+/*
+ * Copyright (c) 2023 Asim Ihsan.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ * SPDX-License-Identifier: MPL-2.0
+ */
+
+package proxy
+
+import (
+	"database/sql"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/asimihsan/virtual-cluster/internal/schema"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+)
+
+func intPtr(v int) *int {
+	return &v
+}
+
+func floatPtr(v float64) *float64 {
+	return &v
+}
+
+func TestFaultRule_Matches(t *testing.T) {
+	tests := []struct {
+		rule    FaultRule
+		method  string
+		path    string
+		matches bool
+	}{
+		{FaultRule{}, "GET", "/anything", true},
+		{FaultRule{Method: "POST"}, "GET", "/users", false},
+		{FaultRule{Method: "get", Path: "/users/*"}, "GET", "/users/1", true},
+		{FaultRule{Path: "/users/*"}, "GET", "/users/1/orders", false},
+		{FaultRule{Path: "/users/**"}, "GET", "/users/1/orders", true},
+		{FaultRule{Path: "/users/**"}, "GET", "/users", true},
+		{FaultRule{Path: "/users/**"}, "GET", "/usersx", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.rule.Method+" "+tt.rule.Path+" "+tt.path, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.path, nil)
+			assert.Equal(t, tt.matches, tt.rule.matches(r))
+		})
+	}
+}
+
+func TestFaultRule_Validate(t *testing.T) {
+	assert.Error(t, FaultRule{}.Validate())
+	assert.Error(t, FaultRule{Status: 42}.Validate())
+	assert.Error(t, FaultRule{Status: 503, Percentage: floatPtr(120)}.Validate())
+	assert.Error(t, FaultRule{Status: 503, Reset: true}.Validate())
+	assert.Error(t, FaultRule{Latency: &LatencyFault{}}.Validate())
+	assert.Error(t, FaultRule{Latency: &LatencyFault{FixedMs: intPtr(10), MinMs: intPtr(1)}}.Validate())
+	assert.Error(t, FaultRule{Latency: &LatencyFault{MinMs: intPtr(10), MaxMs: intPtr(5)}}.Validate())
+	assert.NoError(t, FaultRule{Latency: &LatencyFault{MeanMs: intPtr(100), StddevMs: intPtr(20)}}.Validate())
+	assert.NoError(t, FaultRule{Path: "/users/**", Status: 503, Percentage: floatPtr(12.5)}.Validate())
+}
+
+func TestFaults_Pick(t *testing.T) {
+	faults, err := NewFaults([]FaultRule{
+		{Path: "/slow", Latency: &LatencyFault{MinMs: intPtr(100), MaxMs: intPtr(200)}},
+		{Path: "/slow", Status: 503},
+		{Path: "/slow", Status: 500},
+		{Path: "/never", Status: 503, Percentage: floatPtr(0)},
+	})
+	assert.NoError(t, err)
+	faults.rnd = rand.New(rand.NewSource(1))
+
+	inj := faults.pick(httptest.NewRequest("GET", "/slow", nil))
+	assert.Equal(t, 503, inj.status)
+	assert.GreaterOrEqual(t, inj.latency, 100*time.Millisecond)
+	assert.LessOrEqual(t, inj.latency, 200*time.Millisecond)
+	assert.Len(t, inj.applied, 2)
+	assert.Equal(t, "status:503", inj.applied[1])
+
+	inj = faults.pick(httptest.NewRequest("GET", "/never", nil))
+	assert.Empty(t, inj.applied)
+
+	var none *Faults
+	assert.Empty(t, none.pick(httptest.NewRequest("GET", "/slow", nil)).applied)
+}
+
+func newTestDB(t *testing.T) *sql.DB {
+	db, err := sql.Open("sqlite3", ":memory:")
+	assert.NoError(t, err)
+	db.SetMaxOpenConns(1)
+	assert.NoError(t, schema.Create(db))
+	return db
+}
+
+func newTestProxy(t *testing.T, rules []FaultRule) (*httptest.Server, *sql.DB) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "0123456789")
+	}))
+	t.Cleanup(backend.Close)
+
+	db := newTestDB(t)
+
+	faults, err := NewFaults(rules)
+	assert.NoError(t, err)
+	p, err := NewProxy(backend.URL, "orders", db, WithFaults(faults))
+	assert.NoError(t, err)
+	server := httptest.NewServer(p)
+	t.Cleanup(server.Close)
+	return server, db
+}
+
+func TestProxy_InjectsStatus(t *testing.T) {
+	server, db := newTestProxy(t, []FaultRule{{Method: "GET", Path: "/orders/*", Status: 503}})
+
+	resp, err := http.Get(server.URL + "/orders/1")
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, 503, resp.StatusCode)
+
+	resp, err = http.Get(server.URL + "/health")
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, 200, resp.StatusCode)
+
+	var faults sql.NullString
+	assert.NoError(t, db.QueryRow("SELECT faults FROM http_requests WHERE url = '/orders/1'").Scan(&faults))
+	assert.Equal(t, `["status:503"]`, faults.String)
+	assert.NoError(t, db.QueryRow("SELECT faults FROM http_requests WHERE url = '/health'").Scan(&faults))
+	assert.False(t, faults.Valid)
+}
+
+func TestProxy_TruncatesBody(t *testing.T) {
+	server, _ := newTestProxy(t, []FaultRule{{TruncateBytes: intPtr(4)}})
+
+	resp, err := http.Get(server.URL + "/orders")
+	assert.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Error(t, err)
+	assert.Equal(t, "0123", string(body))
+}
+
+func TestProxy_ResetsConnection(t *testing.T) {
+	server, _ := newTestProxy(t, []FaultRule{{Reset: true}})
+
+	_, err := http.Get(server.URL + "/orders")
+	assert.Error(t, err)
+}
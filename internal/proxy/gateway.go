@@ -0,0 +1,76 @@
+/*
+ * Copyright (c) 2023 Asim Ihsan.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ * SPDX-License-Identifier: MPL-2.0
+ */
+
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Gateway is a single listener in front of several services. A request goes to the handler registered for its
+// host, and otherwise to the one with the longest path prefix that matches it, so that frontends only need one base
+// URL. Each handler is usually the Proxy of a service, which captures the traffic as it would on the service's own
+// proxy port.
+type Gateway struct {
+	hosts map[string]http.Handler
+	paths []gatewayPath
+}
+
+type gatewayPath struct {
+	prefix  string
+	handler http.Handler
+}
+
+func NewGateway() *Gateway {
+	return &Gateway{hosts: make(map[string]http.Handler)}
+}
+
+// Host routes requests for host, with or without a port, to handler.
+func (g *Gateway) Host(host string, handler http.Handler) {
+	g.hosts[strings.ToLower(host)] = handler
+}
+
+// Route routes requests whose path is prefix, or is below it, to handler. The path is passed on unchanged.
+func (g *Gateway) Route(prefix string, handler http.Handler) {
+	g.paths = append(g.paths, gatewayPath{prefix: strings.TrimSuffix(prefix, "/"), handler: handler})
+	sort.SliceStable(g.paths, func(i, j int) bool {
+		return len(g.paths[i].prefix) > len(g.paths[j].prefix)
+	})
+}
+
+func (g *Gateway) handler(r *http.Request) http.Handler {
+	host := strings.ToLower(r.Host)
+	if handler, ok := g.hosts[host]; ok {
+		return handler
+	}
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		if handler, ok := g.hosts[hostname]; ok {
+			return handler
+		}
+	}
+	for _, path := range g.paths {
+		if path.prefix == "" || r.URL.Path == path.prefix || strings.HasPrefix(r.URL.Path, path.prefix+"/") {
+			return path.handler
+		}
+	}
+	return nil
+}
+
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	handler := g.handler(r)
+	if handler == nil {
+		http.Error(w, "no gateway route for "+r.Host+r.URL.Path, http.StatusNotFound)
+		return
+	}
+	handler.ServeHTTP(w, r)
+}
@@ -0,0 +1,116 @@
+/*
+ * Copyright (c) 2023 Asim Ihsan.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ * SPDX-License-Identifier: MPL-2.0
+ */
+
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGateway(t *testing.T) {
+	named := func(name string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = io.WriteString(w, name)
+		})
+	}
+	gateway := NewGateway()
+	gateway.Route("/orders", named("orders"))
+	gateway.Route("/orders/admin/", named("admin"))
+	gateway.Route("/", named("frontend"))
+	gateway.Host("Payments.local", named("payments"))
+
+	tests := []struct {
+		host       string
+		path       string
+		wantStatus int
+		wantBody   string
+	}{
+		{host: "localhost:8000", path: "/orders", wantStatus: http.StatusOK, wantBody: "orders"},
+		{host: "localhost:8000", path: "/orders/1", wantStatus: http.StatusOK, wantBody: "orders"},
+		{host: "localhost:8000", path: "/orders/admin/users", wantStatus: http.StatusOK, wantBody: "admin"},
+		{host: "localhost:8000", path: "/ordersx", wantStatus: http.StatusOK, wantBody: "frontend"},
+		{host: "payments.local:8000", path: "/orders", wantStatus: http.StatusOK, wantBody: "payments"},
+		{host: "PAYMENTS.LOCAL", path: "/charges", wantStatus: http.StatusOK, wantBody: "payments"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.host+tt.path, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "http://"+tt.host+tt.path, nil)
+			w := httptest.NewRecorder()
+			gateway.ServeHTTP(w, r)
+			assert.Equal(t, tt.wantStatus, w.Code)
+			assert.Equal(t, tt.wantBody, w.Body.String())
+		})
+	}
+
+	withoutFallback := NewGateway()
+	withoutFallback.Route("/orders", named("orders"))
+	w := httptest.NewRecorder()
+	withoutFallback.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/payments", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestGateway_CapturesByService(t *testing.T) {
+	db := newTestDB(t)
+	gateway := NewGateway()
+	for _, name := range []string{"orders", "payments"} {
+		name := name
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = fmt.Fprintf(w, "%s %s", name, r.URL.Path)
+		}))
+		defer backend.Close()
+		p, err := NewProxy(backend.URL, name, db)
+		assert.NoError(t, err)
+		if name == "orders" {
+			gateway.Route("/orders", p)
+		} else {
+			gateway.Host("payments.local", p)
+		}
+	}
+	server := httptest.NewServer(gateway)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/orders/1")
+	assert.NoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, "orders /orders/1", string(body))
+
+	r, err := http.NewRequest(http.MethodGet, server.URL+"/charges", nil)
+	assert.NoError(t, err)
+	r.Host = "payments.local"
+	resp, err = http.DefaultClient.Do(r)
+	assert.NoError(t, err)
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, "payments /charges", string(body))
+
+	assert.Eventually(t, func() bool {
+		var count int
+		return db.QueryRow("SELECT COUNT(*) FROM http_responses").Scan(&count) == nil && count == 2
+	}, time.Second, 10*time.Millisecond)
+	rows, err := db.Query("SELECT process_name, url FROM http_requests ORDER BY id")
+	assert.NoError(t, err)
+	defer rows.Close()
+	var captured []string
+	for rows.Next() {
+		var name, url string
+		assert.NoError(t, rows.Scan(&name, &url))
+		captured = append(captured, name+" "+url)
+	}
+	assert.Equal(t, []string{"orders /orders/1", "payments /charges"}, captured)
+}
@@ -0,0 +1,384 @@
+/*
+ * Copyright (c) 2023 Asim Ihsan.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ * SPDX-License-Identifier: MPL-2.0
+ */
+
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/net/http2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/dynamicpb"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Directions of gRPC messages.
+const (
+	GRPCRequest  = "request"
+	GRPCResponse = "response"
+)
+
+// GRPCMessage is a length-prefixed message of a gRPC call.
+type GRPCMessage struct {
+	Direction string
+
+	// Sequence numbers the messages of the call in each direction, from 0.
+	Sequence   int
+	Compressed bool
+
+	// Payload is the serialized message, up to the capture limit, and Size its whole length.
+	Payload   []byte
+	Size      int64
+	Truncated bool
+
+	// JSON is the message decoded with the descriptor of the method, and DecodeError why it could not be decoded.
+	JSON        string
+	DecodeError string
+
+	Time time.Time
+}
+
+// GRPCCall is the outcome of a gRPC call.
+type GRPCCall struct {
+	Service string
+	Method  string
+
+	// Metadata is the request metadata, ResponseMetadata the response headers and Trailers the response trailers.
+	Metadata         http.Header
+	ResponseMetadata http.Header
+	Trailers         http.Header
+
+	// StatusCode is the grpc-status of the call, nil if the call ended without one.
+	StatusCode    *int
+	StatusMessage string
+
+	Start time.Time
+	End   time.Time
+}
+
+// isGRPC reports whether a request is a gRPC call, as opposed to gRPC-Web or plain HTTP.
+func isGRPC(r *http.Request) bool {
+	contentType := r.Header.Get("Content-Type")
+	return contentType == "application/grpc" || strings.HasPrefix(contentType, "application/grpc+") ||
+		strings.HasPrefix(contentType, "application/grpc;")
+}
+
+// splitGRPCPath splits the path of a gRPC call, such as /helloworld.Greeter/SayHello, into service and method.
+func splitGRPCPath(path string) (string, string) {
+	service, method, _ := strings.Cut(strings.TrimPrefix(path, "/"), "/")
+	return service, method
+}
+
+// newH2CTransport returns a transport that speaks HTTP/2 without TLS, as gRPC services listening on plain ports do.
+func newH2CTransport() *http2.Transport {
+	return &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, addr)
+		},
+	}
+}
+
+// grpcCapture records a gRPC call passing through the proxy, message by message.
+type grpcCapture struct {
+	proxy     *Proxy
+	requestID int64
+	call      GRPCCall
+
+	resolveOnce sync.Once
+	descriptor  protoreflect.MethodDescriptor
+	resolveErr  error
+}
+
+func (p *Proxy) startGRPCCapture(r *http.Request, requestID int64, start time.Time) *grpcCapture {
+	if !isGRPC(r) {
+		return nil
+	}
+	service, method := splitGRPCPath(r.URL.Path)
+	c := &grpcCapture{
+		proxy:     p,
+		requestID: requestID,
+		call:      GRPCCall{Service: service, Method: method, Metadata: r.Header.Clone(), Start: start},
+	}
+	if r.Body != nil && r.Body != http.NoBody {
+		r.Body = &tapReader{ReadCloser: r.Body, tap: c.newMessageParser(GRPCRequest, r.Header)}
+	}
+	return c
+}
+
+// tapResponse parses the response messages as the client reads them.
+func (c *grpcCapture) tapResponse(res *http.Response) {
+	if res.Body != nil && res.Body != http.NoBody {
+		res.Body = &tapReader{ReadCloser: res.Body, tap: c.newMessageParser(GRPCResponse, res.Header)}
+	}
+}
+
+// finish records the call once the response is complete. The status is in the trailers, or in the headers of a
+// response that has only headers.
+func (c *grpcCapture) finish(header http.Header, trailers http.Header, upstreamError string, end time.Time) {
+	c.call.ResponseMetadata = header
+	c.call.Trailers = trailers
+	c.call.End = end
+	for _, source := range []http.Header{trailers, header} {
+		if status := source.Get("Grpc-Status"); status != "" {
+			if code, err := strconv.Atoi(status); err == nil {
+				c.call.StatusCode = &code
+				c.call.StatusMessage = decodeGRPCMessage(source.Get("Grpc-Message"))
+				break
+			}
+		}
+	}
+	if c.call.StatusCode == nil && upstreamError != "" {
+		c.call.StatusMessage = upstreamError
+	}
+	if err := RecordGRPCCall(c.proxy.db, c.requestID, c.proxy.processName, c.call); err != nil {
+		log.Printf("Error recording gRPC call: %v", err)
+	}
+}
+
+func (c *grpcCapture) newMessageParser(direction string, header http.Header) *messageParser {
+	return &messageParser{
+		direction: direction,
+		encoding:  header.Get("Grpc-Encoding"),
+		limit:     c.proxy.captureLimit,
+		emit:      c.record,
+	}
+}
+
+func (c *grpcCapture) record(message GRPCMessage, encoding string) {
+	c.decode(&message, encoding)
+	if c.proxy.verbose {
+		log.Debug().
+			Str("process_name", c.proxy.processName).
+			Str("service", c.call.Service).
+			Str("method", c.call.Method).
+			Str("direction", message.Direction).
+			Str("message", message.JSON).
+			Msg("Captured gRPC message")
+	}
+	err := RecordGRPCMessage(c.proxy.db, c.requestID, c.proxy.processName, c.call.Service, c.call.Method, message)
+	if err != nil {
+		log.Printf("Error recording gRPC message: %v", err)
+	}
+}
+
+// decode fills in the JSON form of a message, if the method can be resolved.
+func (c *grpcCapture) decode(message *GRPCMessage, encoding string) {
+	if c.proxy.grpcResolver == nil {
+		return
+	}
+	if message.Truncated {
+		message.DecodeError = "message is larger than the capture limit"
+		return
+	}
+	payload := message.Payload
+	if message.Compressed {
+		if encoding != "gzip" {
+			message.DecodeError = fmt.Sprintf("message is compressed with unsupported encoding %q", encoding)
+			return
+		}
+		reader, err := gzip.NewReader(bytes.NewReader(payload))
+		if err == nil {
+			payload, err = io.ReadAll(reader)
+		}
+		if err != nil {
+			message.DecodeError = err.Error()
+			return
+		}
+	}
+
+	c.resolveOnce.Do(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		c.descriptor, c.resolveErr = c.proxy.grpcResolver.FindMethod(ctx, c.call.Service, c.call.Method)
+	})
+	if c.resolveErr != nil {
+		message.DecodeError = c.resolveErr.Error()
+		return
+	}
+
+	messageType := c.descriptor.Input()
+	if message.Direction == GRPCResponse {
+		messageType = c.descriptor.Output()
+	}
+	decoded := dynamicpb.NewMessage(messageType)
+	if err := proto.Unmarshal(payload, decoded); err != nil {
+		message.DecodeError = err.Error()
+		return
+	}
+	encoded, err := protojson.Marshal(decoded)
+	if err != nil {
+		message.DecodeError = err.Error()
+		return
+	}
+	message.JSON = string(encoded)
+}
+
+// decodeGRPCMessage decodes the percent-encoding of a grpc-message header.
+func decodeGRPCMessage(message string) string {
+	if decoded, err := url.PathUnescape(message); err == nil {
+		return decoded
+	}
+	return message
+}
+
+// tapReader passes what is read through it to tap.
+type tapReader struct {
+	io.ReadCloser
+	tap io.Writer
+}
+
+func (r *tapReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 {
+		_, _ = r.tap.Write(p[:n])
+	}
+	return n, err
+}
+
+// messageParser parses the length-prefixed messages of one direction of a gRPC call as the bytes arrive. Each message
+// is a compressed flag, a 4-byte big-endian length and the message itself.
+type messageParser struct {
+	direction string
+	encoding  string
+	limit     int
+	emit      func(GRPCMessage, string)
+
+	header    []byte
+	message   GRPCMessage
+	inMessage bool
+	remaining uint32
+	payload   bytes.Buffer
+	sequence  int
+}
+
+func (m *messageParser) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		if !m.inMessage {
+			take := 5 - len(m.header)
+			if take > len(p) {
+				take = len(p)
+			}
+			m.header = append(m.header, p[:take]...)
+			p = p[take:]
+			if len(m.header) < 5 {
+				continue
+			}
+			m.remaining = binary.BigEndian.Uint32(m.header[1:])
+			m.message = GRPCMessage{
+				Direction:  m.direction,
+				Sequence:   m.sequence,
+				Compressed: m.header[0]&1 != 0,
+				Size:       int64(m.remaining),
+			}
+			m.payload.Reset()
+			m.inMessage = true
+			if m.remaining == 0 {
+				m.finishMessage()
+			}
+			continue
+		}
+
+		take := uint32(len(p))
+		if take > m.remaining {
+			take = m.remaining
+		}
+		if room := m.limit - m.payload.Len(); room > 0 {
+			keep := int(take)
+			if keep > room {
+				keep = room
+			}
+			m.payload.Write(p[:keep])
+		}
+		m.remaining -= take
+		p = p[take:]
+		if m.remaining == 0 {
+			m.finishMessage()
+		}
+	}
+	return n, nil
+}
+
+func (m *messageParser) finishMessage() {
+	message := m.message
+	message.Payload = append([]byte(nil), m.payload.Bytes()...)
+	message.Truncated = message.Size > int64(len(message.Payload))
+	message.Time = time.Now()
+	m.header = m.header[:0]
+	m.inMessage = false
+	m.sequence++
+	m.emit(message, m.encoding)
+}
+
+// RecordGRPCMessage stores a message of the gRPC call made by the request with id requestID in the grpc_messages
+// table. The serialized message is kept only when it could not be decoded.
+func RecordGRPCMessage(
+	db *sql.DB,
+	requestID int64,
+	processName string,
+	service string,
+	method string,
+	message GRPCMessage,
+) error {
+	var payload []byte
+	var messageJSON, decodeError *string
+	if message.JSON != "" {
+		messageJSON = &message.JSON
+	} else {
+		payload = message.Payload
+	}
+	if message.DecodeError != "" {
+		decodeError = &message.DecodeError
+	}
+	_, err := db.Exec(`
+		INSERT INTO grpc_messages (timestamp, http_request_id, process_name, service, method, direction, sequence, compressed, size, truncated, message_json, payload, decode_error)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		formatTimestamp(message.Time), requestID, processName, service, method, message.Direction,
+		message.Sequence, message.Compressed, message.Size, message.Truncated, messageJSON, payload, decodeError)
+	return err
+}
+
+// RecordGRPCCall stores the outcome of the gRPC call made by the request with id requestID in the grpc_calls table.
+func RecordGRPCCall(db *sql.DB, requestID int64, processName string, call GRPCCall) error {
+	metadata, _ := json.Marshal(nonNilHeader(call.Metadata))
+	responseMetadata, _ := json.Marshal(nonNilHeader(call.ResponseMetadata))
+	trailers, _ := json.Marshal(nonNilHeader(call.Trailers))
+	var statusName *string
+	if call.StatusCode != nil {
+		name := codes.Code(*call.StatusCode).String()
+		statusName = &name
+	}
+	_, err := db.Exec(`
+		INSERT INTO grpc_calls (http_request_id, process_name, service, method, metadata, response_metadata, trailers, status_code, status_name, status_message, started_at, ended_at, duration_ms)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		requestID, processName, call.Service, call.Method, string(metadata), string(responseMetadata),
+		string(trailers), call.StatusCode, statusName, call.StatusMessage, formatTimestamp(call.Start),
+		formatTimestamp(call.End), float64(call.End.Sub(call.Start))/float64(time.Millisecond))
+	return err
+}
@@ -0,0 +1,259 @@
+/*
+ * Copyright (c) 2023 Asim Ihsan.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ * SPDX-License-Identifier: MPL-2.0
+ */
+
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	rpb "google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"os"
+	"sync"
+	"time"
+)
+
+// MethodResolver finds the descriptors of gRPC methods, so that their messages can be decoded.
+type MethodResolver interface {
+	FindMethod(ctx context.Context, service string, method string) (protoreflect.MethodDescriptor, error)
+}
+
+func findMethod(files *protoregistry.Files, service string, method string) (protoreflect.MethodDescriptor, error) {
+	descriptor, err := files.FindDescriptorByName(protoreflect.FullName(service))
+	if err != nil {
+		return nil, errors.Wrapf(err, "unknown gRPC service: %s", service)
+	}
+	serviceDescriptor, ok := descriptor.(protoreflect.ServiceDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("not a gRPC service: %s", service)
+	}
+	methodDescriptor := serviceDescriptor.Methods().ByName(protoreflect.Name(method))
+	if methodDescriptor == nil {
+		return nil, fmt.Errorf("unknown gRPC method: %s/%s", service, method)
+	}
+	return methodDescriptor, nil
+}
+
+// descriptorSetResolver resolves methods from FileDescriptorSet files, as written by
+// protoc --include_imports --descriptor_set_out.
+type descriptorSetResolver struct {
+	files *protoregistry.Files
+}
+
+// NewDescriptorSetResolver loads the FileDescriptorSet files at paths.
+func NewDescriptorSetResolver(paths ...string) (MethodResolver, error) {
+	set := &descriptorpb.FileDescriptorSet{}
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read descriptor set: %s", path)
+		}
+		var fileSet descriptorpb.FileDescriptorSet
+		if err := proto.Unmarshal(data, &fileSet); err != nil {
+			return nil, errors.Wrapf(err, "failed to parse descriptor set: %s", path)
+		}
+		set.File = append(set.File, fileSet.File...)
+	}
+	files, err := protodesc.NewFiles(dedupeFiles(set))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to load descriptor sets")
+	}
+	return &descriptorSetResolver{files: files}, nil
+}
+
+func (r *descriptorSetResolver) FindMethod(
+	_ context.Context,
+	service string,
+	method string,
+) (protoreflect.MethodDescriptor, error) {
+	return findMethod(r.files, service, method)
+}
+
+// dedupeFiles drops files repeated across descriptor sets, such as shared imports.
+func dedupeFiles(set *descriptorpb.FileDescriptorSet) *descriptorpb.FileDescriptorSet {
+	seen := map[string]bool{}
+	deduped := &descriptorpb.FileDescriptorSet{}
+	for _, file := range set.File {
+		if seen[file.GetName()] {
+			continue
+		}
+		seen[file.GetName()] = true
+		deduped.File = append(deduped.File, file)
+	}
+	return deduped
+}
+
+// reflectionRetryInterval is how long a failed reflection lookup is remembered, so that a service without reflection
+// is not asked on every call.
+const reflectionRetryInterval = 30 * time.Second
+
+// reflectionResolver resolves methods by asking the service through the gRPC server reflection protocol.
+type reflectionResolver struct {
+	target string
+
+	mu       sync.Mutex
+	conn     *grpc.ClientConn
+	services map[string]*protoregistry.Files
+	failures map[string]reflectionFailure
+}
+
+type reflectionFailure struct {
+	err error
+	at  time.Time
+}
+
+// NewReflectionResolver resolves methods through server reflection of the gRPC server at target, a host:port.
+func NewReflectionResolver(target string) MethodResolver {
+	return &reflectionResolver{
+		target:   target,
+		services: map[string]*protoregistry.Files{},
+		failures: map[string]reflectionFailure{},
+	}
+}
+
+func (r *reflectionResolver) FindMethod(
+	ctx context.Context,
+	service string,
+	method string,
+) (protoreflect.MethodDescriptor, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	files, ok := r.services[service]
+	if !ok {
+		if failure, failed := r.failures[service]; failed && time.Since(failure.at) < reflectionRetryInterval {
+			return nil, failure.err
+		}
+		var err error
+		files, err = r.load(ctx, service)
+		if err != nil {
+			err = errors.Wrapf(err, "server reflection failed for %s", service)
+			r.failures[service] = reflectionFailure{err: err, at: time.Now()}
+			return nil, err
+		}
+		r.services[service] = files
+		delete(r.failures, service)
+	}
+	return findMethod(files, service, method)
+}
+
+// load fetches the file defining service, and the files it imports, from the server.
+func (r *reflectionResolver) load(ctx context.Context, service string) (*protoregistry.Files, error) {
+	if r.conn == nil {
+		conn, err := grpc.Dial(r.target, grpc.WithTransportCredentials(insecure.NewCredentials()))
+		if err != nil {
+			return nil, err
+		}
+		r.conn = conn
+	}
+	stream, err := rpb.NewServerReflectionClient(r.conn).ServerReflectionInfo(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = stream.CloseSend()
+	}()
+
+	ask := func(request *rpb.ServerReflectionRequest) ([]*descriptorpb.FileDescriptorProto, error) {
+		if err := stream.Send(request); err != nil {
+			return nil, err
+		}
+		response, err := stream.Recv()
+		if err != nil {
+			return nil, err
+		}
+		if errorResponse := response.GetErrorResponse(); errorResponse != nil {
+			return nil, fmt.Errorf("%s", errorResponse.GetErrorMessage())
+		}
+		var files []*descriptorpb.FileDescriptorProto
+		for _, encoded := range response.GetFileDescriptorResponse().GetFileDescriptorProto() {
+			file := &descriptorpb.FileDescriptorProto{}
+			if err := proto.Unmarshal(encoded, file); err != nil {
+				return nil, err
+			}
+			files = append(files, file)
+		}
+		return files, nil
+	}
+
+	found, err := ask(&rpb.ServerReflectionRequest{
+		MessageRequest: &rpb.ServerReflectionRequest_FileContainingSymbol{FileContainingSymbol: service},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Servers usually send the imports along with the file, but fetch any that are missing.
+	set := &descriptorpb.FileDescriptorSet{}
+	byName := map[string]bool{}
+	for len(found) > 0 {
+		file := found[0]
+		found = found[1:]
+		if byName[file.GetName()] {
+			continue
+		}
+		byName[file.GetName()] = true
+		set.File = append(set.File, file)
+		for _, dependency := range file.GetDependency() {
+			if byName[dependency] {
+				continue
+			}
+			if known, err := protoregistry.GlobalFiles.FindFileByPath(dependency); err == nil {
+				found = append(found, protodesc.ToFileDescriptorProto(known))
+				continue
+			}
+			imported, err := ask(&rpb.ServerReflectionRequest{
+				MessageRequest: &rpb.ServerReflectionRequest_FileByFilename{FileByFilename: dependency},
+			})
+			if err != nil {
+				return nil, err
+			}
+			found = append(found, imported...)
+		}
+	}
+	return protodesc.NewFiles(set)
+}
+
+// chainResolver tries each resolver in turn.
+type chainResolver []MethodResolver
+
+// ChainResolvers resolves methods with the first of resolvers that knows them.
+func ChainResolvers(resolvers ...MethodResolver) MethodResolver {
+	if len(resolvers) == 1 {
+		return resolvers[0]
+	}
+	return chainResolver(resolvers)
+}
+
+func (c chainResolver) FindMethod(
+	ctx context.Context,
+	service string,
+	method string,
+) (protoreflect.MethodDescriptor, error) {
+	var errs []error
+	for _, resolver := range c {
+		descriptor, err := resolver.FindMethod(ctx, service, method)
+		if err == nil {
+			return descriptor, nil
+		}
+		errs = append(errs, err)
+	}
+	if len(errs) == 0 {
+		return nil, fmt.Errorf("no descriptors configured for %s/%s", service, method)
+	}
+	return nil, errs[len(errs)-1]
+}
@@ -0,0 +1,237 @@
+/*
+ * Copyright (c) 2023 Asim Ihsan.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ * SPDX-License-Identifier: MPL-2.0
+ */
+
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+func TestMessageParser(t *testing.T) {
+	tests := []struct {
+		name  string
+		input []byte
+		want  []GRPCMessage
+	}{
+		{
+			name:  "one message",
+			input: []byte{0, 0, 0, 0, 3, 'a', 'b', 'c'},
+			want:  []GRPCMessage{{Payload: []byte("abc"), Size: 3}},
+		},
+		{
+			name:  "empty and compressed messages",
+			input: []byte{0, 0, 0, 0, 0, 1, 0, 0, 0, 1, 'z'},
+			want: []GRPCMessage{
+				{Size: 0},
+				{Sequence: 1, Compressed: true, Payload: []byte("z"), Size: 1},
+			},
+		},
+		{
+			name:  "beyond the capture limit",
+			input: append([]byte{0, 0, 0, 0, 6}, "abcdef"...),
+			want:  []GRPCMessage{{Payload: []byte("abcd"), Size: 6, Truncated: true}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []GRPCMessage
+			parser := &messageParser{direction: GRPCRequest, limit: 4, emit: func(message GRPCMessage, _ string) {
+				message.Time = time.Time{}
+				got = append(got, message)
+			}}
+			// Feed a byte at a time, as messages may be split anywhere across HTTP/2 frames.
+			for _, b := range tt.input {
+				_, _ = parser.Write([]byte{b})
+			}
+			for i := range tt.want {
+				tt.want[i].Direction = GRPCRequest
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func newGRPCBackend(t *testing.T) (string, *health.Server) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	server := grpc.NewServer()
+	healthServer := health.NewServer()
+	healthpb.RegisterHealthServer(server, healthServer)
+	reflection.Register(server)
+	go func() {
+		_ = server.Serve(listener)
+	}()
+	t.Cleanup(server.Stop)
+	return listener.Addr().String(), healthServer
+}
+
+func newGRPCProxy(t *testing.T, backend string, db *sql.DB, opts ...ProxyOption) healthpb.HealthClient {
+	p, err := NewProxy("http://"+backend, "health", db, opts...)
+	assert.NoError(t, err)
+	server := httptest.NewServer(h2c.NewHandler(p, &http2.Server{}))
+	t.Cleanup(server.Close)
+
+	conn, err := grpc.Dial(strings.TrimPrefix(server.URL, "http://"),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	assert.NoError(t, err)
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	return healthpb.NewHealthClient(conn)
+}
+
+func readGRPCMessages(t *testing.T, db *sql.DB) []string {
+	rows, err := db.Query(`SELECT direction, COALESCE(message_json, decode_error) FROM grpc_messages ORDER BY id`)
+	assert.NoError(t, err)
+	defer rows.Close()
+	var messages []string
+	for rows.Next() {
+		var direction, message string
+		assert.NoError(t, rows.Scan(&direction, &message))
+		messages = append(messages, direction+" "+strings.ReplaceAll(message, " ", ""))
+	}
+	return messages
+}
+
+func TestProxy_CapturesUnaryGRPCCall(t *testing.T) {
+	backend, healthServer := newGRPCBackend(t)
+	healthServer.SetServingStatus("orders", healthpb.HealthCheckResponse_SERVING)
+	db := newTestDB(t)
+	client := newGRPCProxy(t, backend, db, WithGRPCResolver(NewReflectionResolver(backend)))
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "x-tenant", "acme")
+	resp, err := client.Check(ctx, &healthpb.HealthCheckRequest{Service: "orders"})
+	assert.NoError(t, err)
+	assert.Equal(t, healthpb.HealthCheckResponse_SERVING, resp.Status)
+
+	_, err = client.Check(context.Background(), &healthpb.HealthCheckRequest{Service: "missing"})
+	assert.Error(t, err)
+
+	var calls []string
+	assert.Eventually(t, func() bool {
+		rows, err := db.Query(`SELECT service, method, metadata, status_code, status_name, status_message FROM grpc_calls ORDER BY id`)
+		assert.NoError(t, err)
+		defer rows.Close()
+		calls = nil
+		for rows.Next() {
+			var service, method, metadata, statusName, statusMessage string
+			var statusCode int
+			assert.NoError(t, rows.Scan(&service, &method, &metadata, &statusCode, &statusName, &statusMessage))
+			if statusCode == 0 {
+				assert.Contains(t, metadata, "X-Tenant")
+			}
+			calls = append(calls, strings.Join([]string{service, method, statusName, statusMessage}, " "))
+		}
+		return len(calls) == 2
+	}, 2*time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{
+		"grpc.health.v1.Health Check OK ",
+		"grpc.health.v1.Health Check NotFound unknown service",
+	}, calls)
+
+	assert.Equal(t, []string{
+		`request {"service":"orders"}`,
+		`response {"status":"SERVING"}`,
+		`request {"service":"missing"}`,
+	}, readGRPCMessages(t, db))
+}
+
+func TestProxy_CapturesStreamingGRPCCall(t *testing.T) {
+	backend, healthServer := newGRPCBackend(t)
+	healthServer.SetServingStatus("orders", healthpb.HealthCheckResponse_SERVING)
+
+	// Describe the service with a descriptor set, as protoc --include_imports --descriptor_set_out writes it.
+	set := &descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{
+		protodesc.ToFileDescriptorProto(healthpb.File_grpc_health_v1_health_proto),
+	}}
+	encoded, err := proto.Marshal(set)
+	assert.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "health.pb")
+	assert.NoError(t, os.WriteFile(path, encoded, 0644))
+	resolver, err := NewDescriptorSetResolver(path)
+	assert.NoError(t, err)
+
+	db := newTestDB(t)
+	client := newGRPCProxy(t, backend, db, WithGRPCResolver(resolver))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream, err := client.Watch(ctx, &healthpb.HealthCheckRequest{Service: "orders"})
+	assert.NoError(t, err)
+	update, err := stream.Recv()
+	assert.NoError(t, err)
+	assert.Equal(t, healthpb.HealthCheckResponse_SERVING, update.Status)
+
+	// Each message is captured as it passes, while the call is still open.
+	healthServer.SetServingStatus("orders", healthpb.HealthCheckResponse_NOT_SERVING)
+	update, err = stream.Recv()
+	assert.NoError(t, err)
+	assert.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, update.Status)
+	assert.Eventually(t, func() bool {
+		return len(readGRPCMessages(t, db)) == 3
+	}, 2*time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{
+		`request {"service":"orders"}`,
+		`response {"status":"SERVING"}`,
+		`response {"status":"NOT_SERVING"}`,
+	}, readGRPCMessages(t, db))
+
+	var sequences bytes.Buffer
+	rows, err := db.Query(`SELECT sequence FROM grpc_messages WHERE direction = 'response' ORDER BY id`)
+	assert.NoError(t, err)
+	defer rows.Close()
+	for rows.Next() {
+		var sequence int
+		assert.NoError(t, rows.Scan(&sequence))
+		sequences.WriteByte(byte('0' + sequence))
+	}
+	assert.Equal(t, "01", sequences.String())
+}
+
+func TestProxy_CapturesGRPCWithoutDescriptors(t *testing.T) {
+	backend, _ := newGRPCBackend(t)
+	db := newTestDB(t)
+	client := newGRPCProxy(t, backend, db)
+
+	_, err := client.Check(context.Background(), &healthpb.HealthCheckRequest{Service: ""})
+	assert.NoError(t, err)
+
+	var payload []byte
+	var json sql.NullString
+	err = db.QueryRow(`SELECT payload, message_json FROM grpc_messages WHERE direction = 'response'`).Scan(&payload, &json)
+	assert.NoError(t, err)
+	assert.False(t, json.Valid)
+	var response healthpb.HealthCheckResponse
+	assert.NoError(t, proto.Unmarshal(payload, &response))
+	assert.Equal(t, healthpb.HealthCheckResponse_SERVING, response.Status)
+}
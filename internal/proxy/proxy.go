@@ -11,14 +11,18 @@
 package proxy
 
 import (
-	"bytes"
 	"database/sql"
 	"encoding/json"
+	"fmt"
+	"github.com/asimihsan/virtual-cluster/internal/metrics"
 	"github.com/rs/zerolog/log"
-	"io"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type Proxy struct {
@@ -26,6 +30,24 @@ type Proxy struct {
 	processName string
 	db          *sql.DB
 	verbose     bool
+	faults      *Faults
+
+	captureLimit int
+	blobs        *BlobStore
+
+	// grpcResolver decodes the messages of gRPC calls, and h2c carries gRPC calls to the service.
+	grpcResolver MethodResolver
+	h2c          http.RoundTripper
+
+	// transport, if set, carries requests to the target in place of http.DefaultTransport.
+	transport http.RoundTripper
+
+	// client names the managed service on the other end of a connection, for requests that do not name their caller.
+	client func(conn net.Conn) string
+
+	// egress is set on the proxies the egress proxy creates for external hosts, whose metrics are counted under the
+	// service "egress" rather than under each host.
+	egress bool
 }
 
 type ProxyOption func(*Proxy)
@@ -36,6 +58,49 @@ func WithVerbose(verbose bool) ProxyOption {
 	}
 }
 
+// WithFaults injects faults into proxied requests according to the rules in faults.
+func WithFaults(faults *Faults) ProxyOption {
+	return func(p *Proxy) {
+		p.faults = faults
+	}
+}
+
+// WithCaptureLimit sets how many bytes of each request and response body are stored in the database.
+func WithCaptureLimit(limit int) ProxyOption {
+	return func(p *Proxy) {
+		p.captureLimit = limit
+	}
+}
+
+// WithBlobStore keeps bodies larger than the capture limit in blobs, which the captured rows reference.
+func WithBlobStore(blobs *BlobStore) ProxyOption {
+	return func(p *Proxy) {
+		p.blobs = blobs
+	}
+}
+
+// WithTransport carries requests to the target with transport, e.g. one that trusts the local CA.
+func WithTransport(transport http.RoundTripper) ProxyOption {
+	return func(p *Proxy) {
+		p.transport = transport
+	}
+}
+
+// WithClient attributes requests that do not name their caller to the service client finds for their connection.
+// The server must keep its connections with ConnContext.
+func WithClient(client func(conn net.Conn) string) ProxyOption {
+	return func(p *Proxy) {
+		p.client = client
+	}
+}
+
+// WithGRPCResolver decodes the messages of captured gRPC calls to JSON with the method descriptors from resolver.
+func WithGRPCResolver(resolver MethodResolver) ProxyOption {
+	return func(p *Proxy) {
+		p.grpcResolver = resolver
+	}
+}
+
 func NewProxy(
 	target string,
 	processName string,
@@ -51,6 +116,9 @@ func NewProxy(
 		target:      targetURL,
 		processName: processName,
 		db:          db,
+
+		captureLimit: DefaultCaptureLimit,
+		h2c:          newH2CTransport(),
 	}
 	for _, opt := range opts {
 		opt(proxy)
@@ -62,100 +130,320 @@ type responseRecorder struct {
 	http.ResponseWriter
 	statusCode int
 	headers    http.Header
-	body       bytes.Buffer
+	body       *bodyCapture
+	written    int
+	firstByte  time.Time
+
+	// limit, if set, is how many body bytes are passed on to the client before the rest is dropped.
+	limit *int
 }
 
 func (rr *responseRecorder) WriteHeader(statusCode int) {
-	rr.statusCode = statusCode
+	if rr.firstByte.IsZero() {
+		rr.firstByte = time.Now()
+	}
+	// Informational responses, such as 103 Early Hints, may precede the final one.
+	if statusCode >= 200 && rr.statusCode == 0 {
+		rr.statusCode = statusCode
+		rr.headers = rr.ResponseWriter.Header().Clone()
+		rr.body.setHeader(rr.headers)
+	}
 	rr.ResponseWriter.WriteHeader(statusCode)
 }
 
 func (rr *responseRecorder) Write(b []byte) (int, error) {
-	rr.body.Write(b)
-	return rr.ResponseWriter.Write(b)
+	if rr.statusCode == 0 {
+		rr.WriteHeader(http.StatusOK)
+	}
+	if rr.limit != nil {
+		remaining := *rr.limit - rr.written
+		if remaining < len(b) {
+			if remaining > 0 {
+				_, _ = rr.body.Write(b[:remaining])
+				_, _ = rr.ResponseWriter.Write(b[:remaining])
+				rr.written += remaining
+			}
+			// Pretend the write succeeded so that the reverse proxy does not log an error for the fault.
+			return len(b), nil
+		}
+	}
+	n, err := rr.ResponseWriter.Write(b)
+	_, _ = rr.body.Write(b[:n])
+	rr.written += n
+	return n, err
 }
 
-func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	// Read the request body into a buffer
-	bodyBytes, err := io.ReadAll(r.Body)
-	if err != nil {
-		log.Printf("Error reading request body: %v", err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-		return
+// Flush sends buffered data to the client, so that streamed responses such as server-sent events arrive as the
+// service produces them.
+func (rr *responseRecorder) Flush() {
+	if rr.statusCode == 0 {
+		rr.WriteHeader(http.StatusOK)
+	}
+	if flusher, ok := rr.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
 	}
-	r.Body.Close()
+}
 
-	// Create new io.ReadCloser from the buffer
-	rBody1 := io.NopCloser(bytes.NewReader(bodyBytes))
+// Unwrap gives http.ResponseController access to the client connection, e.g. to hijack it for protocol upgrades.
+func (rr *responseRecorder) Unwrap() http.ResponseWriter {
+	return rr.ResponseWriter
+}
 
-	// Record the HTTP request into the SQLite table
-	headers, _ := json.Marshal(r.Header)
-	if p.verbose {
-		log.Debug().
-			Str("process_name", p.processName).
-			Str("method", r.Method).
-			Str("url", r.URL.String()).
-			Str("body", string(bodyBytes)).
-			Msg("Captured HTTP request")
+// trailers returns the trailers the handler set after the body, both those announced in the Trailer header and those
+// set with http.TrailerPrefix.
+func (rr *responseRecorder) trailers() http.Header {
+	trailers := http.Header{}
+	header := rr.ResponseWriter.Header()
+	for _, announced := range rr.headers.Values("Trailer") {
+		for _, name := range strings.Split(announced, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if values, ok := header[name]; ok && name != "" {
+				trailers[name] = values
+			}
+		}
+	}
+	for name, values := range header {
+		if strings.HasPrefix(name, http.TrailerPrefix) {
+			trailers[http.CanonicalHeaderKey(strings.TrimPrefix(name, http.TrailerPrefix))] = values
+		}
 	}
+	return trailers
+}
 
-	tx, err := p.db.Begin()
-	if err != nil {
-		log.Printf("Error beginning transaction: %v", err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-		return
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+
+	// Record the HTTP request into the SQLite table. The body is streamed through to the service rather than read
+	// up front, so that large and long-lived bodies pass through, and is filled in once the exchange is over.
+	inj := p.faults.pick(r)
+	if RequestCaller(r) == "" {
+		if caller := connCaller(r.Context(), p.client); caller != "" {
+			r = r.WithContext(WithCaller(r.Context(), caller))
+		}
 	}
+	r = startSpan(r)
 
-	res, err := tx.Exec(`
-		INSERT INTO http_requests (process_name, method, url, headers, body)
-	VALUES (?, ?, ?, ?, ?)`,
-		p.processName, r.Method, r.URL.String(), string(headers), string(bodyBytes))
+	requestID, err := RecordRequest(p.db, p.processName, r, CapturedBody{}, inj.applied)
 	if err != nil {
 		log.Printf("Error recording HTTP request: %v", err)
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
+	// The caller is recorded with the request, and the service does not need to see how it was attributed.
+	r.Header.Del(CallerHeader)
+	requestBody := newBodyCapture(p.captureLimit, p.blobs)
+	requestBody.setHeader(r.Header)
+	if r.Body != nil && r.Body != http.NoBody {
+		r.Body = &captureReader{ReadCloser: r.Body, capture: requestBody}
+	}
+	// The request body is recorded before the response, which readers of the response row join against.
+	requestRecorded := false
+	var requestSize int64
+	recordRequestBody := func() {
+		if requestRecorded {
+			return
+		}
+		requestRecorded = true
+		body := requestBody.finish()
+		requestSize = body.Size
+		if p.verbose {
+			log.Debug().
+				Str("process_name", p.processName).
+				Str("method", r.Method).
+				Str("url", r.URL.String()).
+				Str("body", string(body.Data)).
+				Int64("body_size", body.Size).
+				Msg("Captured HTTP request")
+		}
+		if err := UpdateRequestBody(p.db, requestID, body); err != nil {
+			log.Printf("Error recording HTTP request body: %v", err)
+		}
+	}
+	defer recordRequestBody()
 
-	requestID, err := res.LastInsertId()
-	if err != nil {
-		log.Printf("Error getting last insert ID: %v", err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	if inj.latency > 0 {
+		select {
+		case <-time.After(inj.latency):
+		case <-r.Context().Done():
+			return
+		}
+	}
+	if inj.reset {
+		resetConnection(w)
 		return
 	}
-
-	err = tx.Commit()
-	if err != nil {
-		log.Printf("Error committing transaction: %v", err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	if inj.status != 0 {
+		header := http.Header{"Content-Type": []string{"text/plain; charset=utf-8"}}
+		body := []byte(fmt.Sprintf("fault injected by vcluster: status %d\n", inj.status))
+		for key, values := range header {
+			w.Header()[key] = values
+		}
+		firstByte := time.Now()
+		w.WriteHeader(inj.status)
+		_, _ = w.Write(body)
+		end := time.Now()
+		recordRequestBody()
+		p.observe(r, inj.status, end.Sub(start), requestSize, int64(len(body)))
+		err := RecordResponse(p.db, requestID, p.processName, CapturedResponse{
+			StatusCode: inj.status,
+			Header:     header,
+			Body:       NewCapturedBody(body, header),
+			Start:      start,
+			FirstByte:  firstByte,
+			End:        end,
+		})
+		if err != nil {
+			log.Printf("Error recording HTTP response: %v", err)
+		}
+		if err := recordSpan(p.db, p.processName, r, inj.status, "", start, end); err != nil {
+			log.Printf("Error recording span: %v", err)
+		}
 		return
 	}
 
-	// Replace the original request body with the second io.ReadCloser
-	r.Body = rBody1
+	// Create a responseRecorder to capture the status code, headers and body as they stream to the client
+	rr := &responseRecorder{
+		ResponseWriter: w,
+		headers:        make(http.Header),
+		body:           newBodyCapture(p.captureLimit, p.blobs),
+		limit:          inj.truncateBytes,
+	}
 
-	// Create a responseRecorder to capture the status code, headers and body
-	rr := &responseRecorder{ResponseWriter: w, headers: make(http.Header)}
+	// gRPC calls need HTTP/2 all the way to the service, and are captured message by message
+	grpcCall := p.startGRPCCapture(r, requestID, start)
 
-	// Pass the responseRecorder to the proxy
+	// Pass the responseRecorder to the proxy, keeping the error if the service could not be reached
+	var upstreamError string
 	proxy := httputil.NewSingleHostReverseProxy(p.target)
-	proxy.ServeHTTP(rr, r)
+	if p.transport != nil {
+		proxy.Transport = p.transport
+	}
+	if grpcCall != nil && p.target.Scheme == "http" {
+		proxy.Transport = p.h2c
+	}
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		upstreamError = err.Error()
+		log.Printf("Error proxying HTTP request: %v", err)
+		w.WriteHeader(http.StatusBadGateway)
+	}
+	proxy.ModifyResponse = func(res *http.Response) error {
+		// The reverse proxy writes a protocol switch straight to the hijacked client connection, bypassing the
+		// recorder, and then copies the connection in both directions until either side closes it.
+		if res.StatusCode == http.StatusSwitchingProtocols {
+			rr.statusCode = res.StatusCode
+			rr.headers = res.Header.Clone()
+			rr.firstByte = time.Now()
+			if isWebSocketUpgrade(res) {
+				p.tapWebSocket(res, requestID)
+			}
+		}
+		if grpcCall != nil {
+			grpcCall.tapResponse(res)
+		}
+		return nil
+	}
+	aborted := serveRecovering(proxy, rr, r)
+	end := time.Now()
+	if aborted != nil && upstreamError == "" {
+		upstreamError = "response aborted"
+	}
 
 	// Record the HTTP response into the SQLite table
-	headers, _ = json.Marshal(rr.headers)
-	body := rr.body.String()
+	recordRequestBody()
+	trailers := rr.trailers()
+	if grpcCall != nil {
+		grpcCall.finish(rr.headers, trailers, upstreamError, end)
+	}
+	body := rr.body.finish()
+	p.observe(r, rr.statusCode, end.Sub(start), requestSize, body.Size)
 	if p.verbose {
+		headers, _ := json.Marshal(rr.headers)
 		log.Debug().
 			Str("process_name", p.processName).
 			Int("status_code", rr.statusCode).
 			Str("headers", string(headers)).
-			Str("body", body).
+			Str("body", string(body.Data)).
+			Int64("body_size", body.Size).
 			Msg("Captured HTTP response")
 	}
 
-	_, err = p.db.Exec(
-		`INSERT INTO http_responses (http_request_id, process_name, status_code, headers, body) VALUES (?, ?, ?, ?, ?)`,
-		requestID, p.processName, rr.statusCode, string(headers), body)
+	err = RecordResponse(p.db, requestID, p.processName, CapturedResponse{
+		StatusCode:    rr.statusCode,
+		Header:        rr.headers,
+		Trailer:       trailers,
+		Body:          body,
+		Start:         start,
+		FirstByte:     rr.firstByte,
+		End:           end,
+		UpstreamError: upstreamError,
+	})
 	if err != nil {
 		log.Printf("Error recording HTTP response: %v", err)
 	}
+	if err := recordSpan(p.db, p.processName, r, rr.statusCode, upstreamError, start, end); err != nil {
+		log.Printf("Error recording span: %v", err)
+	}
+
+	if aborted != nil {
+		panic(aborted)
+	}
+
+	if inj.truncateBytes != nil {
+		// Send what was let through, then drop the connection so that the client sees the body end early rather
+		// than a shorter, complete one.
+		if flusher, ok := w.(http.Flusher); ok {
+			flusher.Flush()
+		}
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// observe counts a request the proxy has served in its metrics. Labels are kept to bounded sets: the calls of all
+// external hosts are counted under the service "egress", and methods other than the standard ones as "other".
+func (p *Proxy) observe(r *http.Request, statusCode int, duration time.Duration, requestSize int64, responseSize int64) {
+	service := p.processName
+	if p.egress {
+		service = EgressService
+	}
+	caller := CallerFrom(r.Context())
+	metrics.ProxyRequests.WithLabelValues(service, caller, strconv.Itoa(statusCode)).Inc()
+	metrics.ProxyRequestDuration.WithLabelValues(service, caller, metricsMethod(r.Method)).Observe(duration.Seconds())
+	metrics.ProxyBytes.WithLabelValues(service, caller, "request").Add(float64(requestSize))
+	metrics.ProxyBytes.WithLabelValues(service, caller, "response").Add(float64(responseSize))
+}
+
+// metricsMethod returns method if it is one of the standard HTTP methods, or else "other".
+func metricsMethod(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete,
+		http.MethodConnect, http.MethodOptions, http.MethodTrace:
+		return method
+	}
+	return "other"
+}
+
+// serveRecovering serves the request, returning the value of a panic instead of propagating it, so that the response
+// can be recorded before the connection is aborted.
+func serveRecovering(handler http.Handler, w http.ResponseWriter, r *http.Request) (aborted interface{}) {
+	defer func() {
+		aborted = recover()
+	}()
+	handler.ServeHTTP(w, r)
+	return nil
+}
+
+// resetConnection closes the client connection with a TCP RST.
+func resetConnection(w http.ResponseWriter) {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		panic(http.ErrAbortHandler)
+	}
+	conn, _, err := hijacker.Hijack()
+	if err != nil {
+		panic(http.ErrAbortHandler)
+	}
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		_ = tcpConn.SetLinger(0)
+	}
+	_ = conn.Close()
 }
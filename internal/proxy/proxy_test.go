@@ -0,0 +1,273 @@
+/*
+ * Copyright (c) 2023 Asim Ihsan.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ * SPDX-License-Identifier: MPL-2.0
+ */
+
+package proxy
+
+import (
+	"database/sql"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/asimihsan/virtual-cluster/internal/metrics"
+	"github.com/asimihsan/virtual-cluster/internal/tracing"
+	"github.com/asimihsan/virtual-cluster/internal/utils"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+)
+
+type capturedRow struct {
+	statusCode    int
+	headers       http.Header
+	trailers      http.Header
+	startedAt     time.Time
+	firstByteAt   time.Time
+	endedAt       time.Time
+	durationMs    float64
+	upstreamError sql.NullString
+	remoteAddr    string
+}
+
+func readCapturedRow(t *testing.T, db *sql.DB) capturedRow {
+	var row capturedRow
+	var headers string
+	var trailers sql.NullString
+	var startedAt, firstByteAt, endedAt string
+	err := db.QueryRow(`
+		SELECT resp.status_code, resp.headers, resp.trailers, resp.started_at, resp.first_byte_at, resp.ended_at,
+			resp.duration_ms, resp.upstream_error, req.remote_addr
+		FROM http_responses resp JOIN http_requests req ON req.id = resp.http_request_id`).Scan(
+		&row.statusCode, &headers, &trailers, &startedAt, &firstByteAt, &endedAt, &row.durationMs,
+		&row.upstreamError, &row.remoteAddr)
+	assert.NoError(t, err)
+
+	assert.NoError(t, json.Unmarshal([]byte(headers), &row.headers))
+	if trailers.Valid {
+		assert.NoError(t, json.Unmarshal([]byte(trailers.String), &row.trailers))
+	}
+	row.startedAt, err = time.Parse(utils.TimestampFormat, startedAt)
+	assert.NoError(t, err)
+	row.firstByteAt, err = time.Parse(utils.TimestampFormat, firstByteAt)
+	assert.NoError(t, err)
+	row.endedAt, err = time.Parse(utils.TimestampFormat, endedAt)
+	assert.NoError(t, err)
+	return row
+}
+
+func TestProxy_CapturesHeadersTrailersAndTimings(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "X-Checksum")
+		w.Header().Set("X-Request-Id", "abc")
+		w.WriteHeader(http.StatusCreated)
+		time.Sleep(20 * time.Millisecond)
+		_, _ = io.WriteString(w, "created")
+		w.Header().Set("X-Checksum", "42")
+	}))
+	defer backend.Close()
+
+	db := newTestDB(t)
+	p, err := NewProxy(backend.URL, "orders", db)
+	assert.NoError(t, err)
+	server := httptest.NewServer(p)
+	defer server.Close()
+
+	resp, err := http.Post(server.URL+"/orders", "text/plain", nil)
+	assert.NoError(t, err)
+	_, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, "42", resp.Trailer.Get("X-Checksum"))
+
+	row := readCapturedRow(t, db)
+	assert.Equal(t, http.StatusCreated, row.statusCode)
+	assert.Equal(t, "abc", row.headers.Get("X-Request-Id"))
+	assert.Equal(t, "42", row.trailers.Get("X-Checksum"))
+	assert.False(t, row.firstByteAt.Before(row.startedAt))
+	assert.False(t, row.endedAt.Before(row.firstByteAt))
+	assert.GreaterOrEqual(t, row.durationMs, 20.0)
+	assert.False(t, row.upstreamError.Valid)
+	assert.Contains(t, row.remoteAddr, "127.0.0.1:")
+}
+
+func TestProxy_CapturesUpstreamError(t *testing.T) {
+	backend := httptest.NewServer(http.NotFoundHandler())
+	backendURL := backend.URL
+	backend.Close()
+
+	db := newTestDB(t)
+	p, err := NewProxy(backendURL, "orders", db)
+	assert.NoError(t, err)
+	server := httptest.NewServer(p)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/orders")
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+
+	row := readCapturedRow(t, db)
+	assert.Equal(t, http.StatusBadGateway, row.statusCode)
+	assert.True(t, row.upstreamError.Valid)
+	assert.Contains(t, row.upstreamError.String, "connection refused")
+}
+
+func TestProxy_AttributesCaller(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Empty(t, r.Header.Get(CallerHeader))
+	}))
+	defer backend.Close()
+
+	db := newTestDB(t)
+	var resolved int
+	p, err := NewProxy(backend.URL, "orders", db, WithClient(func(conn net.Conn) string {
+		resolved++
+		return "frontend"
+	}))
+	assert.NoError(t, err)
+	server := httptest.NewUnstartedServer(p)
+	server.Config.ConnContext = ConnContext
+	server.Start()
+	defer server.Close()
+
+	// Requests naming their caller keep it; the others get the one found for their connection, which is only looked
+	// up once.
+	for _, path := range []string{"/named", "/a", "/b"} {
+		r, err := http.NewRequest(http.MethodGet, server.URL+path, nil)
+		assert.NoError(t, err)
+		if path == "/named" {
+			r.Header.Set(CallerHeader, "checkout")
+		}
+		resp, err := http.DefaultClient.Do(r)
+		assert.NoError(t, err)
+		_, _ = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+	assert.Equal(t, 1, resolved)
+
+	rows, err := db.Query("SELECT url, caller FROM http_requests ORDER BY id")
+	assert.NoError(t, err)
+	defer rows.Close()
+	callers := make(map[string]string)
+	for rows.Next() {
+		var url, caller string
+		assert.NoError(t, rows.Scan(&url, &caller))
+		callers[url] = caller
+	}
+	assert.Equal(t, map[string]string{"/named": "checkout", "/a": "frontend", "/b": "frontend"}, callers)
+}
+
+func TestProxy_PropagatesTraceparent(t *testing.T) {
+	received := make(chan string, 2)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header.Get(tracing.TraceparentHeader)
+	}))
+	defer backend.Close()
+
+	db := newTestDB(t)
+	p, err := NewProxy(backend.URL, "orders", db)
+	assert.NoError(t, err)
+	server := httptest.NewServer(p)
+	defer server.Close()
+
+	// A request from outside any trace starts one; a request within a trace continues it under a new span.
+	const incoming = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	for _, traceparent := range []string{"", incoming} {
+		r, err := http.NewRequest(http.MethodGet, server.URL, nil)
+		assert.NoError(t, err)
+		if traceparent != "" {
+			r.Header.Set(tracing.TraceparentHeader, traceparent)
+		}
+		resp, err := http.DefaultClient.Do(r)
+		assert.NoError(t, err)
+		resp.Body.Close()
+	}
+
+	rows, err := db.Query("SELECT trace_id, span_id, parent_span_id FROM http_requests ORDER BY id")
+	assert.NoError(t, err)
+	defer rows.Close()
+	var spans []tracing.TraceContext
+	for rows.Next() {
+		var span tracing.TraceContext
+		var parentSpanID sql.NullString
+		assert.NoError(t, rows.Scan(&span.TraceID, &span.SpanID, &parentSpanID))
+		span.ParentSpanID = parentSpanID.String
+		spans = append(spans, span)
+	}
+	assert.Len(t, spans, 2)
+
+	root, ok := tracing.Parse(<-received)
+	assert.True(t, ok)
+	assert.Equal(t, spans[0].TraceID, root.TraceID)
+	assert.Equal(t, spans[0].SpanID, root.SpanID)
+	assert.Empty(t, spans[0].ParentSpanID)
+
+	child, ok := tracing.Parse(<-received)
+	assert.True(t, ok)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", child.TraceID)
+	assert.Equal(t, spans[1].SpanID, child.SpanID)
+	assert.NotEqual(t, "00f067aa0ba902b7", child.SpanID)
+	assert.Equal(t, "00f067aa0ba902b7", spans[1].ParentSpanID)
+
+	// The spans the services are passed are exported, so that the spans of the services connect to their callers'.
+	rows, err = db.Query("SELECT service_name, trace_id, span_id, COALESCE(parent_span_id, ''), kind, status_code FROM otel_spans ORDER BY id")
+	assert.NoError(t, err)
+	defer rows.Close()
+	var exported []tracing.TraceContext
+	for rows.Next() {
+		var serviceName, kind, statusCode string
+		var span tracing.TraceContext
+		assert.NoError(t, rows.Scan(&serviceName, &span.TraceID, &span.SpanID, &span.ParentSpanID, &kind, &statusCode))
+		assert.Equal(t, "orders", serviceName)
+		assert.Equal(t, "server", kind)
+		assert.Equal(t, "unset", statusCode)
+		exported = append(exported, span)
+	}
+	assert.Equal(t, spans, exported)
+}
+
+func TestProxy_CountsRequestsInMetrics(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte("created"))
+	}))
+	defer backend.Close()
+
+	db := newTestDB(t)
+	p, err := NewProxy(backend.URL, "metrics-test", db)
+	assert.NoError(t, err)
+	server := httptest.NewServer(p)
+	defer server.Close()
+
+	resp, err := http.Post(server.URL, "text/plain", strings.NewReader("order"))
+	assert.NoError(t, err)
+	resp.Body.Close()
+
+	req, err := http.NewRequest("PURGE", server.URL, nil)
+	assert.NoError(t, err)
+	resp, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	resp.Body.Close()
+
+	assert.Equal(t, 2.0, testutil.ToFloat64(metrics.ProxyRequests.WithLabelValues("metrics-test", "", "201")))
+	assert.Equal(t, 5.0, testutil.ToFloat64(metrics.ProxyBytes.WithLabelValues("metrics-test", "", "request")))
+	assert.Equal(t, 14.0, testutil.ToFloat64(metrics.ProxyBytes.WithLabelValues("metrics-test", "", "response")))
+	for _, method := range []string{http.MethodPost, "other"} {
+		var latency dto.Metric
+		histogram := metrics.ProxyRequestDuration.WithLabelValues("metrics-test", "", method).(prometheus.Histogram)
+		assert.NoError(t, histogram.Write(&latency))
+		assert.Equal(t, uint64(1), latency.GetHistogram().GetSampleCount(), method)
+	}
+}
@@ -0,0 +1,129 @@
+/*
+ * Copyright (c) 2023 Asim Ihsan.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ * SPDX-License-Identifier: MPL-2.0
+ */
+
+package proxy
+
+import (
+	"database/sql"
+	"encoding/json"
+	"github.com/asimihsan/virtual-cluster/internal/metrics"
+	"github.com/asimihsan/virtual-cluster/internal/schema"
+	"github.com/asimihsan/virtual-cluster/internal/utils"
+	"net/http"
+	"time"
+)
+
+// RecordRequest stores a request in the http_requests table under processName and returns its id. faults lists the
+// faults injected into the request, if any.
+func RecordRequest(db *sql.DB, processName string, r *http.Request, body CapturedBody, faults []string) (int64, error) {
+	headers, _ := json.Marshal(r.Header)
+	var injectedFaults *string
+	if len(faults) > 0 {
+		encoded, _ := json.Marshal(faults)
+		injectedFaults = new(string)
+		*injectedFaults = string(encoded)
+	}
+	var caller *string
+	if name := RequestCaller(r); name != "" {
+		caller = &name
+	}
+	var traceID, spanID, parentSpanID *string
+	if span, ok := requestTrace(r); ok {
+		traceID, spanID, parentSpanID = &span.TraceID, schema.NullIfEmpty(span.SpanID), schema.NullIfEmpty(span.ParentSpanID)
+	}
+	start := time.Now()
+	res, err := db.Exec(`
+		INSERT INTO http_requests (process_name, method, url, headers, body, body_size, body_truncated, body_binary, body_blob, content_type, content_encoding, body_decoded, faults, remote_addr, caller, trace_id, span_id, parent_span_id)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		processName, r.Method, r.URL.String(), string(headers), body.value(), body.Size, body.Truncated, body.Binary,
+		body.blob(), body.ContentType, body.ContentEncoding, body.Decoded, injectedFaults, r.RemoteAddr, caller,
+		traceID, spanID, parentSpanID)
+	metrics.ObserveWrite("http_requests", start, err)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// UpdateRequestBody replaces the body of the request with id requestID. The proxy records a request as soon as it
+// arrives and fills in the body once it has streamed through.
+func UpdateRequestBody(db *sql.DB, requestID int64, body CapturedBody) error {
+	start := time.Now()
+	_, err := db.Exec(`
+		UPDATE http_requests SET body = ?, body_size = ?, body_truncated = ?, body_binary = ?, body_blob = ?,
+			content_type = ?, content_encoding = ?, body_decoded = ?
+	WHERE id = ?`,
+		body.value(), body.Size, body.Truncated, body.Binary, body.blob(), body.ContentType, body.ContentEncoding,
+		body.Decoded, requestID)
+	metrics.ObserveWrite("http_requests", start, err)
+	return err
+}
+
+// CapturedResponse is a response as the client received it.
+type CapturedResponse struct {
+	StatusCode int
+	Header     http.Header
+	Trailer    http.Header
+	Body       CapturedBody
+
+	// Start is when the request arrived, FirstByte when the response status line was sent, and End when the last
+	// byte of the body was sent.
+	Start     time.Time
+	FirstByte time.Time
+	End       time.Time
+
+	// UpstreamError is why the service could not be reached, for responses generated by the proxy itself.
+	UpstreamError string
+}
+
+// RecordResponse stores the response to the request with id requestID in the http_responses table.
+func RecordResponse(db *sql.DB, requestID int64, processName string, resp CapturedResponse) error {
+	headers, _ := json.Marshal(nonNilHeader(resp.Header))
+	var trailers *string
+	if len(resp.Trailer) > 0 {
+		encoded, _ := json.Marshal(resp.Trailer)
+		trailers = new(string)
+		*trailers = string(encoded)
+	}
+	var upstreamError *string
+	if resp.UpstreamError != "" {
+		upstreamError = &resp.UpstreamError
+	}
+	firstByte := resp.FirstByte
+	if firstByte.IsZero() {
+		firstByte = resp.End
+	}
+
+	start := time.Now()
+	_, err := db.Exec(
+		`INSERT INTO http_responses (http_request_id, process_name, status_code, headers, body, body_size, body_truncated, body_binary, body_blob, content_type, content_encoding, body_decoded, trailers, started_at, first_byte_at, ended_at, duration_ms, upstream_error) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		requestID, processName, resp.StatusCode, string(headers), resp.Body.value(), resp.Body.Size,
+		resp.Body.Truncated, resp.Body.Binary, resp.Body.blob(), resp.Body.ContentType, resp.Body.ContentEncoding,
+		resp.Body.Decoded, trailers,
+		formatTimestamp(resp.Start), formatTimestamp(firstByte), formatTimestamp(resp.End),
+		float64(resp.End.Sub(resp.Start))/float64(time.Millisecond), upstreamError)
+	metrics.ObserveWrite("http_responses", start, err)
+	return err
+}
+
+func nonNilHeader(header http.Header) http.Header {
+	if header == nil {
+		return http.Header{}
+	}
+	return header
+}
+
+func formatTimestamp(t time.Time) *string {
+	if t.IsZero() {
+		return nil
+	}
+	formatted := t.UTC().Format(utils.TimestampFormat)
+	return &formatted
+}
@@ -0,0 +1,317 @@
+/*
+ * Copyright (c) 2023 Asim Ihsan.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ * SPDX-License-Identifier: MPL-2.0
+ */
+
+package proxy
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/pkg/errors"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// CACertFile is the name of the local CA's certificate in its directory, which is what clients of a TLS proxy
+	// port need to trust.
+	CACertFile = "ca.pem"
+	caKeyFile  = "ca-key.pem"
+
+	// CABundleFile holds the system's trusted roots followed by the CA's certificate.
+	CABundleFile = "ca-bundle.pem"
+
+	// serviceCertDir is the subdirectory of the CA's directory that service certificates are kept in, apart from the
+	// CA's own files whatever the services are named.
+	serviceCertDir = "services"
+
+	caValidity   = 10 * 365 * 24 * time.Hour
+	certValidity = 397 * 24 * time.Hour
+
+	// certRenewal is how long before it expires a service certificate is issued again.
+	certRenewal = 30 * 24 * time.Hour
+)
+
+// CertificateAuthority is the local CA that issues the certificates proxy ports serve TLS with. It is kept in a
+// directory so that it outlives the cluster: clients only have to be told to trust it once.
+type CertificateAuthority struct {
+	dir  string
+	cert *x509.Certificate
+	key  crypto.Signer
+
+	mu sync.Mutex
+}
+
+// LoadOrCreateCA loads the CA kept in dir, creating the directory and a new CA if there is none yet.
+func LoadOrCreateCA(dir string) (*CertificateAuthority, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, errors.Wrap(err, "failed to create certificate directory")
+	}
+	ca := &CertificateAuthority{dir: dir}
+
+	certPEM, certErr := os.ReadFile(ca.CertPath())
+	keyPEM, keyErr := os.ReadFile(filepath.Join(dir, caKeyFile))
+	if certErr == nil && keyErr == nil {
+		pair, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to load CA from %s", dir)
+		}
+		cert, err := x509.ParseCertificate(pair.Certificate[0])
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to parse CA certificate in %s", dir)
+		}
+		key, ok := pair.PrivateKey.(crypto.Signer)
+		if !ok {
+			return nil, errors.Errorf("CA key in %s cannot sign", dir)
+		}
+		if time.Now().Before(cert.NotAfter) {
+			ca.cert, ca.key = cert, key
+			return ca, nil
+		}
+	} else if !os.IsNotExist(certErr) && certErr != nil {
+		return nil, errors.Wrap(certErr, "failed to read CA certificate")
+	} else if !os.IsNotExist(keyErr) && keyErr != nil {
+		return nil, errors.Wrap(keyErr, "failed to read CA key")
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to generate CA key")
+	}
+	serial, err := newSerialNumber()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"virtual-cluster"}, CommonName: "virtual-cluster local CA"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(caValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create CA certificate")
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse CA certificate")
+	}
+	if err := writeKeyPair(ca.CertPath(), filepath.Join(dir, caKeyFile), der, key); err != nil {
+		return nil, err
+	}
+
+	ca.cert, ca.key = cert, key
+	return ca, nil
+}
+
+// CertPath is the path of the CA's PEM encoded certificate.
+func (ca *CertificateAuthority) CertPath() string {
+	return filepath.Join(ca.dir, CACertFile)
+}
+
+// systemRootFiles are where common Linux distributions and macOS keep their trusted roots in one file.
+var systemRootFiles = []string{
+	"/etc/ssl/certs/ca-certificates.crt",
+	"/etc/pki/tls/certs/ca-bundle.crt",
+	"/etc/ssl/ca-bundle.pem",
+	"/etc/pki/tls/cacert.pem",
+	"/etc/ssl/cert.pem",
+}
+
+// BundlePath writes the system's trusted roots and the CA's certificate to one file, and returns its path. It is for
+// clients that take their roots from a single file, such as those reading SSL_CERT_FILE, and still have to reach
+// hosts whose certificates the CA did not issue.
+func (ca *CertificateAuthority) BundlePath() (string, error) {
+	var bundle []byte
+	for _, path := range systemRootFiles {
+		if roots, err := os.ReadFile(path); err == nil {
+			bundle = append(roots, '\n')
+			break
+		}
+	}
+	certPEM, err := os.ReadFile(ca.CertPath())
+	if err != nil {
+		return "", errors.Wrap(err, "failed to read CA certificate")
+	}
+	bundle = append(bundle, certPEM...)
+
+	path := filepath.Join(ca.dir, CABundleFile)
+	if err := os.WriteFile(path, bundle, 0o644); err != nil {
+		return "", errors.Wrapf(err, "failed to write %s", path)
+	}
+	return path, nil
+}
+
+// Certificate returns the certificate the proxy of the named service serves, valid for the service name and for
+// localhost. It is kept in the services subdirectory of the CA's directory as <name>.pem and <name>-key.pem, and
+// issued again when it is missing, about to expire, or was issued by a different CA.
+func (ca *CertificateAuthority) Certificate(name string) (*tls.Certificate, error) {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return nil, errors.Errorf("invalid service name %q for a certificate", name)
+	}
+
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+
+	dir := filepath.Join(ca.dir, serviceCertDir)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, errors.Wrap(err, "failed to create service certificate directory")
+	}
+	certPath := filepath.Join(dir, name+".pem")
+	keyPath := filepath.Join(dir, name+"-key.pem")
+	if pair, err := tls.LoadX509KeyPair(certPath, keyPath); err == nil && ca.valid(&pair, name) {
+		return &pair, nil
+	}
+
+	der, key, err := ca.issue(name, []string{name, "localhost", "127.0.0.1", "::1"})
+	if err != nil {
+		return nil, err
+	}
+	if err := writeKeyPair(certPath, keyPath, der, key); err != nil {
+		return nil, err
+	}
+
+	pair, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to load certificate for %s", name)
+	}
+	return &pair, nil
+}
+
+// Issue returns a certificate for host, a name or an IP address, without keeping it on disk. The egress proxy issues
+// these on the fly for the hosts it intercepts.
+func (ca *CertificateAuthority) Issue(host string) (*tls.Certificate, error) {
+	der, key, err := ca.issue(host, []string{host})
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse certificate for %s", host)
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, nil
+}
+
+func (ca *CertificateAuthority) issue(commonName string, hosts []string) ([]byte, *ecdsa.PrivateKey, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "failed to generate key for %s", commonName)
+	}
+	serial, err := newSerialNumber()
+	if err != nil {
+		return nil, nil, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{Organization: []string{"virtual-cluster"}, CommonName: commonName},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(certValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, key.Public(), ca.key)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "failed to create certificate for %s", commonName)
+	}
+	return der, key, nil
+}
+
+// ServerTLSConfig is the TLS configuration for the proxy of the named service.
+func (ca *CertificateAuthority) ServerTLSConfig(name string) (*tls.Config, error) {
+	cert, err := ca.Certificate(name)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{*cert},
+		MinVersion:   tls.VersionTLS12,
+		NextProtos:   []string{"h2", "http/1.1"},
+	}, nil
+}
+
+// Pool is a certificate pool holding only the CA, for clients of the proxy ports.
+func (ca *CertificateAuthority) Pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	return pool
+}
+
+// SystemPool is the system's trusted roots and the CA, for clients that reach both the proxy ports and other hosts.
+func (ca *CertificateAuthority) SystemPool() *x509.CertPool {
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	pool.AddCert(ca.cert)
+	return pool
+}
+
+func (ca *CertificateAuthority) valid(pair *tls.Certificate, name string) bool {
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return false
+	}
+	if !bytes.Equal(leaf.RawIssuer, ca.cert.RawSubject) {
+		return false
+	}
+	_, err = leaf.Verify(x509.VerifyOptions{
+		DNSName:     name,
+		Roots:       ca.Pool(),
+		CurrentTime: time.Now().Add(certRenewal),
+	})
+	return err == nil
+}
+
+func writeKeyPair(certPath, keyPath string, der []byte, key *ecdsa.PrivateKey) error {
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode key")
+	}
+	// The key is written first so that a certificate on disk always has its key next to it.
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		return errors.Wrapf(err, "failed to write %s", keyPath)
+	}
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644); err != nil {
+		return errors.Wrapf(err, "failed to write %s", certPath)
+	}
+	return nil
+}
+
+func newSerialNumber() (*big.Int, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to generate serial number")
+	}
+	return serial, nil
+}
@@ -0,0 +1,131 @@
+/*
+ * Copyright (c) 2023 Asim Ihsan.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ * SPDX-License-Identifier: MPL-2.0
+ */
+
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadOrCreateCA(t *testing.T) {
+	dir := t.TempDir()
+
+	ca, err := LoadOrCreateCA(dir)
+	assert.NoError(t, err)
+	first, err := os.ReadFile(ca.CertPath())
+	assert.NoError(t, err)
+
+	// The CA is reused, and so are the certificates it issued.
+	cert, err := ca.Certificate("orders")
+	assert.NoError(t, err)
+	again, err := LoadOrCreateCA(dir)
+	assert.NoError(t, err)
+	second, err := os.ReadFile(again.CertPath())
+	assert.NoError(t, err)
+	assert.Equal(t, first, second)
+	reused, err := again.Certificate("orders")
+	assert.NoError(t, err)
+	assert.Equal(t, cert.Certificate, reused.Certificate)
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	assert.NoError(t, err)
+	for _, name := range []string{"orders", "localhost", "127.0.0.1"} {
+		_, err := leaf.Verify(x509.VerifyOptions{DNSName: name, Roots: ca.Pool()})
+		assert.NoError(t, err, name)
+	}
+	_, err = leaf.Verify(x509.VerifyOptions{DNSName: "payments", Roots: ca.Pool()})
+	assert.Error(t, err)
+
+	// A certificate issued by another CA is replaced.
+	other, err := LoadOrCreateCA(t.TempDir())
+	assert.NoError(t, err)
+	other.dir = dir
+	replaced, err := other.Certificate("orders")
+	assert.NoError(t, err)
+	assert.NotEqual(t, cert.Certificate, replaced.Certificate)
+}
+
+func TestCertificate_KeptApartFromCA(t *testing.T) {
+	dir := t.TempDir()
+	ca, err := LoadOrCreateCA(dir)
+	assert.NoError(t, err)
+	caCert, err := os.ReadFile(ca.CertPath())
+	assert.NoError(t, err)
+
+	// Services named like the CA's files do not replace them.
+	for _, name := range []string{"ca", "ca-bundle"} {
+		_, err := ca.Certificate(name)
+		assert.NoError(t, err, name)
+	}
+	after, err := os.ReadFile(ca.CertPath())
+	assert.NoError(t, err)
+	assert.Equal(t, caCert, after)
+	_, err = os.Stat(filepath.Join(dir, "services", "ca.pem"))
+	assert.NoError(t, err)
+
+	for _, name := range []string{"", "..", "../orders", `a\b`} {
+		_, err := ca.Certificate(name)
+		assert.Error(t, err, name)
+	}
+}
+
+func TestProxy_ServesTLS(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Nil(t, r.TLS, "the service stays on plain HTTP")
+		_, _ = io.WriteString(w, "created")
+	}))
+	defer backend.Close()
+
+	ca, err := LoadOrCreateCA(t.TempDir())
+	assert.NoError(t, err)
+	config, err := ca.ServerTLSConfig("orders")
+	assert.NoError(t, err)
+
+	db := newTestDB(t)
+	p, err := NewProxy(backend.URL, "orders", db)
+	assert.NoError(t, err)
+	server := httptest.NewUnstartedServer(p)
+	server.TLS = config
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{RootCAs: ca.Pool(), ServerName: "orders"},
+		ForceAttemptHTTP2: true,
+	}}
+	resp, err := client.Post(server.URL+"/orders", "text/plain", strings.NewReader("secret order"))
+	assert.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, "created", string(body))
+	assert.Equal(t, 2, resp.ProtoMajor)
+
+	// The proxy terminates TLS, so the traffic is captured in plaintext.
+	var requestBody, responseBody string
+	assert.Eventually(t, func() bool {
+		return db.QueryRow("SELECT body FROM http_responses").Scan(&responseBody) == nil
+	}, time.Second, 10*time.Millisecond)
+	assert.NoError(t, db.QueryRow("SELECT body FROM http_requests").Scan(&requestBody))
+	assert.Equal(t, "secret order", requestBody)
+	assert.Equal(t, "created", responseBody)
+}
@@ -0,0 +1,94 @@
+/*
+ * Copyright (c) 2023 Asim Ihsan.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ * SPDX-License-Identifier: MPL-2.0
+ */
+
+package proxy
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"github.com/asimihsan/virtual-cluster/internal/metrics"
+	"github.com/asimihsan/virtual-cluster/internal/schema"
+	"github.com/asimihsan/virtual-cluster/internal/tracing"
+	"github.com/asimihsan/virtual-cluster/internal/utils"
+	"net/http"
+	"time"
+)
+
+// spanScope is the instrumentation scope of the spans the proxy exports for the calls it forwards.
+const spanScope = "virtual-cluster/proxy"
+
+type traceKey struct{}
+
+// startSpan starts the span of the service handling r, as a child of the span in its traceparent header or else as
+// the root of a new trace, and passes it on to the service in the traceparent header. recordSpan exports it once the
+// call is over.
+func startSpan(r *http.Request) *http.Request {
+	span := tracing.New()
+	if parent, ok := tracing.Parse(r.Header.Get(tracing.TraceparentHeader)); ok {
+		span = parent.Child()
+	}
+	r.Header.Set(tracing.TraceparentHeader, span.Traceparent())
+	return r.WithContext(context.WithValue(r.Context(), traceKey{}, span))
+}
+
+// recordSpan exports the span the proxy started for r into the otel_spans table, as a server span of processName.
+// Services that export their own spans parent them on it through the traceparent header it passed on, so the span
+// connects their traces to their callers'. Requests that are not forwarded, such as those answered by mocks, have no
+// span of the proxy and are not exported.
+func recordSpan(db *sql.DB, processName string, r *http.Request, statusCode int, upstreamError string, start time.Time,
+	end time.Time) error {
+	span, ok := r.Context().Value(traceKey{}).(tracing.TraceContext)
+	if !ok {
+		return nil
+	}
+	attributes := map[string]interface{}{
+		"http.method":      r.Method,
+		"http.target":      r.URL.RequestURI(),
+		"http.status_code": statusCode,
+	}
+	if caller := RequestCaller(r); caller != "" {
+		attributes["vcluster.caller"] = caller
+	}
+	statusCodeName, statusMessage := "unset", ""
+	if upstreamError != "" {
+		statusCodeName, statusMessage = "error", upstreamError
+	} else if statusCode >= http.StatusInternalServerError {
+		statusCodeName = "error"
+	}
+	encodedAttributes, _ := json.Marshal(attributes)
+	resourceAttributes, _ := json.Marshal(map[string]interface{}{"service.name": processName})
+
+	writeStart := time.Now()
+	_, err := db.Exec(`
+		INSERT INTO otel_spans (timestamp, service_name, trace_id, span_id, parent_span_id, name, kind,
+			start_time_unix_nano, end_time_unix_nano, duration_ms, status_code, status_message, attributes, events,
+			links, resource_attributes, scope_name, scope_version)
+		VALUES (?, ?, ?, ?, ?, ?, 'server', ?, ?, ?, ?, ?, ?, '[]', '[]', ?, ?, '')`,
+		start.UTC().Format(utils.TimestampFormat), processName, span.TraceID, span.SpanID,
+		schema.NullIfEmpty(span.ParentSpanID), r.Method, start.UnixNano(), end.UnixNano(),
+		float64(end.Sub(start))/float64(time.Millisecond), statusCodeName, schema.NullIfEmpty(statusMessage),
+		string(encodedAttributes), string(resourceAttributes), spanScope)
+	metrics.ObserveWrite("otel_spans", writeStart, err)
+	return err
+}
+
+// requestTrace returns the span started for r by the proxy, or else the span of the caller that r's traceparent
+// header names as its parent, e.g. for calls answered by mocks. It returns false if r is not part of a trace.
+func requestTrace(r *http.Request) (tracing.TraceContext, bool) {
+	if span, ok := r.Context().Value(traceKey{}).(tracing.TraceContext); ok {
+		return span, true
+	}
+	parent, ok := tracing.Parse(r.Header.Get(tracing.TraceparentHeader))
+	if !ok {
+		return tracing.TraceContext{}, false
+	}
+	return tracing.TraceContext{TraceID: parent.TraceID, ParentSpanID: parent.SpanID, Flags: parent.Flags}, true
+}
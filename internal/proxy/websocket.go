@@ -0,0 +1,273 @@
+/*
+ * Copyright (c) 2023 Asim Ihsan.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ * SPDX-License-Identifier: MPL-2.0
+ */
+
+package proxy
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/binary"
+	"github.com/rs/zerolog/log"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Directions of WebSocket frames.
+const (
+	WebSocketToService = "client_to_service"
+	WebSocketToClient  = "service_to_client"
+)
+
+// WebSocket opcodes, from RFC 6455 section 5.2.
+const (
+	OpcodeContinuation = 0x0
+	OpcodeText         = 0x1
+	OpcodeBinary       = 0x2
+	OpcodeClose        = 0x8
+	OpcodePing         = 0x9
+	OpcodePong         = 0xa
+)
+
+// WebSocketFrame is a frame passed between a client and a service over a proxied WebSocket connection.
+type WebSocketFrame struct {
+	Direction string
+	Opcode    int
+	Fin       bool
+
+	// Compressed is set for frames of messages compressed by the permessage-deflate extension. Their payload is
+	// stored as it was sent.
+	Compressed bool
+
+	// Payload is the unmasked payload, up to the capture limit, and Size the length of the whole payload.
+	Payload   []byte
+	Size      int64
+	Truncated bool
+	Binary    bool
+
+	Time time.Time
+}
+
+// isWebSocketUpgrade reports whether a response switches the connection to the WebSocket protocol.
+func isWebSocketUpgrade(res *http.Response) bool {
+	return res.StatusCode == http.StatusSwitchingProtocols &&
+		strings.EqualFold(res.Header.Get("Upgrade"), "websocket")
+}
+
+// webSocketConn taps the connection to the service of an upgraded WebSocket exchange, parsing the frames written to
+// it by the client and read from it by the service.
+type webSocketConn struct {
+	io.ReadWriteCloser
+	toService *frameParser
+	toClient  *frameParser
+}
+
+func newWebSocketConn(conn io.ReadWriteCloser, limit int, emit func(WebSocketFrame)) *webSocketConn {
+	return &webSocketConn{
+		ReadWriteCloser: conn,
+		toService:       &frameParser{direction: WebSocketToService, limit: limit, emit: emit},
+		toClient:        &frameParser{direction: WebSocketToClient, limit: limit, emit: emit},
+	}
+}
+
+func (c *webSocketConn) Read(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Read(p)
+	c.toClient.feed(p[:n])
+	return n, err
+}
+
+func (c *webSocketConn) Write(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Write(p)
+	c.toService.feed(p[:n])
+	return n, err
+}
+
+// frameParser parses the frames sent in one direction of a WebSocket connection as the bytes arrive, in whatever
+// pieces they arrive in. Payloads are kept up to limit bytes, so that large frames are never held in memory.
+type frameParser struct {
+	direction string
+	limit     int
+	emit      func(WebSocketFrame)
+
+	// header collects the bytes of the frame header until it is complete.
+	header []byte
+
+	frame     WebSocketFrame
+	inPayload bool
+	remaining uint64
+	offset    uint64
+	masked    bool
+	mask      [4]byte
+	payload   bytes.Buffer
+
+	// messageOpcode is the opcode of the message that continuation frames belong to.
+	messageOpcode int
+	// messageCompressed is whether that message is compressed, which only its first frame says.
+	messageCompressed bool
+}
+
+func (f *frameParser) feed(p []byte) {
+	for len(p) > 0 {
+		if !f.inPayload {
+			needed := f.headerSize()
+			take := needed - len(f.header)
+			if take > len(p) {
+				take = len(p)
+			}
+			f.header = append(f.header, p[:take]...)
+			p = p[take:]
+			if len(f.header) < f.headerSize() {
+				continue
+			}
+			f.startPayload()
+			if f.remaining == 0 {
+				f.finishFrame()
+			}
+			continue
+		}
+
+		n := uint64(len(p))
+		if n > f.remaining {
+			n = f.remaining
+		}
+		if f.payload.Len() < f.limit {
+			keep := n
+			if room := uint64(f.limit - f.payload.Len()); keep > room {
+				keep = room
+			}
+			for i := uint64(0); i < keep; i++ {
+				b := p[i]
+				if f.masked {
+					b ^= f.mask[(f.offset+i)%4]
+				}
+				f.payload.WriteByte(b)
+			}
+		}
+		f.offset += n
+		f.remaining -= n
+		p = p[n:]
+		if f.remaining == 0 {
+			f.finishFrame()
+		}
+	}
+}
+
+// headerSize returns the length of the frame header, as far as can be told from the bytes collected so far.
+func (f *frameParser) headerSize() int {
+	if len(f.header) < 2 {
+		return 2
+	}
+	size := 2
+	switch f.header[1] & 0x7f {
+	case 126:
+		size += 2
+	case 127:
+		size += 8
+	}
+	if f.header[1]&0x80 != 0 {
+		size += 4
+	}
+	return size
+}
+
+func (f *frameParser) startPayload() {
+	h := f.header
+	f.frame = WebSocketFrame{
+		Direction:  f.direction,
+		Opcode:     int(h[0] & 0x0f),
+		Fin:        h[0]&0x80 != 0,
+		Compressed: h[0]&0x40 != 0,
+	}
+	f.masked = h[1]&0x80 != 0
+	rest := h[2:]
+	switch h[1] & 0x7f {
+	case 126:
+		f.remaining = uint64(binary.BigEndian.Uint16(rest))
+		rest = rest[2:]
+	case 127:
+		f.remaining = binary.BigEndian.Uint64(rest)
+		rest = rest[8:]
+	default:
+		f.remaining = uint64(h[1] & 0x7f)
+	}
+	if f.masked {
+		copy(f.mask[:], rest)
+	}
+	f.frame.Size = int64(f.remaining)
+	f.offset = 0
+	f.payload.Reset()
+	f.inPayload = true
+}
+
+func (f *frameParser) finishFrame() {
+	frame := f.frame
+	frame.Payload = append([]byte(nil), f.payload.Bytes()...)
+	frame.Truncated = frame.Size > int64(len(frame.Payload))
+	frame.Time = time.Now()
+
+	// Control frames may be interleaved with the frames of a fragmented message, and do not start a message.
+	opcode := frame.Opcode
+	if opcode == OpcodeText || opcode == OpcodeBinary {
+		f.messageOpcode = opcode
+		f.messageCompressed = frame.Compressed
+	} else if opcode == OpcodeContinuation {
+		opcode = f.messageOpcode
+		frame.Compressed = f.messageCompressed
+	}
+	switch {
+	case frame.Compressed || opcode == OpcodeBinary:
+		frame.Binary = true
+	case opcode == OpcodeText:
+		frame.Binary = false
+	default:
+		frame.Binary = isBinary(frame.Payload, frame.Truncated)
+	}
+
+	f.header = f.header[:0]
+	f.inPayload = false
+	f.emit(frame)
+}
+
+// RecordWebSocketFrame stores a frame of the WebSocket connection opened by the request with id requestID in the
+// websocket_frames table.
+func RecordWebSocketFrame(db *sql.DB, requestID int64, processName string, frame WebSocketFrame) error {
+	var payload interface{} = string(frame.Payload)
+	if frame.Binary {
+		payload = frame.Payload
+	}
+	_, err := db.Exec(`
+		INSERT INTO websocket_frames (timestamp, http_request_id, process_name, direction, opcode, fin, compressed, payload, payload_size, payload_truncated, payload_binary)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		formatTimestamp(frame.Time), requestID, processName, frame.Direction, frame.Opcode, frame.Fin,
+		frame.Compressed, payload, frame.Size, frame.Truncated, frame.Binary)
+	return err
+}
+
+// tapWebSocket records the frames passing over the connection to the service of an upgraded WebSocket exchange.
+func (p *Proxy) tapWebSocket(res *http.Response, requestID int64) {
+	conn, ok := res.Body.(io.ReadWriteCloser)
+	if !ok {
+		return
+	}
+	res.Body = newWebSocketConn(conn, p.captureLimit, func(frame WebSocketFrame) {
+		if p.verbose {
+			log.Debug().
+				Str("process_name", p.processName).
+				Str("direction", frame.Direction).
+				Int("opcode", frame.Opcode).
+				Int64("size", frame.Size).
+				Msg("Captured WebSocket frame")
+		}
+		if err := RecordWebSocketFrame(p.db, requestID, p.processName, frame); err != nil {
+			log.Printf("Error recording WebSocket frame: %v", err)
+		}
+	})
+}
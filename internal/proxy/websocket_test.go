@@ -0,0 +1,160 @@
+/*
+ * Copyright (c) 2023 Asim Ihsan.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ * SPDX-License-Identifier: MPL-2.0
+ */
+
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/websocket"
+)
+
+// frameBytes encodes a frame as a client (masked) or service (unmasked) would send it.
+func frameBytes(first byte, payload []byte, masked bool) []byte {
+	var buf bytes.Buffer
+	buf.WriteByte(first)
+	maskBit := byte(0)
+	if masked {
+		maskBit = 0x80
+	}
+	switch {
+	case len(payload) < 126:
+		buf.WriteByte(maskBit | byte(len(payload)))
+	case len(payload) <= 0xffff:
+		buf.WriteByte(maskBit | 126)
+		_ = binary.Write(&buf, binary.BigEndian, uint16(len(payload)))
+	default:
+		buf.WriteByte(maskBit | 127)
+		_ = binary.Write(&buf, binary.BigEndian, uint64(len(payload)))
+	}
+	if masked {
+		mask := [4]byte{0x12, 0x34, 0x56, 0x78}
+		buf.Write(mask[:])
+		for i, b := range payload {
+			buf.WriteByte(b ^ mask[i%4])
+		}
+	} else {
+		buf.Write(payload)
+	}
+	return buf.Bytes()
+}
+
+func TestFrameParser(t *testing.T) {
+	large := []byte(strings.Repeat("abcdefgh", 40))
+
+	tests := []struct {
+		name   string
+		stream [][]byte
+		want   []WebSocketFrame
+	}{
+		{
+			name:   "masked text",
+			stream: [][]byte{frameBytes(0x81, []byte("hello"), true)},
+			want:   []WebSocketFrame{{Opcode: OpcodeText, Fin: true, Payload: []byte("hello"), Size: 5}},
+		},
+		{
+			name:   "empty close",
+			stream: [][]byte{frameBytes(0x88, nil, false)},
+			want:   []WebSocketFrame{{Opcode: OpcodeClose, Fin: true}},
+		},
+		{
+			name: "fragmented binary with an interleaved ping",
+			stream: [][]byte{
+				frameBytes(0x02, []byte{0x00, 0x01}, true),
+				frameBytes(0x89, []byte("ping"), true),
+				frameBytes(0x80, []byte{0x02}, true),
+			},
+			want: []WebSocketFrame{
+				{Opcode: OpcodeBinary, Payload: []byte{0x00, 0x01}, Size: 2, Binary: true},
+				{Opcode: OpcodePing, Fin: true, Payload: []byte("ping"), Size: 4},
+				{Opcode: OpcodeContinuation, Fin: true, Payload: []byte{0x02}, Size: 1, Binary: true},
+			},
+		},
+		{
+			name:   "16-bit length beyond the capture limit",
+			stream: [][]byte{frameBytes(0x81, large, false)},
+			want:   []WebSocketFrame{{Opcode: OpcodeText, Fin: true, Payload: large[:64], Size: 320, Truncated: true}},
+		},
+		{
+			name:   "compressed",
+			stream: [][]byte{frameBytes(0xc1, []byte{0xf2, 0x48, 0x05, 0x00}, false)},
+			want: []WebSocketFrame{
+				{Opcode: OpcodeText, Fin: true, Compressed: true, Payload: []byte{0xf2, 0x48, 0x05, 0x00}, Size: 4, Binary: true},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []WebSocketFrame
+			parser := &frameParser{direction: WebSocketToService, limit: 64, emit: func(frame WebSocketFrame) {
+				frame.Time = time.Time{}
+				got = append(got, frame)
+			}}
+			// Feed a byte at a time, as frames may be split anywhere across reads.
+			for _, b := range bytes.Join(tt.stream, nil) {
+				parser.feed([]byte{b})
+			}
+			for i := range tt.want {
+				tt.want[i].Direction = WebSocketToService
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestProxy_CapturesWebSocketFrames(t *testing.T) {
+	backend := httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+		_, _ = io.Copy(ws, ws)
+	}))
+	defer backend.Close()
+
+	db := newTestDB(t)
+	p, err := NewProxy(backend.URL, "realtime", db)
+	assert.NoError(t, err)
+	server := httptest.NewServer(p)
+	defer server.Close()
+
+	ws, err := websocket.Dial(strings.Replace(server.URL, "http", "ws", 1)+"/socket", "", server.URL)
+	assert.NoError(t, err)
+	assert.NoError(t, websocket.Message.Send(ws, "hello"))
+	var reply string
+	assert.NoError(t, websocket.Message.Receive(ws, &reply))
+	assert.Equal(t, "hello", reply)
+	assert.NoError(t, ws.Close())
+
+	var statusCode int
+	assert.Eventually(t, func() bool {
+		return db.QueryRow("SELECT status_code FROM http_responses").Scan(&statusCode) == nil
+	}, 2*time.Second, 10*time.Millisecond)
+	assert.Equal(t, 101, statusCode)
+
+	rows, err := db.Query(`
+		SELECT f.direction, f.opcode, f.payload FROM websocket_frames f
+		JOIN http_requests req ON req.id = f.http_request_id
+		WHERE f.opcode = ? ORDER BY f.id`, OpcodeText)
+	assert.NoError(t, err)
+	defer rows.Close()
+	var frames []string
+	for rows.Next() {
+		var direction, payload string
+		var opcode int
+		assert.NoError(t, rows.Scan(&direction, &opcode, &payload))
+		frames = append(frames, direction+" "+payload)
+	}
+	assert.Equal(t, []string{WebSocketToService + " hello", WebSocketToClient + " hello"}, frames)
+}
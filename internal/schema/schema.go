@@ -0,0 +1,456 @@
+/*
+ * Copyright (c) 2023 Asim Ihsan.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ * SPDX-License-Identifier: MPL-2.0
+ */
+
+// Package schema creates the tables of the cluster database, which the substrate writes and the packages capturing
+// traffic and telemetry insert into.
+package schema
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// bodyColumns describe how much of a captured HTTP body is stored in its row. They are shared by the http_requests
+// and http_responses tables.
+var bodyColumns = []string{"body_size INTEGER", "body_truncated BOOLEAN", "body_binary BOOLEAN", "body_blob TEXT",
+	"content_type TEXT", "content_encoding TEXT", "body_decoded BOOLEAN"}
+
+// Create creates the tables and indexes of the cluster database that do not exist yet, and adds the columns that
+// tables created by older versions lack. Tests of the packages that write to the database create it with Create too,
+// so that they run against the schema the substrate uses.
+func Create(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS logs (
+			id INTEGER PRIMARY KEY,
+			timestamp TEXT DEFAULT (strftime('%Y-%m-%dT%H:%M:%fZ', 'now')),
+			process_name TEXT,
+			output_type TEXT,
+			content TEXT,
+			trace_id TEXT,
+			span_id TEXT,
+			format TEXT,
+			level TEXT,
+			message TEXT,
+			logger TEXT,
+			fields TEXT
+		)
+	`)
+	if err != nil {
+		return err
+	}
+	err = addMissingColumns(db, "logs", "trace_id TEXT", "span_id TEXT", "format TEXT", "level TEXT", "message TEXT",
+		"logger TEXT", "fields TEXT")
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("CREATE INDEX IF NOT EXISTS logs_level ON logs (level, id)")
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS http_requests (
+			id INTEGER PRIMARY KEY,
+			timestamp TEXT DEFAULT (strftime('%Y-%m-%dT%H:%M:%fZ', 'now')),
+			process_name TEXT,
+			method TEXT,
+			url TEXT,
+			headers TEXT,
+			body TEXT,
+			body_size INTEGER,
+			body_truncated BOOLEAN,
+			body_binary BOOLEAN,
+			body_blob TEXT,
+			content_type TEXT,
+			content_encoding TEXT,
+			body_decoded BOOLEAN,
+			faults TEXT,
+			remote_addr TEXT,
+			caller TEXT,
+			trace_id TEXT,
+			span_id TEXT,
+			parent_span_id TEXT
+		)
+	`)
+	if err != nil {
+		return err
+	}
+	err = addMissingColumns(db, "http_requests", append([]string{"faults TEXT", "remote_addr TEXT", "caller TEXT",
+		"trace_id TEXT", "span_id TEXT", "parent_span_id TEXT"}, bodyColumns...)...)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS http_responses (
+			id INTEGER PRIMARY KEY,
+			http_request_id INTEGER,
+			timestamp TEXT DEFAULT (strftime('%Y-%m-%dT%H:%M:%fZ', 'now')),
+			process_name TEXT,
+			status_code INTEGER,
+			headers TEXT,
+			body TEXT,
+			body_size INTEGER,
+			body_truncated BOOLEAN,
+			body_binary BOOLEAN,
+			body_blob TEXT,
+			content_type TEXT,
+			content_encoding TEXT,
+			body_decoded BOOLEAN,
+			trailers TEXT,
+			started_at TEXT,
+			first_byte_at TEXT,
+			ended_at TEXT,
+			duration_ms REAL,
+			upstream_error TEXT
+		)
+	`)
+	if err != nil {
+		return err
+	}
+	err = addMissingColumns(db, "http_responses", append([]string{"trailers TEXT", "started_at TEXT",
+		"first_byte_at TEXT", "ended_at TEXT", "duration_ms REAL", "upstream_error TEXT"}, bodyColumns...)...)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS websocket_frames (
+			id INTEGER PRIMARY KEY,
+			timestamp TEXT DEFAULT (strftime('%Y-%m-%dT%H:%M:%fZ', 'now')),
+			http_request_id INTEGER,
+			process_name TEXT,
+			direction TEXT,
+			opcode INTEGER,
+			fin BOOLEAN,
+			compressed BOOLEAN,
+			payload TEXT,
+			payload_size INTEGER,
+			payload_truncated BOOLEAN,
+			payload_binary BOOLEAN
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS grpc_calls (
+			id INTEGER PRIMARY KEY,
+			timestamp TEXT DEFAULT (strftime('%Y-%m-%dT%H:%M:%fZ', 'now')),
+			http_request_id INTEGER,
+			process_name TEXT,
+			service TEXT,
+			method TEXT,
+			metadata TEXT,
+			response_metadata TEXT,
+			trailers TEXT,
+			status_code INTEGER,
+			status_name TEXT,
+			status_message TEXT,
+			started_at TEXT,
+			ended_at TEXT,
+			duration_ms REAL
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	// call_edges is every proxied call as an edge from its caller, "" when it is not known, to the service or host
+	// called.
+	_, err = db.Exec(`
+		CREATE VIEW IF NOT EXISTS call_edges AS
+		SELECT
+			q.id AS http_request_id,
+			q.timestamp,
+			COALESCE(q.caller, '') AS caller,
+			q.process_name AS callee,
+			r.status_code,
+			r.duration_ms,
+			r.upstream_error,
+			g.status_code AS grpc_status_code
+		FROM http_requests q
+		LEFT JOIN http_responses r ON r.http_request_id = q.id
+		LEFT JOIN grpc_calls g ON g.http_request_id = q.id
+	`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS grpc_messages (
+			id INTEGER PRIMARY KEY,
+			timestamp TEXT DEFAULT (strftime('%Y-%m-%dT%H:%M:%fZ', 'now')),
+			http_request_id INTEGER,
+			process_name TEXT,
+			service TEXT,
+			method TEXT,
+			direction TEXT,
+			sequence INTEGER,
+			compressed BOOLEAN,
+			size INTEGER,
+			truncated BOOLEAN,
+			message_json TEXT,
+			payload BLOB,
+			decode_error TEXT
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS kafka_messages (
+			id INTEGER PRIMARY KEY,
+			timestamp TEXT DEFAULT (strftime('%Y-%m-%dT%H:%M:%fZ', 'now')),
+			broker_name TEXT,
+			topic_name TEXT,
+			message_key TEXT,
+			message_value TEXT,
+			headers TEXT,
+			trace_id TEXT,
+			span_id TEXT
+		)
+	`)
+	if err != nil {
+		return err
+	}
+	err = addMissingColumns(db, "kafka_messages", "headers TEXT", "trace_id TEXT", "span_id TEXT")
+	if err != nil {
+		return err
+	}
+
+	// Traces are looked up across the captured calls, messages and logs by trace id.
+	_, err = db.Exec(`
+		CREATE INDEX IF NOT EXISTS http_requests_trace_id ON http_requests (trace_id);
+		CREATE INDEX IF NOT EXISTS kafka_messages_trace_id ON kafka_messages (trace_id);
+		CREATE INDEX IF NOT EXISTS logs_trace_id ON logs (trace_id);
+	`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS sql_queries (
+			id INTEGER PRIMARY KEY,
+			timestamp TEXT DEFAULT (strftime('%Y-%m-%dT%H:%M:%fZ', 'now')),
+			dependency_name TEXT,
+			client_name TEXT,
+			database_name TEXT,
+			query TEXT,
+			parameters TEXT,
+			duration_ms REAL,
+			row_count INTEGER,
+			error TEXT
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS redis_commands (
+			id INTEGER PRIMARY KEY,
+			timestamp TEXT DEFAULT (strftime('%Y-%m-%dT%H:%M:%fZ', 'now')),
+			dependency_name TEXT,
+			client_name TEXT,
+			command TEXT,
+			arguments TEXT,
+			reply_type TEXT,
+			error TEXT,
+			duration_ms REAL
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS emails (
+			id INTEGER PRIMARY KEY,
+			timestamp TEXT DEFAULT (strftime('%Y-%m-%dT%H:%M:%fZ', 'now')),
+			dependency_name TEXT,
+			client_name TEXT,
+			envelope_from TEXT,
+			envelope_to TEXT,
+			from_address TEXT,
+			to_addresses TEXT,
+			cc_addresses TEXT,
+			subject TEXT,
+			message_id TEXT,
+			text_body TEXT,
+			html_body TEXT,
+			attachments TEXT,
+			size INTEGER,
+			raw TEXT
+		)
+	`)
+	if err != nil {
+		return err
+	}
+
+	// The otel_ tables hold what services export over OTLP, by the service.name of their resource. Times are kept in
+	// nanoseconds as well as in the timestamp format of the other tables where the precision matters, for spans.
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS otel_spans (
+			id INTEGER PRIMARY KEY,
+			timestamp TEXT,
+			service_name TEXT,
+			trace_id TEXT,
+			span_id TEXT,
+			parent_span_id TEXT,
+			trace_state TEXT,
+			name TEXT,
+			kind TEXT,
+			start_time_unix_nano INTEGER,
+			end_time_unix_nano INTEGER,
+			duration_ms REAL,
+			status_code TEXT,
+			status_message TEXT,
+			attributes TEXT,
+			events TEXT,
+			links TEXT,
+			resource_attributes TEXT,
+			scope_name TEXT,
+			scope_version TEXT
+		);
+		CREATE INDEX IF NOT EXISTS otel_spans_trace_id ON otel_spans (trace_id);
+		CREATE INDEX IF NOT EXISTS otel_spans_service_name ON otel_spans (service_name, start_time_unix_nano);
+
+		CREATE TABLE IF NOT EXISTS otel_logs (
+			id INTEGER PRIMARY KEY,
+			timestamp TEXT,
+			observed_timestamp TEXT,
+			service_name TEXT,
+			severity_number INTEGER,
+			severity_text TEXT,
+			body TEXT,
+			trace_id TEXT,
+			span_id TEXT,
+			attributes TEXT,
+			resource_attributes TEXT,
+			scope_name TEXT
+		);
+		CREATE INDEX IF NOT EXISTS otel_logs_trace_id ON otel_logs (trace_id);
+		CREATE INDEX IF NOT EXISTS otel_logs_service_name ON otel_logs (service_name, timestamp);
+
+		CREATE TABLE IF NOT EXISTS otel_metrics (
+			id INTEGER PRIMARY KEY,
+			timestamp TEXT,
+			start_timestamp TEXT,
+			service_name TEXT,
+			name TEXT,
+			description TEXT,
+			unit TEXT,
+			type TEXT,
+			temporality TEXT,
+			monotonic BOOLEAN,
+			value REAL,
+			data TEXT,
+			attributes TEXT,
+			resource_attributes TEXT,
+			scope_name TEXT
+		);
+		CREATE INDEX IF NOT EXISTS otel_metrics_service_name ON otel_metrics (service_name, name, timestamp);
+
+		CREATE TABLE IF NOT EXISTS metric_series (
+			id INTEGER PRIMARY KEY,
+			service_name TEXT,
+			name TEXT,
+			labels TEXT,
+			type TEXT,
+			help TEXT,
+			UNIQUE (service_name, name, labels)
+		);
+		CREATE INDEX IF NOT EXISTS metric_series_name ON metric_series (name);
+
+		CREATE TABLE IF NOT EXISTS process_events (
+			id INTEGER PRIMARY KEY,
+			timestamp TEXT DEFAULT (strftime('%Y-%m-%dT%H:%M:%fZ', 'now')),
+			process_name TEXT,
+			event TEXT,
+			pid INTEGER,
+			detail TEXT
+		);
+		CREATE INDEX IF NOT EXISTS process_events_process_name ON process_events (process_name, timestamp);
+
+		CREATE TABLE IF NOT EXISTS resource_samples (
+			id INTEGER PRIMARY KEY,
+			timestamp TEXT DEFAULT (strftime('%Y-%m-%dT%H:%M:%fZ', 'now')),
+			kind TEXT,
+			name TEXT,
+			pid INTEGER,
+			container_name TEXT,
+			processes INTEGER,
+			cpu_seconds REAL,
+			cpu_percent REAL,
+			memory_bytes INTEGER,
+			memory_limit_bytes INTEGER,
+			open_fds INTEGER,
+			threads INTEGER
+		);
+		CREATE INDEX IF NOT EXISTS resource_samples_name ON resource_samples (name, timestamp);
+
+		CREATE TABLE IF NOT EXISTS metric_samples (
+			series_id INTEGER,
+			timestamp_ms INTEGER,
+			value REAL,
+			PRIMARY KEY (series_id, timestamp_ms)
+		) WITHOUT ROWID;
+	`)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// addMissingColumns adds columns, each given as "name TYPE", that a table created by an older version lacks. The
+// CREATE TABLE statements in Create stay the source of truth for new databases.
+func addMissingColumns(db *sql.DB, table string, columns ...string) error {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return err
+	}
+	existing := map[string]bool{}
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, columnType string
+		var defaultValue sql.NullString
+		if err := rows.Scan(&cid, &name, &columnType, &notNull, &defaultValue, &pk); err != nil {
+			rows.Close()
+			return err
+		}
+		existing[name] = true
+	}
+	if err := rows.Close(); err != nil {
+		return err
+	}
+
+	for _, column := range columns {
+		name := strings.Fields(column)[0]
+		if existing[name] {
+			continue
+		}
+		if _, err := db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s", table, column)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NullIfEmpty returns nil for an empty string, so that a column with no value is stored as NULL rather than "".
+func NullIfEmpty(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
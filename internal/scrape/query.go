@@ -0,0 +1,311 @@
+/*
+ * Copyright (c) 2023 Asim Ihsan.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ * SPDX-License-Identifier: MPL-2.0
+ */
+
+package scrape
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LookbackDelta is how far back a query looks for the latest sample of a series, as in Prometheus.
+const LookbackDelta = 5 * time.Minute
+
+// maxPoints bounds the points of each series a range query returns, as in Prometheus.
+const maxPoints = 11000
+
+const (
+	// NameLabel is the label a selector matches metric names with.
+	NameLabel = "__name__"
+
+	// JobLabel is the label a selector matches service names with, which Prometheus sets to the name of the job
+	// that scraped a series.
+	JobLabel = "job"
+)
+
+// Matcher matches the value of a label: with Type "=" it must equal Value, with "!=" it must not, and with "=~" and
+// "!~" it must or must not fully match the regular expression Value. A missing label has the value "".
+type Matcher struct {
+	Name  string
+	Type  string
+	Value string
+	re    *regexp.Regexp
+}
+
+func (m Matcher) matches(value string) bool {
+	switch m.Type {
+	case "=":
+		return value == m.Value
+	case "!=":
+		return value != m.Value
+	case "=~":
+		return m.re.MatchString(value)
+	default:
+		return !m.re.MatchString(value)
+	}
+}
+
+// Selector selects series by their name and labels, as a Prometheus instant vector selector such as
+// http_requests_total{job="orders",code=~"5.."} does.
+type Selector []Matcher
+
+var (
+	metricNamePattern = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*`)
+	labelNamePattern  = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*`)
+	matchTypePattern  = regexp.MustCompile(`^(=~|!~|!=|=)`)
+)
+
+// ParseSelector parses a vector selector: a metric name, label matchers in braces, or both.
+func ParseSelector(input string) (Selector, error) {
+	rest := strings.TrimSpace(input)
+	var selector Selector
+	if name := metricNamePattern.FindString(rest); name != "" {
+		selector = append(selector, Matcher{Name: NameLabel, Type: "=", Value: name})
+		rest = strings.TrimSpace(rest[len(name):])
+	}
+	if strings.HasPrefix(rest, "{") {
+		rest = strings.TrimSpace(rest[1:])
+		for !strings.HasPrefix(rest, "}") {
+			name := labelNamePattern.FindString(rest)
+			if name == "" {
+				return nil, fmt.Errorf("expected a label name at %q", rest)
+			}
+			rest = strings.TrimSpace(rest[len(name):])
+			matchType := matchTypePattern.FindString(rest)
+			if matchType == "" {
+				return nil, fmt.Errorf("expected =, !=, =~ or !~ after %s", name)
+			}
+			rest = strings.TrimSpace(rest[len(matchType):])
+			value, remaining, err := unquote(rest)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value for %s: %v", name, err)
+			}
+			matcher := Matcher{Name: name, Type: matchType, Value: value}
+			if matchType == "=~" || matchType == "!~" {
+				if matcher.re, err = regexp.Compile("^(?:" + value + ")$"); err != nil {
+					return nil, fmt.Errorf("invalid regular expression for %s: %v", name, err)
+				}
+			}
+			selector = append(selector, matcher)
+			rest = strings.TrimSpace(remaining)
+			if strings.HasPrefix(rest, ",") {
+				rest = strings.TrimSpace(rest[1:])
+			} else if !strings.HasPrefix(rest, "}") {
+				return nil, fmt.Errorf("expected , or } at %q", rest)
+			}
+		}
+		rest = strings.TrimSpace(rest[1:])
+	}
+	if rest != "" {
+		return nil, fmt.Errorf("unexpected %q in selector %q", rest, input)
+	}
+	for _, matcher := range selector {
+		if !matcher.matches("") {
+			return selector, nil
+		}
+	}
+	return nil, fmt.Errorf("selector %q must have a matcher that does not match the empty string", input)
+}
+
+// unquote reads a double- or single-quoted string from the start of input and returns it and the rest of input.
+func unquote(input string) (string, string, error) {
+	if input == "" || (input[0] != '"' && input[0] != '\'') {
+		return "", "", fmt.Errorf("expected a quoted string at %q", input)
+	}
+	quote := input[0]
+	for i := 1; i < len(input); i++ {
+		switch input[i] {
+		case '\\':
+			i++
+		case quote:
+			quoted := input[:i+1]
+			if quote == '\'' {
+				quoted = `"` + strings.ReplaceAll(input[1:i], `"`, `\"`) + `"`
+			}
+			value, err := strconv.Unquote(quoted)
+			return value, input[i+1:], err
+		}
+	}
+	return "", "", fmt.Errorf("unterminated string %q", input)
+}
+
+// Series is a series with its samples. Labels include its name as NameLabel and its service as JobLabel.
+type Series struct {
+	Labels  map[string]string
+	Samples []Point
+}
+
+// Point is the value of a series at a time.
+type Point struct {
+	Time  time.Time
+	Value float64
+}
+
+// Instant returns the series the selector matches that have a sample within LookbackDelta before at, each with its
+// latest such sample.
+func Instant(db *sql.DB, selector Selector, at time.Time) ([]Series, error) {
+	return Range(db, selector, at, at, time.Second)
+}
+
+// Range returns the series the selector matches, each with its latest sample within LookbackDelta before each step
+// from start to end. Steps with no such sample are left out, as are series with no samples at all.
+func Range(db *sql.DB, selector Selector, start time.Time, end time.Time, step time.Duration) ([]Series, error) {
+	if step <= 0 {
+		return nil, fmt.Errorf("step must be positive")
+	}
+	if end.Before(start) {
+		return nil, fmt.Errorf("end must not be before start")
+	}
+	if end.Sub(start)/step >= maxPoints {
+		return nil, fmt.Errorf("exceeded maximum resolution of %d points per series, use a larger step", maxPoints)
+	}
+
+	candidates, err := selectSeries(db, selector)
+	if err != nil {
+		return nil, err
+	}
+	var result []Series
+	for _, candidate := range candidates {
+		rows, err := db.Query(`
+			SELECT timestamp_ms, value FROM metric_samples
+			WHERE series_id = ? AND timestamp_ms > ? AND timestamp_ms <= ?
+			ORDER BY timestamp_ms`,
+			candidate.id, start.Add(-LookbackDelta).UnixMilli(), end.UnixMilli())
+		if err != nil {
+			return nil, err
+		}
+		var samples []Point
+		for rows.Next() {
+			var timestampMs int64
+			var value sql.NullFloat64
+			if err := rows.Scan(&timestampMs, &value); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			point := Point{Time: time.UnixMilli(timestampMs), Value: math.NaN()}
+			if value.Valid {
+				point.Value = value.Float64
+			}
+			samples = append(samples, point)
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		series := Series{Labels: candidate.labels}
+		next := 0
+		for t := start; !t.After(end); t = t.Add(step) {
+			for next < len(samples) && !samples[next].Time.After(t) {
+				next++
+			}
+			if next > 0 && t.Sub(samples[next-1].Time) < LookbackDelta {
+				series.Samples = append(series.Samples, Point{Time: t, Value: samples[next-1].Value})
+			}
+		}
+		if len(series.Samples) > 0 {
+			result = append(result, series)
+		}
+	}
+	return result, nil
+}
+
+type storedSeries struct {
+	id     int64
+	labels map[string]string
+}
+
+// selectSeries returns the series the selector matches, by name and labels. Equality matchers on the name and the
+// service narrow down the series read from the database; the others are matched here.
+func selectSeries(db *sql.DB, selector Selector) ([]storedSeries, error) {
+	var conditions []string
+	var args []interface{}
+	for _, matcher := range selector {
+		if matcher.Type != "=" {
+			continue
+		}
+		switch matcher.Name {
+		case NameLabel:
+			conditions = append(conditions, "name = ?")
+			args = append(args, matcher.Value)
+		case JobLabel:
+			conditions = append(conditions, "service_name = ?")
+			args = append(args, matcher.Value)
+		}
+	}
+	query := "SELECT id, service_name, name, labels FROM metric_series"
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	rows, err := db.Query(query+" ORDER BY id", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var matched []storedSeries
+	for rows.Next() {
+		var id int64
+		var service, name, encoded string
+		if err := rows.Scan(&id, &service, &name, &encoded); err != nil {
+			return nil, err
+		}
+		labels := make(map[string]string)
+		if err := json.Unmarshal([]byte(encoded), &labels); err != nil {
+			return nil, err
+		}
+		// A series' own job label gives way to the service that exported it, as Prometheus renames it exported_job.
+		if job, ok := labels[JobLabel]; ok {
+			labels["exported_"+JobLabel] = job
+		}
+		labels[NameLabel] = name
+		labels[JobLabel] = service
+		if selectorMatches(selector, labels) {
+			matched = append(matched, storedSeries{id: id, labels: labels})
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(matched, func(i, j int) bool {
+		return encodeLabels(matched[i].labels) < encodeLabels(matched[j].labels)
+	})
+	return matched, nil
+}
+
+func selectorMatches(selector Selector, labels map[string]string) bool {
+	for _, matcher := range selector {
+		if !matcher.matches(labels[matcher.Name]) {
+			return false
+		}
+	}
+	return true
+}
+
+// FormatValue formats a sample value or label bound as Prometheus does, e.g. +Inf, NaN and 0.5.
+func FormatValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
@@ -0,0 +1,125 @@
+/*
+ * Copyright (c) 2023 Asim Ihsan.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ * SPDX-License-Identifier: MPL-2.0
+ */
+
+package scrape
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSelector(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected []Matcher
+		wantErr  bool
+	}{
+		{
+			name:     "name only",
+			input:    "up",
+			expected: []Matcher{{Name: NameLabel, Type: "=", Value: "up"}},
+		},
+		{
+			name:  "name and labels",
+			input: `http_requests_total{job="orders", code!='500'}`,
+			expected: []Matcher{
+				{Name: NameLabel, Type: "=", Value: "http_requests_total"},
+				{Name: "job", Type: "=", Value: "orders"},
+				{Name: "code", Type: "!=", Value: "500"},
+			},
+		},
+		{
+			name:     "labels only",
+			input:    `{__name__="up",}`,
+			expected: []Matcher{{Name: NameLabel, Type: "=", Value: "up"}},
+		},
+		{name: "empty matchers only", input: `{code!="500"}`, wantErr: true},
+		{name: "unterminated", input: `up{job="orders"`, wantErr: true},
+		{name: "invalid regex", input: `up{job=~"("}`, wantErr: true},
+		{name: "trailing input", input: `up foo`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			selector, err := ParseSelector(tt.input)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, Selector(tt.expected), selector)
+		})
+	}
+}
+
+func TestQuery(t *testing.T) {
+	db := newTestDB(t)
+	value := 1
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "# TYPE jobs_total counter\njobs_total{queue=\"fast\"} %d\njobs_total{queue=\"slow\"} 100\n", value)
+	}))
+	defer server.Close()
+
+	scraper := NewScraper(db, "worker", server.URL, time.Second)
+	first := time.Now()
+	assert.NoError(t, scraper.Scrape(context.Background()))
+	time.Sleep(20 * time.Millisecond)
+	value = 2
+	assert.NoError(t, scraper.Scrape(context.Background()))
+	last := time.Now()
+
+	selector, err := ParseSelector(`jobs_total{job="worker",queue=~"f.*"}`)
+	assert.NoError(t, err)
+	result, err := Instant(db, selector, last)
+	assert.NoError(t, err)
+	if assert.Len(t, result, 1) {
+		assert.Equal(t, map[string]string{NameLabel: "jobs_total", JobLabel: "worker", "queue": "fast"}, result[0].Labels)
+		assert.Equal(t, []Point{{Time: last, Value: 2}}, result[0].Samples)
+	}
+
+	// Before the first scrape there is nothing, and after it the latest sample is carried forward.
+	result, err = Range(db, selector, first.Add(-time.Second), last.Add(time.Minute), time.Second)
+	assert.NoError(t, err)
+	if assert.Len(t, result, 1) {
+		assert.Len(t, result[0].Samples, 61)
+		assert.Equal(t, 2.0, result[0].Samples[60].Value)
+	}
+
+	selector, err = ParseSelector(`jobs_total{queue!="fast"}`)
+	assert.NoError(t, err)
+	result, err = Instant(db, selector, last)
+	assert.NoError(t, err)
+	if assert.Len(t, result, 1) {
+		assert.Equal(t, "slow", result[0].Labels["queue"])
+	}
+
+	// Samples older than the lookback are stale.
+	result, err = Instant(db, selector, last.Add(LookbackDelta+time.Second))
+	assert.NoError(t, err)
+	assert.Empty(t, result)
+
+	_, err = Range(db, selector, first, first.Add(time.Hour), time.Millisecond)
+	assert.Error(t, err)
+}
+
+func TestFormatValue(t *testing.T) {
+	assert.Equal(t, "+Inf", FormatValue(math.Inf(1)))
+	assert.Equal(t, "-Inf", FormatValue(math.Inf(-1)))
+	assert.Equal(t, "NaN", FormatValue(math.NaN()))
+	assert.Equal(t, "0.25", FormatValue(0.25))
+	assert.Equal(t, "1027", FormatValue(1027))
+}
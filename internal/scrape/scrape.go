@@ -0,0 +1,251 @@
+/*
+ * Copyright (c) 2023 Asim Ihsan.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ * SPDX-License-Identifier: MPL-2.0
+ */
+
+// Package scrape scrapes the Prometheus metrics of services, stores their samples in the metric_series and
+// metric_samples tables, and answers instant and range queries over them.
+package scrape
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/rs/zerolog/log"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// UpMetric is stored for every scrape, as Prometheus does: 1 if the scrape succeeded and 0 if it failed.
+const UpMetric = "up"
+
+// acceptHeader asks for the text format, which every client library serves.
+const acceptHeader = "text/plain;version=0.0.4;q=1,*/*;q=0.1"
+
+// Scraper scrapes the metrics endpoint of one service at an interval.
+type Scraper struct {
+	db       *sql.DB
+	service  string
+	url      string
+	interval time.Duration
+	client   *http.Client
+
+	// series caches the ids of the series the service has exported.
+	mu     sync.Mutex
+	series map[seriesKey]int64
+	failed bool
+}
+
+type seriesKey struct {
+	name   string
+	labels string
+}
+
+// NewScraper returns a scraper that stores the samples it scrapes from url as those of service.
+func NewScraper(db *sql.DB, service string, url string, interval time.Duration) *Scraper {
+	return &Scraper{
+		db:       db,
+		service:  service,
+		url:      url,
+		interval: interval,
+		client:   &http.Client{Timeout: interval},
+		series:   make(map[seriesKey]int64),
+	}
+}
+
+// Run scrapes at the scraper's interval until stop is closed or sent to.
+func (s *Scraper) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		// The first scrape waits an interval for the service to start. The client's timeout, the interval, bounds a
+		// scrape, so stop is only waited on between scrapes.
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		err := s.Scrape(context.Background())
+		if err != nil && !s.failed {
+			// A service is expected to be down at times, e.g. while it restarts, so only the first failure is logged.
+			log.Printf("Error scraping metrics of %s from %s: %v", s.service, s.url, err)
+		}
+		s.failed = err != nil
+	}
+}
+
+// Scrape scrapes the service once, storing its samples and its up sample.
+func (s *Scraper) Scrape(ctx context.Context) error {
+	now := time.Now()
+	families, err := s.fetch(ctx)
+	up := 1.0
+	if err != nil {
+		up = 0
+	}
+
+	tx, txErr := s.db.Begin()
+	if txErr != nil {
+		return txErr
+	}
+	defer tx.Rollback()
+	if txErr := s.store(tx, UpMetric, nil, dto.MetricType_GAUGE, "", now, up); txErr != nil {
+		return txErr
+	}
+	if err == nil {
+		for _, family := range families {
+			for _, sample := range Samples(family) {
+				at := now
+				if sample.TimestampMs != 0 {
+					at = time.UnixMilli(sample.TimestampMs)
+				}
+				if err := s.store(tx, sample.Name, sample.Labels, family.GetType(), family.GetHelp(), at, sample.Value); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if txErr := tx.Commit(); txErr != nil {
+		return txErr
+	}
+	return err
+}
+
+func (s *Scraper) fetch(ctx context.Context) (map[string]*dto.MetricFamily, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", acceptHeader)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	var parser expfmt.TextParser
+	return parser.TextToMetricFamilies(resp.Body)
+}
+
+// store adds a sample to its series, creating the series the first time it is seen.
+func (s *Scraper) store(
+	tx *sql.Tx,
+	name string,
+	labels map[string]string,
+	metricType dto.MetricType,
+	help string,
+	at time.Time,
+	value float64,
+) error {
+	encoded := encodeLabels(labels)
+	key := seriesKey{name: name, labels: encoded}
+	s.mu.Lock()
+	id, ok := s.series[key]
+	s.mu.Unlock()
+	if !ok {
+		_, err := tx.Exec(`INSERT OR IGNORE INTO metric_series (service_name, name, labels, type, help) VALUES (?, ?, ?, ?, ?)`,
+			s.service, name, encoded, strings.ToLower(metricType.String()), help)
+		if err != nil {
+			return err
+		}
+		err = tx.QueryRow(`SELECT id FROM metric_series WHERE service_name = ? AND name = ? AND labels = ?`,
+			s.service, name, encoded).Scan(&id)
+		if err != nil {
+			return err
+		}
+		s.mu.Lock()
+		s.series[key] = id
+		s.mu.Unlock()
+	}
+	_, err := tx.Exec(`INSERT OR REPLACE INTO metric_samples (series_id, timestamp_ms, value) VALUES (?, ?, ?)`,
+		id, at.UnixMilli(), storedValue(value))
+	return err
+}
+
+// storedValue keeps NaN, which SQLite stores as NULL, apart from the infinities, which it stores as they are.
+func storedValue(value float64) interface{} {
+	if math.IsNaN(value) {
+		return nil
+	}
+	return value
+}
+
+// encodeLabels encodes labels as a JSON object with sorted keys, so that a series always has the same encoding.
+func encodeLabels(labels map[string]string) string {
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	encoded, _ := json.Marshal(labels)
+	return string(encoded)
+}
+
+// Sample is one sample of a metric family as the text format writes it: histograms and summaries are split into
+// their _bucket, _sum and _count series, with le and quantile labels.
+type Sample struct {
+	Name        string
+	Labels      map[string]string
+	Value       float64
+	TimestampMs int64
+}
+
+// Samples returns the samples of a metric family.
+func Samples(family *dto.MetricFamily) []Sample {
+	var samples []Sample
+	name := family.GetName()
+	for _, metric := range family.GetMetric() {
+		labels := make(map[string]string, len(metric.GetLabel()))
+		for _, label := range metric.GetLabel() {
+			labels[label.GetName()] = label.GetValue()
+		}
+		add := func(name string, extra map[string]string, value float64) {
+			sampleLabels := labels
+			if len(extra) > 0 {
+				sampleLabels = make(map[string]string, len(labels)+len(extra))
+				for k, v := range labels {
+					sampleLabels[k] = v
+				}
+				for k, v := range extra {
+					sampleLabels[k] = v
+				}
+			}
+			samples = append(samples, Sample{Name: name, Labels: sampleLabels, Value: value, TimestampMs: metric.GetTimestampMs()})
+		}
+
+		switch family.GetType() {
+		case dto.MetricType_COUNTER:
+			add(name, nil, metric.GetCounter().GetValue())
+		case dto.MetricType_GAUGE:
+			add(name, nil, metric.GetGauge().GetValue())
+		case dto.MetricType_SUMMARY:
+			summary := metric.GetSummary()
+			for _, q := range summary.GetQuantile() {
+				add(name, map[string]string{"quantile": FormatValue(q.GetQuantile())}, q.GetValue())
+			}
+			add(name+"_sum", nil, summary.GetSampleSum())
+			add(name+"_count", nil, float64(summary.GetSampleCount()))
+		case dto.MetricType_HISTOGRAM:
+			histogram := metric.GetHistogram()
+			for _, bucket := range histogram.GetBucket() {
+				add(name+"_bucket", map[string]string{"le": FormatValue(bucket.GetUpperBound())}, float64(bucket.GetCumulativeCount()))
+			}
+			add(name+"_sum", nil, histogram.GetSampleSum())
+			add(name+"_count", nil, float64(histogram.GetSampleCount()))
+		default:
+			add(name, nil, metric.GetUntyped().GetValue())
+		}
+	}
+	return samples
+}
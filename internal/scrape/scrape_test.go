@@ -0,0 +1,115 @@
+/*
+ * Copyright (c) 2023 Asim Ihsan.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ * SPDX-License-Identifier: MPL-2.0
+ */
+
+package scrape
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/asimihsan/virtual-cluster/internal/schema"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestDB(t *testing.T) *sql.DB {
+	db, err := sql.Open("sqlite3", ":memory:")
+	assert.NoError(t, err)
+	db.SetMaxOpenConns(1)
+	assert.NoError(t, schema.Create(db))
+	return db
+}
+
+const exposition = `# HELP http_requests_total Requests served.
+# TYPE http_requests_total counter
+http_requests_total{code="200",method="get"} 1027
+http_requests_total{code="500",method="get"} 3
+# HELP queue_depth Items waiting.
+# TYPE queue_depth gauge
+queue_depth 7
+# TYPE request_seconds histogram
+request_seconds_bucket{le="0.1"} 4
+request_seconds_bucket{le="1"} 9
+request_seconds_bucket{le="+Inf"} 10
+request_seconds_sum 3.5
+request_seconds_count 10
+`
+
+func seriesValues(t *testing.T, db *sql.DB) map[string]float64 {
+	rows, err := db.Query(`
+		SELECT s.name, s.labels, m.value FROM metric_samples m JOIN metric_series s ON s.id = m.series_id`)
+	assert.NoError(t, err)
+	defer rows.Close()
+	values := make(map[string]float64)
+	for rows.Next() {
+		var name, labels string
+		var value float64
+		assert.NoError(t, rows.Scan(&name, &labels, &value))
+		values[name+labels] = value
+	}
+	return values
+}
+
+func TestScraper_Scrape(t *testing.T) {
+	db := newTestDB(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		fmt.Fprint(w, exposition)
+	}))
+	defer server.Close()
+
+	scraper := NewScraper(db, "orders", server.URL+"/metrics", time.Second)
+	assert.NoError(t, scraper.Scrape(context.Background()))
+
+	assert.Equal(t, map[string]float64{
+		`up{}`: 1,
+		`http_requests_total{"code":"200","method":"get"}`: 1027,
+		`http_requests_total{"code":"500","method":"get"}`: 3,
+		`queue_depth{}`:                       7,
+		`request_seconds_bucket{"le":"0.1"}`:  4,
+		`request_seconds_bucket{"le":"1"}`:    9,
+		`request_seconds_bucket{"le":"+Inf"}`: 10,
+		`request_seconds_sum{}`:               3.5,
+		`request_seconds_count{}`:             10,
+	}, seriesValues(t, db))
+
+	var metricType, help string
+	err := db.QueryRow(`SELECT type, help FROM metric_series WHERE service_name = 'orders' AND name = 'http_requests_total' LIMIT 1`).
+		Scan(&metricType, &help)
+	assert.NoError(t, err)
+	assert.Equal(t, "counter", metricType)
+	assert.Equal(t, "Requests served.", help)
+
+	// A second scrape adds samples to the same series.
+	time.Sleep(2 * time.Millisecond)
+	assert.NoError(t, scraper.Scrape(context.Background()))
+	var series, samples int
+	assert.NoError(t, db.QueryRow(`SELECT COUNT(*) FROM metric_series`).Scan(&series))
+	assert.NoError(t, db.QueryRow(`SELECT COUNT(*) FROM metric_samples`).Scan(&samples))
+	assert.Equal(t, 9, series)
+	assert.Equal(t, 18, samples)
+}
+
+func TestScraper_ScrapeFailure_RecordsDown(t *testing.T) {
+	db := newTestDB(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "not ready", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	scraper := NewScraper(db, "orders", server.URL+"/metrics", time.Second)
+	assert.Error(t, scraper.Scrape(context.Background()))
+	assert.Equal(t, map[string]float64{`up{}`: 0}, seriesValues(t, db))
+}
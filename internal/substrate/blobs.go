@@ -0,0 +1,96 @@
+/*
+ * Copyright (c) 2023 Asim Ihsan.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ * SPDX-License-Identifier: MPL-2.0
+ */
+
+package substrate
+
+import (
+	"encoding/base64"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// bodyMetadata selects the body columns of a row, in the order capturedBody scans them.
+const bodyMetadata = "COALESCE(body_size, LENGTH(body), 0), COALESCE(body_truncated, 0), COALESCE(body_binary, 0), " +
+	"COALESCE(body_blob, ''), COALESCE(content_type, ''), COALESCE(content_encoding, ''), COALESCE(body_decoded, 0)"
+
+// capturedBody is a captured HTTP body as read back from the database.
+type capturedBody struct {
+	data      []byte
+	size      int64
+	truncated bool
+	binary    bool
+	blob      string
+
+	contentType     string
+	contentEncoding string
+	decoded         bool
+}
+
+// scanArgs are the destinations for the columns selected by bodyMetadata.
+func (b *capturedBody) scanArgs() []interface{} {
+	return []interface{}{&b.size, &b.truncated, &b.binary, &b.blob, &b.contentType, &b.contentEncoding, &b.decoded}
+}
+
+// addTo adds the body to a websocket message. Binary bodies are base64-encoded, as JSON strings cannot hold them.
+// content_type lets the UI pretty-print JSON, form and multipart bodies; body_decoded tells it that the body is shown
+// without its content_encoding.
+func (b capturedBody) addTo(message map[string]interface{}) map[string]interface{} {
+	b.addData(message, "body")
+	message["body_size"] = b.size
+	message["body_truncated"] = b.truncated
+	message["body_binary"] = b.binary
+	message["body_blob"] = b.blob
+	message["content_type"] = b.contentType
+	message["content_encoding"] = b.contentEncoding
+	message["body_decoded"] = b.decoded
+	return message
+}
+
+// addPayloadTo adds a WebSocket frame payload to a websocket message, encoded as addTo encodes bodies.
+func (b capturedBody) addPayloadTo(message map[string]interface{}) map[string]interface{} {
+	b.addData(message, "payload")
+	message["payload_size"] = b.size
+	message["payload_truncated"] = b.truncated
+	message["payload_binary"] = b.binary
+	return message
+}
+
+func (b capturedBody) addData(message map[string]interface{}, key string) {
+	if b.binary {
+		message[key] = base64.StdEncoding.EncodeToString(b.data)
+		message[key+"_encoding"] = "base64"
+	} else {
+		message[key] = string(b.data)
+	}
+}
+
+// isMemoryDatabase reports whether dbPath names an in-memory SQLite database, which has no directory to keep blobs
+// next to.
+func isMemoryDatabase(dbPath string) bool {
+	return dbPath == "" || strings.Contains(dbPath, ":memory:") || strings.Contains(dbPath, "mode=memory")
+}
+
+var blobName = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// handleGetBlob returns the whole of a body that was too large to store in its row.
+func (m *Manager) handleGetBlob(c echo.Context) error {
+	blob := c.Param("blob")
+	if m.blobs == nil || !blobName.MatchString(blob) {
+		return echo.NewHTTPError(http.StatusNotFound, "no such blob")
+	}
+	path := m.blobs.Path(blob)
+	if _, err := os.Stat(path); err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, "no such blob")
+	}
+	return c.File(path)
+}
@@ -0,0 +1,68 @@
+/*
+ * Copyright (c) 2023 Asim Ihsan.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ * SPDX-License-Identifier: MPL-2.0
+ */
+
+package substrate
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/asimihsan/virtual-cluster/internal/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+// nextEvent returns the next websocket event of type eventType, skipping the others.
+func nextEvent(t *testing.T, send chan []byte, eventType string) map[string]interface{} {
+	deadline := time.After(5 * time.Second)
+	for {
+		select {
+		case message := <-send:
+			var event map[string]interface{}
+			assert.NoError(t, json.Unmarshal(message, &event))
+			if event["type"] == eventType {
+				return event
+			}
+		case <-deadline:
+			t.Fatalf("no %s event", eventType)
+			return nil
+		}
+	}
+}
+
+func TestBroadcast_ResponseCarriesRecordedRequestBody(t *testing.T) {
+	m, err := NewManager(filepath.Join(t.TempDir(), "vcluster.db"), WithHTTPPort(0), WithOTLPPort(0))
+	assert.NoError(t, err)
+	defer m.Close()
+	send := make(chan []byte, websocket.DefaultSendBuffer)
+	m.websocket.AddClient(websocket.NewClient(nil, websocket.WithSendChannel(send)))
+
+	// The proxy records a request before its body has streamed through.
+	_, err = m.db.Exec(`INSERT INTO http_requests (id, process_name, method, url, headers, body, body_size, caller, trace_id)
+		VALUES (1, 'orders', 'POST', '/orders', '{}', '', 0, 'frontend', '4bf92f3577b34da6a3ce929d0e0e4736')`)
+	assert.NoError(t, err)
+	request := nextEvent(t, send, "http_request")
+	assert.Equal(t, "", request["body"])
+
+	_, err = m.db.Exec(`UPDATE http_requests SET body = '{"item":"book"}', body_size = 15 WHERE id = 1`)
+	assert.NoError(t, err)
+	_, err = m.db.Exec(`INSERT INTO http_responses (http_request_id, process_name, status_code, headers, body, body_size)
+		VALUES (1, 'orders', 201, '{}', 'created', 7)`)
+	assert.NoError(t, err)
+	response := nextEvent(t, send, "http_response")
+	request, ok := response["http_request"].(map[string]interface{})
+	if assert.True(t, ok) {
+		assert.Equal(t, `{"item":"book"}`, request["body"])
+		assert.Equal(t, float64(15), request["body_size"])
+		assert.Equal(t, "frontend", request["caller"])
+		assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", request["trace_id"])
+	}
+}
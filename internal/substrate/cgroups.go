@@ -0,0 +1,71 @@
+/*
+ * Copyright (c) 2023 Asim Ihsan.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ * SPDX-License-Identifier: MPL-2.0
+ */
+
+package substrate
+
+import (
+	"fmt"
+	"github.com/asimihsan/virtual-cluster/internal/cgroup"
+	"github.com/asimihsan/virtual-cluster/internal/parser"
+	"log"
+	"os"
+)
+
+// setupCgroups creates the cgroups that limit what services use when any service has limits. Without cgroup v2
+// delegation, services run without their limits.
+func (m *Manager) setupCgroups(asts []*parser.VClusterAST) {
+	needed := false
+	for _, ast := range asts {
+		for _, service := range ast.Services {
+			needed = needed || service.Limits != nil
+		}
+	}
+	if !needed {
+		return
+	}
+
+	pid := os.Getpid()
+	ownCgroup, err := cgroup.OwnCgroup(pid)
+	if err == nil {
+		m.cgroups, err = cgroup.Setup(cgroup.DefaultMountPoint, ownCgroup, pid, fmt.Sprintf("vcluster-%d", pid))
+	}
+	if err != nil {
+		log.Printf("Warning: services run without their limits, as cgroup v2 delegation is not available: %v", err)
+		log.Printf("Run as root, or under systemd-run --user --scope -p Delegate=yes, to apply limits")
+		return
+	}
+	log.Printf("Service limits are applied by the cgroups under %s", ownCgroup)
+}
+
+// serviceCgroup creates the cgroup that limits a service, or returns nil if it has no limits or they cannot be
+// applied.
+func (m *Manager) serviceCgroup(service parser.VClusterServiceDefinitionAST) *cgroup.Group {
+	if service.Limits == nil || m.cgroups == nil {
+		return nil
+	}
+	group, err := m.cgroups.NewGroup(service.Name, cgroup.Limits{
+		MemoryBytes: service.Limits.MemoryBytes,
+		CPU:         service.Limits.CPU,
+		Pids:        service.Limits.Pids,
+	})
+	if err != nil {
+		log.Printf("Warning: service %s runs without its limits: %v", service.Name, err)
+		return nil
+	}
+	return group
+}
+
+// removeCgroups removes the cgroups of services whose processes have exited. Cgroups of processes that are still
+// exiting are left behind, empty once they have.
+func (m *Manager) removeCgroups() {
+	if m.cgroups != nil {
+		_ = m.cgroups.Remove()
+	}
+}
@@ -0,0 +1,215 @@
+/*
+ * Copyright (c) 2023 Asim Ihsan.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ * SPDX-License-Identifier: MPL-2.0
+ */
+
+package substrate
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"github.com/asimihsan/virtual-cluster/internal/parser"
+	"github.com/asimihsan/virtual-cluster/internal/proxy"
+	"github.com/asimihsan/virtual-cluster/internal/utils"
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// startEgress starts the egress proxy if the cluster has one. It runs before any process starts, as every process
+// is told to send its outbound calls through it.
+func (m *Manager) startEgress(asts []*parser.VClusterAST) error {
+	var definition *parser.VClusterEgressDefinitionAST
+	for _, ast := range asts {
+		if ast.Egress == nil {
+			continue
+		}
+		if definition != nil {
+			return fmt.Errorf("only one egress entry is allowed, found one on port %d and one on port %d",
+				definition.Port, ast.Egress.Port)
+		}
+		definition = ast.Egress
+	}
+	if definition == nil {
+		return nil
+	}
+
+	rules, err := proxy.NewEgressRules(definition.Rules)
+	if err != nil {
+		return errors.Wrap(err, "invalid egress rules")
+	}
+	proxyOptions := []proxy.ProxyOption{
+		proxy.WithVerbose(m.verbose),
+		proxy.WithCaptureLimit(m.captureLimit),
+		proxy.WithClient(m.ServiceForConnection),
+	}
+	if m.blobs != nil {
+		proxyOptions = append(proxyOptions, proxy.WithBlobStore(m.blobs))
+	}
+	egressOptions := []proxy.EgressOption{
+		proxy.WithEgressRules(rules),
+		// Exports to the OTLP receiver are telemetry rather than calls of the service, and are not captured.
+		proxy.WithEgressInternalHosts(append(internalHosts(asts), loopbackHosts(m.otlpPort)...)...),
+	}
+	if definition.MITM {
+		// Intercepted calls may be to proxy ports serving TLS as well as to other hosts.
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{RootCAs: m.ca.SystemPool()}
+		proxyOptions = append(proxyOptions, proxy.WithTransport(transport))
+		egressOptions = append(egressOptions, proxy.WithEgressMITM(m.ca))
+
+		// Clients that take their roots from one file need both the system's roots and the CA in it.
+		bundle, err := m.ca.BundlePath()
+		if err != nil {
+			return err
+		}
+		m.env = append(m.env, "SSL_CERT_FILE="+bundle, "REQUESTS_CA_BUNDLE="+bundle)
+	}
+	egress := proxy.NewEgress(m.db, append(egressOptions, proxy.WithEgressProxyOptions(proxyOptions...))...)
+
+	pw := utils.NewPortWaiter(strconv.Itoa(definition.Port))
+	if err := pw.Wait(); err != nil {
+		return errors.Wrap(err, "failed to wait for egress port")
+	}
+
+	m.mu.Lock()
+	m.egressRules = rules
+	m.egressPort = definition.Port
+	m.mu.Unlock()
+
+	stop := make(chan struct{}, 1)
+	m.stopChans = append(m.stopChans, stop)
+	// Only local processes may relay through the proxy. Listening on every interface would let anyone on the network
+	// reach services that listen on loopback, and with MITM get certificates from the local CA for any host.
+	listenAddr := fmt.Sprintf("127.0.0.1:%d", definition.Port)
+	go func() {
+		log.Printf("Starting egress proxy on %s", listenAddr)
+		server := &http.Server{Addr: listenAddr, Handler: egress, ConnContext: proxy.ConnContext}
+
+		go func() {
+			if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Printf("Error starting egress proxy: %v", err)
+			}
+		}()
+
+		<-stop
+		log.Printf("Stopping egress proxy")
+		if err := server.Shutdown(context.Background()); err != nil {
+			log.Printf("Error stopping egress proxy: %v", err)
+		}
+	}()
+
+	return nil
+}
+
+// internalHosts are the addresses of the ports the cluster captures calls on itself: the proxy ports of its services,
+// its gateways, mock services and replays.
+func internalHosts(asts []*parser.VClusterAST) []string {
+	var ports []int
+	for _, ast := range asts {
+		for _, service := range ast.Services {
+			if service.ProxyPort != nil {
+				ports = append(ports, *service.ProxyPort)
+			} else if service.IsReplay() && service.ServicePort != nil {
+				ports = append(ports, *service.ServicePort)
+			}
+		}
+		for _, mockService := range ast.MockServices {
+			ports = append(ports, mockService.Port)
+		}
+		for _, gateway := range ast.Gateways {
+			ports = append(ports, gateway.Port)
+		}
+	}
+	return loopbackHosts(ports...)
+}
+
+// loopbackHosts are the addresses of the given ports on the loopback interface.
+func loopbackHosts(ports ...int) []string {
+	var hosts []string
+	for _, port := range ports {
+		for _, host := range []string{"localhost", "127.0.0.1", "::1"} {
+			hosts = append(hosts, net.JoinHostPort(host, strconv.Itoa(port)))
+		}
+	}
+	return hosts
+}
+
+// processEnv is the environment added for the named managed process. It names the process in ServiceNameEnv, points
+// its OpenTelemetry SDK at the OTLP receiver, and with an egress proxy, sends its outbound calls through it, naming
+// itself as the user of the proxy URL so that its calls are attributed to it. Calls to loopback addresses bypass the
+// egress proxy, as NO_PROXY tells clients that honour it and as Go's net/http does anyway: the dependencies, the OTLP
+// receiver and the proxy ports of other services are all on loopback, and the proxy ports attribute calls by the
+// process on the other end of their connection instead.
+func (m *Manager) processEnv(name string) []string {
+	env := append([]string(nil), m.env...)
+	env = append(env, ServiceNameEnv+"="+name)
+	env = append(env, m.otlpEnv(name)...)
+	m.mu.Lock()
+	port := m.egressPort
+	m.mu.Unlock()
+	if port == 0 {
+		return env
+	}
+
+	proxyURL := (&url.URL{Scheme: "http", User: url.User(name), Host: fmt.Sprintf("127.0.0.1:%d", port)}).String()
+	for _, key := range []string{"HTTP_PROXY", "HTTPS_PROXY", "http_proxy", "https_proxy"} {
+		env = append(env, key+"="+proxyURL)
+	}
+	for _, key := range []string{"NO_PROXY", "no_proxy"} {
+		env = append(env, key+"=localhost,127.0.0.1,::1")
+	}
+	return env
+}
+
+// EgressRules returns the rules of the egress proxy. It returns false if the cluster has no egress proxy.
+func (m *Manager) EgressRules() (*proxy.EgressRules, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.egressRules, m.egressRules != nil
+}
+
+func (m *Manager) handleGetEgressRules(c echo.Context) error {
+	rules, ok := m.EgressRules()
+	if !ok {
+		return echo.NewHTTPError(http.StatusNotFound, "the cluster has no egress proxy")
+	}
+	return c.JSON(http.StatusOK, rules.Rules())
+}
+
+// handlePutEgressRules replaces the egress rules with the JSON array of rules in the request body.
+func (m *Manager) handlePutEgressRules(c echo.Context) error {
+	rules, ok := m.EgressRules()
+	if !ok {
+		return echo.NewHTTPError(http.StatusNotFound, "the cluster has no egress proxy")
+	}
+	var replacement []proxy.EgressRule
+	if err := c.Bind(&replacement); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if err := rules.Set(replacement); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	return c.JSON(http.StatusOK, rules.Rules())
+}
+
+func (m *Manager) handleDeleteEgressRules(c echo.Context) error {
+	rules, ok := m.EgressRules()
+	if !ok {
+		return echo.NewHTTPError(http.StatusNotFound, "the cluster has no egress proxy")
+	}
+	if err := rules.Set(nil); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	return c.NoContent(http.StatusNoContent)
+}
@@ -0,0 +1,172 @@
+/*
+ * Copyright (c) 2023 Asim Ihsan.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ * SPDX-License-Identifier: MPL-2.0
+ */
+
+package substrate
+
+import (
+	"encoding/json"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Email is a message captured by a managed_smtp dependency.
+type Email struct {
+	ID             int               `json:"id"`
+	Timestamp      string            `json:"timestamp"`
+	DependencyName string            `json:"dependency_name"`
+	ClientName     string            `json:"client_name"`
+	EnvelopeFrom   string            `json:"envelope_from"`
+	EnvelopeTo     []string          `json:"envelope_to"`
+	From           string            `json:"from"`
+	To             []string          `json:"to"`
+	Cc             []string          `json:"cc"`
+	Subject        string            `json:"subject"`
+	MessageID      string            `json:"message_id"`
+	TextBody       string            `json:"text_body"`
+	HTMLBody       string            `json:"html_body"`
+	Attachments    []EmailAttachment `json:"attachments"`
+	Size           int               `json:"size"`
+}
+
+type EmailAttachment struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	ContentID   string `json:"content_id,omitempty"`
+	Size        int    `json:"size"`
+}
+
+// EmailFilter narrows down GetEmails. Empty fields match everything.
+type EmailFilter struct {
+	DependencyName string
+	ClientName     string
+
+	// Recipient matches an envelope recipient exactly, ignoring case.
+	Recipient string
+
+	// Subject matches a substring of the subject.
+	Subject string
+}
+
+// GetEmails returns the captured emails matching filter, oldest first.
+func (m *Manager) GetEmails(filter EmailFilter) ([]*Email, error) {
+	var conditions []string
+	var args []interface{}
+	if filter.DependencyName != "" {
+		conditions = append(conditions, "dependency_name = ?")
+		args = append(args, filter.DependencyName)
+	}
+	if filter.ClientName != "" {
+		conditions = append(conditions, "client_name = ?")
+		args = append(args, filter.ClientName)
+	}
+	if filter.Recipient != "" {
+		conditions = append(conditions, "EXISTS (SELECT 1 FROM json_each(envelope_to) WHERE lower(json_each.value) = lower(?))")
+		args = append(args, filter.Recipient)
+	}
+	if filter.Subject != "" {
+		conditions = append(conditions, "instr(subject, ?) > 0")
+		args = append(args, filter.Subject)
+	}
+
+	where := ""
+	if len(conditions) > 0 {
+		where = "WHERE " + strings.Join(conditions, " AND ")
+	}
+	return m.getEmails(where+" ORDER BY id ASC", args...)
+}
+
+// GetEmail returns a captured email with its raw message, or nil if there is no email with that id.
+func (m *Manager) GetEmail(id int) (*Email, string, error) {
+	emails, err := m.getEmails("WHERE id = ?", id)
+	if err != nil || len(emails) == 0 {
+		return nil, "", err
+	}
+	var raw string
+	err = m.db.QueryRow("SELECT raw FROM emails WHERE id = ?", id).Scan(&raw)
+	if err != nil {
+		return nil, "", err
+	}
+	return emails[0], raw, nil
+}
+
+// DeleteEmails removes all captured emails, so that tests can start from an empty mailbox.
+func (m *Manager) DeleteEmails() error {
+	_, err := m.db.Exec("DELETE FROM emails")
+	return err
+}
+
+func (m *Manager) getEmails(clause string, args ...interface{}) ([]*Email, error) {
+	rows, err := m.db.Query(`SELECT id, timestamp, dependency_name, client_name, envelope_from, envelope_to, from_address, to_addresses, cc_addresses, subject, message_id, text_body, html_body, attachments, size FROM emails `+clause, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var emails []*Email
+	for rows.Next() {
+		var email Email
+		var envelopeTo, to, cc, attachments string
+		err = rows.Scan(&email.ID, &email.Timestamp, &email.DependencyName, &email.ClientName, &email.EnvelopeFrom,
+			&envelopeTo, &email.From, &to, &cc, &email.Subject, &email.MessageID, &email.TextBody, &email.HTMLBody,
+			&attachments, &email.Size)
+		if err != nil {
+			return nil, err
+		}
+		_ = json.Unmarshal([]byte(envelopeTo), &email.EnvelopeTo)
+		_ = json.Unmarshal([]byte(to), &email.To)
+		_ = json.Unmarshal([]byte(cc), &email.Cc)
+		_ = json.Unmarshal([]byte(attachments), &email.Attachments)
+		emails = append(emails, &email)
+	}
+	return emails, rows.Err()
+}
+
+func (m *Manager) handleGetEmails(c echo.Context) error {
+	emails, err := m.GetEmails(EmailFilter{
+		DependencyName: c.QueryParam("dependency"),
+		ClientName:     c.QueryParam("client"),
+		Recipient:      c.QueryParam("to"),
+		Subject:        c.QueryParam("subject"),
+	})
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	if emails == nil {
+		emails = []*Email{}
+	}
+	return c.JSON(http.StatusOK, emails)
+}
+
+func (m *Manager) handleGetEmail(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid email id")
+	}
+	email, raw, err := m.GetEmail(id)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	if email == nil {
+		return echo.NewHTTPError(http.StatusNotFound, "email not found")
+	}
+	if c.QueryParam("format") == "raw" {
+		return c.Blob(http.StatusOK, "message/rfc822", []byte(raw))
+	}
+	return c.JSON(http.StatusOK, email)
+}
+
+func (m *Manager) handleDeleteEmails(c echo.Context) error {
+	if err := m.DeleteEmails(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	return c.NoContent(http.StatusNoContent)
+}
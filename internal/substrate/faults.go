@@ -0,0 +1,61 @@
+/*
+ * Copyright (c) 2023 Asim Ihsan.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ * SPDX-License-Identifier: MPL-2.0
+ */
+
+package substrate
+
+import (
+	"fmt"
+	"github.com/asimihsan/virtual-cluster/internal/proxy"
+	"github.com/labstack/echo/v4"
+	"net/http"
+)
+
+// ServiceFaults returns the fault rules of a proxied service. It returns false if the service has no proxy.
+func (m *Manager) ServiceFaults(serviceName string) (*proxy.Faults, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	faults, ok := m.faults[serviceName]
+	return faults, ok
+}
+
+func (m *Manager) handleGetFaults(c echo.Context) error {
+	faults, ok := m.ServiceFaults(c.Param("name"))
+	if !ok {
+		return echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("no proxied service named %s", c.Param("name")))
+	}
+	return c.JSON(http.StatusOK, faults.Rules())
+}
+
+// handlePutFaults replaces the fault rules of a service with the JSON array of rules in the request body.
+func (m *Manager) handlePutFaults(c echo.Context) error {
+	faults, ok := m.ServiceFaults(c.Param("name"))
+	if !ok {
+		return echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("no proxied service named %s", c.Param("name")))
+	}
+	var rules []proxy.FaultRule
+	if err := c.Bind(&rules); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if err := faults.Set(rules); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	return c.JSON(http.StatusOK, faults.Rules())
+}
+
+func (m *Manager) handleDeleteFaults(c echo.Context) error {
+	faults, ok := m.ServiceFaults(c.Param("name"))
+	if !ok {
+		return echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("no proxied service named %s", c.Param("name")))
+	}
+	if err := faults.Set(nil); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	return c.NoContent(http.StatusNoContent)
+}
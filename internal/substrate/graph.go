@@ -0,0 +1,131 @@
+/*
+ * Copyright (c) 2023 Asim Ihsan.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ * SPDX-License-Identifier: MPL-2.0
+ */
+
+package substrate
+
+import (
+	"database/sql"
+	"github.com/asimihsan/virtual-cluster/internal/utils"
+	"github.com/labstack/echo/v4"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// ServiceGraph is the dependency graph of the services as observed through the calls captured between them.
+type ServiceGraph struct {
+	Nodes []string      `json:"nodes"`
+	Edges []ServiceEdge `json:"edges"`
+}
+
+// ServiceEdge sums up the completed calls from Caller to Callee. Caller is "" for calls from outside the cluster or
+// from a caller that could not be told apart. A call is an error when the callee could not be reached, answered with
+// a 5xx status, or ended a gRPC call with a status other than OK.
+type ServiceEdge struct {
+	Caller    string  `json:"caller"`
+	Callee    string  `json:"callee"`
+	Calls     int     `json:"calls"`
+	Errors    int     `json:"errors"`
+	ErrorRate float64 `json:"error_rate"`
+	P50Ms     float64 `json:"p50_ms"`
+	P99Ms     float64 `json:"p99_ms"`
+}
+
+// ServiceGraph returns the graph of the calls made since the given time, or of all calls if since is zero.
+func (m *Manager) ServiceGraph(since time.Time) (*ServiceGraph, error) {
+	rows, err := m.db.Query(`
+		SELECT caller, callee, status_code, COALESCE(duration_ms, 0), COALESCE(upstream_error, ''), grpc_status_code
+		FROM call_edges
+		WHERE status_code IS NOT NULL AND timestamp >= ?`,
+		since.UTC().Format(utils.TimestampFormat))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	type key struct{ caller, callee string }
+	edges := make(map[key]*ServiceEdge)
+	durations := make(map[key][]float64)
+	for rows.Next() {
+		var caller, callee, upstreamError string
+		var statusCode int
+		var durationMs float64
+		var grpcStatusCode sql.NullInt64
+		if err := rows.Scan(&caller, &callee, &statusCode, &durationMs, &upstreamError, &grpcStatusCode); err != nil {
+			return nil, err
+		}
+		k := key{caller, callee}
+		edge, ok := edges[k]
+		if !ok {
+			edge = &ServiceEdge{Caller: caller, Callee: callee}
+			edges[k] = edge
+		}
+		edge.Calls++
+		if upstreamError != "" || statusCode >= 500 || (grpcStatusCode.Valid && grpcStatusCode.Int64 != 0) {
+			edge.Errors++
+		}
+		durations[k] = append(durations[k], durationMs)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	graph := &ServiceGraph{Nodes: []string{}, Edges: []ServiceEdge{}}
+	nodes := make(map[string]bool)
+	for k, edge := range edges {
+		edge.ErrorRate = float64(edge.Errors) / float64(edge.Calls)
+		sort.Float64s(durations[k])
+		edge.P50Ms = percentile(durations[k], 50)
+		edge.P99Ms = percentile(durations[k], 99)
+		graph.Edges = append(graph.Edges, *edge)
+		for _, node := range []string{edge.Caller, edge.Callee} {
+			if node != "" && !nodes[node] {
+				nodes[node] = true
+				graph.Nodes = append(graph.Nodes, node)
+			}
+		}
+	}
+	sort.Strings(graph.Nodes)
+	sort.Slice(graph.Edges, func(i, j int) bool {
+		if graph.Edges[i].Caller != graph.Edges[j].Caller {
+			return graph.Edges[i].Caller < graph.Edges[j].Caller
+		}
+		return graph.Edges[i].Callee < graph.Edges[j].Callee
+	})
+	return graph, nil
+}
+
+// percentile returns the nearest-rank percentile p of sorted, which must not be empty.
+func percentile(sorted []float64, p float64) float64 {
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// handleGetGraph returns the service graph. The since query parameter limits it to recent calls, either as a
+// duration such as 15m or as an RFC 3339 time.
+func (m *Manager) handleGetGraph(c echo.Context) error {
+	var since time.Time
+	if value := c.QueryParam("since"); value != "" {
+		if duration, err := time.ParseDuration(value); err == nil {
+			since = time.Now().Add(-duration)
+		} else if since, err = time.Parse(time.RFC3339, value); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "since must be a duration or an RFC 3339 time")
+		}
+	}
+	graph, err := m.ServiceGraph(since)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	return c.JSON(http.StatusOK, graph)
+}
@@ -0,0 +1,78 @@
+/*
+ * Copyright (c) 2023 Asim Ihsan.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ * SPDX-License-Identifier: MPL-2.0
+ */
+
+package substrate
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServiceGraph(t *testing.T) {
+	m, err := NewManager(filepath.Join(t.TempDir(), "vcluster.db"), WithHTTPPort(0))
+	assert.NoError(t, err)
+	defer m.Close()
+
+	calls := []struct {
+		caller     *string
+		callee     string
+		status     int
+		durationMs float64
+		upstream   string
+		grpcStatus *int
+	}{
+		{caller: ptr("frontend"), callee: "orders", status: 200, durationMs: 10},
+		{caller: ptr("frontend"), callee: "orders", status: 200, durationMs: 20},
+		{caller: ptr("frontend"), callee: "orders", status: 503, durationMs: 30},
+		{caller: ptr("frontend"), callee: "orders", status: 502, durationMs: 1000, upstream: "connection refused"},
+		{caller: ptr("orders"), callee: "payments", status: 200, durationMs: 5, grpcStatus: ptr(14)},
+		{caller: ptr("orders"), callee: "payments", status: 200, durationMs: 7, grpcStatus: ptr(0)},
+		{callee: "frontend", status: 404, durationMs: 1},
+	}
+	for i, call := range calls {
+		res, err := m.db.Exec("INSERT INTO http_requests (process_name, method, url, caller) VALUES (?, 'GET', '/', ?)",
+			call.callee, call.caller)
+		assert.NoError(t, err)
+		requestID, _ := res.LastInsertId()
+		_, err = m.db.Exec(`INSERT INTO http_responses (http_request_id, process_name, status_code, duration_ms, upstream_error)
+			VALUES (?, ?, ?, ?, ?)`, requestID, call.callee, call.status, call.durationMs, call.upstream)
+		assert.NoError(t, err, i)
+		if call.grpcStatus != nil {
+			_, err = m.db.Exec("INSERT INTO grpc_calls (http_request_id, process_name, status_code) VALUES (?, ?, ?)",
+				requestID, call.callee, *call.grpcStatus)
+			assert.NoError(t, err)
+		}
+	}
+	// A call still in flight has no response yet and is left out.
+	_, err = m.db.Exec("INSERT INTO http_requests (process_name, method, url, caller) VALUES ('orders', 'GET', '/', 'frontend')")
+	assert.NoError(t, err)
+
+	graph, err := m.ServiceGraph(time.Time{})
+	assert.NoError(t, err)
+	assert.Equal(t, &ServiceGraph{
+		Nodes: []string{"frontend", "orders", "payments"},
+		Edges: []ServiceEdge{
+			{Caller: "", Callee: "frontend", Calls: 1, P50Ms: 1, P99Ms: 1},
+			{Caller: "frontend", Callee: "orders", Calls: 4, Errors: 2, ErrorRate: 0.5, P50Ms: 20, P99Ms: 1000},
+			{Caller: "orders", Callee: "payments", Calls: 2, Errors: 1, ErrorRate: 0.5, P50Ms: 5, P99Ms: 7},
+		},
+	}, graph)
+
+	graph, err = m.ServiceGraph(time.Now().Add(time.Hour))
+	assert.NoError(t, err)
+	assert.Empty(t, graph.Edges)
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
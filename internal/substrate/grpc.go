@@ -0,0 +1,51 @@
+/*
+ * Copyright (c) 2023 Asim Ihsan.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ * SPDX-License-Identifier: MPL-2.0
+ */
+
+package substrate
+
+import (
+	"fmt"
+	"github.com/asimihsan/virtual-cluster/internal/parser"
+	"github.com/asimihsan/virtual-cluster/internal/proxy"
+	"github.com/asimihsan/virtual-cluster/internal/utils"
+	"github.com/pkg/errors"
+)
+
+// newGRPCResolver builds the resolver that the proxy of a service uses to decode gRPC messages, or returns nil if the
+// service has no grpc block.
+func (m *Manager) newGRPCResolver(service parser.VClusterServiceDefinitionAST) (proxy.MethodResolver, error) {
+	if service.GRPC == nil {
+		return nil, nil
+	}
+
+	var resolvers []proxy.MethodResolver
+	if len(service.GRPC.DescriptorSets) > 0 {
+		paths := make([]string, 0, len(service.GRPC.DescriptorSets))
+		for _, descriptorSet := range service.GRPC.DescriptorSets {
+			_, path, err := utils.StatUpward(descriptorSet, m.verbose)
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to find descriptor set: %s", descriptorSet)
+			}
+			paths = append(paths, path)
+		}
+		resolver, err := proxy.NewDescriptorSetResolver(paths...)
+		if err != nil {
+			return nil, err
+		}
+		resolvers = append(resolvers, resolver)
+	}
+	if service.GRPC.Reflection && service.ServicePort != nil {
+		resolvers = append(resolvers, proxy.NewReflectionResolver(fmt.Sprintf("localhost:%d", *service.ServicePort)))
+	}
+	if len(resolvers) == 0 {
+		return nil, nil
+	}
+	return proxy.ChainResolvers(resolvers...), nil
+}
@@ -0,0 +1,600 @@
+/*
+ * Copyright (c) 2023 Asim Ihsan.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ * SPDX-License-Identifier: MPL-2.0
+ */
+
+package substrate
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/asimihsan/virtual-cluster/internal/tracing"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The Jaeger query API is served under JaegerBasePath, so that the Jaeger data source of Grafana, or a Jaeger UI
+// behind a proxy, can browse the spans services export over OTLP. It is the JSON API of jaeger-query, which the
+// Jaeger UI uses: https://www.jaegertracing.io/docs/latest/apis/#http-json-internal.
+const JaegerBasePath = "/jaeger"
+
+// defaultJaegerLimit is how many traces a search returns when it does not say, as in jaeger-query.
+const defaultJaegerLimit = 20
+
+// jaegerResponse is the envelope of every response of the Jaeger query API.
+type jaegerResponse struct {
+	Data   interface{}   `json:"data"`
+	Total  int           `json:"total"`
+	Limit  int           `json:"limit"`
+	Offset int           `json:"offset"`
+	Errors []jaegerError `json:"errors"`
+}
+
+type jaegerError struct {
+	Code    int    `json:"code"`
+	Message string `json:"msg"`
+}
+
+type jaegerTrace struct {
+	TraceID   string                   `json:"traceID"`
+	Spans     []jaegerSpan             `json:"spans"`
+	Processes map[string]jaegerProcess `json:"processes"`
+	Warnings  []string                 `json:"warnings"`
+}
+
+type jaegerSpan struct {
+	TraceID       string            `json:"traceID"`
+	SpanID        string            `json:"spanID"`
+	OperationName string            `json:"operationName"`
+	References    []jaegerReference `json:"references"`
+	Flags         int               `json:"flags"`
+	StartTime     int64             `json:"startTime"`
+	Duration      int64             `json:"duration"`
+	Tags          []jaegerKeyValue  `json:"tags"`
+	Logs          []jaegerLog       `json:"logs"`
+	ProcessID     string            `json:"processID"`
+	Warnings      []string          `json:"warnings"`
+}
+
+type jaegerReference struct {
+	RefType string `json:"refType"`
+	TraceID string `json:"traceID"`
+	SpanID  string `json:"spanID"`
+}
+
+type jaegerKeyValue struct {
+	Key   string      `json:"key"`
+	Type  string      `json:"type"`
+	Value interface{} `json:"value"`
+}
+
+type jaegerLog struct {
+	Timestamp int64            `json:"timestamp"`
+	Fields    []jaegerKeyValue `json:"fields"`
+}
+
+type jaegerProcess struct {
+	ServiceName string           `json:"serviceName"`
+	Tags        []jaegerKeyValue `json:"tags"`
+}
+
+type jaegerOperation struct {
+	Name     string `json:"name"`
+	SpanKind string `json:"spanKind"`
+}
+
+type jaegerDependency struct {
+	Parent    string `json:"parent"`
+	Child     string `json:"child"`
+	CallCount int    `json:"callCount"`
+}
+
+// jaegerQuery is a trace search. Traces are found by their spans: a trace matches if one of its spans is of Service,
+// and of Operation, has all of Tags among its tags or its process's, and starts and lasts within the given bounds.
+type jaegerQuery struct {
+	Service     string
+	Operation   string
+	Tags        map[string]string
+	Start       time.Time
+	End         time.Time
+	MinDuration time.Duration
+	MaxDuration time.Duration
+	Limit       int
+}
+
+// storedSpan is a row of otel_spans as the Jaeger API reads it.
+type storedSpan struct {
+	traceID, spanID, parentSpanID, name, kind, statusCode, statusMessage string
+	serviceName, scopeName, scopeVersion                                 string
+	attributes, events, links, resourceAttributes                        string
+	startTimeUnixNano, endTimeUnixNano                                   int64
+}
+
+const storedSpanColumns = `trace_id, span_id, COALESCE(parent_span_id, ''), name, kind, status_code,
+	COALESCE(status_message, ''), service_name, COALESCE(scope_name, ''), COALESCE(scope_version, ''), attributes,
+	events, links, resource_attributes, start_time_unix_nano, end_time_unix_nano`
+
+func (s *storedSpan) scanArgs() []interface{} {
+	return []interface{}{&s.traceID, &s.spanID, &s.parentSpanID, &s.name, &s.kind, &s.statusCode, &s.statusMessage,
+		&s.serviceName, &s.scopeName, &s.scopeVersion, &s.attributes, &s.events, &s.links, &s.resourceAttributes,
+		&s.startTimeUnixNano, &s.endTimeUnixNano}
+}
+
+// tags are the Jaeger tags of the span: its attributes, and the kind, status and instrumentation scope that Jaeger
+// keeps as tags, named as the OpenTelemetry exporters to Jaeger named them.
+func (s *storedSpan) tags() []jaegerKeyValue {
+	tags := jaegerTags(s.attributes)
+	if s.kind != "internal" && s.kind != "unspecified" {
+		tags = append(tags, jaegerKeyValue{Key: "span.kind", Type: "string", Value: s.kind})
+	}
+	if s.statusCode != "unset" {
+		tags = append(tags, jaegerKeyValue{Key: "otel.status_code", Type: "string", Value: strings.ToUpper(s.statusCode)})
+	}
+	if s.statusCode == "error" {
+		tags = append(tags, jaegerKeyValue{Key: "error", Type: "bool", Value: true})
+	}
+	if s.statusMessage != "" {
+		tags = append(tags, jaegerKeyValue{Key: "otel.status_description", Type: "string", Value: s.statusMessage})
+	}
+	if s.scopeName != "" {
+		tags = append(tags, jaegerKeyValue{Key: "otel.scope.name", Type: "string", Value: s.scopeName})
+	}
+	if s.scopeVersion != "" {
+		tags = append(tags, jaegerKeyValue{Key: "otel.scope.version", Type: "string", Value: s.scopeVersion})
+	}
+	return tags
+}
+
+// matches reports whether the span or its process has all of the given tags.
+func (s *storedSpan) matches(tags map[string]string) bool {
+	if len(tags) == 0 {
+		return true
+	}
+	values := make(map[string]string)
+	for _, kvs := range [][]jaegerKeyValue{jaegerTags(s.resourceAttributes), s.tags()} {
+		for _, kv := range kvs {
+			values[kv.Key] = fmt.Sprint(kv.Value)
+		}
+	}
+	for key, value := range tags {
+		if actual, ok := values[key]; !ok || actual != value {
+			return false
+		}
+	}
+	return true
+}
+
+// jaegerTags converts stored attributes to Jaeger tags, sorted by key. Values that Jaeger has no type for, arrays and
+// maps, are kept as their JSON.
+func jaegerTags(attributes string) []jaegerKeyValue {
+	decoder := json.NewDecoder(strings.NewReader(attributes))
+	decoder.UseNumber()
+	var values map[string]interface{}
+	if err := decoder.Decode(&values); err != nil {
+		return []jaegerKeyValue{}
+	}
+	tags := make([]jaegerKeyValue, 0, len(values))
+	for key, value := range values {
+		tag := jaegerKeyValue{Key: key, Value: value}
+		switch v := value.(type) {
+		case string:
+			tag.Type = "string"
+		case bool:
+			tag.Type = "bool"
+		case json.Number:
+			if i, err := v.Int64(); err == nil {
+				tag.Type, tag.Value = "int64", i
+			} else {
+				f, _ := v.Float64()
+				tag.Type, tag.Value = "float64", f
+			}
+		default:
+			encoded, _ := json.Marshal(v)
+			tag.Type, tag.Value = "string", string(encoded)
+		}
+		tags = append(tags, tag)
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i].Key < tags[j].Key })
+	return tags
+}
+
+// jaegerServices returns the names of the services that have exported spans.
+func (m *Manager) jaegerServices() ([]string, error) {
+	rows, err := m.db.Query("SELECT DISTINCT service_name FROM otel_spans ORDER BY service_name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	services := []string{}
+	for rows.Next() {
+		var service string
+		if err := rows.Scan(&service); err != nil {
+			return nil, err
+		}
+		services = append(services, service)
+	}
+	return services, rows.Err()
+}
+
+// jaegerOperations returns the operations of a service, only those of the given span kind if it is set.
+func (m *Manager) jaegerOperations(service string, spanKind string) ([]jaegerOperation, error) {
+	rows, err := m.db.Query(`
+		SELECT DISTINCT name, kind FROM otel_spans WHERE service_name = ? AND (? = '' OR kind = ?) ORDER BY name, kind`,
+		service, spanKind, spanKind)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	operations := []jaegerOperation{}
+	for rows.Next() {
+		var operation jaegerOperation
+		if err := rows.Scan(&operation.Name, &operation.SpanKind); err != nil {
+			return nil, err
+		}
+		operations = append(operations, operation)
+	}
+	return operations, rows.Err()
+}
+
+// jaegerTrace returns the trace with the given id, or nil if no spans of it have been exported.
+func (m *Manager) jaegerTrace(traceID string) (*jaegerTrace, error) {
+	traces, err := m.jaegerTraces([]string{traceID})
+	if err != nil || len(traces) == 0 {
+		return nil, err
+	}
+	return &traces[0], nil
+}
+
+// jaegerSearch returns the traces that match the query, those with the most recently started matching span first.
+func (m *Manager) jaegerSearch(query jaegerQuery) ([]jaegerTrace, error) {
+	conditions := []string{"service_name = ?"}
+	args := []interface{}{query.Service}
+	if query.Operation != "" {
+		conditions = append(conditions, "name = ?")
+		args = append(args, query.Operation)
+	}
+	if !query.Start.IsZero() {
+		conditions = append(conditions, "start_time_unix_nano >= ?")
+		args = append(args, query.Start.UnixNano())
+	}
+	if !query.End.IsZero() {
+		conditions = append(conditions, "start_time_unix_nano <= ?")
+		args = append(args, query.End.UnixNano())
+	}
+	if query.MinDuration > 0 {
+		conditions = append(conditions, "end_time_unix_nano - start_time_unix_nano >= ?")
+		args = append(args, query.MinDuration.Nanoseconds())
+	}
+	if query.MaxDuration > 0 {
+		conditions = append(conditions, "end_time_unix_nano - start_time_unix_nano <= ?")
+		args = append(args, query.MaxDuration.Nanoseconds())
+	}
+	rows, err := m.db.Query(`SELECT `+storedSpanColumns+` FROM otel_spans WHERE `+strings.Join(conditions, " AND ")+`
+		ORDER BY start_time_unix_nano DESC`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	limit := query.Limit
+	if limit <= 0 {
+		limit = defaultJaegerLimit
+	}
+	var traceIDs []string
+	found := make(map[string]bool)
+	for len(traceIDs) < limit && rows.Next() {
+		var span storedSpan
+		if err := rows.Scan(span.scanArgs()...); err != nil {
+			return nil, err
+		}
+		if !found[span.traceID] && span.matches(query.Tags) {
+			found[span.traceID] = true
+			traceIDs = append(traceIDs, span.traceID)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+	return m.jaegerTraces(traceIDs)
+}
+
+// jaegerTraces returns the traces with the given ids in the same order, leaving out those with no spans.
+func (m *Manager) jaegerTraces(traceIDs []string) ([]jaegerTrace, error) {
+	traces := []jaegerTrace{}
+	for _, traceID := range traceIDs {
+		rows, err := m.db.Query(`SELECT `+storedSpanColumns+` FROM otel_spans WHERE trace_id = ?
+			ORDER BY start_time_unix_nano, id`, traceID)
+		if err != nil {
+			return nil, err
+		}
+		trace := jaegerTrace{TraceID: traceID, Spans: []jaegerSpan{}, Processes: make(map[string]jaegerProcess)}
+		processIDs := make(map[[2]string]string)
+		for rows.Next() {
+			var span storedSpan
+			if err := rows.Scan(span.scanArgs()...); err != nil {
+				rows.Close()
+				return nil, err
+			}
+
+			// Spans of a service that share a resource share a process.
+			processKey := [2]string{span.serviceName, span.resourceAttributes}
+			processID, ok := processIDs[processKey]
+			if !ok {
+				processID = fmt.Sprintf("p%d", len(processIDs)+1)
+				processIDs[processKey] = processID
+				trace.Processes[processID] = jaegerProcess{
+					ServiceName: span.serviceName,
+					Tags:        jaegerTags(span.resourceAttributes),
+				}
+			}
+			trace.Spans = append(trace.Spans, span.jaegerSpan(processID))
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, err
+		}
+		if len(trace.Spans) > 0 {
+			traces = append(traces, trace)
+		}
+	}
+	return traces, nil
+}
+
+func (s *storedSpan) jaegerSpan(processID string) jaegerSpan {
+	span := jaegerSpan{
+		TraceID:       s.traceID,
+		SpanID:        s.spanID,
+		OperationName: s.name,
+		References:    []jaegerReference{},
+		Flags:         1,
+		StartTime:     s.startTimeUnixNano / int64(time.Microsecond),
+		Duration:      (s.endTimeUnixNano - s.startTimeUnixNano) / int64(time.Microsecond),
+		Tags:          s.tags(),
+		Logs:          []jaegerLog{},
+		ProcessID:     processID,
+	}
+	if s.parentSpanID != "" {
+		span.References = append(span.References, jaegerReference{RefType: "CHILD_OF", TraceID: s.traceID, SpanID: s.parentSpanID})
+	}
+	var links []struct {
+		TraceID string `json:"trace_id"`
+		SpanID  string `json:"span_id"`
+	}
+	_ = json.Unmarshal([]byte(s.links), &links)
+	for _, link := range links {
+		span.References = append(span.References, jaegerReference{RefType: "FOLLOWS_FROM", TraceID: link.TraceID, SpanID: link.SpanID})
+	}
+
+	// Span events are Jaeger's logs, with the event's name in the event field.
+	var events []struct {
+		TimeUnixNano int64           `json:"time_unix_nano"`
+		Name         string          `json:"name"`
+		Attributes   json.RawMessage `json:"attributes"`
+	}
+	_ = json.Unmarshal([]byte(s.events), &events)
+	for _, event := range events {
+		fields := append([]jaegerKeyValue{{Key: "event", Type: "string", Value: event.Name}}, jaegerTags(string(event.Attributes))...)
+		span.Logs = append(span.Logs, jaegerLog{Timestamp: event.TimeUnixNano / int64(time.Microsecond), Fields: fields})
+	}
+	return span
+}
+
+// jaegerDependencies returns the calls between services in the spans that started between start and end, as the
+// spans of one service whose parent is a span of another.
+func (m *Manager) jaegerDependencies(start time.Time, end time.Time) ([]jaegerDependency, error) {
+	rows, err := m.db.Query(`
+		SELECT parent.service_name, child.service_name, COUNT(*)
+		FROM otel_spans child JOIN otel_spans parent ON parent.trace_id = child.trace_id AND parent.span_id = child.parent_span_id
+		WHERE parent.service_name != child.service_name
+			AND child.start_time_unix_nano >= ? AND child.start_time_unix_nano <= ?
+		GROUP BY parent.service_name, child.service_name
+		ORDER BY parent.service_name, child.service_name`,
+		start.UnixNano(), end.UnixNano())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	dependencies := []jaegerDependency{}
+	for rows.Next() {
+		var dependency jaegerDependency
+		if err := rows.Scan(&dependency.Parent, &dependency.Child, &dependency.CallCount); err != nil {
+			return nil, err
+		}
+		dependencies = append(dependencies, dependency)
+	}
+	return dependencies, rows.Err()
+}
+
+// jaegerJSON responds with data in the envelope of the Jaeger query API.
+func jaegerJSON(c echo.Context, data interface{}, total int) error {
+	return c.JSON(http.StatusOK, jaegerResponse{Data: data, Total: total})
+}
+
+// jaegerFailure responds with an error in the envelope of the Jaeger query API, which the Jaeger UI shows.
+func jaegerFailure(c echo.Context, code int, format string, args ...interface{}) error {
+	return c.JSON(code, jaegerResponse{Errors: []jaegerError{{Code: code, Message: fmt.Sprintf(format, args...)}}})
+}
+
+func (m *Manager) handleJaegerServices(c echo.Context) error {
+	services, err := m.jaegerServices()
+	if err != nil {
+		return jaegerFailure(c, http.StatusInternalServerError, "%v", err)
+	}
+	return jaegerJSON(c, services, len(services))
+}
+
+// handleJaegerServiceOperations returns the operation names of a service, as older Jaeger UIs ask for them.
+func (m *Manager) handleJaegerServiceOperations(c echo.Context) error {
+	operations, err := m.jaegerOperations(c.Param("service"), "")
+	if err != nil {
+		return jaegerFailure(c, http.StatusInternalServerError, "%v", err)
+	}
+	names := []string{}
+	for _, operation := range operations {
+		if len(names) == 0 || names[len(names)-1] != operation.Name {
+			names = append(names, operation.Name)
+		}
+	}
+	return jaegerJSON(c, names, len(names))
+}
+
+func (m *Manager) handleJaegerOperations(c echo.Context) error {
+	if c.QueryParam("service") == "" {
+		return jaegerFailure(c, http.StatusBadRequest, "parameter 'service' is required")
+	}
+	operations, err := m.jaegerOperations(c.QueryParam("service"), c.QueryParam("spanKind"))
+	if err != nil {
+		return jaegerFailure(c, http.StatusInternalServerError, "%v", err)
+	}
+	return jaegerJSON(c, operations, len(operations))
+}
+
+func (m *Manager) handleJaegerTrace(c echo.Context) error {
+	traceID, ok := tracing.ParseTraceID(c.Param("trace_id"))
+	if !ok {
+		return jaegerFailure(c, http.StatusBadRequest, "malformed trace id %q", c.Param("trace_id"))
+	}
+	trace, err := m.jaegerTrace(traceID)
+	if err != nil {
+		return jaegerFailure(c, http.StatusInternalServerError, "%v", err)
+	}
+	if trace == nil {
+		return jaegerFailure(c, http.StatusNotFound, "trace not found")
+	}
+	return jaegerJSON(c, []jaegerTrace{*trace}, 1)
+}
+
+// handleJaegerSearch searches traces with the query parameters of jaeger-query: service, operation, tags as a JSON
+// object or as repeated tag=key:value, start and end in Unix microseconds, or else lookback as a duration, minDuration
+// and maxDuration as durations, and limit. Repeated traceID parameters fetch those traces instead.
+func (m *Manager) handleJaegerSearch(c echo.Context) error {
+	params := c.QueryParams()
+	if traceIDs := params["traceID"]; len(traceIDs) > 0 {
+		for i, traceID := range traceIDs {
+			parsed, ok := tracing.ParseTraceID(traceID)
+			if !ok {
+				return jaegerFailure(c, http.StatusBadRequest, "malformed trace id %q", traceID)
+			}
+			traceIDs[i] = parsed
+		}
+		traces, err := m.jaegerTraces(traceIDs)
+		if err != nil {
+			return jaegerFailure(c, http.StatusInternalServerError, "%v", err)
+		}
+		return jaegerJSON(c, traces, len(traces))
+	}
+
+	query, err := parseJaegerQuery(params)
+	if err != nil {
+		return jaegerFailure(c, http.StatusBadRequest, "%v", err)
+	}
+	traces, err := m.jaegerSearch(query)
+	if err != nil {
+		return jaegerFailure(c, http.StatusInternalServerError, "%v", err)
+	}
+	return jaegerJSON(c, traces, len(traces))
+}
+
+func parseJaegerQuery(params map[string][]string) (jaegerQuery, error) {
+	get := func(key string) string {
+		if values := params[key]; len(values) > 0 {
+			return values[0]
+		}
+		return ""
+	}
+	query := jaegerQuery{Service: get("service"), Operation: get("operation"), Tags: make(map[string]string)}
+	if query.Service == "" {
+		return query, fmt.Errorf("parameter 'service' is required")
+	}
+
+	if tags := get("tags"); tags != "" {
+		if err := json.Unmarshal([]byte(tags), &query.Tags); err != nil {
+			return query, fmt.Errorf("malformed parameter 'tags': %v", err)
+		}
+	}
+	for _, tag := range params["tag"] {
+		key, value, ok := strings.Cut(tag, ":")
+		if !ok {
+			return query, fmt.Errorf("malformed parameter 'tag', must be key:value: %s", tag)
+		}
+		query.Tags[key] = value
+	}
+
+	for _, bound := range []struct {
+		key  string
+		time *time.Time
+	}{{"start", &query.Start}, {"end", &query.End}} {
+		if value := get(bound.key); value != "" {
+			micros, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return query, fmt.Errorf("malformed parameter '%s', must be Unix microseconds: %s", bound.key, value)
+			}
+			*bound.time = time.UnixMicro(micros)
+		}
+	}
+	if lookback := get("lookback"); lookback != "" && lookback != "custom" && query.Start.IsZero() {
+		duration, err := time.ParseDuration(lookback)
+		if err != nil {
+			return query, fmt.Errorf("malformed parameter 'lookback': %v", err)
+		}
+		query.Start = time.Now().Add(-duration)
+	}
+
+	for _, bound := range []struct {
+		key      string
+		duration *time.Duration
+	}{{"minDuration", &query.MinDuration}, {"maxDuration", &query.MaxDuration}} {
+		if value := get(bound.key); value != "" {
+			duration, err := time.ParseDuration(value)
+			if err != nil {
+				return query, fmt.Errorf("malformed parameter '%s': %v", bound.key, err)
+			}
+			*bound.duration = duration
+		}
+	}
+
+	if limit := get("limit"); limit != "" {
+		var err error
+		if query.Limit, err = strconv.Atoi(limit); err != nil || query.Limit < 0 {
+			return query, fmt.Errorf("malformed parameter 'limit': %s", limit)
+		}
+	}
+	return query, nil
+}
+
+// handleJaegerDependencies returns the calls between services, over the lookback in milliseconds before endTs, in
+// Unix milliseconds, as the system architecture view of the Jaeger UI asks for them.
+func (m *Manager) handleJaegerDependencies(c echo.Context) error {
+	end := time.Now()
+	if endTs := c.QueryParam("endTs"); endTs != "" {
+		millis, err := strconv.ParseInt(endTs, 10, 64)
+		if err != nil {
+			return jaegerFailure(c, http.StatusBadRequest, "malformed parameter 'endTs': %s", endTs)
+		}
+		end = time.UnixMilli(millis)
+	}
+	lookback := 24 * time.Hour
+	if value := c.QueryParam("lookback"); value != "" {
+		millis, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return jaegerFailure(c, http.StatusBadRequest, "malformed parameter 'lookback': %s", value)
+		}
+		lookback = time.Duration(millis) * time.Millisecond
+	}
+	dependencies, err := m.jaegerDependencies(end.Add(-lookback), end)
+	if err != nil {
+		return jaegerFailure(c, http.StatusInternalServerError, "%v", err)
+	}
+	return jaegerJSON(c, dependencies, len(dependencies))
+}
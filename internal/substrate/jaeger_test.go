@@ -0,0 +1,119 @@
+/*
+ * Copyright (c) 2023 Asim Ihsan.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ * SPDX-License-Identifier: MPL-2.0
+ */
+
+package substrate
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJaegerAPI(t *testing.T) {
+	m, err := NewManager(filepath.Join(t.TempDir(), "vcluster.db"), WithHTTPPort(0), WithOTLPPort(0))
+	assert.NoError(t, err)
+	defer m.Close()
+
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	spans := []struct {
+		service, traceID, spanID, parentSpanID, name, kind, status string
+		offset, duration                                           time.Duration
+		attributes, events                                         string
+	}{
+		{"frontend", "4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7", "", "GET /checkout", "server", "unset", 0, 300 * time.Millisecond, `{"http.status_code": 200}`, `[]`},
+		{"orders", "4bf92f3577b34da6a3ce929d0e0e4736", "b7ad6b7169203331", "00f067aa0ba902b7", "POST /orders", "server", "error", 10 * time.Millisecond, 250 * time.Millisecond, `{"order.id": "o1"}`, `[{"time_unix_nano": 1672531200020000000, "name": "retry", "attributes": {"attempt": 2}}]`},
+		{"orders", "0af7651916cd43dd8448eb211c80319c", "e457b5a2e4d86bd1", "", "GET /orders", "server", "ok", time.Second, 5 * time.Millisecond, `{}`, `[]`},
+	}
+	for _, span := range spans {
+		_, err := m.db.Exec(`INSERT INTO otel_spans (service_name, trace_id, span_id, parent_span_id, name, kind, status_code,
+				start_time_unix_nano, end_time_unix_nano, attributes, events, links, resource_attributes)
+			VALUES (?, ?, ?, NULLIF(?, ''), ?, ?, ?, ?, ?, ?, ?, '[]', ?)`,
+			span.service, span.traceID, span.spanID, span.parentSpanID, span.name, span.kind, span.status,
+			start.Add(span.offset).UnixNano(), start.Add(span.offset+span.duration).UnixNano(), span.attributes,
+			span.events, `{"service.name": "`+span.service+`"}`)
+		assert.NoError(t, err)
+	}
+
+	get := func(handler echo.HandlerFunc, target string, params ...string) (int, jaegerResponse) {
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, target, nil), rec)
+		for i := 0; i < len(params); i += 2 {
+			c.SetParamNames(params[i])
+			c.SetParamValues(params[i+1])
+		}
+		assert.NoError(t, handler(c))
+		var response jaegerResponse
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &response))
+		return rec.Code, response
+	}
+
+	_, response := get(m.handleJaegerServices, "/")
+	assert.Equal(t, []interface{}{"frontend", "orders"}, response.Data)
+
+	_, response = get(m.handleJaegerOperations, "/?service=orders&spanKind=server")
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{"name": "GET /orders", "spanKind": "server"},
+		map[string]interface{}{"name": "POST /orders", "spanKind": "server"},
+	}, response.Data)
+
+	traceIDs := func(response jaegerResponse) []string {
+		var ids []string
+		for _, trace := range response.Data.([]interface{}) {
+			ids = append(ids, trace.(map[string]interface{})["traceID"].(string))
+		}
+		return ids
+	}
+	_, response = get(m.handleJaegerSearch, "/?service=orders")
+	assert.Equal(t, []string{"0af7651916cd43dd8448eb211c80319c", "4bf92f3577b34da6a3ce929d0e0e4736"}, traceIDs(response))
+	_, response = get(m.handleJaegerSearch, "/?service=orders&minDuration=100ms")
+	assert.Equal(t, []string{"4bf92f3577b34da6a3ce929d0e0e4736"}, traceIDs(response))
+	_, response = get(m.handleJaegerSearch, `/?service=orders&tags=%7B%22error%22%3A%22true%22%7D`)
+	assert.Equal(t, []string{"4bf92f3577b34da6a3ce929d0e0e4736"}, traceIDs(response))
+	_, response = get(m.handleJaegerSearch, "/?service=orders&tag=order.id:o2")
+	assert.Empty(t, response.Data)
+	_, response = get(m.handleJaegerSearch, "/?service=orders&limit=1")
+	assert.Equal(t, []string{"0af7651916cd43dd8448eb211c80319c"}, traceIDs(response))
+	code, response := get(m.handleJaegerSearch, "/?operation=GET")
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Equal(t, []jaegerError{{Code: http.StatusBadRequest, Message: "parameter 'service' is required"}}, response.Errors)
+
+	trace, err := m.jaegerTrace("4bf92f3577b34da6a3ce929d0e0e4736")
+	assert.NoError(t, err)
+	assert.Len(t, trace.Spans, 2)
+	assert.Len(t, trace.Processes, 2)
+	child := trace.Spans[1]
+	assert.Equal(t, "POST /orders", child.OperationName)
+	assert.Equal(t, int64(250000), child.Duration)
+	assert.Equal(t, []jaegerReference{{RefType: "CHILD_OF", TraceID: "4bf92f3577b34da6a3ce929d0e0e4736", SpanID: "00f067aa0ba902b7"}}, child.References)
+	assert.Equal(t, []jaegerKeyValue{
+		{Key: "order.id", Type: "string", Value: "o1"},
+		{Key: "span.kind", Type: "string", Value: "server"},
+		{Key: "otel.status_code", Type: "string", Value: "ERROR"},
+		{Key: "error", Type: "bool", Value: true},
+	}, child.Tags)
+	assert.Equal(t, []jaegerLog{{Timestamp: 1672531200020000, Fields: []jaegerKeyValue{
+		{Key: "event", Type: "string", Value: "retry"},
+		{Key: "attempt", Type: "int64", Value: int64(2)},
+	}}}, child.Logs)
+	assert.Equal(t, "orders", trace.Processes[child.ProcessID].ServiceName)
+
+	code, _ = get(m.handleJaegerTrace, "/", "trace_id", "a3ce929d0e0e4736")
+	assert.Equal(t, http.StatusNotFound, code)
+
+	dependencies, err := m.jaegerDependencies(start, start.Add(time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, []jaegerDependency{{Parent: "frontend", Child: "orders", CallCount: 1}}, dependencies)
+}
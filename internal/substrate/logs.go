@@ -0,0 +1,162 @@
+/*
+ * Copyright (c) 2023 Asim Ihsan.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ * SPDX-License-Identifier: MPL-2.0
+ */
+
+package substrate
+
+import (
+	"database/sql"
+	"encoding/json"
+	"github.com/asimihsan/virtual-cluster/internal/logparse"
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// defaultLogLimit is how many logs GetLogs returns when its filter sets no limit.
+const defaultLogLimit = 1000
+
+// Log is a line of output of a managed process. Level, Message, Logger and Fields are set for lines in a format
+// logparse knows, and Level is one of logparse.Levels.
+type Log struct {
+	ID          int                    `json:"id"`
+	Timestamp   string                 `json:"timestamp"`
+	ProcessName string                 `json:"process_name"`
+	OutputType  string                 `json:"output_type"`
+	Content     string                 `json:"content"`
+	TraceID     string                 `json:"trace_id,omitempty"`
+	SpanID      string                 `json:"span_id,omitempty"`
+	Format      string                 `json:"format,omitempty"`
+	Level       string                 `json:"level,omitempty"`
+	Message     string                 `json:"message,omitempty"`
+	Logger      string                 `json:"logger,omitempty"`
+	Fields      map[string]interface{} `json:"fields,omitempty"`
+}
+
+// LogFilter narrows down GetLogs. Empty fields match everything.
+type LogFilter struct {
+	ProcessName string
+
+	// Level is the least severe level of logs to match, such as "warn" for warnings, errors, fatal errors and panics.
+	// Logs without a level only match an empty Level.
+	Level string
+
+	Logger  string
+	TraceID string
+
+	// Message matches a substring of the message of structured logs, and of the content of other logs.
+	Message string
+
+	// AfterID matches logs stored after the log with that id, to page through logs.
+	AfterID int
+
+	// Limit is the most logs to return, or defaultLogLimit if zero.
+	Limit int
+}
+
+// GetLogs returns the logs of managed processes matching filter, oldest first.
+func (m *Manager) GetLogs(filter LogFilter) ([]*Log, error) {
+	var conditions []string
+	var args []interface{}
+	if filter.ProcessName != "" {
+		conditions = append(conditions, "process_name = ?")
+		args = append(args, filter.ProcessName)
+	}
+	if filter.Level != "" {
+		levels := logparse.LevelsFrom(filter.Level)
+		if levels == nil {
+			return nil, errors.Errorf("unknown level %q", filter.Level)
+		}
+		conditions = append(conditions, "level IN (?"+strings.Repeat(", ?", len(levels)-1)+")")
+		for _, level := range levels {
+			args = append(args, level)
+		}
+	}
+	if filter.Logger != "" {
+		conditions = append(conditions, "logger = ?")
+		args = append(args, filter.Logger)
+	}
+	if filter.TraceID != "" {
+		conditions = append(conditions, "trace_id = ?")
+		args = append(args, filter.TraceID)
+	}
+	if filter.Message != "" {
+		conditions = append(conditions, "instr(COALESCE(message, content), ?) > 0")
+		args = append(args, filter.Message)
+	}
+	if filter.AfterID > 0 {
+		conditions = append(conditions, "id > ?")
+		args = append(args, filter.AfterID)
+	}
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = defaultLogLimit
+	}
+
+	where := ""
+	if len(conditions) > 0 {
+		where = "WHERE " + strings.Join(conditions, " AND ")
+	}
+	rows, err := m.db.Query(`SELECT id, timestamp, process_name, output_type, content, trace_id, span_id, format, level,
+		message, logger, fields FROM logs `+where+" ORDER BY id ASC LIMIT ?", append(args, limit)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var logs []*Log
+	for rows.Next() {
+		var entry Log
+		var traceID, spanID, format, level, message, logger, fields sql.NullString
+		err = rows.Scan(&entry.ID, &entry.Timestamp, &entry.ProcessName, &entry.OutputType, &entry.Content, &traceID,
+			&spanID, &format, &level, &message, &logger, &fields)
+		if err != nil {
+			return nil, err
+		}
+		entry.TraceID, entry.SpanID, entry.Format = traceID.String, spanID.String, format.String
+		entry.Level, entry.Message, entry.Logger = level.String, message.String, logger.String
+		if fields.Valid {
+			_ = json.Unmarshal([]byte(fields.String), &entry.Fields)
+		}
+		logs = append(logs, &entry)
+	}
+	return logs, rows.Err()
+}
+
+func (m *Manager) handleGetLogs(c echo.Context) error {
+	filter := LogFilter{
+		ProcessName: c.QueryParam("process"),
+		Level:       c.QueryParam("level"),
+		Logger:      c.QueryParam("logger"),
+		TraceID:     c.QueryParam("trace_id"),
+		Message:     c.QueryParam("message"),
+	}
+	if filter.Level != "" && logparse.LevelsFrom(filter.Level) == nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "level must be one of "+strings.Join(logparse.Levels, ", "))
+	}
+	for name, value := range map[string]*int{"after": &filter.AfterID, "limit": &filter.Limit} {
+		if param := c.QueryParam(name); param != "" {
+			parsed, err := strconv.Atoi(param)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, "invalid "+name)
+			}
+			*value = parsed
+		}
+	}
+	logs, err := m.GetLogs(filter)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	if logs == nil {
+		logs = []*Log{}
+	}
+	return c.JSON(http.StatusOK, logs)
+}
@@ -0,0 +1,68 @@
+/*
+ * Copyright (c) 2023 Asim Ihsan.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ * SPDX-License-Identifier: MPL-2.0
+ */
+
+package substrate
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetLogs_FiltersByLevelAcrossServices(t *testing.T) {
+	m, err := NewManager(filepath.Join(t.TempDir(), "vcluster.db"), WithHTTPPort(0), WithOTLPPort(0))
+	assert.NoError(t, err)
+	defer m.Close()
+
+	lines := []struct {
+		process, line string
+	}{
+		{"orders", `{"level":"info","msg":"order placed","order_id":"o-1"}` + "\n"},
+		{"orders", `{"level":"error","msg":"charge failed","logger":"payments","trace_id":"4bf92f3577b34da6a3ce929d0e0e4736"}` + "\n"},
+		{"users", "time=2023-01-02T15:04:05Z level=WARN msg=\"slow query\" ms=812\n"},
+		{"users", "listening on :8080\n"},
+	}
+	for _, l := range lines {
+		assert.NoError(t, insertLog(m.db, l.process, "stdout", l.line))
+	}
+
+	logs, err := m.GetLogs(LogFilter{Level: "warn"})
+	assert.NoError(t, err)
+	if assert.Len(t, logs, 2) {
+		assert.Equal(t, "orders", logs[0].ProcessName)
+		assert.Equal(t, "error", logs[0].Level)
+		assert.Equal(t, "charge failed", logs[0].Message)
+		assert.Equal(t, "payments", logs[0].Logger)
+		assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", logs[0].TraceID)
+		assert.Nil(t, logs[0].Fields)
+
+		assert.Equal(t, "users", logs[1].ProcessName)
+		assert.Equal(t, "slog", logs[1].Format)
+		assert.Equal(t, "warn", logs[1].Level)
+		assert.Equal(t, map[string]interface{}{"ms": "812"}, logs[1].Fields)
+	}
+
+	logs, err = m.GetLogs(LogFilter{ProcessName: "users"})
+	assert.NoError(t, err)
+	if assert.Len(t, logs, 2) {
+		assert.Equal(t, "", logs[1].Level)
+		assert.Equal(t, "listening on :8080\n", logs[1].Content)
+	}
+
+	logs, err = m.GetLogs(LogFilter{Message: "order"})
+	assert.NoError(t, err)
+	if assert.Len(t, logs, 1) {
+		assert.Equal(t, map[string]interface{}{"order_id": "o-1"}, logs[0].Fields)
+	}
+
+	_, err = m.GetLogs(LogFilter{Level: "loud"})
+	assert.Error(t, err)
+}
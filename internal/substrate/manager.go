@@ -12,27 +12,37 @@ package substrate
 
 import (
 	"context"
+	"crypto/tls"
 	"database/sql"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
-	"github.com/Shopify/sarama"
-	"github.com/asimihsan/virtual-cluster/internal/dependencies/kafka"
-	"github.com/asimihsan/virtual-cluster/internal/dependencies/localstack"
+	"github.com/asimihsan/virtual-cluster/internal/cgroup"
+	"github.com/asimihsan/virtual-cluster/internal/metrics"
+	"github.com/asimihsan/virtual-cluster/internal/mock"
+	"github.com/asimihsan/virtual-cluster/internal/otlp"
 	"github.com/asimihsan/virtual-cluster/internal/parser"
 	"github.com/asimihsan/virtual-cluster/internal/proxy"
+	"github.com/asimihsan/virtual-cluster/internal/schema"
 	"github.com/asimihsan/virtual-cluster/internal/utils"
 	"github.com/asimihsan/virtual-cluster/internal/websocket"
-	"github.com/docker/docker/api/types"
-	"github.com/docker/docker/client"
+	"github.com/asimihsan/virtual-cluster/pkg/dependencies"
 	jsoniter "github.com/json-iterator/go"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/pkg/errors"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 	"log"
+	"net"
 	"net/http"
+	"net/http/httputil"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
+	"sync"
 	"time"
 )
 
@@ -43,14 +53,63 @@ var jsonSorted = jsoniter.Config{
 type Manager struct {
 	dbPath             string
 	db                 *sql.DB
+	mu                 sync.Mutex
 	processes          []*ManagedProcess
+	dependencies       []dependencies.ManagedDependency
 	workingDirectories map[string]string
 	verbose            bool
 	httpPort           int
 	websocket          *websocket.Broadcaster
 	stopChans          []chan struct{}
+
+	// faults holds the fault rules of each proxied service, by service name.
+	faults map[string]*proxy.Faults
+
+	// captureLimit is how many bytes of each proxied body are stored in the database; larger bodies are spilled to
+	// blobs.
+	captureLimit int
+	blobs        *proxy.BlobStore
+
+	// grpcResolvers decode the gRPC messages of proxied services, by service name.
+	grpcResolvers map[string]proxy.MethodResolver
+
+	// dataDir holds what the cluster keeps between runs besides its database, such as the local CA.
+	dataDir string
+
+	// ca issues the certificates of proxy ports that serve TLS. It is nil until a service asks for proxy_tls.
+	ca *proxy.CertificateAuthority
+
+	// env is added to the environment of every managed process.
+	env []string
+
+	// egressRules stub or block the calls made through the egress proxy, which listens on egressPort. Both are
+	// unset when the cluster has no egress proxy.
+	egressRules *proxy.EgressRules
+	egressPort  int
+
+	// otlpPort is where the OTLP receiver listens, and which managed processes export their telemetry to.
+	otlpPort     int
+	otlpReceiver *otlp.Receiver
+	otlpServer   *http.Server
+
+	// cgroups holds the cgroups that limit what services use. It is nil until a service asks for limits, and when
+	// cgroups v2 are not available.
+	cgroups *cgroup.Hierarchy
+
+	// resourceInterval is how often the resources of managed processes and containers are sampled, or 0 for never.
+	resourceInterval time.Duration
 }
 
+const (
+	// CACertEnv is set for managed processes to the path of the local CA's certificate when any proxy port serves
+	// TLS, so that dependents can trust it.
+	CACertEnv = "VCLUSTER_CA_CERT"
+
+	// ServiceNameEnv is set for managed processes to the name of their service, e.g. for them to set
+	// proxy.CallerHeader on the calls they make.
+	ServiceNameEnv = "VCLUSTER_SERVICE_NAME"
+)
+
 func (m *Manager) Websocket() *websocket.Broadcaster {
 	return m.websocket
 }
@@ -69,71 +128,64 @@ func WithHTTPPort(port int) ManagerOption {
 	}
 }
 
-func NewManager(dbPath string, opts ...ManagerOption) (*Manager, error) {
-	db, err := sql.Open("sqlite3", dbPath)
-	if err != nil {
-		return nil, err
+// WithOTLPPort sets the port of the OTLP receiver, by default otlp.DefaultPort. Another port is used if it is taken.
+func WithOTLPPort(port int) ManagerOption {
+	return func(m *Manager) {
+		m.otlpPort = port
 	}
+}
 
-	_, err = db.Exec("PRAGMA synchronous = FULL")
-	if err != nil {
-		log.Fatal(err)
+// WithResourceSampleInterval sets how often the resources managed processes and containers use are sampled, by
+// default DefaultResourceSampleInterval. An interval of 0 turns sampling off.
+func WithResourceSampleInterval(interval time.Duration) ManagerOption {
+	return func(m *Manager) {
+		m.resourceInterval = interval
 	}
+}
 
-	_, err = db.Exec(`
-		CREATE TABLE IF NOT EXISTS logs (
-			id INTEGER PRIMARY KEY,
-			timestamp TEXT DEFAULT (strftime('%Y-%m-%dT%H:%M:%fZ', 'now')),
-			process_name TEXT,
-			output_type TEXT,
-			content TEXT
-		)
-	`)
-	if err != nil {
-		return nil, err
+// WithCaptureLimit sets how many bytes of each proxied request and response body are stored in the database.
+func WithCaptureLimit(limit int) ManagerOption {
+	return func(m *Manager) {
+		m.captureLimit = limit
+	}
+}
+
+// WithBlobDir sets where bodies larger than the capture limit are kept. By default they are kept next to the
+// database file, and not at all for an in-memory database.
+func WithBlobDir(dir string) ManagerOption {
+	return func(m *Manager) {
+		m.blobs = proxy.NewBlobStore(dir, proxy.DefaultMaxBlobSize)
 	}
+}
 
-	_, err = db.Exec(`
-		CREATE TABLE IF NOT EXISTS http_requests (
-			id INTEGER PRIMARY KEY,
-			timestamp TEXT DEFAULT (strftime('%Y-%m-%dT%H:%M:%fZ', 'now')),
-			process_name TEXT,
-			method TEXT,
-			url TEXT,
-			headers TEXT,
-			body TEXT
-		)
-	`)
-	if err != nil {
-		return nil, err
+// WithDataDir sets where the cluster keeps what it needs between runs besides its database. By default it is next to
+// the database file, or in the temporary directory for an in-memory database.
+func WithDataDir(dir string) ManagerOption {
+	return func(m *Manager) {
+		m.dataDir = dir
 	}
+}
+
+// DataDir returns the default data directory for the database at dbPath.
+func DataDir(dbPath string) string {
+	if isMemoryDatabase(dbPath) {
+		return filepath.Join(os.TempDir(), "virtual-cluster")
+	}
+	return dbPath + ".data"
+}
 
-	_, err = db.Exec(`
-		CREATE TABLE IF NOT EXISTS http_responses (
-			id INTEGER PRIMARY KEY,
-			http_request_id INTEGER,
-			timestamp TEXT DEFAULT (strftime('%Y-%m-%dT%H:%M:%fZ', 'now')),
-			process_name TEXT,
-			status_code INTEGER,
-			headers TEXT,
-			body TEXT
-		)
-	`)
+func NewManager(dbPath string, opts ...ManagerOption) (*Manager, error) {
+	db, err := sql.Open("sqlite3", dbPath)
 	if err != nil {
 		return nil, err
 	}
 
-	_, err = db.Exec(`
-		CREATE TABLE IF NOT EXISTS kafka_messages (
-			id INTEGER PRIMARY KEY,
-			timestamp TEXT DEFAULT (strftime('%Y-%m-%dT%H:%M:%fZ', 'now')),
-			broker_name TEXT,
-			topic_name TEXT,
-			message_key TEXT,
-			message_value TEXT
-		)
-	`)
+	_, err = db.Exec("PRAGMA synchronous = FULL")
 	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := schema.Create(db); err != nil {
 		return nil, err
 	}
 
@@ -146,12 +198,26 @@ func NewManager(dbPath string, opts ...ManagerOption) (*Manager, error) {
 		websocket:          websocket.NewBroadcaster(),
 		httpPort:           1371,
 		stopChans:          make([]chan struct{}, 0),
+		faults:             make(map[string]*proxy.Faults),
+		grpcResolvers:      make(map[string]proxy.MethodResolver),
+		captureLimit:       proxy.DefaultCaptureLimit,
+		dataDir:            DataDir(dbPath),
+		otlpPort:           otlp.DefaultPort,
+		resourceInterval:   DefaultResourceSampleInterval,
+	}
+	if !isMemoryDatabase(dbPath) {
+		manager.blobs = proxy.NewBlobStore(proxy.BlobDir(dbPath), proxy.DefaultMaxBlobSize)
 	}
 
 	for _, opt := range opts {
 		opt(manager)
 	}
 
+	if err := manager.startOTLP(); err != nil {
+		return nil, err
+	}
+	manager.startResourceSampler()
+
 	go func() {
 		e := echo.New()
 		e.HideBanner = true
@@ -162,6 +228,29 @@ func NewManager(dbPath string, opts ...ManagerOption) (*Manager, error) {
 			websocket.WebSocketHandler(manager.Websocket()).ServeHTTP(c.Response(), c.Request())
 			return nil
 		})
+		e.GET("/metrics", echo.WrapHandler(metrics.Handler()))
+		e.GET("/api/logs", manager.handleGetLogs)
+		e.GET("/api/emails", manager.handleGetEmails)
+		e.GET("/api/emails/:id", manager.handleGetEmail)
+		e.DELETE("/api/emails", manager.handleDeleteEmails)
+		e.GET("/api/blobs/:blob", manager.handleGetBlob)
+		e.GET("/api/services/:name/faults", manager.handleGetFaults)
+		e.PUT("/api/services/:name/faults", manager.handlePutFaults)
+		e.DELETE("/api/services/:name/faults", manager.handleDeleteFaults)
+		e.GET("/api/graph", manager.handleGetGraph)
+		e.GET("/api/traces/:trace_id", manager.handleGetTrace)
+		e.GET(JaegerBasePath+"/api/services", manager.handleJaegerServices)
+		e.GET(JaegerBasePath+"/api/services/:service/operations", manager.handleJaegerServiceOperations)
+		e.GET(JaegerBasePath+"/api/operations", manager.handleJaegerOperations)
+		e.GET(JaegerBasePath+"/api/traces", manager.handleJaegerSearch)
+		e.GET(JaegerBasePath+"/api/traces/:trace_id", manager.handleJaegerTrace)
+		e.GET(JaegerBasePath+"/api/dependencies", manager.handleJaegerDependencies)
+		e.GET(PrometheusBasePath+"/api/v1/query", manager.handleMetricsQuery)
+		e.GET(PrometheusBasePath+"/api/v1/query_range", manager.handleMetricsQueryRange)
+		e.GET(PrometheusBasePath+"/api/v1/label/__name__/values", manager.handleMetricsNames)
+		e.GET("/api/egress/rules", manager.handleGetEgressRules)
+		e.PUT("/api/egress/rules", manager.handlePutEgressRules)
+		e.DELETE("/api/egress/rules", manager.handleDeleteEgressRules)
 		manager.BroadcastLogsAndRequests()
 		err := e.Start(fmt.Sprintf(":%d", manager.httpPort))
 		if err != nil {
@@ -196,6 +285,8 @@ func (m *Manager) Close() error {
 	for _, stopChan := range m.stopChans {
 		stopChan <- struct{}{}
 	}
+	m.stopOTLP()
+	m.removeCgroups()
 	return m.db.Close()
 }
 
@@ -214,22 +305,36 @@ func (m *Manager) StartServicesAndDependencies(
 	// Perform topological sort
 	// Start services and dependencies one at a time
 
+	if err := m.setupTLS(asts); err != nil {
+		return err
+	}
+	if err := m.startEgress(asts); err != nil {
+		return err
+	}
+	m.setupCgroups(asts)
+
 	for _, ast := range asts {
 		for _, managedDependency := range ast.ManagedDependencies {
-			if managedDependency.ManagedKafka != nil {
-				err := m.StartManagedKafka(managedDependency.Name, managedDependency.ManagedKafka.Port)
-				if err != nil {
-					return errors.Wrapf(err, "failed to start managed kafka: %s", managedDependency.Name)
-				}
-			} else if managedDependency.ManagedLocalstack != nil {
-				err := m.StartManagedLocalstack(managedDependency.Name, managedDependency.ManagedLocalstack.Port)
-				if err != nil {
-					return errors.Wrapf(err, "failed to start managed localstack: %s", managedDependency.Name)
-				}
-			} else {
-				return fmt.Errorf("unknown managed dependency type: %s", managedDependency.Name)
+			dependency, err := dependencies.New(managedDependency.Kind, managedDependency.Name, managedDependency.Config)
+			if err != nil {
+				return errors.Wrapf(err, "failed to create managed dependency: %s", managedDependency.Name)
 			}
+			err = m.StartManagedDependency(dependency)
+			if err != nil {
+				return errors.Wrapf(err, "failed to start managed dependency: %s", managedDependency.Name)
+			}
+		}
 
+		for _, mockService := range ast.MockServices {
+			fmt.Println("Starting mock service:", mockService.Name)
+			stop := make(chan struct{}, 1)
+			m.stopChans = append(m.stopChans, stop)
+
+			err := m.RunMockService(mockService, stop)
+			if err != nil {
+				return errors.Wrapf(err, "failed to start mock service: %s", mockService.Name)
+			}
+			fmt.Println("Started mock service:", mockService.Name)
 		}
 
 		for _, service := range ast.Services {
@@ -238,6 +343,19 @@ func (m *Manager) StartServicesAndDependencies(
 				workingDirectory = "."
 			}
 
+			if service.IsReplay() {
+				fmt.Println("Starting replay of service:", service.Name)
+				stop := make(chan struct{}, 1)
+				m.stopChans = append(m.stopChans, stop)
+
+				err := m.RunReplayService(service, stop)
+				if err != nil {
+					return errors.Wrapf(err, "failed to start replay of service: %s", service.Name)
+				}
+				fmt.Println("Started replay of service:", service.Name)
+				continue
+			}
+
 			if service.ServicePort != nil {
 				fmt.Println("Waiting for service port to be available:", service.Name)
 				pw := utils.NewPortWaiter(string(rune(*service.ServicePort)))
@@ -261,21 +379,48 @@ func (m *Manager) StartServicesAndDependencies(
 				RunCommands:      service.RunCommands,
 				WorkingDirectory: workingDirectory,
 				Stop:             make(chan struct{}, 1),
+				Env:              m.processEnv(service.Name),
+				Cgroup:           m.serviceCgroup(service),
 			}
+			m.mu.Lock()
 			m.processes = append(m.processes, process)
+			m.mu.Unlock()
 
 			go runProcessAndStoreOutput(process, m.db, m.verbose)
 			fmt.Println("Started service:", service.Name)
 
 			if service.ServicePort != nil && service.ProxyPort != nil {
+				faults, err := proxy.NewFaults(service.Faults)
+				if err != nil {
+					return errors.Wrapf(err, "invalid fault rules for service: %s", service.Name)
+				}
+				grpcResolver, err := m.newGRPCResolver(service)
+				if err != nil {
+					return errors.Wrapf(err, "invalid grpc settings for service: %s", service.Name)
+				}
+				m.mu.Lock()
+				m.faults[service.Name] = faults
+				if grpcResolver != nil {
+					m.grpcResolvers[service.Name] = grpcResolver
+				}
+				m.mu.Unlock()
+
 				fmt.Println("Starting HTTP proxy for service:", service.Name)
 				stop := make(chan struct{}, 1)
 				m.stopChans = append(m.stopChans, stop)
 
-				err := m.RunHTTPProxy(
+				var tlsConfig *tls.Config
+				if service.ProxyTLS {
+					tlsConfig, err = m.ca.ServerTLSConfig(service.Name)
+					if err != nil {
+						return errors.Wrapf(err, "failed to issue certificate for service: %s", service.Name)
+					}
+				}
+				err = m.RunHTTPProxy(
 					fmt.Sprintf("http://localhost:%d", *service.ServicePort),
 					fmt.Sprintf(":%d", *service.ProxyPort),
 					service.Name,
+					tlsConfig,
 					stop,
 				)
 				if err != nil {
@@ -283,195 +428,177 @@ func (m *Manager) StartServicesAndDependencies(
 				}
 				fmt.Println("Started HTTP proxy for service:", service.Name)
 			}
+
+			if service.Metrics != nil {
+				m.startScraper(service)
+			}
+		}
+	}
+
+	// Gateways start last, as their routes may point at services from any file.
+	for _, ast := range asts {
+		for _, gateway := range ast.Gateways {
+			fmt.Println("Starting gateway on port:", gateway.Port)
+			stop := make(chan struct{}, 1)
+			m.stopChans = append(m.stopChans, stop)
+
+			err := m.RunGateway(gateway, asts, stop)
+			if err != nil {
+				return errors.Wrapf(err, "failed to start gateway on port: %d", gateway.Port)
+			}
+			fmt.Println("Started gateway on port:", gateway.Port)
 		}
 	}
 
 	return nil
 }
 
-func (m *Manager) StartManagedKafka(
-	managedDependencyName string,
-	port int,
-) error {
-	dir, err := os.MkdirTemp("", "kafka")
-	if err != nil {
-		return errors.Wrap(err, "failed to create temporary directory")
+// setupTLS loads or creates the local CA when any service's proxy port serves TLS or the egress proxy intercepts
+// HTTPS, and tells every managed process where its certificate is.
+func (m *Manager) setupTLS(asts []*parser.VClusterAST) error {
+	needed := false
+	for _, ast := range asts {
+		for _, service := range ast.Services {
+			needed = needed || service.ProxyTLS
+		}
+		needed = needed || (ast.Egress != nil && ast.Egress.MITM)
+	}
+	if !needed {
+		return nil
 	}
 
-	dockerComposeFile, err := kafka.GenerateDockerComposeFile(port)
+	ca, err := proxy.LoadOrCreateCA(filepath.Join(m.dataDir, "tls"))
 	if err != nil {
-		return errors.Wrap(err, "failed to generate docker compose file")
+		return errors.Wrap(err, "failed to set up local CA")
 	}
+	m.ca = ca
+	// Node adds NODE_EXTRA_CA_CERTS to its own roots, so it is safe to set for every process.
+	m.env = append(m.env,
+		fmt.Sprintf("%s=%s", CACertEnv, ca.CertPath()),
+		fmt.Sprintf("NODE_EXTRA_CA_CERTS=%s", ca.CertPath()),
+	)
+	log.Printf("Proxy ports serving TLS use the local CA at %s", ca.CertPath())
+	return nil
+}
 
-	composeFilePath := filepath.Join(dir, "docker-compose.yml")
-	if err := os.WriteFile(composeFilePath, []byte(dockerComposeFile), 0644); err != nil {
-		return errors.Wrap(err, "failed to write docker compose file")
+// StartManagedDependency renders the dependency into a fresh temporary directory, starts it and waits for it to be
+// ready, then observes it in the background.
+func (m *Manager) StartManagedDependency(dependency dependencies.ManagedDependency) error {
+	dir, err := os.MkdirTemp("", dependency.Name())
+	if err != nil {
+		return errors.Wrap(err, "failed to create temporary directory")
 	}
 
-	fmt.Printf("Docker compose file location: %s\n", composeFilePath)
-
-	fmt.Println("Cleaning up containers")
-	cleanupContainers("broker1245")
-	cleanupContainers("kowl12345")
-	cleanupNetworks("my_custom_network")
-
-	pw := utils.NewPortWaiter(string(rune(port)))
-	err = pw.Wait()
-	if err != nil {
-		return errors.Wrapf(err, "failed to wait for kafka port: %s", managedDependencyName)
+	if err := dependency.Render(dir); err != nil {
+		return err
 	}
 
-	fmt.Println("Starting managed dependency:", managedDependencyName)
-	workingDirectory := filepath.Dir(composeFilePath)
-	process := &ManagedProcess{
-		Name:             managedDependencyName,
-		RunCommands:      []string{"docker compose up --no-color"},
-		WorkingDirectory: workingDirectory,
-		Stop:             make(chan struct{}, 1),
+	host := &dependencyHost{manager: m}
+	if err := dependency.Start(host); err != nil {
+		return err
 	}
-	m.processes = append(m.processes, process)
-	go runProcessAndStoreOutput(process, m.db, m.verbose)
-	fmt.Println("Started managed dependency:", managedDependencyName)
+	m.mu.Lock()
+	m.dependencies = append(m.dependencies, dependency)
+	m.mu.Unlock()
 
-	kw := utils.NewKafkaWaiter(fmt.Sprintf("localhost:%d", port))
-	err = kw.Wait()
-	if err != nil {
-		return errors.Wrap(err, "failed to wait for kafka")
+	if err := dependency.Wait(); err != nil {
+		return err
 	}
+	fmt.Printf("Managed dependency %s is ready: %v\n", dependency.Name(), dependency.ConnectionInfo())
 
 	go func() {
-		err = m.ConsumeAndStoreKafkaMessages(managedDependencyName, port)
+		err := dependency.Observe(host)
 		if err != nil {
-			fmt.Println("failed to consume and store kafka messages:", err)
+			fmt.Printf("failed to observe managed dependency %s: %s\n", dependency.Name(), err)
 		}
 	}()
 
 	return nil
 }
 
-func (m *Manager) ConsumeAndStoreKafkaMessages(brokerName string, port int) error {
-	config := sarama.NewConfig()
-	config.Consumer.Return.Errors = true
-	config.Metadata.RefreshFrequency = 1 * time.Second
-
-	// Connect to the Kafka broker
-	broker := fmt.Sprintf("localhost:%d", port)
-	kafkaClient, err := sarama.NewClient([]string{broker}, config)
-	if err != nil {
-		return err
-	}
-	defer func(kafkaClient sarama.Client) {
-		err := kafkaClient.Close()
-		if err != nil {
-			fmt.Println("failed to close kafka client:", err)
-		}
-	}(kafkaClient)
-
-	// Keep track of the topics we're already consuming
-	consumingTopics := make(map[string]bool)
-
-	for {
-		topics, err := kafkaClient.Topics()
-		if err != nil {
-			return err
+// DependencyConnectionInfo returns how services reach a started managed dependency.
+func (m *Manager) DependencyConnectionInfo(name string) (map[string]string, bool) {
+	for _, dependency := range m.dependencies {
+		if dependency.Name() == name {
+			return dependency.ConnectionInfo(), true
 		}
-
-		// For each topicName, if we're not already consuming it, start a consumer
-		for _, topicName := range topics {
-			if consumingTopics[topicName] {
-				continue
-			}
-
-			consumingTopics[topicName] = true
-
-			consumer, err := sarama.NewConsumerFromClient(kafkaClient)
-			if err != nil {
-				return err
-			}
-
-			partitionConsumer, err := consumer.ConsumePartition(topicName, 0, sarama.OffsetOldest)
-			if err != nil {
-				return err
-			}
-
-			topic := topicName
-			go func() {
-				fmt.Printf("Consuming messages from topic: %s\n", topic)
-				for message := range partitionConsumer.Messages() {
-					fmt.Printf("Consumed message from topic: %s\n", topic)
-					fmt.Printf("Message: %s\n", string(message.Value))
-
-					// convert message.Timestamp to UTC then to format '%Y-%m-%dT%H:%M:%fZ', note that time.RFC3339 does not have fractional seconds!
-					timestamp := message.Timestamp.UTC().Format("2006-01-02T15:04:05.123Z")
-
-					// For each message, store it in the SQLite database
-					_, err := m.db.Exec("INSERT INTO kafka_messages (broker_name, topic_name, message_key, message_value, timestamp) VALUES (?, ?, ?, ?, ?)",
-						brokerName, topic, string(message.Key), string(message.Value), timestamp)
-					if err != nil {
-						log.Printf("Failed to insert message into database: %v", err)
-					}
-				}
-			}()
-		}
-
-		// Wait for a bit before checking for new topics
-		time.Sleep(1 * time.Second)
 	}
+	return nil, false
 }
 
-func (m *Manager) StartManagedLocalstack(
-	managedDependencyName string,
-	port int,
-) error {
-	dir, err := os.MkdirTemp("", "localstack")
-	if err != nil {
-		return errors.Wrap(err, "failed to create temporary directory")
-	}
+// dependencyHost is the dependencies.Host the manager hands to managed dependencies.
+type dependencyHost struct {
+	manager *Manager
+}
 
-	dockerComposeFile, err := localstack.GenerateDockerComposeFile(port)
-	if err != nil {
-		return errors.Wrap(err, "failed to generate docker compose file")
+func (h *dependencyHost) RunProcess(name string, runCommands []string, workingDirectory string) func() {
+	process := &ManagedProcess{
+		Name:             name,
+		RunCommands:      runCommands,
+		WorkingDirectory: workingDirectory,
+		Stop:             make(chan struct{}, 1),
 	}
+	h.manager.mu.Lock()
+	h.manager.processes = append(h.manager.processes, process)
+	h.manager.mu.Unlock()
+	go runProcessAndStoreOutput(process, h.manager.db, h.manager.verbose)
 
-	composeFilePath := filepath.Join(dir, "docker-compose.yml")
-	if err := os.WriteFile(composeFilePath, []byte(dockerComposeFile), 0644); err != nil {
-		return errors.Wrap(err, "failed to write docker compose file")
+	return func() {
+		select {
+		case process.Stop <- struct{}{}:
+			fmt.Println("Sent stop signal to process:", process.Name)
+		default:
+			fmt.Println("Channel not ready to receive for process:", process.Name)
+		}
 	}
+}
 
-	fmt.Printf("Docker compose file location: %s\n", composeFilePath)
+func (h *dependencyHost) DB() *sql.DB {
+	return h.manager.db
+}
 
-	fmt.Println("Cleaning up containers")
-	cleanupContainers("localstack_main")
-	cleanupNetworks("localstack_default")
+func (h *dependencyHost) ServiceForConnection(conn net.Conn) string {
+	return h.manager.ServiceForConnection(conn)
+}
 
-	pw := utils.NewPortWaiter(string(rune(port)))
-	err = pw.Wait()
+// ServiceForConnection names the managed service behind a local TCP connection, by walking up the process tree of
+// the peer until it reaches a process started for a service. It returns "" if there is none.
+func (m *Manager) ServiceForConnection(conn net.Conn) string {
+	pid, err := utils.PeerPID(conn)
 	if err != nil {
-		return errors.Wrapf(err, "failed to wait for localstack port: %s", managedDependencyName)
+		return ""
 	}
 
-	fmt.Println("Starting managed dependency:", managedDependencyName)
-	workingDirectory := filepath.Dir(composeFilePath)
-	process := &ManagedProcess{
-		Name:             managedDependencyName,
-		RunCommands:      []string{"docker compose up --no-color"},
-		WorkingDirectory: workingDirectory,
-		Stop:             make(chan struct{}, 1),
+	m.mu.Lock()
+	serviceNames := make(map[int]string, len(m.processes))
+	for _, process := range m.processes {
+		if processPid := process.Pid(); processPid != 0 {
+			serviceNames[processPid] = process.Name
+		}
 	}
-	m.processes = append(m.processes, process)
-	go runProcessAndStoreOutput(process, m.db, m.verbose)
-	fmt.Println("Started managed dependency:", managedDependencyName)
+	m.mu.Unlock()
 
-	localstackWaiter := utils.NewLocalStackWaiter(fmt.Sprintf("http://localhost:%d", port))
-	err = localstackWaiter.Wait()
-	if err != nil {
-		return errors.Wrap(err, "failed to wait for localstack")
+	for pid > 1 {
+		if name, ok := serviceNames[pid]; ok {
+			return name
+		}
+		pid, err = utils.ParentPID(pid)
+		if err != nil {
+			return ""
+		}
 	}
-
-	return nil
+	return ""
 }
 
 func (m *Manager) StopAllProcesses() {
+	for _, dependency := range m.dependencies {
+		if err := dependency.Stop(); err != nil {
+			fmt.Printf("failed to stop managed dependency %s: %s\n", dependency.Name(), err)
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	for _, process := range m.processes {
 		select {
 		case process.Stop <- struct{}{}:
@@ -529,10 +656,10 @@ func (m *Manager) prepareLogContent(content string) string {
 
 func (m *Manager) BroadcastLogsAndRequests() {
 	go func() {
-		var lastLogID, lastHTTPRequestID, lastHTTPResponseID, lastKafkaMessageID int
+		var lastLogID, lastHTTPRequestID, lastHTTPResponseID, lastKafkaMessageID, lastSQLQueryID, lastRedisCommandID, lastEmailID, lastWebSocketFrameID, lastGRPCCallID, lastGRPCMessageID, lastSpanID, lastResourceSampleID, lastProcessEventID int
 		for {
 			// Query logs
-			rows, err := m.db.Query(`SELECT id, timestamp, process_name, output_type, content FROM logs WHERE id > ? ORDER BY id ASC LIMIT 100`, lastLogID)
+			rows, err := m.db.Query(`SELECT id, timestamp, process_name, output_type, content, trace_id, span_id, format, level, message, logger, fields FROM logs WHERE id > ? ORDER BY id ASC LIMIT 100`, lastLogID)
 			if err != nil {
 				log.Printf("error querying logs: %v", err)
 				time.Sleep(1 * time.Second)
@@ -542,7 +669,9 @@ func (m *Manager) BroadcastLogsAndRequests() {
 			for rows.Next() {
 				var id int
 				var processName, outputType, content, timestamp string
-				err = rows.Scan(&id, &timestamp, &processName, &outputType, &content)
+				var traceID, spanID, format, level, logMessage, logger, fields sql.NullString
+				err = rows.Scan(&id, &timestamp, &processName, &outputType, &content, &traceID, &spanID, &format, &level,
+					&logMessage, &logger, &fields)
 				if err != nil {
 					log.Printf("error scanning log row: %v", err)
 					continue
@@ -557,6 +686,13 @@ func (m *Manager) BroadcastLogsAndRequests() {
 					"process_name": processName,
 					"output_type":  outputType,
 					"content":      content,
+					"trace_id":     traceID.String,
+					"span_id":      spanID.String,
+					"format":       format.String,
+					"level":        level.String,
+					"message":      logMessage.String,
+					"logger":       logger.String,
+					"fields":       fields.String,
 				})
 				m.websocket.Broadcast(message)
 			}
@@ -566,7 +702,7 @@ func (m *Manager) BroadcastLogsAndRequests() {
 			}
 
 			// Query HTTP requests
-			rows, err = m.db.Query(`SELECT id, timestamp, process_name, method, url, headers, body FROM http_requests WHERE id > ? ORDER BY id ASC LIMIT 100`, lastHTTPRequestID)
+			rows, err = m.db.Query(`SELECT `+httpRequestEventColumns+` FROM http_requests WHERE id > ? ORDER BY id ASC LIMIT 100`, lastHTTPRequestID)
 			if err != nil {
 				log.Printf("error querying http_requests: %v", err)
 				time.Sleep(1 * time.Second)
@@ -574,26 +710,15 @@ func (m *Manager) BroadcastLogsAndRequests() {
 			}
 
 			for rows.Next() {
-				var id int
-				var processName, method, url, headers, body, timestamp string
-				err = rows.Scan(&id, &timestamp, &processName, &method, &url, &headers, &body)
+				id, message, err := scanHTTPRequestEvent(rows)
 				if err != nil {
 					log.Printf("error scanning http_request row: %v", err)
 					continue
 				}
 
 				lastHTTPRequestID = id
-				message, _ := json.Marshal(map[string]interface{}{
-					"id":           id,
-					"type":         "http_request",
-					"timestamp":    timestamp,
-					"process_name": processName,
-					"method":       method,
-					"url":          url,
-					"headers":      headers,
-					"body":         body,
-				})
-				m.websocket.Broadcast(message)
+				encoded, _ := json.Marshal(message)
+				m.websocket.Broadcast(encoded)
 			}
 			err = rows.Close()
 			if err != nil {
@@ -601,7 +726,7 @@ func (m *Manager) BroadcastLogsAndRequests() {
 			}
 
 			// Query HTTP responses
-			rows, err = m.db.Query(`SELECT id, http_request_id, timestamp, process_name, status_code, headers, body FROM http_responses WHERE id > ? ORDER BY id ASC LIMIT 100`, lastHTTPResponseID)
+			rows, err = m.db.Query(`SELECT id, http_request_id, timestamp, process_name, status_code, headers, body, `+bodyMetadata+`, trailers, started_at, first_byte_at, ended_at, duration_ms, upstream_error FROM http_responses WHERE id > ? ORDER BY id ASC LIMIT 100`, lastHTTPResponseID)
 			if err != nil {
 				log.Printf("error querying http_responses: %v", err)
 				time.Sleep(1 * time.Second)
@@ -610,8 +735,12 @@ func (m *Manager) BroadcastLogsAndRequests() {
 
 			for rows.Next() {
 				var id, httpRequestID, statusCode int
-				var processName, headers, body, timestamp string
-				err = rows.Scan(&id, &httpRequestID, &timestamp, &processName, &statusCode, &headers, &body)
+				var processName, headers, timestamp string
+				var body capturedBody
+				var trailers, startedAt, firstByteAt, endedAt, upstreamError sql.NullString
+				var durationMs sql.NullFloat64
+				dest := append([]interface{}{&id, &httpRequestID, &timestamp, &processName, &statusCode, &headers, &body.data}, body.scanArgs()...)
+				err = rows.Scan(append(dest, &trailers, &startedAt, &firstByteAt, &endedAt, &durationMs, &upstreamError)...)
 				if err != nil {
 					log.Printf("error scanning http_response row: %v", err)
 					continue
@@ -619,39 +748,175 @@ func (m *Manager) BroadcastLogsAndRequests() {
 
 				lastHTTPResponseID = id
 
-				// Query the original HTTP request
-				var originalRequest HTTPProxyRequest
-				err = m.db.QueryRow("SELECT id, timestamp, method, url, headers, body FROM http_requests WHERE id = ?", httpRequestID).Scan(&originalRequest.ID, &originalRequest.Timestamp, &originalRequest.Method, &originalRequest.URL, &originalRequest.Headers, &originalRequest.Body)
+				// The request is sent again with its response: the proxy records a request as it arrives and its body
+				// once it has streamed through, so the http_request event may have gone out before the body was known.
+				_, request, err := scanHTTPRequestEvent(m.db.QueryRow(`SELECT `+httpRequestEventColumns+` FROM http_requests WHERE id = ?`, httpRequestID))
 				if err != nil {
 					log.Printf("error querying original http_request: %v", err)
 					continue
 				}
 
+				message, _ := json.Marshal(body.addTo(map[string]interface{}{
+					"id":             id,
+					"type":           "http_response",
+					"timestamp":      timestamp,
+					"process_name":   processName,
+					"status_code":    statusCode,
+					"headers":        headers,
+					"trailers":       trailers.String,
+					"started_at":     startedAt.String,
+					"first_byte_at":  firstByteAt.String,
+					"ended_at":       endedAt.String,
+					"duration_ms":    durationMs.Float64,
+					"upstream_error": upstreamError.String,
+					"http_request":   request,
+				}))
+
+				m.websocket.Broadcast(message)
+			}
+
+			// Query WebSocket frames
+			rows, err = m.db.Query(`SELECT id, timestamp, http_request_id, process_name, direction, opcode, fin, compressed, payload, payload_size, payload_truncated, payload_binary FROM websocket_frames WHERE id > ? ORDER BY id ASC LIMIT 100`, lastWebSocketFrameID)
+			if err != nil {
+				log.Printf("error querying websocket_frames: %v", err)
+				time.Sleep(1 * time.Second)
+				continue
+			}
+
+			for rows.Next() {
+				var id, httpRequestID, opcode int
+				var payloadSize int64
+				var timestamp, processName, direction string
+				var fin, compressed, payloadTruncated, payloadBinary bool
+				var payload []byte
+				err = rows.Scan(&id, &timestamp, &httpRequestID, &processName, &direction, &opcode, &fin, &compressed, &payload, &payloadSize, &payloadTruncated, &payloadBinary)
+				if err != nil {
+					log.Printf("error scanning websocket_frame row: %v", err)
+					continue
+				}
+
+				lastWebSocketFrameID = id
+				message, _ := json.Marshal(capturedBody{
+					data:      payload,
+					size:      payloadSize,
+					truncated: payloadTruncated,
+					binary:    payloadBinary,
+				}.addPayloadTo(map[string]interface{}{
+					"id":              id,
+					"type":            "websocket_frame",
+					"timestamp":       timestamp,
+					"http_request_id": httpRequestID,
+					"process_name":    processName,
+					"direction":       direction,
+					"opcode":          opcode,
+					"fin":             fin,
+					"compressed":      compressed,
+				}))
+				m.websocket.Broadcast(message)
+			}
+			err = rows.Close()
+			if err != nil {
+				log.Printf("error closing rows for websocket_frames: %v", err)
+			}
+
+			// Query gRPC messages
+			rows, err = m.db.Query(`SELECT id, timestamp, http_request_id, process_name, service, method, direction, sequence, compressed, size, truncated, message_json, payload, decode_error FROM grpc_messages WHERE id > ? ORDER BY id ASC LIMIT 100`, lastGRPCMessageID)
+			if err != nil {
+				log.Printf("error querying grpc_messages: %v", err)
+				time.Sleep(1 * time.Second)
+				continue
+			}
+
+			for rows.Next() {
+				var id, httpRequestID, sequence int
+				var size int64
+				var timestamp, processName, service, method, direction string
+				var compressed, truncated bool
+				var messageJSON, decodeError sql.NullString
+				var payload []byte
+				err = rows.Scan(&id, &timestamp, &httpRequestID, &processName, &service, &method, &direction, &sequence, &compressed, &size, &truncated, &messageJSON, &payload, &decodeError)
+				if err != nil {
+					log.Printf("error scanning grpc_message row: %v", err)
+					continue
+				}
+
+				lastGRPCMessageID = id
 				message, _ := json.Marshal(map[string]interface{}{
-					"id":           id,
-					"type":         "http_response",
-					"timestamp":    timestamp,
-					"process_name": processName,
-					"status_code":  statusCode,
-					"headers":      headers,
-					"body":         body,
-					"http_request": map[string]interface{}{
-						"id":           originalRequest.ID,
-						"type":         "http_request",
-						"timestamp":    originalRequest.Timestamp,
-						"process_name": processName,
-						"method":       originalRequest.Method,
-						"url":          originalRequest.URL,
-						"headers":      originalRequest.Headers,
-						"body":         originalRequest.Body,
-					},
+					"id":              id,
+					"type":            "grpc_message",
+					"timestamp":       timestamp,
+					"http_request_id": httpRequestID,
+					"process_name":    processName,
+					"service":         service,
+					"method":          method,
+					"direction":       direction,
+					"sequence":        sequence,
+					"compressed":      compressed,
+					"size":            size,
+					"truncated":       truncated,
+					"message_json":    messageJSON.String,
+					"payload":         base64.StdEncoding.EncodeToString(payload),
+					"decode_error":    decodeError.String,
 				})
+				m.websocket.Broadcast(message)
+			}
+			err = rows.Close()
+			if err != nil {
+				log.Printf("error closing rows for grpc_messages: %v", err)
+			}
+
+			// Query gRPC calls
+			rows, err = m.db.Query(`SELECT id, timestamp, http_request_id, process_name, service, method, metadata, response_metadata, trailers, status_code, status_name, status_message, started_at, ended_at, duration_ms FROM grpc_calls WHERE id > ? ORDER BY id ASC LIMIT 100`, lastGRPCCallID)
+			if err != nil {
+				log.Printf("error querying grpc_calls: %v", err)
+				time.Sleep(1 * time.Second)
+				continue
+			}
+
+			for rows.Next() {
+				var id, httpRequestID int
+				var timestamp, processName, service, method, metadata, responseMetadata, trailers string
+				var statusCode sql.NullInt64
+				var statusName, statusMessage, startedAt, endedAt sql.NullString
+				var durationMs sql.NullFloat64
+				err = rows.Scan(&id, &timestamp, &httpRequestID, &processName, &service, &method, &metadata, &responseMetadata, &trailers, &statusCode, &statusName, &statusMessage, &startedAt, &endedAt, &durationMs)
+				if err != nil {
+					log.Printf("error scanning grpc_call row: %v", err)
+					continue
+				}
 
+				lastGRPCCallID = id
+				var status interface{}
+				if statusCode.Valid {
+					status = statusCode.Int64
+				}
+				message, _ := json.Marshal(map[string]interface{}{
+					"id":                id,
+					"type":              "grpc_call",
+					"timestamp":         timestamp,
+					"http_request_id":   httpRequestID,
+					"process_name":      processName,
+					"service":           service,
+					"method":            method,
+					"metadata":          metadata,
+					"response_metadata": responseMetadata,
+					"trailers":          trailers,
+					"status_code":       status,
+					"status_name":       statusName.String,
+					"status_message":    statusMessage.String,
+					"started_at":        startedAt.String,
+					"ended_at":          endedAt.String,
+					"duration_ms":       durationMs.Float64,
+				})
 				m.websocket.Broadcast(message)
 			}
+			err = rows.Close()
+			if err != nil {
+				log.Printf("error closing rows for grpc_calls: %v", err)
+			}
 
 			// Query Kafka messages
-			rows, err = m.db.Query(`SELECT id, broker_name, topic_name, message_key, message_value, timestamp FROM kafka_messages WHERE id > ? ORDER BY id ASC LIMIT 100`, lastKafkaMessageID)
+			rows, err = m.db.Query(`SELECT id, broker_name, topic_name, message_key, message_value, timestamp, headers, trace_id, span_id FROM kafka_messages WHERE id > ? ORDER BY id ASC LIMIT 100`, lastKafkaMessageID)
 			if err != nil {
 				log.Printf("error querying kafka_messages: %v", err)
 				time.Sleep(1 * time.Second)
@@ -661,7 +926,8 @@ func (m *Manager) BroadcastLogsAndRequests() {
 			for rows.Next() {
 				var id int
 				var brokerName, topicName, messageKey, messageValue, timestamp string
-				err = rows.Scan(&id, &brokerName, &topicName, &messageKey, &messageValue, &timestamp)
+				var headers, traceID, spanID sql.NullString
+				err = rows.Scan(&id, &brokerName, &topicName, &messageKey, &messageValue, &timestamp, &headers, &traceID, &spanID)
 				if err != nil {
 					log.Printf("error scanning kafka_message row: %v", err)
 					continue
@@ -676,6 +942,9 @@ func (m *Manager) BroadcastLogsAndRequests() {
 					"topic_name":    topicName,
 					"message_key":   messageKey,
 					"message_value": messageValue,
+					"headers":       headers.String,
+					"trace_id":      traceID.String,
+					"span_id":       spanID.String,
 				})
 				m.websocket.Broadcast(messagePayload)
 			}
@@ -684,33 +953,344 @@ func (m *Manager) BroadcastLogsAndRequests() {
 				log.Printf("error closing rows for kafka_messages: %v", err)
 			}
 
+			// Query SQL queries
+			rows, err = m.db.Query(`SELECT id, timestamp, dependency_name, client_name, database_name, query, parameters, duration_ms, row_count, error FROM sql_queries WHERE id > ? ORDER BY id ASC LIMIT 100`, lastSQLQueryID)
+			if err != nil {
+				log.Printf("error querying sql_queries: %v", err)
+				time.Sleep(1 * time.Second)
+				continue
+			}
+
+			for rows.Next() {
+				var id, rowCount int
+				var durationMs float64
+				var dependencyName, clientName, databaseName, query, parameters, timestamp string
+				var queryError sql.NullString
+				err = rows.Scan(&id, &timestamp, &dependencyName, &clientName, &databaseName, &query, &parameters, &durationMs, &rowCount, &queryError)
+				if err != nil {
+					log.Printf("error scanning sql_query row: %v", err)
+					continue
+				}
+
+				lastSQLQueryID = id
+				messagePayload, _ := json.Marshal(map[string]interface{}{
+					"id":              id,
+					"type":            "sql_query",
+					"timestamp":       timestamp,
+					"dependency_name": dependencyName,
+					"client_name":     clientName,
+					"database_name":   databaseName,
+					"query":           query,
+					"parameters":      parameters,
+					"duration_ms":     durationMs,
+					"row_count":       rowCount,
+					"error":           queryError.String,
+				})
+				m.websocket.Broadcast(messagePayload)
+			}
+			err = rows.Close()
+			if err != nil {
+				log.Printf("error closing rows for sql_queries: %v", err)
+			}
+
+			// Query Redis commands
+			rows, err = m.db.Query(`SELECT id, timestamp, dependency_name, client_name, command, arguments, reply_type, error, duration_ms FROM redis_commands WHERE id > ? ORDER BY id ASC LIMIT 100`, lastRedisCommandID)
+			if err != nil {
+				log.Printf("error querying redis_commands: %v", err)
+				time.Sleep(1 * time.Second)
+				continue
+			}
+
+			for rows.Next() {
+				var id int
+				var durationMs float64
+				var dependencyName, clientName, command, arguments, replyType, timestamp string
+				var commandError sql.NullString
+				err = rows.Scan(&id, &timestamp, &dependencyName, &clientName, &command, &arguments, &replyType, &commandError, &durationMs)
+				if err != nil {
+					log.Printf("error scanning redis_command row: %v", err)
+					continue
+				}
+
+				lastRedisCommandID = id
+				messagePayload, _ := json.Marshal(map[string]interface{}{
+					"id":              id,
+					"type":            "redis_command",
+					"timestamp":       timestamp,
+					"dependency_name": dependencyName,
+					"client_name":     clientName,
+					"command":         command,
+					"arguments":       arguments,
+					"reply_type":      replyType,
+					"error":           commandError.String,
+					"duration_ms":     durationMs,
+				})
+				m.websocket.Broadcast(messagePayload)
+			}
+			err = rows.Close()
+			if err != nil {
+				log.Printf("error closing rows for redis_commands: %v", err)
+			}
+
+			// Query emails
+			emails, err := m.getEmails(`WHERE id > ? ORDER BY id ASC LIMIT 100`, lastEmailID)
+			if err != nil {
+				log.Printf("error querying emails: %v", err)
+				time.Sleep(1 * time.Second)
+				continue
+			}
+
+			for _, email := range emails {
+				lastEmailID = email.ID
+				messagePayload, _ := json.Marshal(map[string]interface{}{
+					"id":              email.ID,
+					"type":            "email",
+					"timestamp":       email.Timestamp,
+					"dependency_name": email.DependencyName,
+					"client_name":     email.ClientName,
+					"envelope_from":   email.EnvelopeFrom,
+					"envelope_to":     email.EnvelopeTo,
+					"from":            email.From,
+					"to":              email.To,
+					"cc":              email.Cc,
+					"subject":         email.Subject,
+					"message_id":      email.MessageID,
+					"text_body":       email.TextBody,
+					"html_body":       email.HTMLBody,
+					"attachments":     email.Attachments,
+					"size":            email.Size,
+				})
+				m.websocket.Broadcast(messagePayload)
+			}
+
+			// Query OpenTelemetry spans
+			rows, err = m.db.Query(`SELECT id, timestamp, service_name, trace_id, span_id, COALESCE(parent_span_id, ''), name, kind, start_time_unix_nano, end_time_unix_nano, duration_ms, status_code, COALESCE(status_message, ''), attributes, events, links, resource_attributes, scope_name FROM otel_spans WHERE id > ? ORDER BY id ASC LIMIT 100`, lastSpanID)
+			if err != nil {
+				log.Printf("error querying otel_spans: %v", err)
+				time.Sleep(1 * time.Second)
+				continue
+			}
+
+			for rows.Next() {
+				var id int
+				var timestamp, serviceName, traceID, spanID, parentSpanID, name, kind, statusCode, statusMessage string
+				var attributes, events, links, resourceAttributes, scopeName string
+				var startTimeUnixNano, endTimeUnixNano int64
+				var durationMs float64
+				err = rows.Scan(&id, &timestamp, &serviceName, &traceID, &spanID, &parentSpanID, &name, &kind, &startTimeUnixNano, &endTimeUnixNano, &durationMs, &statusCode, &statusMessage, &attributes, &events, &links, &resourceAttributes, &scopeName)
+				if err != nil {
+					log.Printf("error scanning otel_span row: %v", err)
+					continue
+				}
+
+				lastSpanID = id
+				messagePayload, _ := json.Marshal(map[string]interface{}{
+					"id":                   id,
+					"type":                 "span",
+					"timestamp":            timestamp,
+					"service_name":         serviceName,
+					"trace_id":             traceID,
+					"span_id":              spanID,
+					"parent_span_id":       parentSpanID,
+					"name":                 name,
+					"kind":                 kind,
+					"start_time_unix_nano": startTimeUnixNano,
+					"end_time_unix_nano":   endTimeUnixNano,
+					"duration_ms":          durationMs,
+					"status_code":          statusCode,
+					"status_message":       statusMessage,
+					"attributes":           attributes,
+					"events":               events,
+					"links":                links,
+					"resource_attributes":  resourceAttributes,
+					"scope_name":           scopeName,
+				})
+				m.websocket.Broadcast(messagePayload)
+			}
+			err = rows.Close()
+			if err != nil {
+				log.Printf("error closing rows for otel_spans: %v", err)
+			}
+
+			// Query process events
+			rows, err = m.db.Query(`SELECT id, timestamp, process_name, event, pid, detail FROM process_events WHERE id > ? ORDER BY id ASC LIMIT 100`, lastProcessEventID)
+			if err != nil {
+				log.Printf("error querying process_events: %v", err)
+				time.Sleep(1 * time.Second)
+				continue
+			}
+
+			for rows.Next() {
+				var id int
+				var timestamp, processName, event string
+				var pid *int64
+				var detail sql.NullString
+				err = rows.Scan(&id, &timestamp, &processName, &event, &pid, &detail)
+				if err != nil {
+					log.Printf("error scanning process_event row: %v", err)
+					continue
+				}
+
+				lastProcessEventID = id
+				messagePayload, _ := json.Marshal(map[string]interface{}{
+					"id":           id,
+					"type":         "process_event",
+					"timestamp":    timestamp,
+					"process_name": processName,
+					"event":        event,
+					"pid":          pid,
+					"detail":       detail.String,
+				})
+				m.websocket.Broadcast(messagePayload)
+			}
+			err = rows.Close()
+			if err != nil {
+				log.Printf("error closing rows for process_events: %v", err)
+			}
+
+			// Query resource samples
+			rows, err = m.db.Query(`SELECT id, timestamp, kind, name, pid, container_name, processes, cpu_seconds, cpu_percent, memory_bytes, memory_limit_bytes, open_fds, threads FROM resource_samples WHERE id > ? ORDER BY id ASC LIMIT 100`, lastResourceSampleID)
+			if err != nil {
+				log.Printf("error querying resource_samples: %v", err)
+				time.Sleep(1 * time.Second)
+				continue
+			}
+
+			for rows.Next() {
+				var id int
+				var timestamp, kind, name string
+				// Fields that a kind of sample does not have are null.
+				var pid, processes, memoryLimitBytes, openFDs *int64
+				var containerName *string
+				var cpuSeconds float64
+				var cpuPercent *float64
+				var memoryBytes int64
+				var threads int
+				err = rows.Scan(&id, &timestamp, &kind, &name, &pid, &containerName, &processes, &cpuSeconds, &cpuPercent, &memoryBytes, &memoryLimitBytes, &openFDs, &threads)
+				if err != nil {
+					log.Printf("error scanning resource_sample row: %v", err)
+					continue
+				}
+
+				lastResourceSampleID = id
+				messagePayload, _ := json.Marshal(map[string]interface{}{
+					"id":                 id,
+					"type":               "resource_sample",
+					"timestamp":          timestamp,
+					"kind":               kind,
+					"name":               name,
+					"pid":                pid,
+					"container_name":     containerName,
+					"processes":          processes,
+					"cpu_seconds":        cpuSeconds,
+					"cpu_percent":        cpuPercent,
+					"memory_bytes":       memoryBytes,
+					"memory_limit_bytes": memoryLimitBytes,
+					"open_fds":           openFDs,
+					"threads":            threads,
+				})
+				m.websocket.Broadcast(messagePayload)
+			}
+			err = rows.Close()
+			if err != nil {
+				log.Printf("error closing rows for resource_samples: %v", err)
+			}
+
 			time.Sleep(1 * time.Second)
 		}
 	}()
 }
 
+// httpRequestEventColumns selects what scanHTTPRequestEvent reads of an http_requests row.
+const httpRequestEventColumns = "id, timestamp, process_name, method, url, headers, body, " + bodyMetadata +
+	", faults, remote_addr, caller, trace_id, span_id, parent_span_id"
+
+// scanHTTPRequestEvent reads the http_request websocket event of a row selected with httpRequestEventColumns.
+func scanHTTPRequestEvent(row interface{ Scan(...interface{}) error }) (int, map[string]interface{}, error) {
+	var id int
+	var processName, method, url, headers, timestamp string
+	var body capturedBody
+	var faults, remoteAddr, caller, traceID, spanID, parentSpanID sql.NullString
+	dest := append([]interface{}{&id, &timestamp, &processName, &method, &url, &headers, &body.data}, body.scanArgs()...)
+	err := row.Scan(append(dest, &faults, &remoteAddr, &caller, &traceID, &spanID, &parentSpanID)...)
+	if err != nil {
+		return 0, nil, err
+	}
+	return id, body.addTo(map[string]interface{}{
+		"id":             id,
+		"type":           "http_request",
+		"timestamp":      timestamp,
+		"process_name":   processName,
+		"method":         method,
+		"url":            url,
+		"headers":        headers,
+		"faults":         faults.String,
+		"remote_addr":    remoteAddr.String,
+		"caller":         caller.String,
+		"trace_id":       traceID.String,
+		"span_id":        spanID.String,
+		"parent_span_id": parentSpanID.String,
+	}), nil
+}
+
 type HTTPProxyRequest struct {
-	ID        int
-	Timestamp string
-	Method    string
-	URL       string
-	Headers   string
-	Body      string
+	ID         int
+	Timestamp  string
+	Method     string
+	URL        string
+	Headers    string
+	Body       string
+	Faults     string
+	RemoteAddr string
+
+	// Caller is the service that made the request, when it is known, as for calls through the egress proxy.
+	Caller string
+
+	// TraceID and SpanID are the W3C trace context of the request, and ParentSpanID the span of its caller.
+	TraceID      string
+	SpanID       string
+	ParentSpanID string
+
+	// BodySize is the length of the whole body, of which Body holds the start if BodyTruncated is set. BodyBlob is
+	// the blob holding the whole body, if it was spilled.
+	BodySize      int64
+	BodyTruncated bool
+	BodyBinary    bool
+	BodyBlob      string
+
+	// ContentType and ContentEncoding are the body's headers. BodyDecoded is set when Body has the content encoding
+	// removed.
+	ContentType     string
+	ContentEncoding string
+	BodyDecoded     bool
 }
 
 type HTTPProxyResponse struct {
-	ID            int
-	HTTPRequestID int
-	Timestamp     string
-	StatusCode    int
-	Headers       string
-	Body          string
+	ID              int
+	HTTPRequestID   int
+	Timestamp       string
+	StatusCode      int
+	Headers         string
+	Body            string
+	BodySize        int64
+	BodyTruncated   bool
+	BodyBinary      bool
+	BodyBlob        string
+	ContentType     string
+	ContentEncoding string
+	BodyDecoded     bool
+	Trailers        string
+	StartedAt       string
+	FirstByteAt     string
+	EndedAt         string
+	DurationMs      float64
+	UpstreamError   string
 }
 
 func (m *Manager) GetHTTPProxyRequestsForProcess(
 	processName string,
 ) ([]*HTTPProxyRequest, error) {
-	rows, err := m.db.Query("SELECT id, timestamp, method, url, headers, body FROM http_requests WHERE process_name = ?", processName)
+	rows, err := m.db.Query("SELECT id, timestamp, method, url, headers, body, "+bodyMetadata+", COALESCE(faults, ''), COALESCE(remote_addr, ''), COALESCE(caller, ''), COALESCE(trace_id, ''), COALESCE(span_id, ''), COALESCE(parent_span_id, '') FROM http_requests WHERE process_name = ?", processName)
 	if err != nil {
 		return nil, err
 	}
@@ -719,7 +1299,7 @@ func (m *Manager) GetHTTPProxyRequestsForProcess(
 	var requests []*HTTPProxyRequest
 	for rows.Next() {
 		var request HTTPProxyRequest
-		err = rows.Scan(&request.ID, &request.Timestamp, &request.Method, &request.URL, &request.Headers, &request.Body)
+		err = rows.Scan(&request.ID, &request.Timestamp, &request.Method, &request.URL, &request.Headers, &request.Body, &request.BodySize, &request.BodyTruncated, &request.BodyBinary, &request.BodyBlob, &request.ContentType, &request.ContentEncoding, &request.BodyDecoded, &request.Faults, &request.RemoteAddr, &request.Caller, &request.TraceID, &request.SpanID, &request.ParentSpanID)
 		if err != nil {
 			return nil, err
 		}
@@ -732,7 +1312,7 @@ func (m *Manager) GetHTTPProxyRequestsForProcess(
 func (m *Manager) GetHTTPProxyResponsesForProcess(
 	processName string,
 ) ([]*HTTPProxyResponse, error) {
-	rows, err := m.db.Query("SELECT id, http_request_id, timestamp, status_code, headers, body FROM http_responses WHERE process_name = ?", processName)
+	rows, err := m.db.Query("SELECT id, http_request_id, timestamp, status_code, headers, body, "+bodyMetadata+", COALESCE(trailers, ''), COALESCE(started_at, ''), COALESCE(first_byte_at, ''), COALESCE(ended_at, ''), COALESCE(duration_ms, 0), COALESCE(upstream_error, '') FROM http_responses WHERE process_name = ?", processName)
 	if err != nil {
 		return nil, err
 	}
@@ -741,7 +1321,7 @@ func (m *Manager) GetHTTPProxyResponsesForProcess(
 	var responses []*HTTPProxyResponse
 	for rows.Next() {
 		var response HTTPProxyResponse
-		err = rows.Scan(&response.ID, &response.HTTPRequestID, &response.Timestamp, &response.StatusCode, &response.Headers, &response.Body)
+		err = rows.Scan(&response.ID, &response.HTTPRequestID, &response.Timestamp, &response.StatusCode, &response.Headers, &response.Body, &response.BodySize, &response.BodyTruncated, &response.BodyBinary, &response.BodyBlob, &response.ContentType, &response.ContentEncoding, &response.BodyDecoded, &response.Trailers, &response.StartedAt, &response.FirstByteAt, &response.EndedAt, &response.DurationMs, &response.UpstreamError)
 		if err != nil {
 			return nil, err
 		}
@@ -751,28 +1331,61 @@ func (m *Manager) GetHTTPProxyResponsesForProcess(
 	return responses, nil
 }
 
+// newProxy creates the capturing proxy of the named service, with the faults and gRPC decoding set up for it.
+func (m *Manager) newProxy(target string, processName string) (*proxy.Proxy, error) {
+	var proxyOptions []proxy.ProxyOption
+	if m.verbose {
+		proxyOptions = append(proxyOptions, proxy.WithVerbose(true))
+	}
+	m.mu.Lock()
+	faults, ok := m.faults[processName]
+	grpcResolver, hasGRPCResolver := m.grpcResolvers[processName]
+	m.mu.Unlock()
+	if ok {
+		proxyOptions = append(proxyOptions, proxy.WithFaults(faults))
+	}
+	if hasGRPCResolver {
+		proxyOptions = append(proxyOptions, proxy.WithGRPCResolver(grpcResolver))
+	}
+	proxyOptions = append(proxyOptions, proxy.WithCaptureLimit(m.captureLimit), proxy.WithClient(m.ServiceForConnection))
+	if m.blobs != nil {
+		proxyOptions = append(proxyOptions, proxy.WithBlobStore(m.blobs))
+	}
+
+	return proxy.NewProxy(target, processName, m.db, proxyOptions...)
+}
+
 func (m *Manager) RunHTTPProxy(
 	target string,
 	listenAddr string,
 	processName string,
+	tlsConfig *tls.Config,
 	stop chan struct{},
 ) error {
-	var proxyOptions []proxy.ProxyOption
-	if m.verbose {
-		proxyOptions = append(proxyOptions, proxy.WithVerbose(true))
-	}
-
-	httpProxy, err := proxy.NewProxy(target, processName, m.db, proxyOptions...)
+	httpProxy, err := m.newProxy(target, processName)
 	if err != nil {
 		return err
 	}
 
 	go func() {
 		log.Printf("Starting HTTP proxy on %s", listenAddr)
-		server := &http.Server{Addr: listenAddr, Handler: httpProxy}
+		// h2c lets gRPC clients, which speak HTTP/2 without TLS, use the proxy port.
+		server := &http.Server{
+			Addr:        listenAddr,
+			Handler:     h2c.NewHandler(httpProxy, &http2.Server{}),
+			ConnContext: proxy.ConnContext,
+		}
 
 		go func() {
-			if err := server.ListenAndServe(); err != nil {
+			var err error
+			if tlsConfig != nil {
+				// The service stays on plain HTTP; only the proxy port serves TLS, with HTTP/2 negotiated by ALPN.
+				server.TLSConfig = tlsConfig
+				err = server.ListenAndServeTLS("", "")
+			} else {
+				err = server.ListenAndServe()
+			}
+			if err != nil {
 				log.Printf("Error starting HTTP proxy: %v", err)
 			}
 		}()
@@ -789,52 +1402,205 @@ func (m *Manager) RunHTTPProxy(
 	return nil
 }
 
-func cleanupContainers(containerName string) error {
-	ctx := context.Background()
-	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
-	if err != nil {
-		return errors.Wrap(err, "failed to create docker client")
+// RunGateway serves a gateway on its port until stop is signalled. Routes to a service go through a proxy that
+// captures the traffic under the service's name and forwards it to the service port. Mock services and replays
+// capture what they serve themselves, so routes to them are forwarded as they are.
+func (m *Manager) RunGateway(
+	definition parser.VClusterGatewayDefinitionAST,
+	asts []*parser.VClusterAST,
+	stop chan struct{},
+) error {
+	handlers := make(map[string]http.Handler)
+	handler := func(name string) (http.Handler, error) {
+		if handler, ok := handlers[name]; ok {
+			return handler, nil
+		}
+		target, capture, err := gatewayTarget(name, asts)
+		if err != nil {
+			return nil, err
+		}
+		targetURL := &url.URL{Scheme: "http", Host: fmt.Sprintf("localhost:%d", target)}
+		var handler http.Handler = httputil.NewSingleHostReverseProxy(targetURL)
+		if capture {
+			handler, err = m.newProxy(targetURL.String(), name)
+			if err != nil {
+				return nil, err
+			}
+		}
+		handlers[name] = handler
+		return handler, nil
 	}
 
-	containers, err := cli.ContainerList(ctx, types.ContainerListOptions{All: true})
-	if err != nil {
-		return errors.Wrap(err, "failed to list containers")
+	gateway := proxy.NewGateway()
+	for _, route := range definition.Routes {
+		handler, err := handler(route.Service)
+		if err != nil {
+			return err
+		}
+		if route.Host != "" {
+			gateway.Host(route.Host, handler)
+		} else {
+			gateway.Route(route.Path, handler)
+		}
 	}
 
-	for _, container := range containers {
-		if container.Names[0] == "/"+containerName {
-			fmt.Printf("Removing container %s\n", container.ID)
-			err := cli.ContainerRemove(ctx, container.ID, types.ContainerRemoveOptions{Force: true})
-			if err != nil {
-				return errors.Wrap(err, "failed to remove container "+container.ID)
+	pw := utils.NewPortWaiter(strconv.Itoa(definition.Port))
+	if err := pw.Wait(); err != nil {
+		return errors.Wrap(err, "failed to wait for gateway port")
+	}
+
+	listenAddr := fmt.Sprintf(":%d", definition.Port)
+	go func() {
+		log.Printf("Starting gateway on %s", listenAddr)
+		server := &http.Server{
+			Addr:        listenAddr,
+			Handler:     h2c.NewHandler(gateway, &http2.Server{}),
+			ConnContext: proxy.ConnContext,
+		}
+
+		go func() {
+			if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Printf("Error starting gateway: %v", err)
 			}
+		}()
+
+		<-stop
+		log.Printf("Stopping gateway on %s", listenAddr)
+		if err := server.Shutdown(context.Background()); err != nil {
+			log.Printf("Error stopping gateway: %v", err)
 		}
-	}
+	}()
 
 	return nil
 }
 
-func cleanupNetworks(networkName string) error {
-	ctx := context.Background()
-	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
-	if err != nil {
-		return errors.Wrap(err, "failed to create docker client")
+// gatewayTarget finds the port a gateway forwards the named service's requests to, and whether the gateway has to
+// capture them.
+func gatewayTarget(name string, asts []*parser.VClusterAST) (int, bool, error) {
+	for _, ast := range asts {
+		for _, service := range ast.Services {
+			if service.Name != name {
+				continue
+			}
+			if service.IsReplay() {
+				if service.ProxyPort != nil {
+					return *service.ProxyPort, false, nil
+				}
+				return *service.ServicePort, false, nil
+			}
+			if service.ServicePort == nil {
+				return 0, false, fmt.Errorf("gateway route to service without service_port: %s", name)
+			}
+			return *service.ServicePort, true, nil
+		}
+		for _, mockService := range ast.MockServices {
+			if mockService.Name == name {
+				return mockService.Port, false, nil
+			}
+		}
 	}
+	return 0, false, fmt.Errorf("gateway route to unknown service: %s", name)
+}
 
-	networks, err := cli.NetworkList(ctx, types.NetworkListOptions{})
+// RunMockService serves a mock service on its port until stop is signalled.
+func (m *Manager) RunMockService(
+	definition parser.VClusterMockServiceDefinitionAST,
+	stop chan struct{},
+) error {
+	pw := utils.NewPortWaiter(strconv.Itoa(definition.Port))
+	if err := pw.Wait(); err != nil {
+		return errors.Wrapf(err, "failed to wait for mock service port: %s", definition.Name)
+	}
+
+	mockService, err := mock.NewService(
+		definition.Name,
+		definition.Routes,
+		m.db,
+		mock.WithVerbose(m.verbose),
+		mock.WithFileReader(func(path string) ([]byte, error) {
+			return utils.ReadFileUpward(path, m.verbose)
+		}),
+	)
 	if err != nil {
-		return errors.Wrap(err, "failed to list networks")
+		return err
 	}
 
-	for _, network := range networks {
-		if network.Name == networkName {
-			fmt.Printf("Removing network %s\n", network.ID)
-			err := cli.NetworkRemove(ctx, network.ID)
-			if err != nil {
-				return errors.Wrap(err, "failed to remove network "+network.ID)
+	listenAddr := fmt.Sprintf(":%d", definition.Port)
+	go func() {
+		log.Printf("Starting mock service on %s", listenAddr)
+		server := &http.Server{Addr: listenAddr, Handler: mockService}
+
+		go func() {
+			if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Printf("Error starting mock service: %v", err)
 			}
+		}()
+
+		<-stop
+		log.Printf("Stopping mock service: %s", definition.Name)
+		if err := server.Shutdown(context.Background()); err != nil {
+			log.Printf("Error stopping mock service: %v", err)
 		}
+	}()
+
+	return nil
+}
+
+// RunReplayService answers requests to a service from its recording until stop is signalled. The replay listens on
+// the proxy port if there is one, since that is where the other services send their requests, and on the service
+// port otherwise.
+func (m *Manager) RunReplayService(
+	service parser.VClusterServiceDefinitionAST,
+	stop chan struct{},
+) error {
+	port := service.ServicePort
+	if service.ProxyPort != nil {
+		port = service.ProxyPort
+	}
+	pw := utils.NewPortWaiter(strconv.Itoa(*port))
+	if err := pw.Wait(); err != nil {
+		return errors.Wrapf(err, "failed to wait for replay port: %s", service.Name)
 	}
 
+	_, recordingPath, err := utils.StatUpward(*service.Recording, m.verbose)
+	if err != nil {
+		return errors.Wrapf(err, "failed to find recording: %s", *service.Recording)
+	}
+	replay, err := mock.NewReplay(service.Name, recordingPath, m.db, mock.WithReplayVerbose(m.verbose))
+	if err != nil {
+		return err
+	}
+	var tlsConfig *tls.Config
+	if service.ProxyTLS && service.ProxyPort != nil {
+		tlsConfig, err = m.ca.ServerTLSConfig(service.Name)
+		if err != nil {
+			return errors.Wrapf(err, "failed to issue certificate for replay of service: %s", service.Name)
+		}
+	}
+
+	listenAddr := fmt.Sprintf(":%d", *port)
+	go func() {
+		log.Printf("Starting replay on %s", listenAddr)
+		server := &http.Server{Addr: listenAddr, Handler: replay, TLSConfig: tlsConfig}
+
+		go func() {
+			var err error
+			if tlsConfig != nil {
+				err = server.ListenAndServeTLS("", "")
+			} else {
+				err = server.ListenAndServe()
+			}
+			if err != nil && err != http.ErrServerClosed {
+				log.Printf("Error starting replay: %v", err)
+			}
+		}()
+
+		<-stop
+		log.Printf("Stopping replay: %s", service.Name)
+		if err := server.Shutdown(context.Background()); err != nil {
+			log.Printf("Error stopping replay: %v", err)
+		}
+	}()
+
 	return nil
 }
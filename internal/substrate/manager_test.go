@@ -17,8 +17,10 @@ import (
 	"testing"
 	"time"
 
+	"github.com/asimihsan/virtual-cluster/internal/dependencies/kafka"
 	"github.com/asimihsan/virtual-cluster/internal/parser"
 	"github.com/asimihsan/virtual-cluster/internal/substrate"
+	"github.com/asimihsan/virtual-cluster/pkg/dependencies"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -116,8 +118,9 @@ func TestStartAndStopManagedKafka(t *testing.T) {
 
 	// Define managed Kafka dependency.
 	managedKafka := &parser.VClusterManagedDependencyDefinitionAST{
-		Name:         "kafka",
-		ManagedKafka: &parser.ManagedKafka{Port: 9095},
+		Name:   "kafka",
+		Kind:   kafka.Kind,
+		Config: dependencies.Config{"port": 9095},
 	}
 
 	// Start the managed Kafka dependency
@@ -0,0 +1,79 @@
+/*
+ * Copyright (c) 2023 Asim Ihsan.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ * SPDX-License-Identifier: MPL-2.0
+ */
+
+package substrate
+
+import (
+	"fmt"
+	"github.com/asimihsan/virtual-cluster/internal/otlp"
+	"github.com/pkg/errors"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"log"
+	"net"
+	"net/http"
+)
+
+const (
+	// OTLPEndpointEnv is set for managed processes to the OTLP receiver, which takes OTLP/HTTP and OTLP/gRPC exports
+	// on the same port.
+	OTLPEndpointEnv = "OTEL_EXPORTER_OTLP_ENDPOINT"
+
+	// OTLPServiceNameEnv is set for managed processes to the name of their service, which their telemetry is stored
+	// under.
+	OTLPServiceNameEnv = "OTEL_SERVICE_NAME"
+)
+
+// startOTLP starts the OTLP receiver on the port set by WithOTLPPort, or on a free port if that one is taken, e.g. by
+// a collector already running on the machine. Managed processes are told the port the receiver ends up on.
+func (m *Manager) startOTLP() error {
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", m.otlpPort))
+	if err != nil {
+		log.Printf("OTLP port %d is not available, using another: %v", m.otlpPort, err)
+		listener, err = net.Listen("tcp", ":0")
+		if err != nil {
+			return errors.Wrap(err, "failed to listen for OTLP exports")
+		}
+	}
+	m.otlpPort = listener.Addr().(*net.TCPAddr).Port
+	m.otlpReceiver = otlp.NewReceiver(m.db)
+	m.otlpServer = &http.Server{Handler: h2c.NewHandler(m.otlpReceiver, &http2.Server{})}
+
+	go func() {
+		log.Printf("Starting OTLP receiver on %s", listener.Addr())
+		if err := m.otlpServer.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Printf("Error serving OTLP: %v", err)
+		}
+	}()
+	return nil
+}
+
+// stopOTLP stops the OTLP receiver. The receiver's gRPC streams are over connections the server hands to HTTP/2, which
+// closing the server does not close.
+func (m *Manager) stopOTLP() {
+	if m.otlpServer == nil {
+		return
+	}
+	_ = m.otlpServer.Close()
+	m.otlpReceiver.Stop()
+}
+
+// OTLPPort returns the port of the OTLP receiver.
+func (m *Manager) OTLPPort() int {
+	return m.otlpPort
+}
+
+// otlpEnv points the OpenTelemetry SDK of the named managed process at the OTLP receiver.
+func (m *Manager) otlpEnv(name string) []string {
+	return []string{
+		fmt.Sprintf("%s=http://127.0.0.1:%d", OTLPEndpointEnv, m.otlpPort),
+		OTLPServiceNameEnv + "=" + name,
+	}
+}
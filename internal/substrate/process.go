@@ -13,10 +13,21 @@ package substrate
 import (
 	"bufio"
 	"database/sql"
+	"encoding/json"
 	"fmt"
+	"github.com/asimihsan/virtual-cluster/internal/cgroup"
+	"github.com/asimihsan/virtual-cluster/internal/logparse"
+	"github.com/asimihsan/virtual-cluster/internal/metrics"
+	"github.com/asimihsan/virtual-cluster/internal/schema"
 	_ "github.com/mattn/go-sqlite3"
+	"github.com/pkg/errors"
+	"io"
 	"log"
+	"os"
 	"os/exec"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type ManagedProcess struct {
@@ -24,6 +35,103 @@ type ManagedProcess struct {
 	RunCommands      []string
 	WorkingDirectory string
 	Stop             chan struct{}
+
+	// Env is added to the environment the substrate itself runs with.
+	Env []string
+
+	// Cgroup limits what the process and its descendants may use, if set.
+	Cgroup *cgroup.Group
+
+	mu  sync.Mutex
+	pid int
+}
+
+// Pid returns the process ID of the command that is currently running, or 0 if none is.
+func (p *ManagedProcess) Pid() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.pid
+}
+
+func (p *ManagedProcess) setPid(pid int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.pid = pid
+}
+
+// insertLog stores a line of a process's output, with the level, message, logger, trace context and other fields
+// of lines in a format logparse knows.
+func insertLog(db *sql.DB, processName string, outputType string, line string) error {
+	entry := logparse.Parse(line)
+	var fields []byte
+	if entry.Fields != nil {
+		var err error
+		fields, err = json.Marshal(entry.Fields)
+		if err != nil {
+			return errors.Wrap(err, "failed to marshal log fields")
+		}
+	}
+	metrics.LogLines.WithLabelValues(processName, outputType).Inc()
+	start := time.Now()
+	_, err := db.Exec(`INSERT INTO logs (process_name, output_type, content, trace_id, span_id, format, level, message,
+		logger, fields) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		processName, outputType, line, schema.NullIfEmpty(entry.TraceID), schema.NullIfEmpty(entry.SpanID),
+		schema.NullIfEmpty(entry.Format), schema.NullIfEmpty(entry.Level), schema.NullIfEmpty(entry.Message), schema.NullIfEmpty(entry.Logger),
+		schema.NullIfEmpty(string(fields)))
+	metrics.ObserveWrite("logs", start, err)
+	return err
+}
+
+// Events of the process_events table, in the lifecycle of a managed process.
+const (
+	ProcessEventStarted   = "started"
+	ProcessEventExited    = "exited"
+	ProcessEventStopped   = "stopped"
+	ProcessEventOOMKilled = "oom_killed"
+)
+
+// insertProcessEvent stores an event in the lifecycle of a process. detail says more about it, such as how a process
+// exited, or is empty.
+func insertProcessEvent(db *sql.DB, processName string, event string, pid int, detail string) {
+	var pidValue, detailValue interface{}
+	if pid != 0 {
+		pidValue = pid
+	}
+	if detail != "" {
+		detailValue = detail
+	}
+	_, err := db.Exec("INSERT INTO process_events (process_name, event, pid, detail) VALUES (?, ?, ?, ?)",
+		processName, event, pidValue, detailValue)
+	if err != nil {
+		log.Printf("Error recording %s event of process %s: %v", event, processName, err)
+	}
+}
+
+// watchOOMKills records an event each time the kernel kills processes in the process's cgroup for going over its
+// memory limit, until done is closed.
+func watchOOMKills(process *ManagedProcess, db *sql.DB, done <-chan struct{}) {
+	reported, err := process.Cgroup.OOMKills()
+	if err != nil {
+		log.Printf("Not watching process %s for OOM kills: %v", process.Name, err)
+		return
+	}
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		kills, err := process.Cgroup.OOMKills()
+		if err != nil || kills <= reported {
+			continue
+		}
+		log.Printf("Process %s went over its memory limit: %d processes OOM killed", process.Name, kills-reported)
+		insertProcessEvent(db, process.Name, ProcessEventOOMKilled, process.Pid(),
+			fmt.Sprintf("%d processes killed for going over the memory limit", kills-reported))
+		reported = kills
+	}
 }
 
 func runProcessAndStoreOutput(
@@ -35,7 +143,7 @@ func runProcessAndStoreOutput(
 		if verbose {
 			fmt.Printf("%s: %s", process.Name, line)
 		}
-		_, err := db.Exec("INSERT INTO logs (process_name, output_type, content) VALUES (?, 'stdout', ?)", process.Name, line)
+		err := insertLog(db, process.Name, "stdout", line)
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -45,21 +153,57 @@ func runProcessAndStoreOutput(
 		if verbose {
 			fmt.Printf("%s: %s", process.Name, line)
 		}
-		_, err := db.Exec("INSERT INTO logs (process_name, output_type, content) VALUES (?, 'stderr', ?)", process.Name, line)
+		err := insertLog(db, process.Name, "stderr", line)
 		if err != nil {
 			log.Fatal(err)
 		}
 	}
 
+	// The stop signal is passed on to the running command, noting that the process was stopped rather than exited.
+	var stopped atomic.Bool
+	stop := make(chan struct{}, 1)
+	go func() {
+		<-process.Stop
+		stopped.Store(true)
+		stop <- struct{}{}
+	}()
+	started := func(pid int) {
+		metrics.ProcessStarts.WithLabelValues(process.Name).Inc()
+		process.setPid(pid)
+		insertProcessEvent(db, process.Name, ProcessEventStarted, pid, "")
+	}
+	if process.Cgroup != nil {
+		done := make(chan struct{})
+		defer close(done)
+		go watchOOMKills(process, db, done)
+	}
+
 	for _, cmdStr := range process.RunCommands {
 		fmt.Println("Running command:", cmdStr)
 		err := runShellCommand(
-			process.Stop,
+			stop,
 			cmdStr,
 			process.WorkingDirectory,
+			process.Env,
 			outputCallback,
 			errorCallback,
+			started,
+			process.Cgroup,
 		)
+		pid := process.Pid()
+		process.setPid(0)
+		switch {
+		case stopped.Load():
+			metrics.ProcessExits.WithLabelValues(process.Name, "stopped").Inc()
+			insertProcessEvent(db, process.Name, ProcessEventStopped, pid, "")
+			return
+		case err != nil:
+			metrics.ProcessExits.WithLabelValues(process.Name, "failure").Inc()
+			insertProcessEvent(db, process.Name, ProcessEventExited, pid, err.Error())
+		default:
+			metrics.ProcessExits.WithLabelValues(process.Name, "success").Inc()
+			insertProcessEvent(db, process.Name, ProcessEventExited, pid, "exit status 0")
+		}
 		if err != nil {
 			fmt.Println("Error occurred while running command:", cmdStr, "Error:", err)
 			break
@@ -69,23 +213,30 @@ func runProcessAndStoreOutput(
 
 type OutputCallback func(string)
 type ErrorCallback func(string)
+type StartedCallback func(pid int)
 
 func runShellCommand(
 	stop chan struct{},
 	command string,
 	workingDirectory string,
+	env []string,
 	outputCallback OutputCallback,
 	errorCallback ErrorCallback,
+	startedCallback StartedCallback,
+	group *cgroup.Group,
 ) error {
-	cmd := exec.Command("bash", "-c", command)
-	cmd.Dir = workingDirectory
-
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		return err
+	cmd, stdout, stderr, err := startShellCommand(command, workingDirectory, env, group)
+	if err != nil && group != nil {
+		// Starting straight into a cgroup needs a kernel and seccomp profile that allow clone3, so the process is
+		// otherwise moved into its cgroup once it has started.
+		log.Printf("Warning: failed to start %q in its cgroup, moving it there once started instead: %v", command, err)
+		cmd, stdout, stderr, err = startShellCommand(command, workingDirectory, env, nil)
+		if err == nil {
+			if err := group.Add(cmd.Process.Pid); err != nil {
+				log.Printf("Warning: %q runs without its limits: %v", command, err)
+			}
+		}
 	}
-
-	stderr, err := cmd.StderrPipe()
 	if err != nil {
 		return err
 	}
@@ -96,8 +247,8 @@ func runShellCommand(
 	errorScanner := bufio.NewScanner(stderr)
 	go readStream(errorScanner, errorCallback, "stderr")
 
-	if err := cmd.Start(); err != nil {
-		return err
+	if startedCallback != nil {
+		startedCallback(cmd.Process.Pid)
 	}
 
 	// Wait for the command to finish.
@@ -120,6 +271,40 @@ func runShellCommand(
 	}
 }
 
+// startShellCommand starts command with bash, in group unless it is nil, and returns it with its output streams.
+func startShellCommand(
+	command string,
+	workingDirectory string,
+	env []string,
+	group *cgroup.Group,
+) (*exec.Cmd, io.ReadCloser, io.ReadCloser, error) {
+	cmd := exec.Command("bash", "-c", command)
+	cmd.Dir = workingDirectory
+	if len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	if group != nil {
+		release, err := group.Apply(cmd)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		defer release()
+	}
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, nil, nil, err
+	}
+	return cmd, stdout, stderr, nil
+}
+
 func readStream(
 	scanner *bufio.Scanner,
 	callback func(string),
@@ -12,13 +12,23 @@ package substrate
 
 import (
 	"bytes"
+	"database/sql"
+	"os"
+	"path/filepath"
+	"strconv"
 	"testing"
+	"time"
+
+	"github.com/asimihsan/virtual-cluster/internal/cgroup"
+	"github.com/asimihsan/virtual-cluster/internal/schema"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestRunShellCommand(t *testing.T) {
 	tests := []struct {
 		name           string
 		command        string
+		env            []string
 		expectedOutput string
 		expectedError  error
 	}{
@@ -34,6 +44,13 @@ func TestRunShellCommand(t *testing.T) {
 			expectedOutput: "hello world\ngoodbye world\n",
 			expectedError:  nil,
 		},
+		{
+			name:           "environment",
+			command:        "echo $VCLUSTER_CA_CERT",
+			env:            []string{"VCLUSTER_CA_CERT=/tmp/ca.pem"},
+			expectedOutput: "/tmp/ca.pem\n",
+			expectedError:  nil,
+		},
 	}
 
 	for _, tt := range tests {
@@ -46,12 +63,15 @@ func TestRunShellCommand(t *testing.T) {
 				stopChan,
 				tt.command,
 				".", /* working directory */
+				tt.env,
 				func(line string) {
 					output.WriteString(line)
 				},
 				func(line string) {
 					errOutput.WriteString(line)
 				},
+				nil, /* started callback */
+				nil, /* cgroup */
 			)
 
 			if err != nil && tt.expectedError == nil {
@@ -73,3 +93,67 @@ func TestRunShellCommand(t *testing.T) {
 		})
 	}
 }
+
+func TestRunProcessAndStoreOutput_RecordsProcessEvents(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	assert.NoError(t, err)
+	db.SetMaxOpenConns(1)
+	assert.NoError(t, schema.Create(db))
+
+	events := func(name string) []string {
+		rows, err := db.Query("SELECT event, COALESCE(detail, '') FROM process_events WHERE process_name = ? ORDER BY id", name)
+		assert.NoError(t, err)
+		defer rows.Close()
+		var events []string
+		for rows.Next() {
+			var event, detail string
+			assert.NoError(t, rows.Scan(&event, &detail))
+			events = append(events, event+" "+detail)
+		}
+		return events
+	}
+
+	// A command that fails ends the process.
+	runProcessAndStoreOutput(&ManagedProcess{
+		Name:        "worker",
+		RunCommands: []string{"true", "exit 3", "true"},
+		Stop:        make(chan struct{}, 1),
+	}, db, false)
+	assert.Equal(t, []string{
+		"started ", "exited exit status 0",
+		"started ", "exited exit status 3",
+	}, events("worker"))
+
+	stopped := &ManagedProcess{Name: "server", RunCommands: []string{"sleep 10"}, Stop: make(chan struct{}, 1)}
+	done := make(chan struct{})
+	go func() {
+		runProcessAndStoreOutput(stopped, db, false)
+		close(done)
+	}()
+	assert.Eventually(t, func() bool { return stopped.Pid() != 0 }, 5*time.Second, 10*time.Millisecond)
+	stopped.Stop <- struct{}{}
+	<-done
+	assert.Equal(t, []string{"started ", "stopped "}, events("server"))
+}
+
+func TestRunShellCommand_MovesIntoCgroupWhenItCannotStartThere(t *testing.T) {
+	// A directory that is not a cgroup cannot be started in, as on kernels without CLONE_INTO_CGROUP.
+	mountPoint := t.TempDir()
+	for _, dir := range []string{mountPoint, filepath.Join(mountPoint, "vcluster")} {
+		assert.NoError(t, os.MkdirAll(dir, 0755))
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, "cgroup.controllers"), []byte("pids"), 0644))
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, "cgroup.subtree_control"), nil, 0644))
+	}
+	hierarchy, err := cgroup.Setup(mountPoint, "/", os.Getpid(), "vcluster")
+	assert.NoError(t, err)
+	group, err := hierarchy.NewGroup("orders", cgroup.Limits{})
+	assert.NoError(t, err)
+
+	var pid int
+	err = runShellCommand(make(chan struct{}), "true", ".", nil, func(string) {}, func(string) {},
+		func(started int) { pid = started }, group)
+	assert.NoError(t, err)
+	procs, err := os.ReadFile(filepath.Join(group.Path(), "cgroup.procs"))
+	assert.NoError(t, err)
+	assert.Equal(t, strconv.Itoa(pid), string(procs))
+}
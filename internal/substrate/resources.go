@@ -0,0 +1,210 @@
+/*
+ * Copyright (c) 2023 Asim Ihsan.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ * SPDX-License-Identifier: MPL-2.0
+ */
+
+package substrate
+
+import (
+	"context"
+	"github.com/asimihsan/virtual-cluster/internal/utils"
+	"github.com/asimihsan/virtual-cluster/pkg/dependencies"
+	"github.com/docker/docker/client"
+	"log"
+	"strconv"
+	"time"
+)
+
+// DefaultResourceSampleInterval is how often the resources managed processes and containers use are sampled.
+const DefaultResourceSampleInterval = 5 * time.Second
+
+const (
+	// ResourceKindProcess samples are of a managed process and all of its descendants.
+	ResourceKindProcess = "process"
+
+	// ResourceKindContainer samples are of a container of a managed dependency.
+	ResourceKindContainer = "container"
+)
+
+// containerized is implemented by managed dependencies that run in containers.
+type containerized interface {
+	ContainerNames() []string
+}
+
+// resourceSample is a row of the resource_samples table. Fields that a kind of sample does not have are nil.
+type resourceSample struct {
+	kind             string
+	name             string
+	pid              *int
+	containerName    *string
+	processes        *int
+	cpuTime          time.Duration
+	memoryBytes      int64
+	memoryLimitBytes *int64
+	openFDs          *int
+	threads          int
+}
+
+// resourceSampler samples the resources of managed processes and containers into the resource_samples table.
+type resourceSampler struct {
+	manager *Manager
+	docker  *client.Client
+
+	// last holds the previous sample of each process and container, to work out the CPU used since.
+	last map[string]sampledCPU
+
+	// failed notes the processes and containers whose sampling failed, so that only the first failure is logged.
+	failed map[string]bool
+}
+
+type sampledCPU struct {
+	at      time.Time
+	cpuTime time.Duration
+}
+
+// startResourceSampler samples resources at the manager's interval until it closes.
+func (m *Manager) startResourceSampler() {
+	if m.resourceInterval <= 0 {
+		return
+	}
+	stop := make(chan struct{}, 1)
+	m.stopChans = append(m.stopChans, stop)
+
+	sampler := &resourceSampler{manager: m, last: make(map[string]sampledCPU), failed: make(map[string]bool)}
+	go func() {
+		ticker := time.NewTicker(m.resourceInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				if sampler.docker != nil {
+					_ = sampler.docker.Close()
+				}
+				return
+			case <-ticker.C:
+			}
+			sampler.sample()
+		}
+	}()
+}
+
+func (s *resourceSampler) sample() {
+	s.manager.mu.Lock()
+	processes := make([]*ManagedProcess, len(s.manager.processes))
+	copy(processes, s.manager.processes)
+	managedDependencies := make([]dependencies.ManagedDependency, len(s.manager.dependencies))
+	copy(managedDependencies, s.manager.dependencies)
+	s.manager.mu.Unlock()
+
+	var samples []resourceSample
+	for _, process := range processes {
+		pid := process.Pid()
+		if pid == 0 {
+			continue
+		}
+		usage, err := utils.TreeUsage(pid)
+		if err != nil {
+			s.logFailure(process.Name, "Error sampling resources of process %s: %v", process.Name, err)
+			continue
+		}
+		s.failed[process.Name] = false
+		samples = append(samples, resourceSample{
+			kind:        ResourceKindProcess,
+			name:        process.Name,
+			pid:         &pid,
+			processes:   &usage.Processes,
+			cpuTime:     usage.CPUTime,
+			memoryBytes: usage.RSSBytes,
+			openFDs:     &usage.OpenFDs,
+			threads:     usage.Threads,
+		})
+	}
+
+	for _, dependency := range managedDependencies {
+		withContainers, ok := dependency.(containerized)
+		if !ok {
+			continue
+		}
+		for _, containerName := range withContainers.ContainerNames() {
+			sample, err := s.sampleContainer(dependency.Name(), containerName)
+			if err != nil {
+				// Containers are sampled from when their dependency starts, which is before they are running.
+				s.logFailure(containerName, "Error sampling resources of container %s: %v", containerName, err)
+				continue
+			}
+			s.failed[containerName] = false
+			samples = append(samples, sample)
+		}
+	}
+
+	for _, sample := range samples {
+		if err := s.store(sample); err != nil {
+			log.Printf("Error storing resource sample of %s: %v", sample.name, err)
+		}
+	}
+}
+
+func (s *resourceSampler) sampleContainer(dependencyName string, containerName string) (resourceSample, error) {
+	if s.docker == nil {
+		docker, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+		if err != nil {
+			return resourceSample{}, err
+		}
+		s.docker = docker
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.manager.resourceInterval)
+	defer cancel()
+	usage, err := utils.ContainerStats(ctx, s.docker, containerName)
+	if err != nil {
+		return resourceSample{}, err
+	}
+	name := containerName
+	return resourceSample{
+		kind:             ResourceKindContainer,
+		name:             dependencyName,
+		containerName:    &name,
+		cpuTime:          usage.CPUTime,
+		memoryBytes:      usage.MemoryBytes,
+		memoryLimitBytes: &usage.MemoryLimitBytes,
+		threads:          usage.Pids,
+	}, nil
+}
+
+func (s *resourceSampler) logFailure(key string, format string, args ...interface{}) {
+	if !s.failed[key] {
+		log.Printf(format, args...)
+	}
+	s.failed[key] = true
+}
+
+// store inserts a sample, with the share of a CPU it used since the previous sample of the same process or
+// container, which can be more than 100% for processes that use several.
+func (s *resourceSampler) store(sample resourceSample) error {
+	now := time.Now()
+	key := sample.kind + "/" + sample.name
+	if sample.pid != nil {
+		key += "/" + strconv.Itoa(*sample.pid)
+	}
+	if sample.containerName != nil {
+		key += "/" + *sample.containerName
+	}
+	var cpuPercent *float64
+	if last, ok := s.last[key]; ok && now.After(last.at) && sample.cpuTime >= last.cpuTime {
+		percent := 100 * float64(sample.cpuTime-last.cpuTime) / float64(now.Sub(last.at))
+		cpuPercent = &percent
+	}
+	s.last[key] = sampledCPU{at: now, cpuTime: sample.cpuTime}
+
+	_, err := s.manager.db.Exec(`
+		INSERT INTO resource_samples (kind, name, pid, container_name, processes, cpu_seconds, cpu_percent, memory_bytes, memory_limit_bytes, open_fds, threads)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		sample.kind, sample.name, sample.pid, sample.containerName, sample.processes, sample.cpuTime.Seconds(),
+		cpuPercent, sample.memoryBytes, sample.memoryLimitBytes, sample.openFDs, sample.threads)
+	return err
+}
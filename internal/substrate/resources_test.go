@@ -0,0 +1,69 @@
+/*
+ * Copyright (c) 2023 Asim Ihsan.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ * SPDX-License-Identifier: MPL-2.0
+ */
+
+package substrate
+
+import (
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/asimihsan/virtual-cluster/internal/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResourceSampler_SamplesProcessTrees(t *testing.T) {
+	m, err := NewManager(filepath.Join(t.TempDir(), "vcluster.db"), WithHTTPPort(0), WithOTLPPort(0), WithResourceSampleInterval(0))
+	assert.NoError(t, err)
+	defer m.Close()
+
+	// A shell with a child of its own stands in for a service that forks.
+	cmd := exec.Command("bash", "-c", "sleep 10 & wait")
+	assert.NoError(t, cmd.Start())
+	defer func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	}()
+	assert.Eventually(t, func() bool {
+		tree, err := utils.ProcessTree(cmd.Process.Pid)
+		return err == nil && len(tree) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	running := &ManagedProcess{Name: "orders"}
+	running.setPid(cmd.Process.Pid)
+	m.processes = append(m.processes, running, &ManagedProcess{Name: "stopped"})
+
+	sampler := &resourceSampler{manager: m, last: make(map[string]sampledCPU), failed: make(map[string]bool)}
+	sampler.sample()
+	sampler.sample()
+
+	rows, err := m.db.Query(`SELECT kind, name, pid, processes, memory_bytes, open_fds, threads, cpu_percent IS NOT NULL FROM resource_samples ORDER BY id`)
+	assert.NoError(t, err)
+	defer rows.Close()
+	var count int
+	for rows.Next() {
+		var kind, name string
+		var pid, processes, openFDs, threads int
+		var memoryBytes int64
+		var hasCPUPercent bool
+		assert.NoError(t, rows.Scan(&kind, &name, &pid, &processes, &memoryBytes, &openFDs, &threads, &hasCPUPercent))
+		assert.Equal(t, ResourceKindProcess, kind)
+		assert.Equal(t, "orders", name)
+		assert.Equal(t, cmd.Process.Pid, pid)
+		assert.Equal(t, 2, processes)
+		assert.Greater(t, memoryBytes, int64(0))
+		assert.Greater(t, openFDs, 0)
+		assert.GreaterOrEqual(t, threads, processes)
+		// Only the second sample has a previous one to work out the CPU used since.
+		assert.Equal(t, count == 1, hasCPUPercent)
+		count++
+	}
+	assert.Equal(t, 2, count)
+}
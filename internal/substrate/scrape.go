@@ -0,0 +1,182 @@
+/*
+ * Copyright (c) 2023 Asim Ihsan.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ * SPDX-License-Identifier: MPL-2.0
+ */
+
+package substrate
+
+import (
+	"fmt"
+	"github.com/asimihsan/virtual-cluster/internal/parser"
+	"github.com/asimihsan/virtual-cluster/internal/scrape"
+	"github.com/labstack/echo/v4"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// The scraped metrics are queried with the HTTP API of Prometheus under PrometheusBasePath, so that the Prometheus
+// data source of Grafana can chart them. Queries are vector selectors, such as up{job="orders"}, rather than PromQL.
+const PrometheusBasePath = "/prometheus"
+
+// defaultQueryStep is the step of a range query that does not give one.
+const defaultQueryStep = 15 * time.Second
+
+// startScraper scrapes the metrics endpoint of a service that has a metrics block until the manager closes.
+func (m *Manager) startScraper(service parser.VClusterServiceDefinitionAST) {
+	port := service.ServicePort
+	if service.Metrics.Port != nil {
+		port = service.Metrics.Port
+	}
+	url := fmt.Sprintf("http://localhost:%d%s", *port, service.Metrics.Path)
+	log.Printf("Scraping metrics of %s from %s every %s", service.Name, url, service.Metrics.Interval)
+
+	stop := make(chan struct{}, 1)
+	m.stopChans = append(m.stopChans, stop)
+	go scrape.NewScraper(m.db, service.Name, url, service.Metrics.Interval).Run(stop)
+}
+
+// promResponse is the envelope of every response of the Prometheus HTTP API:
+// https://prometheus.io/docs/prometheus/latest/querying/api/.
+type promResponse struct {
+	Status    string      `json:"status"`
+	Data      interface{} `json:"data,omitempty"`
+	ErrorType string      `json:"errorType,omitempty"`
+	Error     string      `json:"error,omitempty"`
+}
+
+type promData struct {
+	ResultType string       `json:"resultType"`
+	Result     []promSeries `json:"result"`
+}
+
+type promSeries struct {
+	Metric map[string]string `json:"metric"`
+	Value  []interface{}     `json:"value,omitempty"`
+	Values [][]interface{}   `json:"values,omitempty"`
+}
+
+func promPoint(point scrape.Point) []interface{} {
+	return []interface{}{float64(point.Time.UnixMilli()) / 1000, scrape.FormatValue(point.Value)}
+}
+
+func promError(c echo.Context, format string, args ...interface{}) error {
+	return c.JSON(http.StatusBadRequest, promResponse{Status: "error", ErrorType: "bad_data", Error: fmt.Sprintf(format, args...)})
+}
+
+// parsePromTime parses a time as the Prometheus HTTP API takes it, in RFC 3339 or in Unix seconds, or returns
+// fallback if there is none.
+func parsePromTime(value string, fallback time.Time) (time.Time, error) {
+	if value == "" {
+		return fallback, nil
+	}
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		whole, fraction := math.Modf(seconds)
+		return time.Unix(int64(whole), int64(math.Round(fraction*1000))*int64(time.Millisecond)), nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("cannot parse %q to a valid timestamp", value)
+}
+
+// parsePromDuration parses a step as the Prometheus HTTP API takes it, as a duration such as 15s or in seconds.
+func parsePromDuration(value string) (time.Duration, error) {
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		return time.Duration(seconds * float64(time.Second)), nil
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return d, nil
+	}
+	return 0, fmt.Errorf("cannot parse %q to a valid duration", value)
+}
+
+// handleMetricsQuery answers an instant query, a selector of series at a time, with a vector.
+func (m *Manager) handleMetricsQuery(c echo.Context) error {
+	selector, err := scrape.ParseSelector(c.QueryParam("query"))
+	if err != nil {
+		return promError(c, "invalid parameter \"query\": %v", err)
+	}
+	at, err := parsePromTime(c.QueryParam("time"), time.Now())
+	if err != nil {
+		return promError(c, "invalid parameter \"time\": %v", err)
+	}
+
+	series, err := scrape.Instant(m.db, selector, at)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	result := make([]promSeries, 0, len(series))
+	for _, s := range series {
+		result = append(result, promSeries{Metric: s.Labels, Value: promPoint(s.Samples[len(s.Samples)-1])})
+	}
+	return c.JSON(http.StatusOK, promResponse{Status: "success", Data: promData{ResultType: "vector", Result: result}})
+}
+
+// handleMetricsQueryRange answers a range query, a selector of series at every step from start to end, with a
+// matrix.
+func (m *Manager) handleMetricsQueryRange(c echo.Context) error {
+	selector, err := scrape.ParseSelector(c.QueryParam("query"))
+	if err != nil {
+		return promError(c, "invalid parameter \"query\": %v", err)
+	}
+	end, err := parsePromTime(c.QueryParam("end"), time.Now())
+	if err != nil {
+		return promError(c, "invalid parameter \"end\": %v", err)
+	}
+	start, err := parsePromTime(c.QueryParam("start"), end.Add(-time.Hour))
+	if err != nil {
+		return promError(c, "invalid parameter \"start\": %v", err)
+	}
+	step := defaultQueryStep
+	if value := c.QueryParam("step"); value != "" {
+		if step, err = parsePromDuration(value); err != nil {
+			return promError(c, "invalid parameter \"step\": %v", err)
+		}
+	}
+
+	series, err := scrape.Range(m.db, selector, start, end, step)
+	if err != nil {
+		return promError(c, "%v", err)
+	}
+	result := make([]promSeries, 0, len(series))
+	for _, s := range series {
+		values := make([][]interface{}, 0, len(s.Samples))
+		for _, point := range s.Samples {
+			values = append(values, promPoint(point))
+		}
+		result = append(result, promSeries{Metric: s.Labels, Values: values})
+	}
+	return c.JSON(http.StatusOK, promResponse{Status: "success", Data: promData{ResultType: "matrix", Result: result}})
+}
+
+// handleMetricsNames lists the names of the scraped metrics, as the label values API of Prometheus does for
+// __name__, so that a query editor can complete them.
+func (m *Manager) handleMetricsNames(c echo.Context) error {
+	rows, err := m.db.Query(`SELECT DISTINCT name FROM metric_series`)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	defer rows.Close()
+	names := make([]string, 0)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+		names = append(names, name)
+	}
+	if err := rows.Err(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	sort.Strings(names)
+	return c.JSON(http.StatusOK, promResponse{Status: "success", Data: names})
+}
@@ -0,0 +1,88 @@
+/*
+ * Copyright (c) 2023 Asim Ihsan.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ * SPDX-License-Identifier: MPL-2.0
+ */
+
+package substrate
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrometheusAPI(t *testing.T) {
+	m, err := NewManager(filepath.Join(t.TempDir(), "vcluster.db"), WithHTTPPort(0), WithOTLPPort(0))
+	assert.NoError(t, err)
+	defer m.Close()
+
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	_, err = m.db.Exec(`
+		INSERT INTO metric_series (id, service_name, name, labels, type, help) VALUES
+			(1, 'orders', 'up', '{}', 'gauge', ''),
+			(2, 'orders', 'http_requests_total', '{"code":"200"}', 'counter', ''),
+			(3, 'orders', 'http_requests_total', '{"code":"500"}', 'counter', '')`)
+	assert.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		at := start.Add(time.Duration(i) * 15 * time.Second).UnixMilli()
+		_, err := m.db.Exec(`INSERT INTO metric_samples (series_id, timestamp_ms, value) VALUES (1, ?, 1), (2, ?, ?), (3, ?, 1)`,
+			at, at, 10*(i+1), at)
+		assert.NoError(t, err)
+	}
+
+	get := func(handler echo.HandlerFunc, target string) (int, promResponse) {
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, target, nil), rec)
+		assert.NoError(t, handler(c))
+		var response promResponse
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &response))
+		return rec.Code, response
+	}
+
+	code, response := get(m.handleMetricsQuery, `/?query=http_requests_total{code="200"}&time=1672531230`)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, map[string]interface{}{
+		"resultType": "vector",
+		"result": []interface{}{map[string]interface{}{
+			"metric": map[string]interface{}{"__name__": "http_requests_total", "job": "orders", "code": "200"},
+			"value":  []interface{}{1672531230.0, "30"},
+		}},
+	}, response.Data)
+
+	code, response = get(m.handleMetricsQueryRange, `/?query={__name__="http_requests_total",code=~"2.."}&start=2023-01-01T00:00:00Z&end=2023-01-01T00:00:30Z&step=10s`)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, map[string]interface{}{
+		"resultType": "matrix",
+		"result": []interface{}{map[string]interface{}{
+			"metric": map[string]interface{}{"__name__": "http_requests_total", "job": "orders", "code": "200"},
+			"values": []interface{}{
+				[]interface{}{1672531200.0, "10"},
+				[]interface{}{1672531210.0, "10"},
+				[]interface{}{1672531220.0, "20"},
+				[]interface{}{1672531230.0, "30"},
+			},
+		}},
+	}, response.Data)
+
+	_, response = get(m.handleMetricsNames, "/")
+	assert.Equal(t, []interface{}{"http_requests_total", "up"}, response.Data)
+
+	code, response = get(m.handleMetricsQuery, `/?query={code="200"`)
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Equal(t, "error", response.Status)
+	assert.Equal(t, "bad_data", response.ErrorType)
+
+	code, _ = get(m.handleMetricsQueryRange, `/?query=up&start=1672531230&end=1672531200`)
+	assert.Equal(t, http.StatusBadRequest, code)
+}
@@ -0,0 +1,228 @@
+/*
+ * Copyright (c) 2023 Asim Ihsan.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ * SPDX-License-Identifier: MPL-2.0
+ */
+
+package substrate
+
+import (
+	"database/sql"
+	"github.com/asimihsan/virtual-cluster/internal/tracing"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"sort"
+)
+
+// Trace returns the HTTP exchanges, Kafka messages, log lines and exported spans of a trace in the order they
+// happened. Each is a map shaped like the websocket message for it, except that an HTTP exchange has type
+// http_exchange and holds its request and, once there is one, its response.
+func (m *Manager) Trace(traceID string) ([]map[string]interface{}, error) {
+	var events []map[string]interface{}
+
+	exchanges, err := m.traceHTTPExchanges(traceID)
+	if err != nil {
+		return nil, err
+	}
+	events = append(events, exchanges...)
+
+	rows, err := m.db.Query(`
+		SELECT id, timestamp, broker_name, topic_name, message_key, message_value, COALESCE(headers, ''), COALESCE(span_id, '')
+		FROM kafka_messages WHERE trace_id = ?`, traceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		var timestamp, brokerName, topicName, messageKey, messageValue, headers, spanID string
+		if err := rows.Scan(&id, &timestamp, &brokerName, &topicName, &messageKey, &messageValue, &headers, &spanID); err != nil {
+			return nil, err
+		}
+		events = append(events, map[string]interface{}{
+			"id":            id,
+			"type":          "kafka_message",
+			"timestamp":     timestamp,
+			"broker_name":   brokerName,
+			"topic_name":    topicName,
+			"message_key":   messageKey,
+			"message_value": messageValue,
+			"headers":       headers,
+			"trace_id":      traceID,
+			"span_id":       spanID,
+		})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = m.db.Query(`
+		SELECT id, timestamp, process_name, output_type, content, COALESCE(span_id, ''), COALESCE(level, ''),
+			COALESCE(message, ''), COALESCE(logger, ''), COALESCE(fields, '')
+		FROM logs WHERE trace_id = ?`, traceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		var timestamp, processName, outputType, content, spanID, level, message, logger, fields string
+		if err := rows.Scan(&id, &timestamp, &processName, &outputType, &content, &spanID, &level, &message, &logger,
+			&fields); err != nil {
+			return nil, err
+		}
+		events = append(events, map[string]interface{}{
+			"id":           id,
+			"type":         "log",
+			"timestamp":    timestamp,
+			"process_name": processName,
+			"output_type":  outputType,
+			"content":      m.prepareLogContent(content),
+			"trace_id":     traceID,
+			"span_id":      spanID,
+			"level":        level,
+			"message":      message,
+			"logger":       logger,
+			"fields":       fields,
+		})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = m.db.Query(`
+		SELECT id, timestamp, service_name, span_id, COALESCE(parent_span_id, ''), name, kind, duration_ms, status_code,
+			COALESCE(status_message, ''), attributes
+		FROM otel_spans WHERE trace_id = ?`, traceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		var timestamp, serviceName, spanID, parentSpanID, name, kind, statusCode, statusMessage, attributes string
+		var durationMs float64
+		if err := rows.Scan(&id, &timestamp, &serviceName, &spanID, &parentSpanID, &name, &kind, &durationMs, &statusCode,
+			&statusMessage, &attributes); err != nil {
+			return nil, err
+		}
+		events = append(events, map[string]interface{}{
+			"id":             id,
+			"type":           "span",
+			"timestamp":      timestamp,
+			"service_name":   serviceName,
+			"trace_id":       traceID,
+			"span_id":        spanID,
+			"parent_span_id": parentSpanID,
+			"name":           name,
+			"kind":           kind,
+			"duration_ms":    durationMs,
+			"status_code":    statusCode,
+			"status_message": statusMessage,
+			"attributes":     attributes,
+		})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Timestamps are all stored in the same format, so they sort as strings.
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i]["timestamp"].(string) < events[j]["timestamp"].(string)
+	})
+	if events == nil {
+		events = []map[string]interface{}{}
+	}
+	return events, nil
+}
+
+// traceHTTPExchanges returns the HTTP exchanges of a trace, in the order the requests were recorded.
+func (m *Manager) traceHTTPExchanges(traceID string) ([]map[string]interface{}, error) {
+	rows, err := m.db.Query(`
+		SELECT id, timestamp, process_name, method, url, headers, body, `+bodyMetadata+`, COALESCE(faults, ''),
+			COALESCE(remote_addr, ''), COALESCE(caller, ''), COALESCE(span_id, ''), COALESCE(parent_span_id, '')
+		FROM http_requests WHERE trace_id = ? ORDER BY id`, traceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var exchanges []map[string]interface{}
+	var requestIDs []int
+	for rows.Next() {
+		var id int
+		var timestamp, processName, method, url, headers, faults, remoteAddr, caller, spanID, parentSpanID string
+		var body capturedBody
+		dest := append([]interface{}{&id, &timestamp, &processName, &method, &url, &headers, &body.data}, body.scanArgs()...)
+		if err := rows.Scan(append(dest, &faults, &remoteAddr, &caller, &spanID, &parentSpanID)...); err != nil {
+			return nil, err
+		}
+		exchanges = append(exchanges, map[string]interface{}{
+			"type":           "http_exchange",
+			"timestamp":      timestamp,
+			"process_name":   processName,
+			"caller":         caller,
+			"trace_id":       traceID,
+			"span_id":        spanID,
+			"parent_span_id": parentSpanID,
+			"request": body.addTo(map[string]interface{}{
+				"id":          id,
+				"timestamp":   timestamp,
+				"method":      method,
+				"url":         url,
+				"headers":     headers,
+				"faults":      faults,
+				"remote_addr": remoteAddr,
+			}),
+			"response": nil,
+		})
+		requestIDs = append(requestIDs, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	for i, requestID := range requestIDs {
+		var id, statusCode int
+		var timestamp, headers string
+		var body capturedBody
+		var durationMs sql.NullFloat64
+		var upstreamError sql.NullString
+		dest := append([]interface{}{&id, &timestamp, &statusCode, &headers, &body.data}, body.scanArgs()...)
+		err := m.db.QueryRow("SELECT id, timestamp, status_code, headers, body, "+bodyMetadata+", duration_ms, upstream_error FROM http_responses WHERE http_request_id = ?", requestID).
+			Scan(append(dest, &durationMs, &upstreamError)...)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		exchanges[i]["response"] = body.addTo(map[string]interface{}{
+			"id":             id,
+			"timestamp":      timestamp,
+			"status_code":    statusCode,
+			"headers":        headers,
+			"duration_ms":    durationMs.Float64,
+			"upstream_error": upstreamError.String,
+		})
+	}
+	return exchanges, nil
+}
+
+// handleGetTrace returns the HTTP exchanges, Kafka messages, log lines and spans of the trace trace_id in time order.
+func (m *Manager) handleGetTrace(c echo.Context) error {
+	traceID, ok := tracing.ParseTraceID(c.Param("trace_id"))
+	if !ok {
+		return echo.NewHTTPError(http.StatusBadRequest, "trace_id must be 32 hex digits")
+	}
+	events, err := m.Trace(traceID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	return c.JSON(http.StatusOK, events)
+}
@@ -0,0 +1,70 @@
+/*
+ * Copyright (c) 2023 Asim Ihsan.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ * SPDX-License-Identifier: MPL-2.0
+ */
+
+package substrate
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTrace(t *testing.T) {
+	m, err := NewManager(filepath.Join(t.TempDir(), "vcluster.db"), WithHTTPPort(0))
+	assert.NoError(t, err)
+	defer m.Close()
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	res, err := m.db.Exec(`INSERT INTO http_requests (timestamp, process_name, method, url, headers, body, trace_id, span_id, caller)
+		VALUES ('2023-01-01T00:00:00.000Z', 'orders', 'POST', '/orders', '{}', '{}', ?, '00f067aa0ba902b7', 'frontend')`, traceID)
+	assert.NoError(t, err)
+	requestID, _ := res.LastInsertId()
+	_, err = m.db.Exec(`INSERT INTO http_responses (timestamp, http_request_id, process_name, status_code, headers, body, duration_ms)
+		VALUES ('2023-01-01T00:00:00.050Z', ?, 'orders', 201, '{}', '', 50)`, requestID)
+	assert.NoError(t, err)
+	_, err = m.db.Exec(`INSERT INTO http_requests (timestamp, process_name, method, url, headers, body, trace_id)
+		VALUES ('2023-01-01T00:00:00.030Z', 'payments', 'POST', '/charges', '{}', '', ?)`, traceID)
+	assert.NoError(t, err)
+	_, err = m.db.Exec(`INSERT INTO kafka_messages (timestamp, broker_name, topic_name, message_key, message_value, trace_id)
+		VALUES ('2023-01-01T00:00:00.040Z', 'kafka', 'orders', 'o1', '{}', ?)`, traceID)
+	assert.NoError(t, err)
+	assert.NoError(t, insertLog(m.db, "orders", "stdout",
+		`{"msg":"accepted","trace_id":"`+traceID+`","span_id":"00f067aa0ba902b7"}`))
+	_, err = m.db.Exec("UPDATE logs SET timestamp = '2023-01-01T00:00:00.010Z'")
+	assert.NoError(t, err)
+	_, err = m.db.Exec(`INSERT INTO otel_spans (timestamp, service_name, trace_id, span_id, name, kind, duration_ms, status_code, attributes)
+		VALUES ('2023-01-01T00:00:00.020Z', 'orders', ?, 'b7ad6b7169203331', 'charge', 'client', 5, 'unset', '{}')`, traceID)
+	assert.NoError(t, err)
+
+	// Nothing outside the trace is returned.
+	_, err = m.db.Exec(`INSERT INTO http_requests (process_name, method, url, headers, body, trace_id)
+		VALUES ('orders', 'GET', '/', '{}', '', '0af7651916cd43dd8448eb211c80319c')`)
+	assert.NoError(t, err)
+	assert.NoError(t, insertLog(m.db, "orders", "stdout", "listening"))
+
+	events, err := m.Trace(traceID)
+	assert.NoError(t, err)
+	var types []string
+	for _, event := range events {
+		types = append(types, event["type"].(string))
+	}
+	assert.Equal(t, []string{"http_exchange", "log", "span", "http_exchange", "kafka_message"}, types)
+
+	assert.Equal(t, "frontend", events[0]["caller"])
+	assert.Equal(t, 201, events[0]["response"].(map[string]interface{})["status_code"])
+	assert.Equal(t, "00f067aa0ba902b7", events[1]["span_id"])
+	assert.Equal(t, "charge", events[2]["name"])
+	assert.Nil(t, events[3]["response"])
+
+	events, err = m.Trace("0000000000000000a3ce929d0e0e4736")
+	assert.NoError(t, err)
+	assert.Empty(t, events)
+}
@@ -0,0 +1,186 @@
+/*
+ * Copyright (c) 2023 Asim Ihsan.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ * SPDX-License-Identifier: MPL-2.0
+ */
+
+// Package tracing reads and writes the W3C trace context that correlates captured HTTP exchanges, Kafka messages and
+// log lines.
+package tracing
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// TraceparentHeader is the W3C trace context header, https://www.w3.org/TR/trace-context/.
+const TraceparentHeader = "traceparent"
+
+// TraceContext identifies a span of a trace. TraceID is 32 and SpanID and ParentSpanID 16 lowercase hex digits.
+type TraceContext struct {
+	TraceID      string
+	SpanID       string
+	ParentSpanID string
+	Flags        byte
+}
+
+const sampled = 0x01
+
+// New starts a trace, with a sampled root span.
+func New() TraceContext {
+	return TraceContext{TraceID: randomHex(16), SpanID: randomHex(8), Flags: sampled}
+}
+
+// Child starts a span within the trace, whose parent is t.
+func (t TraceContext) Child() TraceContext {
+	return TraceContext{TraceID: t.TraceID, SpanID: randomHex(8), ParentSpanID: t.SpanID, Flags: t.Flags}
+}
+
+// Traceparent is the traceparent header value that makes t the parent of the receiver's span.
+func (t TraceContext) Traceparent() string {
+	return fmt.Sprintf("00-%s-%s-%02x", t.TraceID, t.SpanID, t.Flags)
+}
+
+// Parse reads a traceparent header value, whose parent-id becomes SpanID. Versions after 00 are read as 00, as the
+// specification asks.
+func Parse(traceparent string) (TraceContext, bool) {
+	parts := strings.Split(strings.TrimSpace(traceparent), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return TraceContext{}, false
+	}
+	if _, err := hex.DecodeString(parts[0]); err != nil {
+		return TraceContext{}, false
+	}
+	traceID, ok := validID(parts[1], 16)
+	if !ok {
+		return TraceContext{}, false
+	}
+	spanID, ok := validID(parts[2], 8)
+	if !ok {
+		return TraceContext{}, false
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil || len(flags) != 1 {
+		return TraceContext{}, false
+	}
+	return TraceContext{TraceID: traceID, SpanID: spanID, Flags: flags[0]}, true
+}
+
+// FromHeaders reads the trace context of a message from its headers: traceparent, or else the B3 headers of Zipkin
+// instrumentation. Header names are matched without regard to case.
+func FromHeaders(headers map[string]string) (TraceContext, bool) {
+	lower := make(map[string]string, len(headers))
+	for key, value := range headers {
+		lower[strings.ToLower(key)] = value
+	}
+	if t, ok := Parse(lower[TraceparentHeader]); ok {
+		return t, true
+	}
+	// b3: {TraceId}-{SpanId}[-{SamplingState}[-{ParentSpanId}]]
+	if b3 := strings.Split(lower["b3"], "-"); len(b3) >= 2 {
+		return fromIDs(b3[0], b3[1])
+	}
+	return fromIDs(lower["x-b3-traceid"], lower["x-b3-spanid"])
+}
+
+// traceIDKeys and spanIDKeys are the fields logging libraries and their OpenTelemetry bridges write trace ids to.
+var (
+	traceIDKeys = []string{"trace_id", "traceId", "traceID", "trace.id", "otelTraceID", "TraceId"}
+	spanIDKeys  = []string{"span_id", "spanId", "spanID", "span.id", "otelSpanID", "SpanId"}
+)
+
+// FromJSON reads the trace and span ids of a JSON log line, from its top-level trace id fields or a traceparent
+// field. It returns false if the line is not a JSON object or has no valid trace id.
+func FromJSON(line []byte) (TraceContext, bool) {
+	var fields map[string]interface{}
+	if err := json.Unmarshal(line, &fields); err != nil {
+		return TraceContext{}, false
+	}
+	return FromFields(fields)
+}
+
+// FromFields reads the trace and span ids of a structured log record, as FromJSON does.
+func FromFields(fields map[string]interface{}) (TraceContext, bool) {
+	if traceparent, ok := fields[TraceparentHeader].(string); ok {
+		if t, ok := Parse(traceparent); ok {
+			return t, true
+		}
+	}
+	var traceID, spanID string
+	for _, key := range traceIDKeys {
+		if value, ok := fields[key].(string); ok {
+			traceID = value
+			break
+		}
+	}
+	for _, key := range spanIDKeys {
+		if value, ok := fields[key].(string); ok {
+			spanID = value
+			break
+		}
+	}
+	return fromIDs(traceID, spanID)
+}
+
+// IsContextField returns whether a field of a structured log record is one FromFields reads the trace context from.
+func IsContextField(key string) bool {
+	if key == TraceparentHeader {
+		return true
+	}
+	for _, keys := range [][]string{traceIDKeys, spanIDKeys} {
+		for _, k := range keys {
+			if key == k {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ParseTraceID returns a trace id in lowercase, as it is stored. 64-bit trace ids, as Jaeger and B3 allow, are padded
+// to 128 bits.
+func ParseTraceID(traceID string) (string, bool) {
+	traceID = strings.TrimSpace(traceID)
+	if len(traceID) == 16 {
+		traceID = strings.Repeat("0", 16) + traceID
+	}
+	return validID(traceID, 16)
+}
+
+// fromIDs validates a trace id and an optional span id.
+func fromIDs(traceID string, spanID string) (TraceContext, bool) {
+	traceID, ok := ParseTraceID(traceID)
+	if !ok {
+		return TraceContext{}, false
+	}
+	t := TraceContext{TraceID: traceID, Flags: sampled}
+	if spanID, ok := validID(strings.TrimSpace(spanID), 8); ok {
+		t.SpanID = spanID
+	}
+	return t, true
+}
+
+// validID returns id in lowercase if it is the hex encoding of size bytes that are not all zero.
+func validID(id string, size int) (string, bool) {
+	if len(id) != size*2 {
+		return "", false
+	}
+	id = strings.ToLower(id)
+	if _, err := hex.DecodeString(id); err != nil || strings.Trim(id, "0") == "" {
+		return "", false
+	}
+	return id, true
+}
+
+func randomHex(size int) string {
+	b := make([]byte, size)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
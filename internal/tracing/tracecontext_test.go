@@ -0,0 +1,148 @@
+/*
+ * Copyright (c) 2023 Asim Ihsan.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ * SPDX-License-Identifier: MPL-2.0
+ */
+
+package tracing
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name        string
+		traceparent string
+		want        TraceContext
+		wantOK      bool
+	}{
+		{
+			name:        "sampled",
+			traceparent: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+			want:        TraceContext{TraceID: "4bf92f3577b34da6a3ce929d0e0e4736", SpanID: "00f067aa0ba902b7", Flags: 1},
+			wantOK:      true,
+		},
+		{
+			name:        "upper case is accepted",
+			traceparent: "00-4BF92F3577B34DA6A3CE929D0E0E4736-00F067AA0BA902B7-00",
+			want:        TraceContext{TraceID: "4bf92f3577b34da6a3ce929d0e0e4736", SpanID: "00f067aa0ba902b7"},
+			wantOK:      true,
+		},
+		{
+			name:        "later version with more fields",
+			traceparent: "01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+			want:        TraceContext{TraceID: "4bf92f3577b34da6a3ce929d0e0e4736", SpanID: "00f067aa0ba902b7", Flags: 1},
+			wantOK:      true,
+		},
+		{name: "all zero trace id", traceparent: "00-00000000000000000000000000000000-00f067aa0ba902b7-01"},
+		{name: "all zero span id", traceparent: "00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01"},
+		{name: "invalid version", traceparent: "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"},
+		{name: "short trace id", traceparent: "00-4bf92f3577b34da6-00f067aa0ba902b7-01"},
+		{name: "empty", traceparent: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := Parse(tt.traceparent)
+			assert.Equal(t, tt.wantOK, ok)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestChild(t *testing.T) {
+	root := New()
+	child := root.Child()
+	assert.Equal(t, root.TraceID, child.TraceID)
+	assert.Equal(t, root.SpanID, child.ParentSpanID)
+	assert.NotEqual(t, root.SpanID, child.SpanID)
+
+	parsed, ok := Parse(child.Traceparent())
+	assert.True(t, ok)
+	assert.Equal(t, TraceContext{TraceID: child.TraceID, SpanID: child.SpanID, Flags: 1}, parsed)
+}
+
+func TestFromHeaders(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers map[string]string
+		want    TraceContext
+		wantOK  bool
+	}{
+		{
+			name:    "traceparent",
+			headers: map[string]string{"Traceparent": "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"},
+			want:    TraceContext{TraceID: "4bf92f3577b34da6a3ce929d0e0e4736", SpanID: "00f067aa0ba902b7", Flags: 1},
+			wantOK:  true,
+		},
+		{
+			name:    "b3 single header with a 64-bit trace id",
+			headers: map[string]string{"b3": "a3ce929d0e0e4736-00f067aa0ba902b7-1"},
+			want:    TraceContext{TraceID: "0000000000000000a3ce929d0e0e4736", SpanID: "00f067aa0ba902b7", Flags: 1},
+			wantOK:  true,
+		},
+		{
+			name: "b3 multiple headers",
+			headers: map[string]string{
+				"X-B3-TraceId": "4bf92f3577b34da6a3ce929d0e0e4736",
+				"X-B3-SpanId":  "00f067aa0ba902b7",
+			},
+			want:   TraceContext{TraceID: "4bf92f3577b34da6a3ce929d0e0e4736", SpanID: "00f067aa0ba902b7", Flags: 1},
+			wantOK: true,
+		},
+		{name: "none", headers: map[string]string{"content-type": "application/json"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := FromHeaders(tt.headers)
+			assert.Equal(t, tt.wantOK, ok)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestFromJSON(t *testing.T) {
+	tests := []struct {
+		name   string
+		line   string
+		want   TraceContext
+		wantOK bool
+	}{
+		{
+			name:   "snake case",
+			line:   `{"level":"info","msg":"charged","trace_id":"4bf92f3577b34da6a3ce929d0e0e4736","span_id":"00f067aa0ba902b7"}`,
+			want:   TraceContext{TraceID: "4bf92f3577b34da6a3ce929d0e0e4736", SpanID: "00f067aa0ba902b7", Flags: 1},
+			wantOK: true,
+		},
+		{
+			name:   "camel case without a span",
+			line:   `{"message":"charged","traceId":"4BF92F3577B34DA6A3CE929D0E0E4736"}`,
+			want:   TraceContext{TraceID: "4bf92f3577b34da6a3ce929d0e0e4736", Flags: 1},
+			wantOK: true,
+		},
+		{
+			name:   "traceparent",
+			line:   `{"msg":"charged","traceparent":"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"}`,
+			want:   TraceContext{TraceID: "4bf92f3577b34da6a3ce929d0e0e4736", SpanID: "00f067aa0ba902b7", Flags: 1},
+			wantOK: true,
+		},
+		{name: "not a trace id", line: `{"trace_id":"abc"}`},
+		{name: "not JSON", line: `charged trace_id=4bf92f3577b34da6a3ce929d0e0e4736`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := FromJSON([]byte(tt.line))
+			assert.Equal(t, tt.wantOK, ok)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
@@ -0,0 +1,69 @@
+/*
+ * Copyright (c) 2023 Asim Ihsan.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ * SPDX-License-Identifier: MPL-2.0
+ */
+
+package utils
+
+import (
+	"context"
+	"fmt"
+	"github.com/docker/docker/client"
+	"github.com/pkg/errors"
+	"time"
+)
+
+// ContainerWaiter waits until a Docker container is ready. Containers with a docker healthcheck must report
+// healthy, other containers only need to be running.
+type ContainerWaiter struct {
+	BaseWaiter
+	containerName string
+}
+
+func NewContainerWaiter(containerName string, opts ...WaiterOption) *ContainerWaiter {
+	cw := &ContainerWaiter{
+		BaseWaiter: BaseWaiter{
+			interval: 1 * time.Second,
+			timeout:  60 * time.Second,
+		},
+		containerName: containerName,
+	}
+
+	for _, opt := range opts {
+		opt(&cw.BaseWaiter)
+	}
+
+	return cw
+}
+
+func (cw *ContainerWaiter) Wait() error {
+	return cw.BaseWaiter.Wait(cw)
+}
+
+func (cw *ContainerWaiter) CheckHealth() (bool, error) {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return false, errors.Wrap(err, "failed to create docker client")
+	}
+	defer cli.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), cw.interval)
+	defer cancel()
+
+	container, err := cli.ContainerInspect(ctx, cw.containerName)
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to inspect container: %s", cw.containerName)
+	}
+	if container.State == nil || !container.State.Running {
+		return false, fmt.Errorf("container is not running: %s", cw.containerName)
+	}
+	if container.State.Health != nil && container.State.Health.Status != "healthy" {
+		return false, fmt.Errorf("container is %s: %s", container.State.Health.Status, cw.containerName)
+	}
+	return true, nil
+}
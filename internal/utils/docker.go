@@ -0,0 +1,113 @@
+/*
+ * Copyright (c) 2023 Asim Ihsan.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ * SPDX-License-Identifier: MPL-2.0
+ */
+
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	"github.com/pkg/errors"
+	"time"
+)
+
+func CleanupContainers(containerName string) error {
+	ctx := context.Background()
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return errors.Wrap(err, "failed to create docker client")
+	}
+
+	containers, err := cli.ContainerList(ctx, types.ContainerListOptions{All: true})
+	if err != nil {
+		return errors.Wrap(err, "failed to list containers")
+	}
+
+	for _, container := range containers {
+		if container.Names[0] == "/"+containerName {
+			fmt.Printf("Removing container %s\n", container.ID)
+			err := cli.ContainerRemove(ctx, container.ID, types.ContainerRemoveOptions{Force: true})
+			if err != nil {
+				return errors.Wrap(err, "failed to remove container "+container.ID)
+			}
+		}
+	}
+
+	return nil
+}
+
+func CleanupNetworks(networkName string) error {
+	ctx := context.Background()
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return errors.Wrap(err, "failed to create docker client")
+	}
+
+	networks, err := cli.NetworkList(ctx, types.NetworkListOptions{})
+	if err != nil {
+		return errors.Wrap(err, "failed to list networks")
+	}
+
+	for _, network := range networks {
+		if network.Name == networkName {
+			fmt.Printf("Removing network %s\n", network.ID)
+			err := cli.NetworkRemove(ctx, network.ID)
+			if err != nil {
+				return errors.Wrap(err, "failed to remove network "+network.ID)
+			}
+		}
+	}
+
+	return nil
+}
+
+// ContainerUsage is what a running container uses, as docker stats reports it.
+type ContainerUsage struct {
+	// CPUTime is the CPU time the container has used since it started.
+	CPUTime time.Duration
+
+	// MemoryBytes is the memory the container uses, leaving out the page cache it could give back, as docker stats
+	// does, and MemoryLimitBytes what it may use.
+	MemoryBytes      int64
+	MemoryLimitBytes int64
+
+	// Pids counts the processes and threads in the container.
+	Pids int
+}
+
+// ContainerStats samples what the container named containerName uses.
+func ContainerStats(ctx context.Context, cli *client.Client, containerName string) (ContainerUsage, error) {
+	resp, err := cli.ContainerStatsOneShot(ctx, containerName)
+	if err != nil {
+		return ContainerUsage{}, errors.Wrap(err, "failed to get container stats")
+	}
+	defer resp.Body.Close()
+
+	var stats types.StatsJSON
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		return ContainerUsage{}, errors.Wrap(err, "failed to decode container stats")
+	}
+	memory := int64(stats.MemoryStats.Usage)
+	// cgroup v2 reports inactive_file, and cgroup v1 total_inactive_file.
+	for _, key := range []string{"inactive_file", "total_inactive_file"} {
+		if inactive, ok := stats.MemoryStats.Stats[key]; ok && int64(inactive) < memory {
+			memory -= int64(inactive)
+			break
+		}
+	}
+	return ContainerUsage{
+		CPUTime:          time.Duration(stats.CPUStats.CPUUsage.TotalUsage),
+		MemoryBytes:      memory,
+		MemoryLimitBytes: int64(stats.MemoryStats.Limit),
+		Pids:             int(stats.PidsStats.Current),
+	}, nil
+}
@@ -0,0 +1,52 @@
+/*
+ * Copyright (c) 2023 Asim Ihsan.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ * SPDX-License-Identifier: MPL-2.0
+ */
+
+package utils
+
+import (
+	"net/http"
+	"time"
+)
+
+// HTTPWaiter waits until a GET request to an endpoint returns 200 OK.
+type HTTPWaiter struct {
+	BaseWaiter
+	endpoint string
+}
+
+func NewHTTPWaiter(endpoint string, opts ...WaiterOption) *HTTPWaiter {
+	hw := &HTTPWaiter{
+		BaseWaiter: BaseWaiter{
+			interval: 1 * time.Second,
+			timeout:  10 * time.Second,
+		},
+		endpoint: endpoint,
+	}
+
+	for _, opt := range opts {
+		opt(&hw.BaseWaiter)
+	}
+
+	return hw
+}
+
+func (hw *HTTPWaiter) Wait() error {
+	return hw.BaseWaiter.Wait(hw)
+}
+
+func (hw *HTTPWaiter) CheckHealth() (bool, error) {
+	resp, err := http.Get(hw.endpoint)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	return resp.StatusCode == http.StatusOK, nil
+}
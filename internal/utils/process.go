@@ -0,0 +1,30 @@
+/*
+ * Copyright (c) 2023 Asim Ihsan.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ * SPDX-License-Identifier: MPL-2.0
+ */
+
+package utils
+
+import (
+	"time"
+)
+
+// ProcessUsage is what a process, or a tree of processes, uses.
+type ProcessUsage struct {
+	// Processes is how many processes the usage is of.
+	Processes int
+
+	// CPUTime is the user and system CPU time the processes have used since they started.
+	CPUTime time.Duration
+
+	// RSSBytes is the memory resident for the processes, counting memory they share once for each.
+	RSSBytes int64
+
+	OpenFDs int
+	Threads int
+}
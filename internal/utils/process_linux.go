@@ -0,0 +1,217 @@
+//go:build linux
+
+/*
+ * Copyright (c) 2023 Asim Ihsan.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ * SPDX-License-Identifier: MPL-2.0
+ */
+
+package utils
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// clockTicks is USER_HZ, the unit of CPU times in /proc, which is 100 on every architecture Linux supports.
+const clockTicks = 100
+
+// PeerPID returns the local process that owns the other end of a TCP connection. It finds the peer socket in
+// /proc/net/tcp and then the process that has it open, so it only sees processes of the same user.
+func PeerPID(conn net.Conn) (int, error) {
+	local, ok := conn.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		return 0, fmt.Errorf("not a TCP connection")
+	}
+	remote, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return 0, fmt.Errorf("not a TCP connection")
+	}
+
+	// The peer socket has our remote address as its local address and vice versa.
+	inode, err := socketInode(remote.Port, local.Port)
+	if err != nil {
+		return 0, err
+	}
+	return pidForSocketInode(inode)
+}
+
+func socketInode(localPort int, remotePort int) (string, error) {
+	for _, table := range []string{"/proc/net/tcp", "/proc/net/tcp6"} {
+		file, err := os.Open(table)
+		if err != nil {
+			continue
+		}
+		scanner := bufio.NewScanner(file)
+		scanner.Scan() // header
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) < 10 {
+				continue
+			}
+			if hexPort(fields[1]) == localPort && hexPort(fields[2]) == remotePort {
+				_ = file.Close()
+				return fields[9], nil
+			}
+		}
+		_ = file.Close()
+	}
+	return "", fmt.Errorf("no socket found for local port %d and remote port %d", localPort, remotePort)
+}
+
+// hexPort parses the port of an address like 0100007F:1F90.
+func hexPort(address string) int {
+	i := strings.LastIndexByte(address, ':')
+	if i < 0 {
+		return -1
+	}
+	port, err := strconv.ParseInt(address[i+1:], 16, 32)
+	if err != nil {
+		return -1
+	}
+	return int(port)
+}
+
+func pidForSocketInode(inode string) (int, error) {
+	target := "socket:[" + inode + "]"
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return 0, err
+	}
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		fdDir := filepath.Join("/proc", entry.Name(), "fd")
+		fds, err := os.ReadDir(fdDir)
+		if err != nil {
+			continue
+		}
+		for _, fd := range fds {
+			link, err := os.Readlink(filepath.Join(fdDir, fd.Name()))
+			if err == nil && link == target {
+				return pid, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("no process found for socket inode %s", inode)
+}
+
+// ParentPID returns the parent of a process.
+func ParentPID(pid int) (int, error) {
+	fields, err := statFields(pid)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(fields[1])
+}
+
+// statFields returns the fields of /proc/<pid>/stat after the command name, starting with the state and then the
+// ppid. The command name is in parentheses and may itself contain spaces or parentheses, so fields are counted from
+// the last closing parenthesis.
+func statFields(pid int) ([]string, error) {
+	stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return nil, err
+	}
+	i := strings.LastIndexByte(string(stat), ')')
+	if i < 0 {
+		return nil, fmt.Errorf("malformed stat for pid %d", pid)
+	}
+	fields := strings.Fields(string(stat[i+1:]))
+	if len(fields) < 22 {
+		return nil, fmt.Errorf("malformed stat for pid %d", pid)
+	}
+	return fields, nil
+}
+
+// ProcessTree returns a process and all of its descendants, the process first.
+func ProcessTree(pid int) ([]int, error) {
+	if _, err := os.Stat(fmt.Sprintf("/proc/%d", pid)); err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+	children := make(map[int][]int)
+	for _, entry := range entries {
+		child, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		// Processes that exit while /proc is read are left out.
+		parent, err := ParentPID(child)
+		if err != nil {
+			continue
+		}
+		children[parent] = append(children[parent], child)
+	}
+
+	tree := []int{pid}
+	for i := 0; i < len(tree); i++ {
+		tree = append(tree, children[tree[i]]...)
+	}
+	return tree, nil
+}
+
+// TreeUsage returns the resources a process and all of its descendants use.
+func TreeUsage(pid int) (ProcessUsage, error) {
+	tree, err := ProcessTree(pid)
+	if err != nil {
+		return ProcessUsage{}, err
+	}
+	var total ProcessUsage
+	for _, p := range tree {
+		usage, err := processUsage(p)
+		if err != nil {
+			// The process exited since the tree was read.
+			continue
+		}
+		total.Processes++
+		total.CPUTime += usage.CPUTime
+		total.RSSBytes += usage.RSSBytes
+		total.OpenFDs += usage.OpenFDs
+		total.Threads += usage.Threads
+	}
+	if total.Processes == 0 {
+		return ProcessUsage{}, fmt.Errorf("process %d exited", pid)
+	}
+	return total, nil
+}
+
+func processUsage(pid int) (ProcessUsage, error) {
+	fields, err := statFields(pid)
+	if err != nil {
+		return ProcessUsage{}, err
+	}
+	// utime, stime, num_threads and rss are fields 14, 15, 20 and 24 of stat, counting the pid and command name.
+	var values [4]int64
+	for i, field := range []int{11, 12, 17, 21} {
+		if values[i], err = strconv.ParseInt(fields[field], 10, 64); err != nil {
+			return ProcessUsage{}, fmt.Errorf("malformed stat for pid %d", pid)
+		}
+	}
+	fds, err := os.ReadDir(fmt.Sprintf("/proc/%d/fd", pid))
+	if err != nil {
+		return ProcessUsage{}, err
+	}
+	return ProcessUsage{
+		Processes: 1,
+		CPUTime:   time.Duration(values[0]+values[1]) * time.Second / clockTicks,
+		RSSBytes:  values[3] * int64(os.Getpagesize()),
+		OpenFDs:   len(fds),
+		Threads:   int(values[2]),
+	}, nil
+}
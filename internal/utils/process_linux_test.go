@@ -0,0 +1,75 @@
+//go:build linux
+
+/*
+ * Copyright (c) 2023 Asim Ihsan.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ * SPDX-License-Identifier: MPL-2.0
+ */
+
+package utils_test
+
+import (
+	"net"
+	"os"
+	"os/exec"
+	"testing"
+
+	"github.com/asimihsan/virtual-cluster/internal/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPeerPID(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer listener.Close()
+
+	client, err := net.Dial("tcp", listener.Addr().String())
+	assert.NoError(t, err)
+	defer client.Close()
+
+	server, err := listener.Accept()
+	assert.NoError(t, err)
+	defer server.Close()
+
+	pid, err := utils.PeerPID(server)
+	assert.NoError(t, err)
+	assert.Equal(t, os.Getpid(), pid)
+
+	parent, err := utils.ParentPID(pid)
+	assert.NoError(t, err)
+	assert.Equal(t, os.Getppid(), parent)
+}
+
+func TestTreeUsage(t *testing.T) {
+	cmd := exec.Command("sleep", "10")
+	assert.NoError(t, cmd.Start())
+	defer func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	}()
+
+	tree, err := utils.ProcessTree(os.Getpid())
+	assert.NoError(t, err)
+	assert.Equal(t, os.Getpid(), tree[0])
+	assert.Contains(t, tree, cmd.Process.Pid)
+
+	own, err := utils.TreeUsage(cmd.Process.Pid)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, own.Processes)
+	assert.Equal(t, 1, own.Threads)
+	assert.Greater(t, own.RSSBytes, int64(0))
+	assert.Greater(t, own.OpenFDs, 0)
+
+	usage, err := utils.TreeUsage(os.Getpid())
+	assert.NoError(t, err)
+	assert.GreaterOrEqual(t, usage.Processes, 2)
+	assert.Greater(t, usage.Threads, own.Threads)
+	assert.Greater(t, usage.RSSBytes, own.RSSBytes)
+
+	_, err = utils.TreeUsage(1 << 30)
+	assert.Error(t, err)
+}
@@ -0,0 +1,38 @@
+//go:build !linux
+
+/*
+ * Copyright (c) 2023 Asim Ihsan.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ * SPDX-License-Identifier: MPL-2.0
+ */
+
+package utils
+
+import (
+	"fmt"
+	"net"
+)
+
+// PeerPID is only implemented on Linux.
+func PeerPID(conn net.Conn) (int, error) {
+	return 0, fmt.Errorf("finding the process behind a connection is not supported on this platform")
+}
+
+// ParentPID is only implemented on Linux.
+func ParentPID(pid int) (int, error) {
+	return 0, fmt.Errorf("finding the parent of a process is not supported on this platform")
+}
+
+// ProcessTree is only implemented on Linux.
+func ProcessTree(pid int) ([]int, error) {
+	return nil, fmt.Errorf("finding the descendants of a process is not supported on this platform")
+}
+
+// TreeUsage is only implemented on Linux.
+func TreeUsage(pid int) (ProcessUsage, error) {
+	return ProcessUsage{}, fmt.Errorf("sampling the resources of a process is not supported on this platform")
+}
@@ -0,0 +1,52 @@
+/*
+ * Copyright (c) 2023 Asim Ihsan.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ * SPDX-License-Identifier: MPL-2.0
+ */
+
+package utils
+
+import (
+	"net"
+	"time"
+)
+
+// TCPWaiter waits until something is accepting TCP connections on an address. It is the opposite of PortWaiter,
+// which waits for a port to be free.
+type TCPWaiter struct {
+	BaseWaiter
+	address string
+}
+
+func NewTCPWaiter(address string, opts ...WaiterOption) *TCPWaiter {
+	tw := &TCPWaiter{
+		BaseWaiter: BaseWaiter{
+			interval: 1 * time.Second,
+			timeout:  10 * time.Second,
+		},
+		address: address,
+	}
+
+	for _, opt := range opts {
+		opt(&tw.BaseWaiter)
+	}
+
+	return tw
+}
+
+func (tw *TCPWaiter) Wait() error {
+	return tw.BaseWaiter.Wait(tw)
+}
+
+func (tw *TCPWaiter) CheckHealth() (bool, error) {
+	conn, err := net.DialTimeout("tcp", tw.address, tw.interval)
+	if err != nil {
+		return false, err
+	}
+	_ = conn.Close()
+	return true, nil
+}
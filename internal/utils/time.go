@@ -0,0 +1,15 @@
+/*
+ * Copyright (c) 2023 Asim Ihsan.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ * SPDX-License-Identifier: MPL-2.0
+ */
+
+package utils
+
+// TimestampFormat matches the timestamps SQLite writes with strftime('%Y-%m-%dT%H:%M:%fZ', 'now'), so rows with
+// timestamps set from Go sort correctly alongside rows that use the column default. Format UTC times with it.
+const TimestampFormat = "2006-01-02T15:04:05.000Z"
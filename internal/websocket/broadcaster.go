@@ -11,6 +11,7 @@
 package websocket
 
 import (
+	"github.com/asimihsan/virtual-cluster/internal/metrics"
 	"sync"
 )
 
@@ -30,6 +31,7 @@ func (b *Broadcaster) AddClient(client *Client) {
 	defer b.mu.Unlock()
 
 	b.clients[client] = true
+	metrics.WebsocketClients.Set(float64(len(b.clients)))
 }
 
 func (b *Broadcaster) RemoveClient(client *Client) {
@@ -37,6 +39,7 @@ func (b *Broadcaster) RemoveClient(client *Client) {
 	defer b.mu.Unlock()
 
 	delete(b.clients, client)
+	metrics.WebsocketClients.Set(float64(len(b.clients)))
 }
 
 func (b *Broadcaster) Broadcast(message []byte) {
@@ -44,6 +47,10 @@ func (b *Broadcaster) Broadcast(message []byte) {
 	defer b.mu.RUnlock()
 
 	for client := range b.clients {
-		client.Send(message)
+		if client.Send(message) {
+			metrics.WebsocketMessages.Inc()
+		} else {
+			metrics.WebsocketDroppedMessages.Inc()
+		}
 	}
 }
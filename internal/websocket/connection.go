@@ -15,6 +15,9 @@ import (
 	"log"
 )
 
+// DefaultSendBuffer is how many messages a client can fall behind by before messages to it are dropped.
+const DefaultSendBuffer = 256
+
 type Client struct {
 	conn *websocket.Conn
 	send chan []byte
@@ -28,15 +31,26 @@ func WithSendChannel(send chan []byte) ClientOption {
 	}
 }
 
-func NewClient(conn *websocket.Conn) *Client {
-	return &Client{
+func NewClient(conn *websocket.Conn, opts ...ClientOption) *Client {
+	c := &Client{
 		conn: conn,
-		send: make(chan []byte),
+		send: make(chan []byte, DefaultSendBuffer),
+	}
+	for _, opt := range opts {
+		opt(c)
 	}
+	return c
 }
 
-func (c *Client) Send(message []byte) {
-	c.send <- message
+// Send queues a message for the client, and returns false without queueing it if the client has fallen too far
+// behind, so that one slow client does not hold up the others.
+func (c *Client) Send(message []byte) bool {
+	select {
+	case c.send <- message:
+		return true
+	default:
+		return false
+	}
 }
 
 func (c *Client) ReadPump() {
@@ -0,0 +1,94 @@
+/*
+ * Copyright (c) 2023 Asim Ihsan.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ * SPDX-License-Identifier: MPL-2.0
+ */
+
+package dependencies
+
+import (
+	"fmt"
+	"github.com/asimihsan/virtual-cluster/internal/utils"
+	"github.com/pkg/errors"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// Compose implements Name, Start and Stop for dependencies that run as a docker compose project. Dependencies embed
+// it and write their compose file with WriteComposeFile from Render.
+type Compose struct {
+	DependencyName string
+
+	// Containers and Networks are removed before starting, in case a previous run did not shut down cleanly.
+	Containers []string
+	Networks   []string
+
+	// Ports are host ports that must be free before starting.
+	Ports []int
+
+	composeFilePath string
+	stop            func()
+}
+
+func (c *Compose) Name() string {
+	return c.DependencyName
+}
+
+// ContainerNames returns the names of the containers of the dependency.
+func (c *Compose) ContainerNames() []string {
+	return c.Containers
+}
+
+func (c *Compose) WriteComposeFile(dir string, dockerComposeFile string) error {
+	composeFilePath := filepath.Join(dir, "docker-compose.yml")
+	if err := os.WriteFile(composeFilePath, []byte(dockerComposeFile), 0644); err != nil {
+		return errors.Wrap(err, "failed to write docker compose file")
+	}
+
+	fmt.Printf("Docker compose file location: %s\n", composeFilePath)
+	c.composeFilePath = composeFilePath
+	return nil
+}
+
+func (c *Compose) Start(host Host) error {
+	if c.composeFilePath == "" {
+		return fmt.Errorf("docker compose file has not been rendered: %s", c.DependencyName)
+	}
+
+	fmt.Println("Cleaning up containers")
+	for _, container := range c.Containers {
+		if err := utils.CleanupContainers(container); err != nil {
+			fmt.Println("failed to clean up container:", err)
+		}
+	}
+	for _, network := range c.Networks {
+		if err := utils.CleanupNetworks(network); err != nil {
+			fmt.Println("failed to clean up network:", err)
+		}
+	}
+
+	for _, port := range c.Ports {
+		pw := utils.NewPortWaiter(strconv.Itoa(port))
+		if err := pw.Wait(); err != nil {
+			return errors.Wrapf(err, "failed to wait for port %d: %s", port, c.DependencyName)
+		}
+	}
+
+	fmt.Println("Starting managed dependency:", c.DependencyName)
+	c.stop = host.RunProcess(c.DependencyName, []string{"docker compose up --no-color"}, filepath.Dir(c.composeFilePath))
+	fmt.Println("Started managed dependency:", c.DependencyName)
+
+	return nil
+}
+
+func (c *Compose) Stop() error {
+	if c.stop != nil {
+		c.stop()
+	}
+	return nil
+}
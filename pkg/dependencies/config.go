@@ -0,0 +1,117 @@
+/*
+ * Copyright (c) 2023 Asim Ihsan.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ * SPDX-License-Identifier: MPL-2.0
+ */
+
+package dependencies
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Config holds the settings of a managed dependency block. Values are a string, an int, a bool, a []string or, for
+// nested blocks, a Config. A decimal number such as 15.4 is kept as the string it was written as.
+type Config map[string]interface{}
+
+// CheckKeys returns an error naming any setting that is not in allowed, which catches typos in vcluster files.
+func (c Config) CheckKeys(allowed ...string) error {
+	allowedKeys := make(map[string]bool, len(allowed))
+	for _, key := range allowed {
+		allowedKeys[key] = true
+	}
+
+	var unknown []string
+	for key := range c {
+		if !allowedKeys[key] {
+			unknown = append(unknown, key)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("unknown settings: %v", unknown)
+	}
+	return nil
+}
+
+// String returns the string setting key, or "" if it is not set.
+func (c Config) String(key string) (string, error) {
+	value, ok := c[key]
+	if !ok {
+		return "", nil
+	}
+	s, ok := value.(string)
+	if !ok {
+		return "", fmt.Errorf("setting %s must be a string", key)
+	}
+	return s, nil
+}
+
+// Int returns the int setting key, or 0 if it is not set.
+func (c Config) Int(key string) (int, error) {
+	value, ok := c[key]
+	if !ok {
+		return 0, nil
+	}
+	i, ok := value.(int)
+	if !ok {
+		return 0, fmt.Errorf("setting %s must be a number", key)
+	}
+	return i, nil
+}
+
+// Bool returns the bool setting key, or false if it is not set.
+func (c Config) Bool(key string) (bool, error) {
+	value, ok := c[key]
+	if !ok {
+		return false, nil
+	}
+	b, ok := value.(bool)
+	if !ok {
+		return false, fmt.Errorf("setting %s must be true or false", key)
+	}
+	return b, nil
+}
+
+// Port returns the port setting key, which must be set.
+func (c Config) Port(key string) (int, error) {
+	port, err := c.Int(key)
+	if err != nil {
+		return 0, err
+	}
+	if port < 1 || port > 65535 {
+		return 0, fmt.Errorf("invalid port number for setting %s: %d", key, port)
+	}
+	return port, nil
+}
+
+// Strings returns the list setting key, or nil if it is not set.
+func (c Config) Strings(key string) ([]string, error) {
+	value, ok := c[key]
+	if !ok {
+		return nil, nil
+	}
+	s, ok := value.([]string)
+	if !ok {
+		return nil, fmt.Errorf("setting %s must be a list of strings", key)
+	}
+	return s, nil
+}
+
+// Block returns the nested block key, or nil if it is not set.
+func (c Config) Block(key string) (Config, error) {
+	value, ok := c[key]
+	if !ok {
+		return nil, nil
+	}
+	block, ok := value.(Config)
+	if !ok {
+		return nil, fmt.Errorf("setting %s must be a block", key)
+	}
+	return block, nil
+}
@@ -0,0 +1,58 @@
+/*
+ * Copyright (c) 2023 Asim Ihsan.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ * SPDX-License-Identifier: MPL-2.0
+ */
+
+package dependencies
+
+import (
+	"database/sql"
+	"net"
+)
+
+// ManagedDependency is a dependency, such as Kafka or LocalStack, that the substrate runs on behalf of services.
+// The substrate calls Render, Start and Wait in that order, runs Observe in the background while the dependency is
+// up, and calls Stop when the cluster shuts down.
+type ManagedDependency interface {
+	// Name is the managed_dependency name from the vcluster file. Logs of the dependency are stored under it.
+	Name() string
+
+	// Render writes the files needed to start the dependency, such as a docker compose file, into dir.
+	Render(dir string) error
+
+	// Start launches the dependency from the files written by Render. It does not wait for the dependency to be
+	// ready.
+	Start(host Host) error
+
+	// Wait blocks until the dependency is ready to serve requests.
+	Wait() error
+
+	// Stop shuts the dependency down.
+	Stop() error
+
+	// ConnectionInfo describes how services reach the dependency, e.g. {"bootstrap_servers": "localhost:9092"}.
+	ConnectionInfo() map[string]string
+
+	// Observe captures traffic of the dependency into the substrate database. It blocks for as long as there is
+	// something to capture; dependencies with nothing to capture return nil straight away.
+	Observe(host Host) error
+}
+
+// Host is what the substrate offers a managed dependency.
+type Host interface {
+	// RunProcess runs commands in the background with their output captured into the logs table under name. The
+	// returned function stops the process.
+	RunProcess(name string, runCommands []string, workingDirectory string) (stop func())
+
+	// DB is the substrate database that observed traffic is written to.
+	DB() *sql.DB
+
+	// ServiceForConnection names the managed service on the other end of a connection accepted by the dependency,
+	// so that captured traffic can be attributed to it. It returns "" if the service is unknown.
+	ServiceForConnection(conn net.Conn) string
+}
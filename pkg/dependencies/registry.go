@@ -0,0 +1,73 @@
+/*
+ * Copyright (c) 2023 Asim Ihsan.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ * SPDX-License-Identifier: MPL-2.0
+ */
+
+package dependencies
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Factory creates a managed dependency called name from the settings in its vcluster block. It must only validate
+// and store config; nothing should be started until the substrate calls Start.
+type Factory func(name string, config Config) (ManagedDependency, error)
+
+var (
+	registryMu sync.RWMutex
+	registry   = make(map[string]Factory)
+)
+
+// Register makes a dependency kind, such as "managed_kafka", available to vcluster files. Dependency packages call
+// it from init, and a program enables a package by importing it for its side effects, as cmd/virtual-cluster does.
+// Register panics if kind is registered twice.
+func Register(kind string, factory Factory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if factory == nil {
+		panic("dependencies: Register factory is nil for " + kind)
+	}
+	if _, ok := registry[kind]; ok {
+		panic("dependencies: Register called twice for " + kind)
+	}
+	registry[kind] = factory
+}
+
+func Lookup(kind string) (Factory, bool) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	factory, ok := registry[kind]
+	return factory, ok
+}
+
+// Kinds returns the registered dependency kinds in sorted order.
+func Kinds() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	kinds := make([]string, 0, len(registry))
+	for kind := range registry {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	return kinds
+}
+
+func New(kind string, name string, config Config) (ManagedDependency, error) {
+	factory, ok := Lookup(kind)
+	if !ok {
+		return nil, fmt.Errorf(
+			"unknown managed dependency type: %s (registered types: %s)", kind, strings.Join(Kinds(), ", "))
+	}
+	return factory(name, config)
+}
@@ -0,0 +1,103 @@
+/*
+ * Copyright (c) 2023 Asim Ihsan.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/.
+ *
+ * SPDX-License-Identifier: MPL-2.0
+ */
+
+package dependencies_test
+
+import (
+	"testing"
+
+	"github.com/asimihsan/virtual-cluster/pkg/dependencies"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeDependency struct {
+	dependencies.Compose
+	port int
+}
+
+func (f *fakeDependency) Render(dir string) error              { return nil }
+func (f *fakeDependency) Wait() error                          { return nil }
+func (f *fakeDependency) ConnectionInfo() map[string]string    { return nil }
+func (f *fakeDependency) Observe(host dependencies.Host) error { return nil }
+
+func newFakeDependency(name string, config dependencies.Config) (dependencies.ManagedDependency, error) {
+	if err := config.CheckKeys("port"); err != nil {
+		return nil, err
+	}
+	port, err := config.Port("port")
+	if err != nil {
+		return nil, err
+	}
+	return &fakeDependency{Compose: dependencies.Compose{DependencyName: name}, port: port}, nil
+}
+
+func TestRegistry(t *testing.T) {
+	dependencies.Register("managed_fake", newFakeDependency)
+
+	_, ok := dependencies.Lookup("managed_fake")
+	assert.True(t, ok)
+	assert.Contains(t, dependencies.Kinds(), "managed_fake")
+	assert.Panics(t, func() {
+		dependencies.Register("managed_fake", newFakeDependency)
+	})
+
+	dependency, err := dependencies.New("managed_fake", "fake", dependencies.Config{"port": 1234})
+	assert.NoError(t, err)
+	assert.Equal(t, "fake", dependency.Name())
+	assert.Equal(t, 1234, dependency.(*fakeDependency).port)
+
+	_, err = dependencies.New("managed_fake", "fake", dependencies.Config{"port": 1234, "prot": 1})
+	assert.EqualError(t, err, "unknown settings: [prot]")
+
+	_, err = dependencies.New("managed_fake", "fake", dependencies.Config{"port": "1234"})
+	assert.EqualError(t, err, "setting port must be a number")
+
+	_, err = dependencies.New("managed_unknown", "fake", dependencies.Config{})
+	assert.EqualError(t, err, "unknown managed dependency type: managed_unknown (registered types: managed_fake)")
+}
+
+func TestConfigBlock(t *testing.T) {
+	config := dependencies.Config{
+		"healthcheck": dependencies.Config{"endpoint": "http://localhost:9200"},
+		"ports":       []string{"9200:9200"},
+	}
+
+	block, err := config.Block("healthcheck")
+	assert.NoError(t, err)
+	endpoint, err := block.String("endpoint")
+	assert.NoError(t, err)
+	assert.Equal(t, "http://localhost:9200", endpoint)
+
+	missing, err := config.Block("missing")
+	assert.NoError(t, err)
+	assert.Nil(t, missing)
+
+	_, err = config.Block("ports")
+	assert.Error(t, err)
+
+	ports, err := config.Strings("ports")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"9200:9200"}, ports)
+}
+
+func TestConfigBool(t *testing.T) {
+	config := dependencies.Config{"enabled": true, "port": 1234}
+
+	enabled, err := config.Bool("enabled")
+	assert.NoError(t, err)
+	assert.True(t, enabled)
+
+	missing, err := config.Bool("missing")
+	assert.NoError(t, err)
+	assert.False(t, missing)
+
+	_, err = config.Bool("port")
+	assert.EqualError(t, err, "setting port must be true or false")
+}